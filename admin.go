@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"go-aliyun-webdav/webdav"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// driveAdmin 管理接口：列出账号下的网盘并切换当前提供服务的网盘
+type driveAdmin struct {
+	mu         sync.Mutex
+	fs         *webdav.Handler
+	rootFolder string
+}
+
+type driveInfo struct {
+	model.Drive
+	Active bool `json:"active"`
+}
+
+// listDrives GET /admin/drives
+func (a *driveAdmin) listDrives(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	drives, err := aliyun.ListDrives(req.Context(), a.fs.CurrentConfig().Token)
+	if err != nil {
+		apiErrorFrom(w, err)
+		return
+	}
+	result := make([]driveInfo, 0, len(drives))
+	for _, d := range drives {
+		result = append(result, driveInfo{Drive: d, Active: d.DriveId == a.fs.CurrentConfig().DriveId})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// switchDrive POST /admin/drive，参数drive_id，切换后清空缓存
+func (a *driveAdmin) switchDrive(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	driveId := req.FormValue("drive_id")
+	if driveId == "" {
+		apiError(w, http.StatusBadRequest, codeBadRequest, "drive_id is required")
+		return
+	}
+	drives, err := aliyun.ListDrives(req.Context(), a.fs.CurrentConfig().Token)
+	if err != nil {
+		apiErrorFrom(w, err)
+		return
+	}
+	found := false
+	for _, d := range drives {
+		if d.DriveId == driveId {
+			found = true
+			break
+		}
+	}
+	if !found {
+		apiError(w, http.StatusNotFound, codeNotFound, "drive not found: "+driveId)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	//根目录是按网盘解析的，先解析新网盘的根目录，失败时不做任何改动。
+	//缓存键都按网盘区分，旧网盘的缓存不会被新网盘读到，不需要清空
+	rootFileId, rootPath, err := aliyun.ResolveRootFolder(req.Context(), a.fs.CurrentConfig().Token, driveId, a.rootFolder)
+	if err != nil {
+		apiError(w, http.StatusConflict, codeConflict, err.Error())
+		return
+	}
+	//网盘和根目录一起替换，替换期间读取配置的请求会等待
+	a.fs.UpdateConfig(func(c model.Config) model.Config {
+		aliyun.SetRoot(rootFileId, rootPath)
+		c.DriveId = driveId
+		return c
+	})
+	net.Logln(req.Context(), "🔀  切换网盘", driveId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listUploads GET /admin/uploads，列出进行中的上传任务及进度
+func listUploads(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(aliyun.Uploads())
+}
+
+// shortcuts /admin/shortcuts：GET列出快捷方式；POST新建，参数path及target(网盘中的路径)、file_id、url三者之一；DELETE删除，参数path
+func shortcuts(fs *webdav.Handler, w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(fs.Shortcuts.List())
+	case http.MethodPost:
+		sc := webdav.Shortcut{Path: req.FormValue("path"), FileId: req.FormValue("file_id"), URL: req.FormValue("url")}
+		if target := strings.Trim(req.FormValue("target"), "/"); target != "" {
+			item, _, err := aliyun.Walk(req.Context(), fs.CurrentConfig().Token, fs.CurrentConfig().DriveId, strings.Split(target, "/"), "")
+			if err != nil {
+				apiErrorFrom(w, err)
+				return
+			}
+			if item.FileId == "" {
+				apiError(w, http.StatusNotFound, codeNotFound, "target not found: "+target)
+				return
+			}
+			sc.FileId = item.FileId
+		}
+		if _, ok := fs.Shortcuts.Get(sc.Path); !ok {
+			//不能遮盖网盘中已存在的文件
+			item, _, err := aliyun.Walk(req.Context(), fs.CurrentConfig().Token, fs.CurrentConfig().DriveId, strings.Split(strings.Trim(sc.Path, "/"), "/"), "")
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				apiErrorFrom(w, err)
+				return
+			}
+			if err == nil && item.FileId != "" {
+				apiError(w, http.StatusConflict, codeConflict, "path already exists: "+sc.Path)
+				return
+			}
+		}
+		if err := fs.Shortcuts.Add(sc); err != nil {
+			apiError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+		net.Logln(req.Context(), "🔗  新建快捷方式", sc.Path)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if err := fs.Shortcuts.Remove(req.FormValue("path")); err != nil {
+			apiError(w, http.StatusNotFound, codeNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, POST, DELETE")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/webdav"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDriveAdmin(t *testing.T) {
+	h, fs, s := newTestServer(t, func(cfg *ServerConfig) { cfg.RootFolder = "/Media" })
+	media := s.Mkdir("root", "Media")
+	s.Handle("/v2/drive/list_my_drives", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(model.DriveListModel{Items: []model.Drive{
+			{DriveId: "1", DriveName: "Default"},
+			{DriveId: "2", DriveName: "Backup"},
+		}})
+	})
+	t.Cleanup(func() { aliyun.SetRoot("root", "/") })
+
+	w := call(h, "GET", "/admin/drives", nil)
+	var drives []driveInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &drives); err != nil || len(drives) != 2 {
+		t.Fatalf("GET /admin/drives = %d %s", w.Code, w.Body.String())
+	}
+	if !drives[0].Active || drives[1].Active {
+		t.Errorf("active drives = %v, %v; want the first one", drives[0].Active, drives[1].Active)
+	}
+
+	//旧网盘根目录下的同名目录不能当作新网盘的根目录
+	cache.GoCache.Set(cache.ListKey("1", "root"), model.FileListModel{Items: []model.ListModel{{FileId: "other", Name: "Media", Type: "folder"}}}, -1)
+	if w := call(h, "POST", "/admin/drive", strings.NewReader("drive_id=2")); w.Code != http.StatusNoContent {
+		t.Fatalf("switching drives = %d %s", w.Code, w.Body.String())
+	}
+	if id := fs.CurrentConfig().DriveId; id != "2" {
+		t.Errorf("active drive = %s after switching, want 2", id)
+	}
+	if id, p := aliyun.RootFileId(), aliyun.RootPath(); id != media || p != "/Media/" {
+		t.Errorf("root = %s %s after switching, want the root folder %s /Media/", id, p, media)
+	}
+
+	if w := call(h, "POST", "/admin/drive", strings.NewReader("drive_id=9")); w.Code != http.StatusNotFound {
+		t.Errorf("switching to an unknown drive = %d, want 404", w.Code)
+	}
+	if w := call(h, "POST", "/admin/drive", strings.NewReader("")); w.Code != http.StatusBadRequest {
+		t.Errorf("switching without drive_id = %d, want 400", w.Code)
+	}
+	if w := call(h, "GET", "/admin/drive", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/drive = %d, want 405", w.Code)
+	}
+	if id := fs.CurrentConfig().DriveId; id != "2" {
+		t.Errorf("active drive = %s after failed switches, want 2", id)
+	}
+}
+
+func TestListUploads(t *testing.T) {
+	h, _, _ := newTestServer(t, nil)
+	w := call(h, "GET", "/admin/uploads", nil)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("GET /admin/uploads = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var uploads []model.UploadProgress
+	if err := json.Unmarshal(w.Body.Bytes(), &uploads); err != nil || len(uploads) != 0 {
+		t.Errorf("uploads = %s, want an empty list", w.Body.String())
+	}
+	if w := call(h, "POST", "/admin/uploads", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /admin/uploads = %d, want 405", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/admin/uploads", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/uploads without credentials = %d, want 401", w.Code)
+	}
+}
+
+func TestShortcutsAdmin(t *testing.T) {
+	store, err := webdav.NewShortcutStore(filepath.Join(t.TempDir(), "shortcuts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, s := newTestServer(t, func(cfg *ServerConfig) { cfg.Handler.Shortcuts = store })
+	media := s.Mkdir("root", "media")
+	id := s.Put(media, "movie.txt", []byte("movie content"))
+	s.Put("root", "taken.txt", []byte("t"))
+
+	form := func(values url.Values) *strings.Reader { return strings.NewReader(values.Encode()) }
+	if w := call(h, "POST", "/admin/shortcuts", form(url.Values{"path": {"/fav.txt"}, "target": {"/media/movie.txt"}})); w.Code != http.StatusCreated {
+		t.Fatalf("POST = %d %s, want 201", w.Code, w.Body.String())
+	}
+	if sc, ok := store.Get("fav.txt"); !ok || sc.FileId != id {
+		t.Errorf("shortcut = %+v, want file %s", sc, id)
+	}
+	w := call(h, "GET", "/fav.txt", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "movie content" {
+		t.Errorf("GET through the shortcut = %d %q, want the target content", w.Code, w.Body.String())
+	}
+
+	for _, c := range []struct {
+		values url.Values
+		want   int
+	}{
+		//不能遮盖网盘中已存在的文件
+		{url.Values{"path": {"taken.txt"}, "file_id": {id}}, http.StatusConflict},
+		{url.Values{"path": {"x.txt"}, "target": {"media/missing.txt"}}, http.StatusNotFound},
+		{url.Values{"path": {"x.txt"}}, http.StatusBadRequest},
+	} {
+		if w := call(h, "POST", "/admin/shortcuts", form(c.values)); w.Code != c.want {
+			t.Errorf("POST %v = %d, want %d", c.values, w.Code, c.want)
+		}
+	}
+
+	var list []webdav.Shortcut
+	w = call(h, "GET", "/admin/shortcuts", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].Path != "fav.txt" {
+		t.Errorf("GET /admin/shortcuts = %s", w.Body.String())
+	}
+	if w := call(h, "DELETE", "/admin/shortcuts?path=fav.txt", nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want 204", w.Code)
+	}
+	if w := call(h, "DELETE", "/admin/shortcuts?path=fav.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d, want 404", w.Code)
+	}
+	if w := call(h, "GET", "/fav.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a removed shortcut = %d, want 404", w.Code)
+	}
+	//查找目标或检查路径时阿里云出错，返回相应的错误码而不是not_found
+	cache.GoCache.Flush()
+	for body, want := range map[string]string{
+		`{"code":"InternalError","message":"failed"}`:     codeUpstreamError,
+		`{"code":"NeedCaptcha","message":"need captcha"}`: codeRiskControl,
+	} {
+		body := body
+		s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(body))
+		})
+		for _, values := range []url.Values{
+			{"path": {"x.txt"}, "target": {"media/movie.txt"}},
+			{"path": {"x.txt"}, "file_id": {id}},
+		} {
+			w := call(h, "POST", "/admin/shortcuts", form(values))
+			if got := decodeAPIError(t, w); got.Error.Code != want {
+				t.Errorf("POST %v with the listing failing = %d %q, want %q", values, w.Code, got.Error.Code, want)
+			}
+		}
+	}
+}
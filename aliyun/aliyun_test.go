@@ -0,0 +1,16 @@
+package aliyun
+
+import (
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/cache"
+	"testing"
+)
+
+// newFake 启动模拟的阿里云盘接口，测试结束时关闭，每个测试使用新的全局缓存
+func newFake(t *testing.T) *aliyuntest.Server {
+	t.Helper()
+	cache.GoCache = cache.New(cache.DefaultExpiration, 0)
+	s := aliyuntest.New()
+	t.Cleanup(s.Close)
+	return s
+}
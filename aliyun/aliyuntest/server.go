@@ -0,0 +1,653 @@
+// Package aliyuntest 提供测试用的阿里云盘接口模拟服务，文件保存在内存中。
+// New会把http.DefaultTransport替换为把api.aliyundrive.com的请求转发到模拟服务的Transport，
+// 分片上传地址和下载地址直接指向模拟服务，Close时恢复原来的Transport
+package aliyuntest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-aliyun-webdav/aliyun/model"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DriveId 模拟网盘的drive_id
+const DriveId = "1"
+
+// APIHost 被转发到模拟服务的接口域名
+const APIHost = "api.aliyundrive.com"
+
+// File 模拟网盘中的文件或文件夹
+type File struct {
+	Id        string
+	ParentId  string
+	Name      string
+	Type      string
+	Content   []byte
+	Trashed   bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	//Size不为负时，列表和详情中返回该大小而不是内容的长度，模拟阿里云延迟更新文件信息
+	Size int64
+	//上传时按文件名得到的扩展名和类型，与阿里云一样重命名后不会更新
+	FileExtension string
+	ContentType   string
+	//阿里云按文件类型给出的分类(如video)和生成的缩略图地址，默认为空
+	Category  string
+	Thumbnail string
+}
+
+// Sha1 文件内容的SHA1，大写十六进制
+func (f File) Sha1() string {
+	h := sha1.Sum(f.Content)
+	return strings.ToUpper(hex.EncodeToString(h[:]))
+}
+
+func (f File) item() model.ListModel {
+	fi := model.ListModel{
+		DriveId:      DriveId,
+		FileId:       f.Id,
+		Name:         f.Name,
+		Type:         f.Type,
+		Status:       "available",
+		ParentFileId: f.ParentId,
+		CreatedAt:    model.Time{Time: f.CreatedAt},
+		UpdatedAt:    model.Time{Time: f.UpdatedAt},
+	}
+	if f.Type == "file" {
+		fi.Size = int64(len(f.Content))
+		if f.Size >= 0 {
+			fi.Size = f.Size
+		}
+		fi.ContentHash = f.Sha1()
+		fi.FileExtension = f.FileExtension
+		fi.ContentType = f.ContentType
+		fi.Category = f.Category
+		fi.Thumbnail = f.Thumbnail
+	}
+	return fi
+}
+
+// upload 创建文件后尚未完成的分片上传
+type upload struct {
+	fileId   string
+	parentId string
+	name     string
+	parts    map[int][]byte
+}
+
+// Server 模拟的阿里云盘接口
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	files      map[string]*File
+	uploads    map[string]*upload
+	nextId     int
+	calls      map[string]int
+	requestIds map[string][]string
+	handlers   map[string]http.HandlerFunc
+	transport  http.RoundTripper
+}
+
+// New 启动模拟服务并接管http.DefaultTransport
+func New() *Server {
+	s := &Server{
+		files:      map[string]*File{},
+		uploads:    map[string]*upload{},
+		calls:      map[string]int{},
+		requestIds: map[string][]string{},
+		handlers:   map[string]http.HandlerFunc{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	target, _ := url.Parse(s.URL)
+	s.transport = http.DefaultTransport
+	http.DefaultTransport = rewriteTransport{target: target, next: s.transport}
+	return s
+}
+
+// Close 关闭模拟服务并恢复http.DefaultTransport
+func (s *Server) Close() {
+	http.DefaultTransport = s.transport
+	s.Server.Close()
+}
+
+// rewriteTransport 把发往APIHost的请求转发到模拟服务
+type rewriteTransport struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == APIHost {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = t.target.Scheme
+		req.URL.Host = t.target.Host
+		req.Host = t.target.Host
+	}
+	return t.next.RoundTrip(req)
+}
+
+// Handle 用h处理路径为p的请求，代替模拟的默认行为，h为nil时恢复默认行为
+func (s *Server) Handle(p string, h http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h == nil {
+		delete(s.handlers, p)
+		return
+	}
+	s.handlers[p] = h
+}
+
+// Calls 路径为p的请求次数
+func (s *Server) Calls(p string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[p]
+}
+
+// RequestIDs 路径为p的各次请求带的X-Request-ID
+func (s *Server) RequestIDs(p string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requestIds[p]...)
+}
+
+func (s *Server) newId() string {
+	s.nextId++
+	return fmt.Sprintf("f%04d", s.nextId)
+}
+
+func (s *Server) add(parentId string, name string, typ string, content []byte) string {
+	f := newFile(s.newId(), parentId, name, typ, content)
+	s.files[f.Id] = f
+	return f.Id
+}
+
+func newFile(id string, parentId string, name string, typ string, content []byte) *File {
+	now := time.Now()
+	ext := path.Ext(name)
+	return &File{Id: id, ParentId: parentId, Name: name, Type: typ, Content: content, CreatedAt: now, UpdatedAt: now, Size: -1,
+		FileExtension: strings.TrimPrefix(ext, "."), ContentType: mime.TypeByExtension(ext)}
+}
+
+// Mkdir 在parentId下创建文件夹，返回file_id
+func (s *Server) Mkdir(parentId string, name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(parentId, name, "folder", nil)
+}
+
+// Put 在parentId下创建内容为content的文件，返回file_id
+func (s *Server) Put(parentId string, name string, content []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(parentId, name, "file", append([]byte(nil), content...))
+}
+
+// Update 修改fileId对应的文件
+func (s *Server) Update(fileId string, update func(f *File)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[fileId]; ok {
+		update(f)
+	}
+}
+
+// File 返回fileId对应的文件
+func (s *Server) File(fileId string) (File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[fileId]
+	if !ok {
+		return File{}, false
+	}
+	return *f, true
+}
+
+// Lookup 按网盘根目录下的路径(如"a/b.txt")查找未删除的文件
+func (s *Server) Lookup(p string) (File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parentId := "root"
+	var found *File
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if found = s.child(parentId, name); found == nil {
+			return File{}, false
+		}
+		parentId = found.Id
+	}
+	if found == nil {
+		return File{}, false
+	}
+	return *found, true
+}
+
+func (s *Server) child(parentId string, name string) *File {
+	for _, f := range s.files {
+		if f.ParentId == parentId && f.Name == name && !f.Trashed {
+			return f
+		}
+	}
+	return nil
+}
+
+// children 未删除的子项，按修改时间倒序
+func (s *Server) children(parentId string) []*File {
+	var list []*File
+	for _, f := range s.files {
+		if f.ParentId == parentId && !f.Trashed {
+			list = append(list, f)
+		}
+	}
+	sortByUpdated(list)
+	return list
+}
+
+func sortByUpdated(list []*File) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].UpdatedAt.Equal(list[j].UpdatedAt) {
+			return list[i].UpdatedAt.After(list[j].UpdatedAt)
+		}
+		return list[i].Id > list[j].Id
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeCode(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"code": code, "message": code})
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.calls[r.URL.Path]++
+	s.requestIds[r.URL.Path] = append(s.requestIds[r.URL.Path], r.Header.Get("X-Request-ID"))
+	h := s.handlers[r.URL.Path]
+	s.mu.Unlock()
+	if h != nil {
+		h(w, r)
+		return
+	}
+	s.Default(w, r)
+}
+
+// Default 按模拟的默认行为处理请求，用于Handle设置的处理函数只改变部分请求的结果
+func (s *Server) Default(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/oss/") {
+		s.serveOSS(w, r)
+		return
+	}
+	var body map[string]interface{}
+	data, _ := ioutil.ReadAll(r.Body)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &body); err != nil {
+			writeCode(w, http.StatusBadRequest, "InvalidParameter")
+			return
+		}
+	}
+	str := func(key string) string {
+		v, _ := body[key].(string)
+		return v
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/adrive/v3/file/list":
+		s.list(w, str("parent_file_id"), str("marker"), body["limit"])
+	case "/adrive/v1/file/get_path":
+		s.getPath(w, str("file_id"))
+	case "/token/refresh":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "access-" + str("refresh_token"), "refresh_token": str("refresh_token"), "default_drive_id": DriveId, "expires_in": 7200})
+	case "/v2/file/get":
+		f, ok := s.files[str("file_id")]
+		if !ok {
+			writeCode(w, http.StatusNotFound, "NotFound.File")
+			return
+		}
+		fi := f.item()
+		if f.Trashed {
+			fi.Status = "trashed"
+		}
+		writeJSON(w, http.StatusOK, fi)
+	case "/v2/recyclebin/trash":
+		f, ok := s.files[str("file_id")]
+		if !ok || f.Trashed {
+			writeCode(w, http.StatusNotFound, "NotFound.File")
+			return
+		}
+		f.Trashed = true
+		f.UpdatedAt = time.Now()
+		w.WriteHeader(http.StatusNoContent)
+	case "/v2/recyclebin/list":
+		var list []*File
+		for _, f := range s.files {
+			if f.Trashed {
+				list = append(list, f)
+			}
+		}
+		sortByUpdated(list)
+		items := make([]model.ListModel, 0, len(list))
+		for _, f := range list {
+			fi := f.item()
+			fi.Status = "trashed"
+			items = append(items, fi)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "next_marker": ""})
+	case "/v2/recyclebin/restore":
+		f, ok := s.files[str("file_id")]
+		if !ok || !f.Trashed {
+			writeCode(w, http.StatusNotFound, "NotFound.File")
+			return
+		}
+		f.Trashed = false
+		w.WriteHeader(http.StatusNoContent)
+	case "/v3/file/update":
+		f, ok := s.files[str("file_id")]
+		if !ok || f.Trashed {
+			writeCode(w, http.StatusNotFound, "NotFound.File")
+			return
+		}
+		if other := s.child(f.ParentId, str("name")); other != nil && other != f && str("check_name_mode") == "refuse" {
+			writeCode(w, http.StatusConflict, "AlreadyExist.File")
+			return
+		}
+		f.Name = str("name")
+		f.UpdatedAt = time.Now()
+		writeJSON(w, http.StatusOK, f.item())
+	case "/v3/batch":
+		s.batch(w, body)
+	case "/adrive/v2/file/createWithFolders":
+		s.create(w, body)
+	case "/v2/file/get_upload_url":
+		u, ok := s.uploads[str("upload_id")]
+		if !ok {
+			writeCode(w, http.StatusNotFound, "NotFound.UploadId")
+			return
+		}
+		parts, _ := body["part_info_list"].([]interface{})
+		writeJSON(w, http.StatusOK, map[string]interface{}{"file_id": u.fileId, "upload_id": str("upload_id"), "part_info_list": s.partList(str("upload_id"), len(parts))})
+	case "/v2/file/complete":
+		s.complete(w, str("upload_id"))
+	case "/v2/file/get_download_url":
+		f, ok := s.files[str("file_id")]
+		if !ok || f.Type != "file" {
+			writeCode(w, http.StatusNotFound, "NotFound.File")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"url": s.URL + "/oss/download/" + f.Id, "size": len(f.Content), "expiration": time.Now().Add(15 * time.Minute)})
+	case "/v2/drive/get":
+		var used int64
+		for _, f := range s.files {
+			used += int64(len(f.Content))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"drive_id": DriveId, "total_size": 1 << 40, "used_size": used})
+	case "/v2/drive/list_my_drives":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": []model.Drive{{DriveId: DriveId, DriveName: "Default", DriveType: "normal", TotalSize: 1 << 40}}})
+	case "/adrive/v3/file/search":
+		s.search(w, str("query"))
+	default:
+		writeCode(w, http.StatusNotFound, "NotFound.API")
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, parentId string, marker string, limit interface{}) {
+	if parentId != "root" {
+		if p, ok := s.files[parentId]; !ok || p.Trashed {
+			writeCode(w, http.StatusNotFound, "NotFound.File")
+			return
+		}
+	}
+	list := s.children(parentId)
+	start, _ := strconv.Atoi(marker)
+	size := len(list)
+	if n, ok := limit.(float64); ok && n > 0 {
+		size = int(n)
+	}
+	if start > len(list) {
+		start = len(list)
+	}
+	end := start + size
+	next := ""
+	if end < len(list) {
+		next = strconv.Itoa(end)
+	} else {
+		end = len(list)
+	}
+	items := make([]model.ListModel, 0, end-start)
+	for _, f := range list[start:end] {
+		items = append(items, f.item())
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "next_marker": next})
+}
+
+func (s *Server) getPath(w http.ResponseWriter, fileId string) {
+	var items []model.FilePath
+	for id := fileId; id != "root"; {
+		f, ok := s.files[id]
+		if !ok {
+			writeCode(w, http.StatusNotFound, "NotFound.File")
+			return
+		}
+		items = append(items, model.FilePath{FileId: f.Id, Name: f.Name, Type: f.Type})
+		id = f.ParentId
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+func (s *Server) search(w http.ResponseWriter, query string) {
+	//只支持name = "x"及name match "x"两种条件
+	exact := strings.Contains(query, "name = ")
+	name := query
+	if i := strings.Index(query, `"`); i >= 0 {
+		name = query[i+1:]
+		if j := strings.Index(name, `"`); j >= 0 {
+			name = name[:j]
+		}
+	}
+	var list []*File
+	for _, f := range s.files {
+		if f.Trashed {
+			continue
+		}
+		if (exact && f.Name == name) || (!exact && strings.Contains(f.Name, name)) {
+			list = append(list, f)
+		}
+	}
+	sortByUpdated(list)
+	items := make([]model.ListModel, 0, len(list))
+	for _, f := range list {
+		items = append(items, f.item())
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "next_marker": ""})
+}
+
+func (s *Server) batch(w http.ResponseWriter, body map[string]interface{}) {
+	requests, _ := body["requests"].([]interface{})
+	responses := make([]map[string]interface{}, 0, len(requests))
+	for _, r := range requests {
+		req, _ := r.(map[string]interface{})
+		b, _ := req["body"].(map[string]interface{})
+		fileId, _ := b["file_id"].(string)
+		to, _ := b["to_parent_file_id"].(string)
+		status := http.StatusOK
+		resultId := fileId
+		if f, ok := s.files[fileId]; !ok || f.Trashed {
+			status = http.StatusNotFound
+		} else if _, ok := s.files[to]; !ok && to != "root" {
+			status = http.StatusNotFound
+		} else if req["url"] == "/file/copy" {
+			//与阿里云一样，目标目录下已有同名项时自动改名
+			name := f.Name
+			for i := 1; s.child(to, name) != nil; i++ {
+				name = strings.TrimSuffix(f.Name, path.Ext(f.Name)) + "(" + strconv.Itoa(i) + ")" + path.Ext(f.Name)
+			}
+			resultId, status = s.copy(f, to, name), http.StatusCreated
+		} else {
+			f.ParentId = to
+			f.UpdatedAt = time.Now()
+		}
+		responses = append(responses, map[string]interface{}{"id": req["id"], "status": status, "body": map[string]string{"file_id": resultId}})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"responses": responses})
+}
+
+// copy 把f及其子项复制到parentId下并命名为name，返回副本的file_id
+func (s *Server) copy(f *File, parentId string, name string) string {
+	children := s.children(f.Id)
+	id := s.add(parentId, name, f.Type, append([]byte(nil), f.Content...))
+	for _, child := range children {
+		s.copy(child, id, child.Name)
+	}
+	return id
+}
+
+func (s *Server) partList(uploadId string, n int) []map[string]interface{} {
+	expires := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	parts := make([]map[string]interface{}, 0, n)
+	for i := 1; i <= n; i++ {
+		parts = append(parts, map[string]interface{}{
+			"part_number": i,
+			"upload_url":  s.URL + "/oss/upload/" + uploadId + "/" + strconv.Itoa(i) + "?x-oss-expires=" + expires,
+		})
+	}
+	return parts
+}
+
+func (s *Server) create(w http.ResponseWriter, body map[string]interface{}) {
+	str := func(key string) string {
+		v, _ := body[key].(string)
+		return v
+	}
+	parentId, name := str("parent_file_id"), str("name")
+	if parentId != "root" {
+		if p, ok := s.files[parentId]; !ok || p.Trashed || p.Type != "folder" {
+			writeCode(w, http.StatusNotFound, "NotFound.File")
+			return
+		}
+	}
+	existing := s.child(parentId, name)
+	if str("type") == "folder" {
+		if existing != nil {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"file_id": existing.Id, "parent_file_id": parentId, "type": existing.Type, "name": existing.Name, "file_name": existing.Name, "exist": true})
+			return
+		}
+		id := s.add(parentId, name, "folder", nil)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"file_id": id, "parent_file_id": parentId, "type": "folder", "name": name, "file_name": name})
+		return
+	}
+	size, _ := body["size"].(float64)
+	if preHash := str("pre_hash"); preHash != "" {
+		for _, f := range s.files {
+			n := len(f.Content)
+			if n > 1024 {
+				n = 1024
+			}
+			h := sha1.Sum(f.Content[:n])
+			if f.Type == "file" && int64(len(f.Content)) == int64(size) && hex.EncodeToString(h[:]) == strings.ToLower(preHash) {
+				writeCode(w, http.StatusConflict, "PreHashMatched")
+				return
+			}
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"parent_file_id": parentId, "file_name": name, "rapid_upload": false})
+		return
+	}
+	if hash := str("content_hash"); hash != "" {
+		for _, f := range s.files {
+			if f.Type == "file" && int64(len(f.Content)) == int64(size) && f.Sha1() == strings.ToUpper(hash) && str("proof_code") != "" {
+				if existing != nil {
+					delete(s.files, existing.Id)
+				}
+				id := s.add(parentId, name, "file", f.Content)
+				writeJSON(w, http.StatusCreated, map[string]interface{}{"file_id": id, "parent_file_id": parentId, "type": "file", "file_name": name, "upload_id": "rapid-" + id, "rapid_upload": true})
+				return
+			}
+		}
+	}
+	parts, _ := body["part_info_list"].([]interface{})
+	s.nextId++
+	uploadId := fmt.Sprintf("u%04d", s.nextId)
+	u := &upload{fileId: s.newId(), parentId: parentId, name: name, parts: map[int][]byte{}}
+	s.uploads[uploadId] = u
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"file_id": u.fileId, "parent_file_id": parentId, "type": "file", "file_name": name, "upload_id": uploadId, "rapid_upload": false, "part_info_list": s.partList(uploadId, len(parts))})
+}
+
+func (s *Server) complete(w http.ResponseWriter, uploadId string) {
+	u, ok := s.uploads[uploadId]
+	if !ok {
+		writeCode(w, http.StatusNotFound, "NotFound.UploadId")
+		return
+	}
+	delete(s.uploads, uploadId)
+	numbers := make([]int, 0, len(u.parts))
+	for n := range u.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	var content []byte
+	for _, n := range numbers {
+		content = append(content, u.parts[n]...)
+	}
+	if existing := s.child(u.parentId, u.name); existing != nil {
+		delete(s.files, existing.Id)
+	}
+	f := newFile(u.fileId, u.parentId, u.name, "file", content)
+	s.files[f.Id] = f
+	fi := f.item()
+	writeJSON(w, http.StatusOK, fi)
+}
+
+// serveOSS 模拟OSS的分片上传(PUT /oss/upload/<upload_id>/<part>)和下载(GET /oss/download/<file_id>)
+func (s *Server) serveOSS(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/oss/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "upload" && r.Method == http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n, _ := strconv.Atoi(parts[2])
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		u, ok := s.uploads[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		u.parts[n] = data
+		w.WriteHeader(http.StatusOK)
+	case len(parts) == 2 && parts[0] == "download" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.mu.Lock()
+		f, ok := s.files[parts[1]]
+		var content []byte
+		var modified time.Time
+		if ok {
+			content, modified = f.Content, f.UpdatedAt
+		}
+		s.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -1,6 +1,7 @@
 package aliyun
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,21 +9,125 @@ import (
 	"go-aliyun-webdav/aliyun/cache"
 	"go-aliyun-webdav/aliyun/model"
 	"go-aliyun-webdav/aliyun/net"
+	"go-aliyun-webdav/utils"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-func GetList(token string, driveId string, parentFileId string, marker ...string) (model.FileListModel, error) {
+// MaxListPageSize 阿里云列表接口每页最多返回的条数
+const MaxListPageSize = 200
+
+// ListPageSize 列出目录时每页的条数，越大请求次数越少，但单次请求越慢、占用内存越多
+var ListPageSize = MaxListPageSize
+
+// ErrUnexpectedResponse 阿里云返回了错误信息，或者返回内容缺少必要的字段(接口格式可能已变化)
+var ErrUnexpectedResponse = errors.New("aliyun: unexpected response")
+
+// checkResponse 检查接口返回内容，field为正常返回时必定存在的字段。
+// 文件不存在时返回的错误可以用errors.Is(err, os.ErrNotExist)判断
+func checkResponse(body []byte, field string) error {
+	if net.IsRiskControl(body) {
+		return net.ErrRiskControl
+	}
+	if len(body) == 0 {
+		return fmt.Errorf("%w: empty body", ErrUnexpectedResponse)
+	}
+	if code := gjson.GetBytes(body, "code").Str; code != "" {
+		if strings.HasPrefix(code, "NotFound") {
+			return fmt.Errorf("%w: %s", os.ErrNotExist, code)
+		}
+		if net.IsPermissionDenied(body) {
+			return fmt.Errorf("%w: %s %s", net.ErrPermissionDenied, code, gjson.GetBytes(body, "message").Str)
+		}
+		return fmt.Errorf("%w: %s %s", ErrUnexpectedResponse, code, gjson.GetBytes(body, "message").Str)
+	}
+	if !gjson.GetBytes(body, field).Exists() {
+		return fmt.Errorf("%w: missing field %s", ErrUnexpectedResponse, field)
+	}
+	return nil
+}
+
+// root 对外提供服务的根目录，默认为网盘根目录，可通过-root-folder指定为某个子目录。
+// 切换网盘时会被替换，所以通过RootFileId、RootPath读取
+var root = struct {
+	sync.RWMutex
+	fileId string
+	path   string
+}{fileId: "root", path: "/"}
+
+// RootFileId 对外提供服务的根目录的FileId
+func RootFileId() string {
+	root.RLock()
+	defer root.RUnlock()
+	return root.fileId
+}
+
+// RootPath 根目录在网盘中的完整路径，以/结尾
+func RootPath() string {
+	root.RLock()
+	defer root.RUnlock()
+	return root.path
+}
+
+// SetRoot 替换对外提供服务的根目录，fileId和path由ResolveRootFolder得到
+func SetRoot(fileId string, path string) {
+	root.Lock()
+	root.fileId, root.path = fileId, path
+	root.Unlock()
+}
+
+// ResolveRootFolder 查找网盘中的folderPath目录(如/Media)，返回其FileId和以/结尾的完整路径，
+// folderPath为空时是网盘根目录
+func ResolveRootFolder(ctx context.Context, token string, driveId string, folderPath string) (string, string, error) {
+	folderPath = strings.Trim(folderPath, "/")
+	if folderPath == "" {
+		return "root", "/", nil
+	}
+	item, _, err := Walk(ctx, token, driveId, strings.Split(folderPath, "/"), "root")
+	if err != nil || item.FileId == "" {
+		return "", "", errors.New("root folder not found: " + folderPath)
+	}
+	if item.Type != "folder" {
+		return "", "", errors.New("root folder is not a folder: " + folderPath)
+	}
+	return item.FileId, "/" + folderPath + "/", nil
+}
+
+// SetRootFolder 把网盘中的folderPath目录(如/Media)设置为对外提供服务的根目录
+func SetRootFolder(ctx context.Context, token string, driveId string, folderPath string) error {
+	fileId, path, err := ResolveRootFolder(ctx, token, driveId, folderPath)
+	if err != nil {
+		return err
+	}
+	SetRoot(fileId, path)
+	return nil
+}
+
+func GetList(ctx context.Context, token string, driveId string, parentFileId string, marker ...string) (model.FileListModel, error) {
 
 	if len(parentFileId) == 0 {
-		parentFileId = "root"
+		parentFileId = RootFileId()
 	}
+	if len(marker) > 0 {
+		return getList(ctx, token, driveId, parentFileId, marker...)
+	}
+	v, err := flight.Do(ctx, "GetList/"+driveId+"/"+parentFileId, func() (interface{}, error) {
+		return getList(ctx, token, driveId, parentFileId)
+	})
+	list, _ := v.(model.FileListModel)
+	return list, err
+}
+
+func getList(ctx context.Context, token string, driveId string, parentFileId string, marker ...string) (model.FileListModel, error) {
 
 	var list model.FileListModel
-	if result, ok := cache.GoCache.Get(parentFileId); ok {
+	if result, ok := cache.GoCache.Get(cache.ListKey(driveId, parentFileId)); ok {
 		list, ok = result.(model.FileListModel)
 		if ok {
 			return list, nil
@@ -32,7 +137,7 @@ func GetList(token string, driveId string, parentFileId string, marker ...string
 	postData := make(map[string]interface{})
 	postData["drive_id"] = driveId
 	postData["parent_file_id"] = parentFileId
-	postData["limit"] = 200
+	postData["limit"] = ListPageSize
 	postData["all"] = false
 	postData["url_expire_sec"] = 1600
 	postData["image_thumbnail_process"] = "image/resize,w_400/format,jpeg"
@@ -48,36 +153,44 @@ func GetList(token string, driveId string, parentFileId string, marker ...string
 
 	data, err := json.Marshal(postData)
 	if err != nil {
-		fmt.Println("获取列表转义数据失败", err)
+		net.Logln(ctx, "获取列表转义数据失败", err)
 		return model.FileListModel{}, err
 	}
 
-	body := net.Post(model.APILISTURL, token, data)
+	body := net.Post(ctx, model.APILISTURL, token, data)
+	if err := checkResponse(body, "items"); err != nil {
+		net.Logln(ctx, "获取列表失败", parentFileId, err)
+		return model.FileListModel{}, err
+	}
 
 	e := json.Unmarshal(body, &list)
 	if e != nil {
-		fmt.Println(e)
+		net.Logln(ctx, e)
 	}
+	list.Items = safeNames(list.Items)
 	if list.NextMarker != "" {
-		//fmt.Println("Next Page Marker: " + list.NextMarker)
-		var newList, _ = GetList(token, driveId, parentFileId, list.NextMarker)
+		//net.Logln(ctx, "Next Page Marker: " + list.NextMarker)
+		var newList, _ = getList(ctx, token, driveId, parentFileId, list.NextMarker)
 		list.Items = append(list.Items, newList.Items...)
 		list.NextMarker = newList.NextMarker
 	}
+	if len(marker) == 0 {
+		list = withUploaded(driveId, parentFileId, list)
+	}
 	if len(list.Items) > 0 {
-		cache.GoCache.SetDefault(parentFileId, list)
+		cache.SetDefault(cache.ListKey(driveId, parentFileId), list)
 	}
 	return list, nil
 }
 
-func GetFilePath(token string, driveId string, parentFileId string, fileId string, typeStr string) (string, error) {
+func GetFilePath(ctx context.Context, token string, driveId string, parentFileId string, fileId string, typeStr string) (string, error) {
 
 	if len(parentFileId) == 0 {
-		parentFileId = "root"
+		parentFileId = RootFileId()
 	}
 	path := "/"
 	var list model.ListFilePath
-	if result, ok := cache.GoCache.Get(parentFileId + "path"); ok {
+	if result, ok := cache.GoCache.Get(cache.PathKey(driveId, parentFileId)); ok {
 		path, ok = result.(string)
 		if ok {
 			return path, nil
@@ -90,15 +203,15 @@ func GetFilePath(token string, driveId string, parentFileId string, fileId strin
 
 	data, err := json.Marshal(postData)
 	if err != nil {
-		fmt.Println("获取列表转义数据失败", err)
+		net.Logln(ctx, "获取列表转义数据失败", err)
 		return "/", err
 	}
 
-	body := net.Post(model.APIFILEPATH, token, data)
+	body := net.Post(ctx, model.APIFILEPATH, token, data)
 
 	e := json.Unmarshal(body, &list)
 	if e != nil {
-		fmt.Println(e)
+		net.Logln(ctx, e)
 	}
 	minNum := 0
 	if typeStr == "folder" {
@@ -106,24 +219,40 @@ func GetFilePath(token string, driveId string, parentFileId string, fileId strin
 	}
 	for i := len(list.Items); i > minNum; i-- {
 		if list.Items[i-1].Type == "folder" {
-			path += list.Items[i-1].Name + "/"
+			path += SafeName(list.Items[i-1].Name) + "/"
 		}
 	}
+	//去掉挂载根目录的前缀
+	if rootPath := RootPath(); strings.HasPrefix(path, rootPath) {
+		path = "/" + path[len(rootPath):]
+	}
 
-	cache.GoCache.SetDefault(parentFileId+"path", path)
+	cache.SetDefault(cache.PathKey(driveId, parentFileId), path)
 
 	return path, nil
 }
 
-func GetFile(w http.ResponseWriter, url string, token string, rangeStr string, ifRange string) bool {
+func GetFile(ctx context.Context, w io.Writer, url string, token string, driveId string, fileId string, rangeStr string, ifRange string) bool {
 
-	body := net.Get(w, url, token, rangeStr, ifRange)
+	body := net.Get(ctx, w, url, token, rangeStr, ifRange, func() string {
+		return GetDownloadUrl(ctx, token, driveId, fileId)
+	})
 	//net.GetProxy(w, req, url, token)
 	return body
 	//return []byte{}
 }
 
-func RefreshToken(refreshToken string) model.RefreshTokenModel {
+// GetFileRange 下载文件中rangeStr指定的部分，OSS没有按Range返回206时返回net.ErrRangeIgnored，不写入任何内容
+func GetFileRange(ctx context.Context, w io.Writer, url string, token string, driveId string, fileId string, rangeStr string) error {
+	return net.GetRange(ctx, w, url, token, rangeStr, "", func() string {
+		return GetDownloadUrl(ctx, token, driveId, fileId)
+	})
+}
+
+// RefreshLog 刷新token失败的日志，断网时连续相同的失败只打印一次，之后定期汇总
+var RefreshLog = &utils.RepeatLogger{Interval: time.Hour}
+
+func RefreshToken(ctx context.Context, refreshToken string) model.RefreshTokenModel {
 	path := refreshToken
 	if _, errs := os.Stat(path); errs == nil {
 		buf, _ := ioutil.ReadFile(path)
@@ -132,20 +261,20 @@ func RefreshToken(refreshToken string) model.RefreshTokenModel {
 			refreshToken = refreshToken[:32] // refreshToken is only 32 bit?? FIXME
 		}
 	}
-	rs := net.Post(model.APIREFRESHTOKENURL, "", []byte(`{"refresh_token":"`+refreshToken+`"}`))
+	rs := net.Post(ctx, model.APIREFRESHTOKENURL, "", []byte(`{"refresh_token":"`+refreshToken+`"}`))
 	var refresh model.RefreshTokenModel
 
 	if len(rs) <= 0 {
-		fmt.Println("刷新token失败")
+		RefreshLog.Println("刷新token失败")
 		return refresh
 	}
 
 	err := json.Unmarshal(rs, &refresh)
 	if err != nil {
-		fmt.Println("刷新token失败,失败信息", err)
-		fmt.Println("刷新token返回信息", refresh)
+		RefreshLog.Println("刷新token失败,失败信息", err)
 		return refresh
 	}
+	RefreshLog.Reset()
 
 	if refreshToken == refresh.RefreshToken {
 		return refresh
@@ -156,102 +285,142 @@ func RefreshToken(refreshToken string) model.RefreshTokenModel {
 		return refresh
 	}
 	if err != nil {
-		fmt.Println("更新token文件失败,失败信息", err)
+		net.Logln(ctx, "更新token文件失败,失败信息", err)
 		return refresh
 	}
 
 	err = ioutil.WriteFile(path, []byte(refresh.RefreshToken), 0600)
 	if err != nil {
-		fmt.Println("更新token文件失败,失败信息", err)
+		net.Logln(ctx, "更新token文件失败,失败信息", err)
 	}
 
 	return refresh
 }
 
-func RemoveTrash(token string, driveId string, fileId string, parentFileId string) bool {
-	net.Post(model.APIREMOVETRASH, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`"}`))
-	//if len(rs) == 0 {
-	//	cache.GoCache.Delete(parentFileId)
-	//}
-	cache.GoCache.Delete(parentFileId)
-	return false
+// RemoveTrash 把文件移到回收站。失败时可以用errors.Is判断风控、无权限及文件不存在(os.ErrNotExist)
+func RemoveTrash(ctx context.Context, token string, driveId string, fileId string, parentFileId string) error {
+	rs, code := net.PostExpectStatus(ctx, model.APIREMOVETRASH, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`"}`))
+	cache.GoCache.Delete(cache.ListKey(driveId, parentFileId))
+	if code >= 200 && code < 300 {
+		return nil
+	}
+	if err := checkResponse(rs, "code"); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: trash status %d", ErrUnexpectedResponse, code)
 }
 
-func ReName(token string, driveId string, newName string, fileId string) bool {
-	rs := net.Post(model.APIFILEUPDATE, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`","name":"`+newName+`","check_name_mode":"refuse"}`))
+// ListTrash 列出回收站中的文件，按删除时间倒序
+func ListTrash(ctx context.Context, token string, driveId string) (model.FileListModel, error) {
+	var list model.FileListModel
+	rs := net.Post(ctx, model.APITRASHLIST, token, []byte(`{"drive_id":"`+driveId+`","limit":200,"order_by":"updated_at","order_direction":"DESC"}`))
+	if err := checkResponse(rs, "items"); err != nil {
+		return list, err
+	}
+	if err := json.Unmarshal(rs, &list); err != nil {
+		return list, fmt.Errorf("%w: %v", ErrUnexpectedResponse, err)
+	}
+	list.Items = safeNames(list.Items)
+	return list, nil
+}
+
+// RestoreTrash 将回收站中的文件还原到原来的目录
+func RestoreTrash(ctx context.Context, token string, driveId string, fileId string, parentFileId string) error {
+	_, code := net.PostExpectStatus(ctx, model.APITRASHRESTORE, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`"}`))
+	cache.GoCache.Delete(cache.ListKey(driveId, parentFileId))
+	if code != http.StatusOK && code != http.StatusNoContent && code != http.StatusAccepted {
+		return fmt.Errorf("%w: restore status %d", ErrUnexpectedResponse, code)
+	}
+	return nil
+}
+
+// ReName 重命名文件，同一目录下已有同名项时失败，返回是否成功
+func ReName(ctx context.Context, token string, driveId string, newName string, fileId string) bool {
+	postData := make(map[string]interface{})
+	postData["drive_id"] = driveId
+	postData["file_id"] = fileId
+	postData["name"] = newName
+	postData["check_name_mode"] = "refuse"
+	data, err := json.Marshal(postData)
+	if err != nil {
+		net.Logln(ctx, "重命名转义数据失败", err)
+		return false
+	}
+	rs := net.Post(ctx, model.APIFILEUPDATE, token, data)
+	//重名(check_name_mode为refuse)等失败时返回错误码，没有file_id
+	if err := checkResponse(rs, "file_id"); err != nil {
+		net.Logln(ctx, "重命名失败", fileId, newName, err)
+		return false
+	}
 	var m model.ListModel
 	e := json.Unmarshal(rs, &m)
 	if e != nil {
-		fmt.Println(e)
+		net.Logln(ctx, e)
 	}
-	cache.GoCache.Delete(m.ParentFileId)
-	fmt.Println(string(rs))
+	cache.GoCache.Delete(cache.ListKey(driveId, m.ParentFileId))
+	net.Logln(ctx, string(rs))
 	return true
 }
 
-// Walk 通过路径查找对应项目及所有子项目，当新建文件或文件夹时，也返回Not Found
-func Walk(token string, driverId string, paths []string, parentFileId string) (model.ListModel, model.FileListModel, error) {
+// Walk 通过路径查找对应项目及所有子项目，当新建文件或文件夹时，也返回Not Found(可用errors.Is(err, os.ErrNotExist)判断)
+func Walk(ctx context.Context, token string, driverId string, paths []string, parentFileId string) (model.ListModel, model.FileListModel, error) {
 	var item model.ListModel
 	var list model.FileListModel
-	var err error
-	err = errors.New("not found")
+	//以/结尾的路径拆分后最后一段为空
+	for len(paths) > 1 && paths[len(paths)-1] == "" {
+		paths = paths[:len(paths)-1]
+	}
 	if len(paths) == 0 || paths[0] == "" {
 		item = model.ListModel{}
-		list, _ = GetList(token, driverId, "")
+		list, _ = GetList(ctx, token, driverId, "")
 		return item, list, nil
 	}
 	if parentFileId == "" {
-		parentFileId = "root"
+		parentFileId = RootFileId()
 	}
-	for _, path := range paths {
-		list, _ = GetList(token, driverId, parentFileId)
-		var found bool
-		for _, v := range list.Items {
-			if v.Name == path {
-				found = true
-				item = v
-				//找到一个匹配的并且为路径的最后一个，则直接返回相应信息，并直接跳出本循环
-				if path == paths[len(paths)-1] {
-					list, _ = GetList(token, driverId, item.FileId)
-					return item, list, nil
-				}
-				break
-			}
+	list, err := GetList(ctx, token, driverId, parentFileId)
+	if err != nil {
+		return item, list, err
+	}
+	for _, v := range list.Items {
+		if v.Name != paths[0] {
+			continue
 		}
-		if found {
-			//开始递归查询子目录
-			paths = paths[1:]
-			item, list, err = Walk(token, driverId, paths, item.FileId)
+		//找到一个匹配的并且为路径的最后一段，则直接返回相应信息
+		if len(paths) == 1 {
+			list, _ = GetList(ctx, token, driverId, v.FileId)
+			return v, list, nil
 		}
-
+		//开始递归查询子目录
+		return Walk(ctx, token, driverId, paths[1:], v.FileId)
 	}
-	return item, list, err
+	return item, list, fmt.Errorf("%w: %s", os.ErrNotExist, paths[0])
 }
 
-func Locate(token string, driverId string, paths []string, parentFileId string) (model.ListModel, model.FileListModel) {
+func Locate(ctx context.Context, token string, driverId string, paths []string, parentFileId string) (model.ListModel, model.FileListModel) {
 	var item model.ListModel
 	var list model.FileListModel
 	if len(paths) == 0 || paths[0] == "" {
 		item = model.ListModel{}
-		list, _ = GetList(token, driverId, "")
+		list, _ = GetList(ctx, token, driverId, "")
 		return item, list
 	}
 	for _, path := range paths {
 		if parentFileId == "" {
-			parentFileId = "root"
+			parentFileId = RootFileId()
 		}
 
-		list = Search(token, driverId, path, parentFileId, "folder")
+		list = Search(ctx, token, driverId, path, parentFileId, "folder")
 
 		if len(list.Items) > 0 {
 			item = list.Items[0]
-			list, _ = GetList(token, driverId, item.FileId)
+			list, _ = GetList(ctx, token, driverId, item.FileId)
 			if path == paths[len(paths)-1] {
 				return item, list
 			}
-			item, list = Locate(token, driverId, paths[1:], item.FileId)
+			item, list = Locate(ctx, token, driverId, paths[1:], item.FileId)
 		} else {
-			list, _ = GetList(token, driverId, item.FileId)
+			list, _ = GetList(ctx, token, driverId, item.FileId)
 			return item, list
 		}
 
@@ -259,27 +428,45 @@ func Locate(token string, driverId string, paths []string, parentFileId string)
 	return item, list
 }
 
-func Search(token string, driveId string, name string, parentFileId string, Type string) model.FileListModel {
+func Search(ctx context.Context, token string, driveId string, name string, parentFileId string, Type string) model.FileListModel {
 	var list model.FileListModel
-	if c, ok := cache.GoCache.Get("SearchResult_" + parentFileId + name); ok {
+	if c, ok := cache.GoCache.Get("SearchResult_" + driveId + "_" + parentFileId + name); ok {
 		return c.(model.FileListModel)
 	}
 	if Type == "" {
 		Type = "folder"
 	}
 	//{"drive_id":"67476554","query":"parent_file_id = \"61bdf6d66eced7c2c5324bb9a1fa54ae0d5e0f7d\" and (name = \"Screen Shot 2021-08-20 at 22.17.53.png\")","order_by":"name ASC","limit":100}
-	body := net.Post(model.APISEARCH, token, []byte(`{"drive_id":"`+driveId+`","query":"parent_file_id = \"`+parentFileId+`\" and (name = \"`+name+`\") and (type=\"`+Type+`\")","order_by":"name ASC","limit":200}`))
+	body := net.Post(ctx, model.APISEARCH, token, []byte(`{"drive_id":"`+driveId+`","query":"parent_file_id = \"`+parentFileId+`\" and (name = \"`+name+`\") and (type=\"`+Type+`\")","order_by":"name ASC","limit":200}`))
 	e := json.Unmarshal(body, &list)
 	if e != nil {
-		fmt.Println(e)
+		net.Logln(ctx, e)
 	}
 	if len(list.Items) > 0 {
-		cache.GoCache.Set("SearchResult_"+parentFileId+name, list, -1)
+		cache.GoCache.Set("SearchResult_"+driveId+"_"+parentFileId+name, list, -1)
 	}
 	return list
 }
-func MakeDir(token string, driveId string, name string, parentFileId string) model.ListModel {
-	rs := net.Post(model.APIMKDIR, token, []byte(`{"drive_id":"`+driveId+`","parent_file_id":"`+parentFileId+`","name":"`+name+`","check_name_mode":"refuse","type":"folder"}`))
+
+// FilePathItems 返回fileId自身及其所有上级目录，依次由fileId向网盘根目录排列，不含网盘根目录
+func FilePathItems(ctx context.Context, token string, driveId string, fileId string) ([]model.FilePath, error) {
+	data, err := json.Marshal(map[string]interface{}{"drive_id": driveId, "file_id": fileId})
+	if err != nil {
+		return nil, err
+	}
+	body := net.Post(ctx, model.APIFILEPATH, token, data)
+	if err := checkResponse(body, "items"); err != nil {
+		return nil, err
+	}
+	var list model.ListFilePath
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnexpectedResponse, err)
+	}
+	return list.Items, nil
+}
+
+func MakeDir(ctx context.Context, token string, driveId string, name string, parentFileId string) model.ListModel {
+	rs := net.Post(ctx, model.APIMKDIR, token, []byte(`{"drive_id":"`+driveId+`","parent_file_id":"`+parentFileId+`","name":"`+name+`","check_name_mode":"refuse","type":"folder"}`))
 	var fi model.ListModel
 	//正确返回示例
 	//{
@@ -294,24 +481,39 @@ func MakeDir(token string, driveId string, name string, parentFileId string) mod
 	err := json.Unmarshal(rs, &fi)
 	if err == nil {
 		if fi.Name == name {
-			cache.GoCache.Delete(parentFileId)
+			cache.GoCache.Delete(cache.ListKey(driveId, parentFileId))
 		}
 		return fi
 	}
 	return fi
 }
 
-func GetFileDetail(token string, driveId string, fileId string) model.ListModel {
-	rs := net.Post(model.APIFILEDETAIL, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`"}`))
+func GetFileDetail(ctx context.Context, token string, driveId string, fileId string) (model.ListModel, error) {
+	v, err := flight.Do(ctx, "GetFileDetail/"+driveId+"/"+fileId, func() (interface{}, error) {
+		return getFileDetail(ctx, token, driveId, fileId)
+	})
+	fi, _ := v.(model.ListModel)
+	return fi, err
+}
+
+func getFileDetail(ctx context.Context, token string, driveId string, fileId string) (model.ListModel, error) {
+	rs := net.Post(ctx, model.APIFILEDETAIL, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`"}`))
 	var m model.ListModel
+	if err := checkResponse(rs, "file_id"); err != nil {
+		return m, err
+	}
 	e := json.Unmarshal(rs, &m)
 	if e != nil {
-		fmt.Println(e)
+		net.Logln(ctx, e)
+		return m, fmt.Errorf("%w: %v", ErrUnexpectedResponse, e)
+	}
+	if unsafeName(m.Name) {
+		m.OriginalName, m.Name = m.Name, SafeName(m.Name)
 	}
-	return m
+	return withUploadedDetail(driveId, m), nil
 }
 
-func BatchFile(token string, driveId string, fileId string, parentFileId string) bool {
+func BatchFile(ctx context.Context, token string, driveId string, fileId string, parentFileId string) bool {
 
 	//	{
 	//		"requests": ,
@@ -323,25 +525,51 @@ func BatchFile(token string, driveId string, fileId string, parentFileId string)
 
 	var requests string = `{"requests":[{"body": ` + bodyJson + `,"headers": ` + contentType + `,"id": "` + fileId + `","method": "POST","url": "/file/move"}],"resource": "file"}`
 
-	rs := net.Post(model.APIFILEBATCH, token, []byte(requests))
-	if gjson.GetBytes(rs, "responses.0.friends").Num == 200 {
-		cache.GoCache.Delete(parentFileId)
-		cache.GoCache.Delete(fileId)
+	rs := net.Post(ctx, model.APIFILEBATCH, token, []byte(requests))
+	if gjson.GetBytes(rs, "responses.0.status").Num == 200 {
+		cache.GoCache.Delete(cache.ListKey(driveId, parentFileId))
+		cache.GoCache.Delete(cache.ListKey(driveId, fileId))
 		return true
 	}
 
 	return false
 }
-func UpdateFileFolder(token string, driveId string, fileName string, parentFileId string) bool {
+
+// CopyFile 把fileId(文件或文件夹)复制到同一网盘的parentFileId下，返回副本的file_id。
+// 目标目录下已有同名项时阿里云会自动改名，需要指定名称时复制后再重命名
+func CopyFile(ctx context.Context, token string, driveId string, fileId string, parentFileId string) (string, error) {
+	bodyJson := `{"drive_id": "` + driveId + `","file_id": "` + fileId + `","to_drive_id": "` + driveId + `","to_parent_file_id": "` + parentFileId + `","auto_rename": true}`
+	contentType := `{"Content-Type": "application/json"}`
+	requests := `{"requests":[{"body": ` + bodyJson + `,"headers": ` + contentType + `,"id": "` + fileId + `","method": "POST","url": "/file/copy"}],"resource": "file"}`
+
+	rs := net.Post(ctx, model.APIFILEBATCH, token, []byte(requests))
+	if err := checkResponse(rs, "responses.0"); err != nil {
+		return "", err
+	}
+	result := []byte(gjson.GetBytes(rs, "responses.0.body").Raw)
+	if status := gjson.GetBytes(rs, "responses.0.status").Int(); status < 200 || status >= 300 {
+		if err := checkResponse(result, "code"); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: copy status %d", ErrUnexpectedResponse, status)
+	}
+	if err := checkResponse(result, "file_id"); err != nil {
+		return "", err
+	}
+	cache.GoCache.Delete(cache.ListKey(driveId, parentFileId))
+	return gjson.GetBytes(result, "file_id").Str, nil
+}
+
+func UpdateFileFolder(ctx context.Context, token string, driveId string, fileName string, parentFileId string) bool {
 
 	//	{
 	//		"requests": ,
 	//	"resource": "file"
 	//	}
 	createData := `{"drive_id": "` + driveId + `","parent_file_id": "` + parentFileId + `","name": "` + fileName + `","check_name_mode": "refuse","type": "folder"}`
-	net.Post(model.APIFILEUPLOAD, token, []byte(createData))
-	// rs := net.Post(model.APIFILEUPLOAD, token, []byte(createData))
-	// fmt.Println(string(rs))
+	net.Post(ctx, model.APIFILEUPLOAD, token, []byte(createData))
+	// rs := net.Post(ctx, model.APIFILEUPLOAD, token, []byte(createData))
+	// net.Logln(ctx, string(rs))
 	//正确返回占星显示
 	//	{"parent_file_id":"60794ad941ee2d8d24f843b7a0ffd80279927dfc","type":"folder","file_id":"613caeb4d5b1ba9fb4604d4aa5aef2b408ab3121","domain_id":"bj29","drive_id":"1662258","file_name":"1SDSDSD.png","encrypt_mode":"none"}
 	//
@@ -369,10 +597,11 @@ func UpdateFileFolder(token string, driveId string, fileName string, parentFileI
 	return false
 }
 
-func UpdateFileFile(token string, driveId string, fileName string, parentFileId string, size string, length int, contentHash string, proof string, flashUpload bool) ([]gjson.Result, string, string, bool) {
+// UpdateFileFile 创建文件，返回分片上传地址、upload_id、file_id、是否已闪传，以及阿里云实际使用的文件名
+func UpdateFileFile(ctx context.Context, token string, driveId string, fileName string, parentFileId string, size string, length int, contentHash string, proof string, flashUpload bool) ([]gjson.Result, string, string, bool, string, error) {
 
 	if len(parentFileId) == 0 {
-		parentFileId = "root"
+		parentFileId = RootFileId()
 	}
 
 	var partStr string = "["
@@ -389,42 +618,75 @@ func UpdateFileFile(token string, driveId string, fileName string, parentFileId
 	} else {
 		createData = `{"drive_id":"` + driveId + `","part_info_list":` + partStr + `,"parent_file_id":"` + parentFileId + `","name":"` + fileName + `","type":"file","check_name_mode":"overwrite","size":` + size + `,"content_hash_name":"","proof_version":"v1"}`
 	}
-	rs := net.Post(model.APIFILEUPLOAD, token, []byte(createData))
+	rs := net.Post(ctx, model.APIFILEUPLOAD, token, []byte(createData))
+	name := actualName(ctx, fileName, gjson.GetBytes(rs, "file_name").Str)
 	rapidUpload := gjson.GetBytes(rs, "rapid_upload").Bool()
 	if rapidUpload == true {
-		return nil, gjson.GetBytes(rs, "upload_id").Str, gjson.GetBytes(rs, "file_id").Str, true
+		return nil, gjson.GetBytes(rs, "upload_id").Str, gjson.GetBytes(rs, "file_id").Str, true, name, nil
 	}
 	urlArr := gjson.GetBytes(rs, "part_info_list.#.upload_url").Array()
+	var err error
 	if len(urlArr) == 0 {
-		fmt.Println("❌  创建文件出错", string(rs))
+		net.Logln(ctx, "❌  创建文件出错", string(rs))
+		if err = checkResponse(rs, "part_info_list"); err == nil {
+			err = fmt.Errorf("%w: missing upload urls", ErrUnexpectedResponse)
+		}
 	}
-	return urlArr, gjson.GetBytes(rs, "upload_id").Str, gjson.GetBytes(rs, "file_id").Str, false
+	return urlArr, gjson.GetBytes(rs, "upload_id").Str, gjson.GetBytes(rs, "file_id").Str, false, name, err
 
 }
-func UploadFile(url string, token string, data []byte) bool {
+func UploadFile(ctx context.Context, url string, token string, data []byte) bool {
 	//最多试5次
 	for i := 0; i < 5; i++ {
-		rs, status := net.Put(url, token, data)
+		rs, status := net.Put(ctx, url, token, data)
 		if len(rs) == 0 && status == 0 {
 			return true
 		} else {
-			fmt.Println("❌  Upload Error: ", string(rs), " Retrying in 5 seconds")
-			time.Sleep(5 * time.Second)
+			if ctx.Err() != nil {
+				return false
+			}
+			net.Logln(ctx, "❌  Upload Error: ", string(rs), " Retrying in 5 seconds")
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+				return false
+			}
 		}
 	}
 	return false
 }
-func UploadFileComplete(token string, driveId string, uploadId string, fileId string, parentId string) bool {
+
+// UploadFileComplete 完成上传，返回阿里云实际使用的文件名，接口没有返回文件名时为空
+func UploadFileComplete(ctx context.Context, token string, driveId string, uploadId string, fileId string, parentId string) string {
 
 	createData := `{"drive_id": "` + driveId + `","file_id": "` + fileId + `","upload_id": "` + uploadId + `"}`
 
-	rs := net.Post(model.APIFILECOMPLETE, token, []byte(createData))
-	fmt.Println("⬆️  Upload Result:", gjson.GetBytes(rs, "file_id").Str, gjson.GetBytes(rs, "name").Str, gjson.GetBytes(rs, "size").Str)
-	cache.GoCache.Delete(parentId)
+	rs := net.Post(ctx, model.APIFILECOMPLETE, token, []byte(createData))
+	net.Logln(ctx, "⬆️  Upload Result:", gjson.GetBytes(rs, "file_id").Str, gjson.GetBytes(rs, "name").Str, gjson.GetBytes(rs, "size").Str)
+	cache.GoCache.Delete(cache.ListKey(driveId, parentId))
 
-	return false
+	return gjson.GetBytes(rs, "name").Str
 }
-func GetDownloadUrl(token string, driveId string, fileId string) string {
+
+// actualName 阿里云可能以其他名称创建文件(如同名文件冲突时自动重命名)，以返回的名称为准
+func actualName(ctx context.Context, requested string, returned string) string {
+	if returned == "" {
+		return requested
+	}
+	if returned != requested {
+		net.Logln(ctx, "⚠️  阿里云以其他名称创建了文件", requested, "->", returned)
+	}
+	return returned
+}
+func GetDownloadUrl(ctx context.Context, token string, driveId string, fileId string) string {
+	v, _ := flight.Do(ctx, "GetDownloadUrl/"+driveId+"/"+fileId, func() (interface{}, error) {
+		return getDownloadUrl(ctx, token, driveId, fileId), nil
+	})
+	url, _ := v.(string)
+	return url
+}
+
+func getDownloadUrl(ctx context.Context, token string, driveId string, fileId string) string {
 
 	postData := make(map[string]interface{})
 	postData["drive_id"] = driveId
@@ -432,21 +694,69 @@ func GetDownloadUrl(token string, driveId string, fileId string) string {
 
 	data, _ := json.Marshal(postData)
 
-	body := net.Post(model.APIFILEDOWNLOAD, token, data)
+	body := net.Post(ctx, model.APIFILEDOWNLOAD, token, data)
+	return downloadUrlField(body)
+
+}
+
+// DownloadUrlFields 下载地址接口返回多个地址时优先使用的字段，依次尝试，
+// 如cdn_url(CDN加速，部分账号才有)、url、internal_url(阿里云内网)，都没有时使用url
+var DownloadUrlFields = []string{"url"}
+
+// KnownDownloadUrlFields 下载地址接口可能返回的地址字段
+var KnownDownloadUrlFields = map[string]bool{"url": true, "cdn_url": true, "internal_url": true}
+
+func downloadUrlField(body []byte) string {
+	for _, field := range DownloadUrlFields {
+		if u := gjson.GetBytes(body, field).Str; u != "" {
+			return u
+		}
+	}
 	return gjson.GetBytes(body, "url").Str
+}
 
+// GetVideoPlayInfo 获取视频转码后的播放地址(m3u8)，key为清晰度模板，如LD(360p)、SD(540p)、HD(720p)、FHD(1080p)、QHD(1440p)，
+// 只包含已经转码完成的清晰度
+func GetVideoPlayInfo(ctx context.Context, token string, driveId string, fileId string) (map[string]string, error) {
+	rs := net.Post(ctx, model.APIVIDEOPLAYINFO, token, []byte(`{"drive_id":"`+driveId+`","file_id":"`+fileId+`","category":"live_transcoding","template_id":"","get_subtitle_info":false}`))
+	if err := checkResponse(rs, "video_preview_play_info"); err != nil {
+		return nil, err
+	}
+	urls := map[string]string{}
+	for _, task := range gjson.GetBytes(rs, "video_preview_play_info.live_transcoding_task_list").Array() {
+		if task.Get("status").Str == "finished" && task.Get("url").Str != "" {
+			urls[task.Get("template_id").Str] = task.Get("url").Str
+		}
+	}
+	return urls, nil
 }
-func GetBoxSize(token string) (string, string) {
+
+func GetBoxSize(ctx context.Context, token string) (string, string) {
 
 	postData := make(map[string]interface{})
 
 	data, _ := json.Marshal(postData)
 
-	body := net.Post(model.APITOTLESIZE, token, data)
+	body := net.Post(ctx, model.APITOTLESIZE, token, data)
 	return gjson.GetBytes(body, "personal_space_info.total_size").String(), gjson.GetBytes(body, "personal_space_info.used_size").String()
 
 }
-func GetUploadUrls(token string, driveId string, fileId string, uploadId string, length int) []gjson.Result {
+
+// GetDriveSize 获取指定网盘的总空间和已用空间，获取不到时退回到账号整体的空间
+func GetDriveSize(ctx context.Context, token string, driveId string) (string, string) {
+	postData := make(map[string]interface{})
+	postData["drive_id"] = driveId
+
+	data, _ := json.Marshal(postData)
+
+	body := net.Post(ctx, model.APIDRIVEGET, token, data)
+	total, used := gjson.GetBytes(body, "total_size"), gjson.GetBytes(body, "used_size")
+	if !total.Exists() || !used.Exists() {
+		return GetBoxSize(ctx, token)
+	}
+	return total.String(), used.String()
+}
+func GetUploadUrls(ctx context.Context, token string, driveId string, fileId string, uploadId string, length int) []gjson.Result {
 	var partStr string = "["
 	for i := 0; i < length; i++ {
 		partStr += `{"part_number":` + strconv.Itoa(i+1) + `},`
@@ -454,7 +764,20 @@ func GetUploadUrls(token string, driveId string, fileId string, uploadId string,
 	partStr = partStr[:len(partStr)-1]
 	partStr += "]"
 	uploadRequest := `{"drive_id":"` + driveId + `","part_info_list":` + partStr + `,"file_id":"` + fileId + `","upload_id":"` + uploadId + `"}`
-	rs := net.Post(model.APIFILEUPLOADURL, token, []byte(uploadRequest))
-	//fmt.Println(string(rs))
+	rs := net.Post(ctx, model.APIFILEUPLOADURL, token, []byte(uploadRequest))
+	//net.Logln(ctx, string(rs))
 	return gjson.GetBytes(rs, "part_info_list.#.upload_url").Array()
 }
+
+// ListDrives 列出账号下所有的网盘
+func ListDrives(ctx context.Context, token string) ([]model.Drive, error) {
+	body := net.Post(ctx, model.APIDRIVELIST, token, []byte(`{}`))
+	if net.IsRiskControl(body) {
+		return nil, net.ErrRiskControl
+	}
+	var list model.DriveListModel
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
@@ -0,0 +1,387 @@
+package aliyun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/tidwall/gjson"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/net"
+	"go-aliyun-webdav/utils"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveRootFolder(t *testing.T) {
+	s := newFake(t)
+	media := s.Mkdir("root", "Media")
+	movies := s.Mkdir(media, "Movies")
+	s.Put("root", "file.txt", []byte("x"))
+	ctx := context.Background()
+
+	for folder, want := range map[string][2]string{
+		"":              {"root", "/"},
+		"/":             {"root", "/"},
+		"/Media":        {media, "/Media/"},
+		"Media/Movies/": {movies, "/Media/Movies/"},
+	} {
+		fileId, path, err := ResolveRootFolder(ctx, "token", aliyuntest.DriveId, folder)
+		if err != nil || fileId != want[0] || path != want[1] {
+			t.Errorf("ResolveRootFolder(%q) = %q, %q, %v; want %q, %q", folder, fileId, path, err, want[0], want[1])
+		}
+	}
+	for _, folder := range []string{"/missing", "/file.txt"} {
+		if _, _, err := ResolveRootFolder(ctx, "token", aliyuntest.DriveId, folder); err == nil {
+			t.Errorf("ResolveRootFolder(%q) succeeded", folder)
+		}
+	}
+}
+
+func TestRiskControl(t *testing.T) {
+	s := newFake(t)
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":"NeedCaptcha","message":"need captcha"}`))
+	})
+	if _, err := GetList(context.Background(), "token", aliyuntest.DriveId, "root"); !errors.Is(err, net.ErrRiskControl) {
+		t.Errorf("GetList = %v, want ErrRiskControl", err)
+	}
+	if err := net.RiskControlled(); err != net.ErrRiskControl {
+		t.Errorf("RiskControlled = %v after a risk-control response", err)
+	}
+
+	//有请求正常返回后清除风控状态
+	s.Handle("/adrive/v3/file/list", nil)
+	if _, err := GetList(context.Background(), "token", aliyuntest.DriveId, "root"); err != nil {
+		t.Fatalf("GetList: %v", err)
+	}
+	if err := net.RiskControlled(); err != nil {
+		t.Errorf("RiskControlled = %v after a normal response", err)
+	}
+}
+
+func TestPermissionDenied(t *testing.T) {
+	s := newFake(t)
+	for body, want := range map[string]bool{
+		`{"code":"ForbiddenNoPermission.File","message":"No permission"}`: true,
+		`{"code":"PermissionDenied","message":"denied"}`:                  true,
+		`{"code":"UserNotAllowedAccessDrive","message":"not allowed"}`:    true,
+		//令牌过期由刷新令牌处理，不算无权限
+		`{"code":"AccessTokenInvalid","message":"expired"}`: false,
+	} {
+		if got := net.IsPermissionDenied([]byte(body)); got != want {
+			t.Errorf("IsPermissionDenied(%s) = %v, want %v", body, got, want)
+		}
+	}
+
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"code":"ForbiddenNoPermission.File","message":"No permission"}`))
+	})
+	if _, err := GetList(context.Background(), "token", aliyuntest.DriveId, "root"); !errors.Is(err, net.ErrPermissionDenied) {
+		t.Errorf("GetList = %v, want ErrPermissionDenied", err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	s := newFake(t)
+	a := s.Mkdir("root", "a")
+	b := s.Mkdir(a, "b")
+	c := s.Put(b, "c.txt", []byte("c"))
+	x := s.Mkdir("root", "x")
+	xx := s.Mkdir(x, "x")
+	s.Put(xx, "in-xx.txt", []byte("x"))
+	s.Put("root", "c.txt", []byte("root c"))
+
+	for _, tc := range []struct {
+		path     string
+		want     string
+		children int
+	}{
+		{"a/b", b, 1},
+		{"a/b/", b, 1},
+		{"a/b/c.txt", c, 0},
+		{"x/x", xx, 1},
+	} {
+		item, list, err := Walk(context.Background(), "token", aliyuntest.DriveId, strings.Split(tc.path, "/"), "")
+		if err != nil || item.FileId != tc.want {
+			t.Errorf("Walk(%s) = %s, %v; want %s", tc.path, item.FileId, err, tc.want)
+		}
+		if len(list.Items) != tc.children {
+			t.Errorf("Walk(%s) listed %d children, want %d", tc.path, len(list.Items), tc.children)
+		}
+	}
+	for _, p := range []string{"missing/c.txt", "a/missing", "a/b/c.txt/d"} {
+		if item, _, err := Walk(context.Background(), "token", aliyuntest.DriveId, strings.Split(p, "/"), ""); err == nil || item.FileId != "" {
+			t.Errorf("Walk(%s) = %s, %v; want not found", p, item.FileId, err)
+		}
+	}
+}
+
+func TestUnexpectedResponses(t *testing.T) {
+	s := newFake(t)
+	id := s.Put("root", "a.txt", []byte("a"))
+	ctx := context.Background()
+	for name, body := range map[string]string{
+		"error object":    `{"code":"InternalError","message":"oops"}`,
+		"renamed field":   `{"entries":[],"next_marker":""}`,
+		"empty body":      ``,
+		"not json object": `[1,2,3]`,
+	} {
+		body := body
+		s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) })
+		s.Handle("/v2/file/get", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) })
+		cache.GoCache.Flush()
+		if _, err := GetList(ctx, "token", aliyuntest.DriveId, "root"); !errors.Is(err, ErrUnexpectedResponse) {
+			t.Errorf("%s: GetList = %v, want ErrUnexpectedResponse", name, err)
+		}
+		if _, _, err := Walk(ctx, "token", aliyuntest.DriveId, []string{"a.txt"}, ""); !errors.Is(err, ErrUnexpectedResponse) {
+			t.Errorf("%s: Walk = %v, want ErrUnexpectedResponse", name, err)
+		}
+		if _, err := GetFileDetail(ctx, "token", aliyuntest.DriveId, id); !errors.Is(err, ErrUnexpectedResponse) {
+			t.Errorf("%s: GetFileDetail = %v, want ErrUnexpectedResponse", name, err)
+		}
+	}
+
+	//文件不存在不属于接口格式变化
+	s.Handle("/v2/file/get", nil)
+	if _, err := GetFileDetail(ctx, "token", aliyuntest.DriveId, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("GetFileDetail of a missing file = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestGetDriveSize(t *testing.T) {
+	s := newFake(t)
+	s.Handle("/v2/drive/get", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		switch gjson.GetBytes(data, "drive_id").Str {
+		case "1":
+			w.Write([]byte(`{"drive_id":"1","total_size":1000,"used_size":100}`))
+		case "2":
+			w.Write([]byte(`{"drive_id":"2","total_size":5000,"used_size":4000}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+	s.Handle("/v2/databox/get_personal_info", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"personal_space_info":{"total_size":9000,"used_size":10}}`))
+	})
+	ctx := context.Background()
+	for _, c := range []struct{ driveId, total, used string }{
+		{"1", "1000", "100"},
+		{"2", "5000", "4000"},
+		//取不到网盘的空间时退回到账号整体的空间
+		{"3", "9000", "10"},
+	} {
+		if total, used := GetDriveSize(ctx, "token", c.driveId); total != c.total || used != c.used {
+			t.Errorf("GetDriveSize(%s) = %s, %s; want %s, %s", c.driveId, total, used, c.total, c.used)
+		}
+	}
+}
+
+func TestListPageSize(t *testing.T) {
+	defer func(old int) { ListPageSize = old }(ListPageSize)
+	s := newFake(t)
+	dir := s.Mkdir("root", "dir")
+	for i := 0; i < 7; i++ {
+		s.Put(dir, "file"+strconv.Itoa(i), []byte("x"))
+	}
+	var limits []int64
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		limits = append(limits, gjson.GetBytes(data, "limit").Int())
+		s.Default(w, r)
+	})
+
+	if _, err := GetList(context.Background(), "token", aliyuntest.DriveId, "root"); err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 1 || limits[0] != MaxListPageSize {
+		t.Errorf("default page limits = %v, want %d", limits, MaxListPageSize)
+	}
+
+	//每页3条时7个文件分3页取得
+	limits = nil
+	ListPageSize = 3
+	list, err := GetList(context.Background(), "token", aliyuntest.DriveId, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 7 {
+		t.Errorf("listed %d items, want 7", len(list.Items))
+	}
+	if len(limits) != 3 {
+		t.Errorf("listed %d pages, want 3", len(limits))
+	}
+	for _, limit := range limits {
+		if limit != 3 {
+			t.Errorf("page limits = %v, want 3", limits)
+			break
+		}
+	}
+}
+
+func TestDownloadUrlFields(t *testing.T) {
+	defer func(old []string) { DownloadUrlFields = old }(DownloadUrlFields)
+	s := newFake(t)
+	id := s.Put("root", "a.bin", []byte("a"))
+	withCDN := true
+	s.Handle("/v2/file/get_download_url", func(w http.ResponseWriter, r *http.Request) {
+		body := `{"url":"https://oss.example.com/a","internal_url":"https://internal.example.com/a"`
+		if withCDN {
+			body += `,"cdn_url":"https://cdn.example.com/a"`
+		}
+		w.Write([]byte(body + `}`))
+	})
+
+	for _, c := range []struct {
+		fields  []string
+		withCDN bool
+		want    string
+	}{
+		{[]string{"url"}, true, "https://oss.example.com/a"},
+		{[]string{"cdn_url", "url"}, true, "https://cdn.example.com/a"},
+		{[]string{"internal_url"}, true, "https://internal.example.com/a"},
+		//没有优先的地址时依次尝试，都没有时使用url
+		{[]string{"cdn_url", "internal_url"}, false, "https://internal.example.com/a"},
+		{[]string{"cdn_url"}, false, "https://oss.example.com/a"},
+	} {
+		DownloadUrlFields, withCDN = c.fields, c.withCDN
+		cache.GoCache.Flush()
+		if got := GetDownloadUrl(context.Background(), "token", aliyuntest.DriveId, id); got != c.want {
+			t.Errorf("fields %v (cdn_url %v) gave %s, want %s", c.fields, c.withCDN, got, c.want)
+		}
+	}
+}
+
+func TestGetVideoPlayInfo(t *testing.T) {
+	s := newFake(t)
+	id := s.Put("root", "a.mp4", []byte("video"))
+	s.Handle("/v2/file/get_video_preview_play_info", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if gjson.GetBytes(data, "file_id").Str != id {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":"NotFound.File","message":"not found"}`))
+			return
+		}
+		w.Write([]byte(`{"video_preview_play_info":{"live_transcoding_task_list":[
+			{"template_id":"LD","status":"finished","url":"https://hls.example.com/LD/index.m3u8"},
+			{"template_id":"HD","status":"finished","url":"https://hls.example.com/HD/index.m3u8"},
+			{"template_id":"FHD","status":"running","url":""}]}}`))
+	})
+
+	urls, err := GetVideoPlayInfo(context.Background(), "token", aliyuntest.DriveId, id)
+	if err != nil {
+		t.Fatalf("GetVideoPlayInfo: %v", err)
+	}
+	//只返回已经转码完成的清晰度
+	want := map[string]string{
+		"LD": "https://hls.example.com/LD/index.m3u8",
+		"HD": "https://hls.example.com/HD/index.m3u8",
+	}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("play info = %v, want %v", urls, want)
+	}
+	if _, err := GetVideoPlayInfo(context.Background(), "token", aliyuntest.DriveId, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("play info of a missing file = %v, want ErrNotExist", err)
+	}
+}
+
+func TestRefreshTokenRepeatedFailures(t *testing.T) {
+	s := newFake(t)
+	defer func(old *utils.RepeatLogger) { RefreshLog = old }(RefreshLog)
+	RefreshLog = &utils.RepeatLogger{Interval: time.Hour}
+	down := true
+	s.Handle("/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.Write([]byte("<html>gateway error</html>"))
+			return
+		}
+		s.Default(w, r)
+	})
+
+	//标准输出换成管道，统计刷新失败的日志行数
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *os.File) { os.Stdout = old }(os.Stdout)
+	os.Stdout = wr
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(rd)
+		out <- string(data)
+	}()
+	for i := 0; i < 5; i++ {
+		if refresh := RefreshToken(context.Background(), "refresh"); refresh.AccessToken != "" {
+			t.Errorf("refresh %d succeeded while the upstream is down", i)
+		}
+	}
+	down = false
+	if refresh := RefreshToken(context.Background(), "refresh"); refresh.AccessToken == "" {
+		t.Error("refresh failed after the upstream recovered")
+	}
+	wr.Close()
+	log := <-out
+
+	if n := strings.Count(log, "刷新token失败"); n != 2 {
+		t.Errorf("logged %d refresh failure lines, want the first and one summary:\n%s", n, log)
+	}
+	if !strings.Contains(log, "又重复了4次") {
+		t.Errorf("no summary of the 4 repeated failures:\n%s", log)
+	}
+}
+
+func TestUnsafeNames(t *testing.T) {
+	defer func(old string) { UnsafeNames = old }(UnsafeNames)
+	for name, want := range map[string]string{
+		".":      "%2E",
+		"..":     "%2E%2E",
+		"...":    "...",
+		".hide":  ".hide",
+		"a/b":    "a%2Fb",
+		"a/../b": "a%2F..%2Fb",
+		"plain":  "plain",
+	} {
+		if got := SafeName(name); got != want {
+			t.Errorf("SafeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	s := newFake(t)
+	s.Put("root", ".", []byte("dot"))
+	s.Put("root", "..", []byte("dotdot"))
+	s.Put("root", "a/b", []byte("slash"))
+	s.Put("root", "plain.txt", []byte("plain"))
+	names := func() []string {
+		cache.GoCache.Flush()
+		list, err := GetList(context.Background(), "token", aliyuntest.DriveId, "root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, item := range list.Items {
+			names = append(names, item.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	UnsafeNames = "escape"
+	if got, want := names(), []string{"%2E", "%2E%2E", "a%2Fb", "plain.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("escaped names = %q, want %q", got, want)
+	}
+	UnsafeNames = "hide"
+	if got, want := names(), []string{"plain.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("names with unsafe ones hidden = %q, want %q", got, want)
+	}
+}
@@ -2,10 +2,111 @@ package cache
 
 import (
 	"github.com/patrickmn/go-cache"
+	"math/rand"
+	"strings"
+	"sync"
 	"time"
 )
 
-var GoCache *cache.Cache //定义全局变量
+// DefaultExpiration 缓存项的默认过期时间
+const DefaultExpiration = 5 * time.Minute
+
+// Jitter 缓存过期时间的随机浮动比例，避免一次PROPFIND写入的大量缓存同时过期后集中重新查询
+var Jitter = 0.1
+
+var GoCache *Cache //定义全局变量
 func Init() {
-	GoCache = cache.New(5*time.Minute, 60*time.Second)
+	GoCache = New(DefaultExpiration, 60*time.Second)
+}
+
+// Cache 在go-cache的基础上增加批量写入和按前缀删除
+// 读写都先经过mu，SetMany在一次加锁中写入所有项，期间go-cache自身的锁不再有竞争
+type Cache struct {
+	*cache.Cache
+	mu sync.RWMutex
+}
+
+// New 创建缓存，参数与go-cache的New相同
+func New(defaultExpiration time.Duration, cleanupInterval time.Duration) *Cache {
+	return &Cache{Cache: cache.New(defaultExpiration, cleanupInterval)}
+}
+
+// Get 读取未过期的缓存项
+func (c *Cache) Get(k string) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Cache.Get(k)
+}
+
+// Set 写入缓存项，d的含义与go-cache相同
+func (c *Cache) Set(k string, v interface{}, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Cache.Set(k, v, d)
+}
+
+// Delete 删除缓存项
+func (c *Cache) Delete(k string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Cache.Delete(k)
+}
+
+// Flush 删除所有缓存项
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Cache.Flush()
+}
+
+// DeletePrefix 删除键以prefix开头的所有缓存项
+func (c *Cache) DeletePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.Cache.Items() {
+		if strings.HasPrefix(k, prefix) {
+			c.Cache.Delete(k)
+		}
+	}
+}
+
+// FileIdKey 路径对应FileId的缓存键，按网盘区分，不同网盘中的相同路径互不影响
+func FileIdKey(driveId string, path string) string {
+	return "FID_" + driveId + "_" + path
+}
+
+// ListKey 目录的文件列表的缓存键，按网盘区分，不同网盘中的相同FileId(如root)互不影响
+func ListKey(driveId string, parentFileId string) string {
+	return "LIST_" + driveId + "_" + parentFileId
+}
+
+// PathKey 目录路径的缓存键，按网盘区分
+func PathKey(driveId string, parentFileId string) string {
+	return "PATH_" + driveId + "_" + parentFileId
+}
+
+// SetDefault 以默认过期时间写入缓存，过期时间在[DefaultExpiration, DefaultExpiration*(1+Jitter))之间随机浮动
+func SetDefault(k string, v interface{}) {
+	GoCache.Set(k, v, jittered(DefaultExpiration))
+}
+
+func jittered(d time.Duration) time.Duration {
+	if Jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*Jitter*float64(d))
+}
+
+// SetMany 以默认过期时间批量写入缓存项，与SetDefault一样每项的过期时间随机浮动
+func SetMany(items map[string]interface{}) {
+	GoCache.SetMany(items)
+}
+
+// SetMany 在一次加锁中写入多个缓存项，每项的过期时间在默认过期时间上按Jitter随机浮动
+func (c *Cache) SetMany(items map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range items {
+		c.Cache.Set(k, v, jittered(DefaultExpiration))
+	}
 }
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func children(n int) map[string]interface{} {
+	items := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		items[FileIdKey("1", "/big/file"+strconv.Itoa(i))] = "fid" + strconv.Itoa(i)
+	}
+	return items
+}
+
+func TestSetMany(t *testing.T) {
+	c := New(time.Minute, 0)
+	c.Set("old", "x", cache.DefaultExpiration)
+	c.SetMany(map[string]interface{}{"a": "1", "old": "2"})
+	for k, want := range map[string]string{"a": "1", "old": "2"} {
+		if v, ok := c.Get(k); !ok || v != want {
+			t.Errorf("Get(%q) = %v, %v, want %q", k, v, ok, want)
+		}
+	}
+	if item := c.Items()["a"]; item.Expiration == 0 {
+		t.Error("SetMany item never expires")
+	}
+}
+
+// BenchmarkCacheChildren caches the ids of a 5000-item folder while other
+// requests read the cache, as a PROPFIND of a large folder does, once with a
+// Set per child and once with a single SetMany.
+func BenchmarkCacheChildren(b *testing.B) {
+	items := children(5000)
+	run := func(b *testing.B, set func(c *Cache)) {
+		c := New(time.Minute, 0)
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if i%10 == 0 {
+					set(c)
+				} else {
+					c.Get(FileIdKey("1", "/big/file"+strconv.Itoa(i%5000)))
+				}
+			}
+		})
+	}
+	b.Run("Set", func(b *testing.B) {
+		run(b, func(c *Cache) {
+			for k, v := range items {
+				c.Set(k, v, DefaultExpiration)
+			}
+		})
+	})
+	b.Run("SetMany", func(b *testing.B) {
+		run(b, func(c *Cache) { c.SetMany(items) })
+	})
+}
+
+// checkJitter asserts that every entry set between start and end expires
+// within the jitter window and that the expiry times are spread out.
+func checkJitter(t *testing.T, c *Cache, start, end time.Time) {
+	t.Helper()
+	lo := start.Add(DefaultExpiration).UnixNano()
+	hi := end.Add(DefaultExpiration + time.Duration(Jitter*float64(DefaultExpiration))).UnixNano()
+	items := c.Items()
+	expirations := map[int64]bool{}
+	for k, item := range items {
+		if item.Expiration < lo || item.Expiration > hi {
+			t.Errorf("%s expires %v after the write, outside the jitter window", k, time.Duration(item.Expiration-start.UnixNano()))
+		}
+		expirations[item.Expiration] = true
+	}
+	if len(expirations) < len(items)*4/5 {
+		t.Errorf("only %d distinct expiry times among %d entries set together", len(expirations), len(items))
+	}
+}
+
+func TestSetDefaultJitter(t *testing.T) {
+	defer func(old *Cache) { GoCache = old }(GoCache)
+	GoCache = New(DefaultExpiration, 0)
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		SetDefault("k"+strconv.Itoa(i), i)
+	}
+	checkJitter(t, GoCache, start, time.Now())
+}
+
+func TestSetManyJitter(t *testing.T) {
+	defer func(old *Cache) { GoCache = old }(GoCache)
+	GoCache = New(DefaultExpiration, 0)
+	start := time.Now()
+	SetMany(children(50))
+	checkJitter(t, GoCache, start, time.Now())
+}
+
+func TestSetDefaultNoJitter(t *testing.T) {
+	defer func(old float64) { Jitter = old }(Jitter)
+	Jitter = 0
+	if d := jittered(time.Minute); d != time.Minute {
+		t.Errorf("jittered(1m) = %v with no jitter", d)
+	}
+}
+
+func TestFileIdKey(t *testing.T) {
+	if FileIdKey("1", "a/b") == FileIdKey("2", "a/b") {
+		t.Error("the same path in two drives shares a key")
+	}
+	if FileIdKey("1", "a") == FileIdKey("1", "b") {
+		t.Error("two paths share a key")
+	}
+}
@@ -0,0 +1,184 @@
+package aliyun
+
+import (
+	"container/list"
+	"context"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//视频拖动进度条时播放器会发出大量小的Range请求，每个都要请求一次OSS。
+//开启本地缓存后，文件第一次收到Range请求时在后台下载整个文件到本地，之后的Range请求直接读本地文件
+
+// DiskCacheDir 本地缓存文件的目录，为空时不开启
+var DiskCacheDir string
+
+// DiskCacheLimit 本地缓存最多占用的磁盘空间(字节)，超出时删除最久未使用的文件，大于该值的文件不缓存
+var DiskCacheLimit int64
+
+type diskCacheEntry struct {
+	fileId  string
+	version string
+	size    int64
+	ready   bool
+	elem    *list.Element
+}
+
+var (
+	diskCacheMu   sync.Mutex
+	diskCacheUsed int64
+	diskCacheLRU  = list.New()
+	diskCacheMap  = map[string]*diskCacheEntry{}
+)
+
+// DiskCacheEnabled 是否开启了本地缓存
+func DiskCacheEnabled() bool {
+	return DiskCacheDir != "" && DiskCacheLimit > 0
+}
+
+// InitDiskCache 创建缓存目录并删除上次运行遗留的缓存文件
+func InitDiskCache() error {
+	if err := os.MkdirAll(DiskCacheDir, 0700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(DiskCacheDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			os.Remove(filepath.Join(DiskCacheDir, entry.Name()))
+		}
+	}
+	return nil
+}
+
+func diskCachePath(fileId string) string {
+	return filepath.Join(DiskCacheDir, fileId)
+}
+
+// FileVersion 文件内容的版本，内容被修改后不同：有content_hash时为content_hash，否则为修改时间及大小
+func FileVersion(fi model.ListModel) string {
+	if fi.ContentHash != "" {
+		return strings.ToUpper(fi.ContentHash)
+	}
+	return fi.UpdatedAt.UTC().Format(time.RFC3339Nano) + "/" + strconv.FormatInt(fi.Size, 10)
+}
+
+// CachedFile 返回已完整缓存到本地的文件fi，缓存的版本与FileVersion(fi)不一致(文件已被修改)时视为未缓存
+func CachedFile(fi model.ListModel) (*os.File, bool) {
+	fileId := fi.FileId
+	if !DiskCacheEnabled() {
+		return nil, false
+	}
+	diskCacheMu.Lock()
+	defer diskCacheMu.Unlock()
+	e, ok := diskCacheMap[fileId]
+	if !ok || !e.ready || e.version != FileVersion(fi) || e.size != fi.Size {
+		return nil, false
+	}
+	f, err := os.Open(diskCachePath(fileId))
+	if err != nil {
+		removeDiskCacheEntry(e)
+		return nil, false
+	}
+	diskCacheLRU.MoveToFront(e.elem)
+	return f, true
+}
+
+// CacheFileAsync 在后台把整个文件fi下载到本地缓存，同一版本已在缓存或正在下载时不做任何事
+func CacheFileAsync(ctx context.Context, token string, driveId string, fi model.ListModel) {
+	fileId, size, version := fi.FileId, fi.Size, FileVersion(fi)
+	if !DiskCacheEnabled() || size <= 0 || size > DiskCacheLimit {
+		return
+	}
+	diskCacheMu.Lock()
+	if e, ok := diskCacheMap[fileId]; ok {
+		if e.version == version {
+			diskCacheMu.Unlock()
+			return
+		}
+		if !e.ready {
+			//旧版本仍在下载，等它完成后再说
+			diskCacheMu.Unlock()
+			return
+		}
+		removeDiskCacheEntry(e)
+	}
+	//删除最久未使用的文件腾出空间，正在下载的文件不删除
+	for elem := diskCacheLRU.Back(); elem != nil && diskCacheUsed+size > DiskCacheLimit; {
+		prev := elem.Prev()
+		if e := elem.Value.(*diskCacheEntry); e.ready {
+			removeDiskCacheEntry(e)
+		}
+		elem = prev
+	}
+	if diskCacheUsed+size > DiskCacheLimit {
+		diskCacheMu.Unlock()
+		return
+	}
+	e := &diskCacheEntry{fileId: fileId, version: version, size: size}
+	e.elem = diskCacheLRU.PushFront(e)
+	diskCacheMap[fileId] = e
+	diskCacheUsed += size
+	diskCacheMu.Unlock()
+
+	//请求结束后仍在后台下载
+	go fillDiskCache(net.Detached(ctx), token, driveId, e)
+}
+
+func fillDiskCache(ctx context.Context, token string, driveId string, e *diskCacheEntry) {
+	tmp := diskCachePath(e.fileId) + ".part"
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(tmp)
+			diskCacheMu.Lock()
+			removeDiskCacheEntry(e)
+			diskCacheMu.Unlock()
+		}
+	}()
+	f, err := os.Create(tmp)
+	if err != nil {
+		net.Logln(ctx, "❌  创建本地缓存文件失败", err)
+		return
+	}
+	renew := func() string {
+		return GetDownloadUrl(ctx, token, driveId, e.fileId)
+	}
+	fetched := net.Get(ctx, f, renew(), token, "", "", renew)
+	stat, statErr := f.Stat()
+	f.Close()
+	if !fetched || statErr != nil || stat.Size() != e.size {
+		net.Logln(ctx, "❌  下载到本地缓存失败", e.fileId)
+		return
+	}
+	if err := os.Rename(tmp, diskCachePath(e.fileId)); err != nil {
+		net.Logln(ctx, "❌  下载到本地缓存失败", e.fileId, err)
+		return
+	}
+	ok = true
+	diskCacheMu.Lock()
+	e.ready = true
+	diskCacheMu.Unlock()
+	net.Logln(ctx, "💾  已缓存到本地", e.fileId, e.size)
+}
+
+// removeDiskCacheEntry 删除缓存项及其文件，调用时需持有diskCacheMu
+func removeDiskCacheEntry(e *diskCacheEntry) {
+	if diskCacheMap[e.fileId] != e {
+		return
+	}
+	delete(diskCacheMap, e.fileId)
+	diskCacheLRU.Remove(e.elem)
+	diskCacheUsed -= e.size
+	if e.ready {
+		os.Remove(diskCachePath(e.fileId))
+	}
+}
@@ -0,0 +1,143 @@
+package aliyun
+
+import (
+	"container/list"
+	"context"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/model"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useDiskCache 开启上限为limit字节的空本地缓存，测试结束后恢复
+func useDiskCache(t *testing.T, limit int64) {
+	t.Helper()
+	oldDir, oldLimit := DiskCacheDir, DiskCacheLimit
+	t.Cleanup(func() {
+		DiskCacheDir, DiskCacheLimit = oldDir, oldLimit
+		diskCacheMap, diskCacheLRU, diskCacheUsed = map[string]*diskCacheEntry{}, list.New(), 0
+	})
+	DiskCacheDir, DiskCacheLimit = t.TempDir(), limit
+	diskCacheMap, diskCacheLRU, diskCacheUsed = map[string]*diskCacheEntry{}, list.New(), 0
+}
+
+// cacheFile 在后台缓存文件id并等待完成，返回文件信息及缓存是否成功
+func cacheFile(t *testing.T, id string) (model.ListModel, bool) {
+	t.Helper()
+	fi, err := GetFileDetail(context.Background(), "token", aliyuntest.DriveId, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	CacheFileAsync(context.Background(), "token", aliyuntest.DriveId, fi)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		diskCacheMu.Lock()
+		e, ok := diskCacheMap[id]
+		ready := ok && e.ready
+		diskCacheMu.Unlock()
+		if ready {
+			return fi, true
+		}
+		if !ok {
+			return fi, false
+		}
+	}
+	t.Fatalf("file %s still being cached", id)
+	return fi, false
+}
+
+func TestDiskCache(t *testing.T) {
+	s := newFake(t)
+	useDiskCache(t, 1<<20)
+	id := s.Put("root", "movie.mp4", []byte("0123456789"))
+
+	fi, ok := cacheFile(t, id)
+	if !ok {
+		t.Fatal("file not cached")
+	}
+	f, ok := CachedFile(fi)
+	if !ok {
+		t.Fatal("CachedFile found nothing")
+	}
+	content, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(content) != "0123456789" {
+		t.Errorf("cached content = %q", content)
+	}
+	CacheFileAsync(context.Background(), "token", aliyuntest.DriveId, fi)
+	if n := s.Calls("/oss/download/" + id); n != 1 {
+		t.Errorf("file downloaded %d times, want once", n)
+	}
+
+	//文件内容被修改后不再使用旧的缓存
+	changed := fi
+	changed.ContentHash = "0000000000000000000000000000000000000000"
+	if _, ok := CachedFile(changed); ok {
+		t.Error("cache served a changed file")
+	}
+	changed = fi
+	changed.Size++
+	if _, ok := CachedFile(changed); ok {
+		t.Error("cache served a file of another size")
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	s := newFake(t)
+	useDiskCache(t, 10)
+	a := s.Put("root", "a.bin", []byte("aaaaaa"))
+	b := s.Put("root", "b.bin", []byte("bbbbbb"))
+	big := s.Put("root", "big.bin", []byte("01234567890"))
+
+	fa, _ := cacheFile(t, a)
+	fb, ok := cacheFile(t, b)
+	if !ok {
+		t.Fatal("b not cached")
+	}
+	if _, ok := CachedFile(fa); ok {
+		t.Error("least recently used file kept over the limit")
+	}
+	if _, err := os.Stat(filepath.Join(DiskCacheDir, a)); !os.IsNotExist(err) {
+		t.Errorf("evicted file left on disk: %v", err)
+	}
+	if _, ok := CachedFile(fb); !ok {
+		t.Error("most recent file evicted")
+	}
+	if _, ok := cacheFile(t, big); ok {
+		t.Error("file larger than the cache was cached")
+	}
+	if n := s.Calls("/oss/download/" + big); n != 0 {
+		t.Errorf("file larger than the cache downloaded %d times", n)
+	}
+}
+
+func TestDiskCacheFailedDownload(t *testing.T) {
+	s := newFake(t)
+	useDiskCache(t, 1<<20)
+	id := s.Put("root", "a.bin", []byte("content"))
+	s.Handle("/oss/download/"+id, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	if _, ok := cacheFile(t, id); ok {
+		t.Fatal("failed download cached")
+	}
+	entries, _ := os.ReadDir(DiskCacheDir)
+	if len(entries) != 0 || diskCacheUsed != 0 {
+		t.Errorf("failed download left %d files, %d bytes in use", len(entries), diskCacheUsed)
+	}
+}
+
+func TestInitDiskCache(t *testing.T) {
+	useDiskCache(t, 1<<20)
+	leftover := filepath.Join(DiskCacheDir, "f0001.part")
+	ioutil.WriteFile(leftover, []byte("x"), 0600)
+	if err := InitDiskCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("leftover cache file kept: %v", err)
+	}
+}
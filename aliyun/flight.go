@@ -0,0 +1,63 @@
+package aliyun
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup 合并并发的相同请求：同一个key同时只有一个请求发往阿里云，
+// 其余调用等待并共享它的结果。媒体库扫描时会并发请求同一目录或同一文件的下载地址
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+	//发起请求的调用在请求期间被取消，结果不可用
+	canceled bool
+}
+
+var flight flightGroup
+
+// Do 执行fn并返回其结果，key相同的调用正在进行时等待其完成并返回同一结果。
+// 等待的调用自己的ctx结束时返回ctx.Err()；发起请求的调用被取消时，仍在等待的调用重新发起请求
+func (g *flightGroup) Do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flightCall)
+		}
+		c, ok := g.calls[key]
+		if !ok {
+			break
+		}
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !c.canceled {
+			return c.val, c.err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		c.canceled = ctx.Err() != nil
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
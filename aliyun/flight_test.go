@@ -0,0 +1,142 @@
+package aliyun
+
+import (
+	"context"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// holdRequests 让path的请求等到release关闭后再按默认方式处理，返回第一个请求到达的通知
+func holdRequests(s *aliyuntest.Server, path string, release <-chan struct{}) <-chan struct{} {
+	reached := make(chan struct{})
+	var once sync.Once
+	s.Handle(path, func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(reached) })
+		<-release
+		s.Default(w, r)
+	})
+	return reached
+}
+
+func TestConcurrentCallsShared(t *testing.T) {
+	const n = 10
+	for _, c := range []struct {
+		name string
+		path string
+		call func(id string) interface{}
+	}{
+		{"GetList", "/adrive/v3/file/list", func(id string) interface{} {
+			list, _ := GetList(context.Background(), "token", aliyuntest.DriveId, id)
+			return len(list.Items)
+		}},
+		{"GetFileDetail", "/v2/file/get", func(id string) interface{} {
+			fi, _ := GetFileDetail(context.Background(), "token", aliyuntest.DriveId, id)
+			return fi.FileId
+		}},
+		{"GetDownloadUrl", "/v2/file/get_download_url", func(id string) interface{} {
+			return GetDownloadUrl(context.Background(), "token", aliyuntest.DriveId, id)
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := newFake(t)
+			dir := s.Mkdir("root", "dir")
+			id := s.Put(dir, "a.txt", []byte("a"))
+			if c.name == "GetList" {
+				id = dir
+			}
+			release := make(chan struct{})
+			reached := holdRequests(s, c.path, release)
+
+			results := make(chan interface{}, n)
+			for i := 0; i < n; i++ {
+				go func() { results <- c.call(id) }()
+			}
+			<-reached
+			//等其余的调用都加入到进行中的请求
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			first := <-results
+			for i := 1; i < n; i++ {
+				if got := <-results; got != first {
+					t.Errorf("call %d got %v, want the shared result %v", i, got, first)
+				}
+			}
+			if calls := s.Calls(c.path); calls != 1 {
+				t.Errorf("%d concurrent calls made %d upstream requests, want 1", n, calls)
+			}
+		})
+	}
+}
+
+func TestFlightDistinctKeys(t *testing.T) {
+	s := newFake(t)
+	a := s.Mkdir("root", "a")
+	b := s.Mkdir("root", "b")
+	release := make(chan struct{})
+	holdRequests(s, "/adrive/v3/file/list", release)
+	var wg sync.WaitGroup
+	for _, id := range []string{a, b} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			GetList(context.Background(), "token", aliyuntest.DriveId, id)
+		}(id)
+	}
+	close(release)
+	wg.Wait()
+	if calls := s.Calls("/adrive/v3/file/list"); calls != 2 {
+		t.Errorf("lists of two folders made %d upstream requests, want 2", calls)
+	}
+}
+
+func TestFlightCanceledLeader(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+			return "leader", nil
+		}
+		return "retried", nil
+	}
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leader := make(chan interface{})
+	go func() {
+		v, _ := g.Do(leaderCtx, "k", fn)
+		leader <- v
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	waiter := make(chan interface{})
+	go func() {
+		v, _ := g.Do(context.Background(), "k", fn)
+		waiter <- v
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	//发起请求的调用被取消后，它的结果不再共享给等待的调用
+	cancel()
+	close(release)
+	<-leader
+	if v := <-waiter; v != "retried" {
+		t.Errorf("waiter got %v, want its own request after the leader was canceled", v)
+	}
+
+	//等待的调用自己被取消时直接返回
+	block := make(chan struct{})
+	defer close(block)
+	go g.Do(context.Background(), "slow", func() (interface{}, error) { <-block; return nil, nil })
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancelWaiter := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelWaiter()
+	if _, err := g.Do(ctx, "slow", fn); err != context.DeadlineExceeded {
+		t.Errorf("canceled waiter = %v, want context.DeadlineExceeded", err)
+	}
+}
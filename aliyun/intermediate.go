@@ -0,0 +1,164 @@
+package aliyun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"go-aliyun-webdav/aliyun/net"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// 中间文件所在的目录，为空时使用当前目录
+var TempDir string
+
+// 中间文件在磁盘上无法创建(如Docker中工作目录只读)时，不超过该大小(字节)的上传改为在内存中缓冲
+var MemoryUploadLimit int64 = 16 * 1024 * 1024
+
+// ErrNoIntermediateFile 临时目录都不可写且文件太大无法在内存中缓冲
+var ErrNoIntermediateFile = errors.New("aliyun: cannot create intermediate file, temp dir is not writable")
+
+var errMemoryBufferFull = errors.New("aliyun: upload exceeds in-memory buffer limit")
+
+// uploadBuffer 上传时缓冲请求内容的中间文件，可以是磁盘上的文件或内存中的缓冲
+type uploadBuffer interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+}
+
+// tempMeta 中间文件对应的上传目标，保存在中间文件名加tempMetaSuffix的文件中
+type tempMeta struct {
+	DriveId  string `json:"drive_id"`
+	ParentId string `json:"parent_id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+}
+
+const tempMetaSuffix = ".json"
+
+func writeTempMeta(ctx context.Context, file string, meta tempMeta) {
+	data, _ := json.Marshal(meta)
+	if err := ioutil.WriteFile(file+tempMetaSuffix, data, 0600); err != nil {
+		net.Logln(ctx, "⚠️  无法保存上传记录，崩溃后不能续传", file, err)
+	}
+}
+
+func readTempMeta(file string) (tempMeta, bool) {
+	var meta tempMeta
+	data, err := ioutil.ReadFile(file + tempMetaSuffix)
+	if err != nil || json.Unmarshal(data, &meta) != nil {
+		return meta, false
+	}
+	return meta, true
+}
+
+// tempNames 正在使用的中间文件名。中间文件名由上传目标决定，
+// 同一目标同样大小的上传同时进行时，后开始的改用带序号的文件名
+var tempNames = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+func acquireTempName(name string) string {
+	tempNames.Lock()
+	defer tempNames.Unlock()
+	candidate := name
+	for i := 2; tempNames.m[candidate]; i++ {
+		candidate = name + "-" + strconv.Itoa(i)
+	}
+	tempNames.m[candidate] = true
+	return candidate
+}
+
+func releaseTempName(name string) {
+	tempNames.Lock()
+	delete(tempNames.m, name)
+	tempNames.Unlock()
+}
+
+func tempDir() string {
+	if TempDir == "" {
+		return "."
+	}
+	return TempDir
+}
+
+// intermediateDirs 可以存放中间文件的目录：配置的临时目录及系统临时目录
+func intermediateDirs() []string {
+	dirs := []string{tempDir()}
+	if sys := os.TempDir(); filepath.Clean(sys) != filepath.Clean(dirs[0]) {
+		dirs = append(dirs, sys)
+	}
+	return dirs
+}
+
+// createIntermediateFile 依次尝试在配置的临时目录、系统临时目录中创建中间文件，
+// 都失败时大小已知且不超过MemoryUploadLimit(或大小未知)的上传改用内存缓冲
+func createIntermediateFile(ctx context.Context, name string, size int64) (uploadBuffer, error) {
+	for _, dir := range intermediateDirs() {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err == nil {
+			return f, nil
+		}
+		net.Logln(ctx, "⚠️  无法创建中间文件", dir, err)
+	}
+	if MemoryUploadLimit <= 0 || size > MemoryUploadLimit {
+		return nil, ErrNoIntermediateFile
+	}
+	net.Logln(ctx, "⚠️  改为在内存中缓冲上传内容", name, size)
+	return &memoryFile{name: name, limit: MemoryUploadLimit}, nil
+}
+
+// memoryFile 内存中的中间文件，写完后才读取
+type memoryFile struct {
+	name   string
+	limit  int64
+	buf    bytes.Buffer
+	reader *bytes.Reader
+}
+
+func (m *memoryFile) Name() string {
+	return m.name
+}
+
+func (m *memoryFile) Write(p []byte) (int, error) {
+	if int64(m.buf.Len()+len(p)) > m.limit {
+		return 0, errMemoryBufferFull
+	}
+	m.reader = nil
+	return m.buf.Write(p)
+}
+
+func (m *memoryFile) contents() *bytes.Reader {
+	if m.reader == nil {
+		m.reader = bytes.NewReader(m.buf.Bytes())
+	}
+	return m.reader
+}
+
+func (m *memoryFile) Read(p []byte) (int, error) {
+	return m.contents().Read(p)
+}
+
+func (m *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	return m.contents().ReadAt(p, off)
+}
+
+func (m *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	return m.contents().Seek(offset, whence)
+}
+
+func (m *memoryFile) Close() error {
+	m.buf = bytes.Buffer{}
+	m.reader = nil
+	return nil
+}
@@ -0,0 +1,137 @@
+package aliyun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// notDir 返回一个普通文件的路径，在其中无法创建文件(以root运行时目录权限不起作用)
+func notDir(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useTempDirs 设置配置的临时目录和系统临时目录
+func useTempDirs(t *testing.T, dir, sys string) {
+	t.Helper()
+	oldTmp, hadTmp := os.LookupEnv("TMPDIR")
+	t.Cleanup(func() {
+		if hadTmp {
+			os.Setenv("TMPDIR", oldTmp)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+	})
+	os.Setenv("TMPDIR", sys)
+	TempDir = dir
+}
+
+func useMemoryUploadLimit(t *testing.T, limit int64) {
+	t.Helper()
+	old := MemoryUploadLimit
+	t.Cleanup(func() { MemoryUploadLimit = old })
+	MemoryUploadLimit = limit
+}
+
+func TestIntermediateSystemTempDir(t *testing.T) {
+	s := newFake(t)
+	sys := t.TempDir()
+	useTempDirs(t, notDir(t), sys)
+
+	f, err := createIntermediateFile(context.Background(), "a.tmp", 10)
+	if err != nil {
+		t.Fatalf("createIntermediateFile: %v", err)
+	}
+	f.Close()
+	if _, onDisk := f.(*os.File); !onDisk || filepath.Dir(f.Name()) != sys {
+		t.Errorf("intermediate file %s, want it in the system temp dir %s", f.Name(), sys)
+	}
+
+	content := binaryContent(40)
+	r := httptest.NewRequest("PUT", "/a.txt", bytes.NewReader(content))
+	fileId, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "a.txt")
+	if err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if got, _ := s.File(fileId); !bytes.Equal(got.Content, content) {
+		t.Errorf("stored %d bytes, want the uploaded content", len(got.Content))
+	}
+}
+
+func TestIntermediateMemory(t *testing.T) {
+	s := newFake(t)
+	useTempDirs(t, notDir(t), notDir(t))
+	useMemoryUploadLimit(t, 1024*1024)
+
+	//普通上传和闪传都从内存缓冲中读取
+	content := binaryContent(200 * 1024)
+	r := httptest.NewRequest("PUT", "/a.bin", bytes.NewReader(content))
+	fileId, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "a.bin")
+	if err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if got, _ := s.File(fileId); !bytes.Equal(got.Content, content) {
+		t.Errorf("stored %d bytes, want the uploaded content", len(got.Content))
+	}
+	r = httptest.NewRequest("PUT", "/copy.bin", bytes.NewReader(content))
+	fileId, _, err = ContentHandle(r, "token", aliyuntest.DriveId, "root", "copy.bin")
+	if err != nil {
+		t.Fatalf("rapid ContentHandle: %v", err)
+	}
+	if got, _ := s.File(fileId); !bytes.Equal(got.Content, content) {
+		t.Errorf("rapid upload stored %d bytes, want the uploaded content", len(got.Content))
+	}
+	if n := s.Calls("/v2/file/complete"); n != 1 {
+		t.Errorf("completed %d uploads, want the copy to be a rapid upload", n)
+	}
+
+	//大小未知的上传也可以缓冲到内存
+	r = httptest.NewRequest("PUT", "/chunked.bin", bytes.NewReader(content))
+	r.ContentLength = -1
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "chunked.bin"); err != nil {
+		t.Errorf("chunked ContentHandle: %v", err)
+	}
+}
+
+func TestIntermediateTooLarge(t *testing.T) {
+	s := newFake(t)
+	useTempDirs(t, notDir(t), notDir(t))
+	useMemoryUploadLimit(t, 1024)
+	content := binaryContent(4096)
+
+	r := httptest.NewRequest("PUT", "/big.bin", bytes.NewReader(content))
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "big.bin"); !errors.Is(err, ErrNoIntermediateFile) {
+		t.Errorf("ContentHandle beyond the memory limit = %v, want ErrNoIntermediateFile", err)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 0 {
+		t.Errorf("upload started %d times without an intermediate file", n)
+	}
+
+	//大小未知的上传超过内存限制时失败，不上传不完整的内容
+	r = httptest.NewRequest("PUT", "/chunked.bin", bytes.NewReader(content))
+	r.ContentLength = -1
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "chunked.bin"); err == nil {
+		t.Error("chunked upload beyond the memory limit succeeded")
+	}
+	if _, ok := s.Lookup("chunked.bin"); ok {
+		t.Error("truncated chunked upload stored")
+	}
+
+	//MemoryUploadLimit为0时不使用内存
+	MemoryUploadLimit = 0
+	r = httptest.NewRequest("PUT", "/small.bin", bytes.NewReader(content[:10]))
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "small.bin"); !errors.Is(err, ErrNoIntermediateFile) {
+		t.Errorf("ContentHandle with memory disabled = %v, want ErrNoIntermediateFile", err)
+	}
+}
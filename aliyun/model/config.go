@@ -1,11 +1,15 @@
 package model
 
+import "time"
+
 const (
 	APIBASE            = "https://api.aliyundrive.com"
 	APILISTURL         = APIBASE + "/adrive/v3/file/list"
 	APIFILEPATH        = APIBASE + "/adrive/v1/file/get_path"
 	APIREFRESHTOKENURL = APIBASE + "/token/refresh"
 	APIREMOVETRASH     = APIBASE + "/v2/recyclebin/trash" //移动到垃圾箱
+	APITRASHLIST       = APIBASE + "/v2/recyclebin/list"
+	APITRASHRESTORE    = APIBASE + "/v2/recyclebin/restore"
 	APIFILEUPDATE      = APIBASE + "/v3/file/update"
 	APIMKDIR           = APIBASE + "/adrive/v2/file/createWithFolders"
 	APIFILEDETAIL      = APIBASE + "/v2/file/get"
@@ -17,6 +21,9 @@ const (
 	APIFILEDOWNLOAD    = APIBASE + "/v2/file/get_download_url"
 	APITOTLESIZE       = APIBASE + "/v2/databox/get_personal_info"
 	APISEARCH          = APIBASE + "/adrive/v3/file/search"
+	APIDRIVELIST       = APIBASE + "/v2/drive/list_my_drives"
+	APIDRIVEGET        = APIBASE + "/v2/drive/get"
+	APIVIDEOPLAYINFO   = APIBASE + "/v2/file/get_video_preview_play_info"
 )
 
 type Config struct {
@@ -25,3 +32,17 @@ type Config struct {
 	DriveId      string `json:"drive_id"`
 	ExpireTime   int64  `json:"expire_time"`
 }
+
+// Refresh 用刷新token的结果更新配置，已切换过的DriveId保持不变
+func (c Config) Refresh(refresh RefreshTokenModel) Config {
+	driveId := c.DriveId
+	if driveId == "" {
+		driveId = refresh.DefaultDriveId
+	}
+	return Config{
+		RefreshToken: refresh.RefreshToken,
+		Token:        refresh.AccessToken,
+		DriveId:      driveId,
+		ExpireTime:   time.Now().Unix() + refresh.ExpiresIn,
+	}
+}
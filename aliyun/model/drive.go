@@ -0,0 +1,15 @@
+package model
+
+type Drive struct {
+	DriveId   string `json:"drive_id"`
+	DriveName string `json:"drive_name"`
+	DriveType string `json:"drive_type"`
+	Owner     string `json:"owner"`
+	TotalSize int64  `json:"total_size"`
+	UsedSize  int64  `json:"used_size"`
+	Status    string `json:"status"`
+}
+
+type DriveListModel struct {
+	Items []Drive `json:"items"`
+}
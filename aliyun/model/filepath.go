@@ -1,8 +1,9 @@
 package model
 
 type FilePath struct {
-	Name string `json:"name,omitempty"`
-	Type string `json:"type,omitempty"`
+	FileId string `json:"file_id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Type   string `json:"type,omitempty"`
 	// 	created_at: "2021-09-06T07:12:29.103Z"
 	// domain_id: "bj29"
 	// drive_id: "1662258"
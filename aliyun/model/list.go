@@ -1,27 +1,28 @@
 package model
 
-import "time"
-
 type ListModel struct {
-	DriveId       string    `json:"drive_id"`
-	FileId        string    `json:"file_id"`
-	Name          string    `json:"name"`
-	Type          string    `json:"type"`
-	Status        string    `json:"status"`
-	ParentFileId  string    `json:"parent_file_id"`
-	Starred       bool      `json:"starred"`
-	ContentType   string    `json:"content_type"`
-	FileExtension string    `json:"file_extension"`
-	MimeType      string    `json:"mime_type"`
-	MimeExtension string    `json:"mime_extension"`
-	Hidden        bool      `json:"hidden"`
-	Size          int64     `json:"size"`
-	Category      string    `json:"category"`
-	DownloadUrl   string    `json:"download_url"`
-	Url           string    `json:"url"`
-	Thumbnail     string    `json:"thumbnail"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	DriveId       string `json:"drive_id"`
+	FileId        string `json:"file_id"`
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Status        string `json:"status"`
+	ParentFileId  string `json:"parent_file_id"`
+	Starred       bool   `json:"starred"`
+	ContentType   string `json:"content_type"`
+	FileExtension string `json:"file_extension"`
+	MimeType      string `json:"mime_type"`
+	MimeExtension string `json:"mime_extension"`
+	Hidden        bool   `json:"hidden"`
+	Size          int64  `json:"size"`
+	ContentHash   string `json:"content_hash"`
+	Category      string `json:"category"`
+	DownloadUrl   string `json:"download_url"`
+	Url           string `json:"url"`
+	Thumbnail     string `json:"thumbnail"`
+	CreatedAt     Time   `json:"created_at"`
+	UpdatedAt     Time   `json:"updated_at"`
+	//Name在路径中有特殊含义而被替换时，阿里云中的原始名称
+	OriginalName string `json:"-"`
 }
 
 type FileListModel struct {
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(2021, 9, 1, 8, 30, 15, 0, time.UTC)
+	for _, s := range []string{
+		"2021-09-01T08:30:15Z",
+		"2021-09-01T08:30:15.123Z",
+		"2021-09-01T08:30:15.123456789Z",
+		"2021-09-01T16:30:15.5+08:00",
+		"2021-09-01T08:30:15.000",
+		"2021-09-01T08:30:15",
+		"2021-09-01 08:30:15",
+		"2021-09-01 16:30:15+08:00",
+	} {
+		got, err := ParseTime(s)
+		if err != nil {
+			t.Errorf("ParseTime(%q): %v", s, err)
+			continue
+		}
+		if got.Truncate(time.Second).Unix() != want.Unix() {
+			t.Errorf("ParseTime(%q) = %v, want %v", s, got, want)
+		}
+	}
+	if _, err := ParseTime("yesterday"); err == nil {
+		t.Error("ParseTime(yesterday) succeeded")
+	}
+}
+
+func TestListModelTimes(t *testing.T) {
+	var m ListModel
+	data := `{"file_id":"1","created_at":"2021-09-01T08:30:15.123Z","updated_at":"2021-09-02 10:00:00"}`
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !m.CreatedAt.Equal(time.Date(2021, 9, 1, 8, 30, 15, 123e6, time.UTC)) {
+		t.Errorf("CreatedAt = %v", m.CreatedAt)
+	}
+	if !m.UpdatedAt.Equal(time.Date(2021, 9, 2, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("UpdatedAt = %v", m.UpdatedAt)
+	}
+
+	//没有时间字段或为null时为零值
+	m = ListModel{}
+	if err := json.Unmarshal([]byte(`{"created_at":null}`), &m); err != nil || !m.CreatedAt.IsZero() || !m.UpdatedAt.IsZero() {
+		t.Errorf("missing times = %v, %v, %v; want zero", m.CreatedAt, m.UpdatedAt, err)
+	}
+}
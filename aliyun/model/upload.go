@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// UploadProgress 正在进行中的上传任务的进度
+type UploadProgress struct {
+	Name      string    `json:"name"`
+	ParentId  string    `json:"parent_id"`
+	Size      int64     `json:"size"`
+	Parts     int       `json:"parts"`
+	PartsDone int       `json:"parts_done"`
+	BytesDone int64     `json:"bytes_done"`
+	StartTime time.Time `json:"start_time"`
+	Speed     int64     `json:"speed"` //字节/秒
+}
@@ -0,0 +1,39 @@
+package aliyun
+
+import (
+	"go-aliyun-webdav/aliyun/model"
+	"strings"
+)
+
+// 阿里云允许文件名为.或..，这样的名称在路径中会被当成当前目录、上级目录，造成解析错误甚至越出挂载的目录。
+// escape(默认)把名称中的.替换为%2E后列出，客户端用该名称访问；hide不列出这些文件
+var UnsafeNames = "escape"
+
+// unsafeName 名称在路径中有特殊含义，不能原样作为路径的一段
+func unsafeName(name string) bool {
+	return name == "." || name == ".." || strings.Contains(name, "/")
+}
+
+// SafeName 返回文件在WebDAV路径中使用的名称，.和..替换为%2E、%2E%2E，/替换为%2F，
+// 请求路径中原样的.和..不会与任何文件匹配
+func SafeName(name string) string {
+	if name == "." || name == ".." {
+		return strings.Repeat("%2E", len(name))
+	}
+	return strings.ReplaceAll(name, "/", "%2F")
+}
+
+// safeNames 按UnsafeNames处理列表中名称不安全的文件，items会被原地修改
+func safeNames(items []model.ListModel) []model.ListModel {
+	kept := items[:0]
+	for _, item := range items {
+		if unsafeName(item.Name) {
+			if UnsafeNames == "hide" {
+				continue
+			}
+			item.OriginalName, item.Name = item.Name, SafeName(item.Name)
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
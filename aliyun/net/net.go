@@ -2,134 +2,367 @@ package net
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/tidwall/gjson"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-func Post(url, token string, data []byte) []byte {
+// Debug 是否打印阿里云接口的请求和响应内容，token、签名等敏感信息会被隐藏
+var Debug = false
 
-	res, code := PostExpectStatus(url, token, data)
+// debugBodyLimit 调试日志中请求/响应内容的最大长度
+const debugBodyLimit = 1024
+
+var sensitiveFields = regexp.MustCompile(`"(access_token|refresh_token|proof_code|token)"\s*:\s*"[^"]*"`)
+
+// redactURL 隐藏URL中的签名参数
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	for k := range q {
+		lk := strings.ToLower(k)
+		if strings.Contains(lk, "signature") || strings.Contains(lk, "token") || strings.Contains(lk, "access-key") || strings.Contains(lk, "accesskeyid") {
+			q.Set(k, "***")
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// redactBody 隐藏内容中的token、proof等字段，并截断过长的内容
+func redactBody(body []byte) string {
+	s := sensitiveFields.ReplaceAllString(strings.TrimRight(string(body), "\r\n"), `"$1":"***"`)
+	if len(s) > debugBodyLimit {
+		s = s[:debugBodyLimit] + "...(" + fmt.Sprint(len(s)) + " bytes)"
+	}
+	return s
+}
+
+// redactHeader 隐藏Authorization请求头
+func redactHeader(header http.Header) http.Header {
+	h := header.Clone()
+	if h.Get("Authorization") != "" {
+		h.Set("Authorization", "***")
+	}
+	return h
+}
+
+// debugLog 开启Debug时打印一次接口调用的请求与响应
+func debugLog(req *http.Request, reqBody []byte, status int, resBody []byte) {
+	if !Debug {
+		return
+	}
+	ctx := req.Context()
+	Logln(ctx, "🔍  ", req.Method, redactURL(req.URL.String()), status)
+	Logln(ctx, "🔍   request header:", redactHeader(req.Header))
+	if reqBody != nil {
+		Logln(ctx, "🔍   request body:", redactBody(reqBody))
+	}
+	if resBody != nil {
+		Logln(ctx, "🔍   response body:", redactBody(resBody))
+	}
+}
+
+// ErrRiskControl 阿里云触发风控，账号需要在阿里云盘App中完成验证后才能继续使用
+var ErrRiskControl = errors.New("aliyun: account is under risk control, verification required")
+
+// riskControlCodes 阿里云风控/二次验证时返回的错误码
+var riskControlCodes = map[string]bool{
+	"NeedCaptcha":                   true,
+	"NeedSecondVerify":              true,
+	"UserDeviceIllegality":          true,
+	"UserDeviceOffline":             true,
+	"DeviceSessionSignatureInvalid": true,
+}
+
+// ErrPermissionDenied 令牌有效但没有执行该操作的权限(如只读授权的令牌上传文件)，刷新令牌也无法解决
+var ErrPermissionDenied = errors.New("aliyun: token lacks permission for this operation")
+
+// IsPermissionDenied 判断接口返回内容是否为无权限的响应，令牌过期(AccessTokenInvalid等)不算在内
+func IsPermissionDenied(body []byte) bool {
+	code := gjson.GetBytes(body, "code").Str
+	return strings.HasPrefix(code, "Forbidden") || code == "PermissionDenied" || code == "UserNotAllowedAccessDrive"
+}
+
+// riskControlled 最近一次请求是否命中风控，命中后直到有请求正常返回才清除
+var riskControlled int32
+
+// IsRiskControl 判断接口返回内容是否为风控/二次验证响应
+func IsRiskControl(body []byte) bool {
+	return riskControlCodes[gjson.GetBytes(body, "code").Str]
+}
+
+// RiskControlled 账号当前处于风控状态时返回ErrRiskControl
+func RiskControlled() error {
+	if atomic.LoadInt32(&riskControlled) == 1 {
+		return ErrRiskControl
+	}
+	return nil
+}
+
+func Post(ctx context.Context, url, token string, data []byte) []byte {
+
+	res, code := PostExpectStatus(ctx, url, token, data)
 	if code != -1 {
 		return res
 	}
 	return res
 }
 
-func PostExpectStatus(url, token string, data []byte) ([]byte, int) {
-	method := "POST"
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(data))
+// retryAfter 等待d后重试，返回false表示ctx已结束(客户端断开或超过请求时限)，不再重试
+func retryAfter(ctx context.Context, d time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	Logln(ctx, "🐛  Retrying...in", d)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
+// newRequest 创建调用阿里云的请求，ctx中有请求ID时带上X-Request-ID，阿里云及代理的日志可以对应到客户端的请求
+func newRequest(ctx context.Context, method, url string, data []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
 	if err != nil {
-		fmt.Println(err)
-		return nil, -1
+		return nil, err
+	}
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
 	}
-	req.Header.Add("accept", "application/json, text/plain, */*")
-	req.Header.Add("user-agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/92.0.4515.159 Safari/537.36")
-	req.Header.Add("content-type", "application/json;charset=UTF-8")
-	req.Header.Add("origin", "https://www.aliyundrive.com")
-	req.Header.Add("referer", "https://www.aliyundrive.com/")
-	req.Header.Add("Authorization", "Bearer "+token)
+	return req, nil
+}
+
+func PostExpectStatus(ctx context.Context, url, token string, data []byte) ([]byte, int) {
+	method := "POST"
+	client := &http.Client{}
 
 	for i := 0; i < 5; i++ {
+		//每次重试都重新创建请求，上一次发送时请求体已被读完
+		req, err := newRequest(ctx, method, url, data)
+		if err != nil {
+			Logln(ctx, err)
+			return nil, -1
+		}
+		req.Header.Add("accept", "application/json, text/plain, */*")
+		ua, _ := userAgent()
+		req.Header.Add("user-agent", ua)
+		req.Header.Add("content-type", "application/json;charset=UTF-8")
+		req.Header.Add("origin", "https://www.aliyundrive.com")
+		req.Header.Add("referer", "https://www.aliyundrive.com/")
+		req.Header.Add("Authorization", "Bearer "+token)
 
 		res, err := client.Do(req)
 		if err != nil {
-			fmt.Println("❌  ", err)
-			fmt.Println("🐛  Retrying...in 5 seconds")
-			time.Sleep(5 * time.Second)
+			Logln(ctx, "❌  ", err)
+			if !retryAfter(ctx, 5*time.Second) {
+				return nil, -1
+			}
 			continue
 		}
 		defer func(Body io.ReadCloser) {
 			err := Body.Close()
 			if err != nil {
-				fmt.Println("🙅  ", err)
+				Logln(ctx, "🙅  ", err)
 			}
 		}(res.Body)
 
 		body, err := ioutil.ReadAll(res.Body)
 		if err != nil {
-			fmt.Println(err)
+			Logln(ctx, err)
 			return nil, -1
 		}
+		debugLog(req, data, res.StatusCode, body)
+		if IsRiskControl(body) {
+			if atomic.SwapInt32(&riskControlled, 1) == 0 {
+				Logln(ctx, "🚨  阿里云触发风控(", gjson.GetBytes(body, "code").Str, ")，请打开阿里云盘App完成账号验证后再使用")
+			}
+		} else if IsPermissionDenied(body) {
+			Logln(ctx, "🚫  令牌没有该操作的权限(", gjson.GetBytes(body, "code").Str, ")", redactURL(url))
+		} else if res.StatusCode < 400 {
+			atomic.StoreInt32(&riskControlled, 0)
+		}
 		return body, res.StatusCode
 	}
 	return nil, -1
 }
-func Put(url, token string, data []byte) ([]byte, int64) {
+func Put(ctx context.Context, url, token string, data []byte) ([]byte, int64) {
 	method := "PUT"
 	client := &http.Client{}
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(data))
-
-	if err != nil {
-		fmt.Println(err)
-		return nil, -1
-	}
 	for i := 0; i < 5; i++ {
+		req, err := newRequest(ctx, method, url, data)
+		if err != nil {
+			Logln(ctx, err)
+			return nil, -1
+		}
+		setUserAgent(req)
 		res, err := client.Do(req)
+		if err == nil {
+			debugLog(req, nil, res.StatusCode, nil)
+		}
 
 		if err != nil || res.StatusCode != 200 {
-			fmt.Println("❌  ", err)
-			fmt.Println("🐛  Retrying...in 5 seconds")
-			time.Sleep(5 * time.Second)
+			if err == nil {
+				res.Body.Close()
+			}
+			Logln(ctx, "❌  ", err)
+			if !retryAfter(ctx, 5*time.Second) {
+				return nil, -1
+			}
 			continue
 		}
 		defer func(Body io.ReadCloser) {
 			err := Body.Close()
 			if err != nil {
-				fmt.Println("🙅  ", err)
+				Logln(ctx, "🙅  ", err)
 			}
 		}(res.Body)
 
 		body, err := ioutil.ReadAll(res.Body)
 		if err != nil {
-			fmt.Println(err)
+			Logln(ctx, err)
 			return nil, -1
 		}
 		return body, 0
 	}
-	fmt.Println("💀  Fail to PUT", url)
+	Logln(ctx, "💀  Fail to PUT", redactURL(url))
 	return nil, -1
 }
-func Get(w http.ResponseWriter, url, token string, rangeStr string, ifRange string) bool {
+
+// Get 下载url的内容并写入w。签名的下载地址在获取和使用之间过期时OSS会返回403，
+// 此时通过renew重新获取下载地址并重试一次；OSS返回的错误内容不会写给客户端
+// 客户端断开(ctx取消)或超过IdleTimeout没有数据流动时，立即中断与OSS的连接
+func Get(ctx context.Context, w io.Writer, url, token string, rangeStr string, ifRange string, renew func() string) bool {
+	return GetRange(ctx, w, url, token, rangeStr, ifRange, renew) == nil
+}
+
+// ErrRangeIgnored 请求了Range，OSS却没有返回206而是返回了整个文件
+var ErrRangeIgnored = errors.New("aliyun: upstream ignored the requested range")
+
+// errGetFailed 下载失败，原因已记录在日志中
+var errGetFailed = errors.New("aliyun: download failed")
+
+// GetRange 与Get相同，但返回失败的原因。rangeStr不为空(且没有ifRange)时要求OSS返回206，
+// 返回200时不写入任何内容并返回ErrRangeIgnored，调用方可以改为下载整个文件
+func GetRange(ctx context.Context, w io.Writer, url, token string, rangeStr string, ifRange string, renew func() string) error {
 
 	method := "GET"
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	client := &http.Client{}
-	req, err := http.NewRequest(method, url, nil)
+	newRequest := func(url string) (*http.Request, error) {
+		req, err := newRequest(ctx, method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		//req.Header.Add("accept", "application/json, text/plain, */*")
+		//req.Header.Add("user-agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/92.0.4515.159 Safari/537.36")
+		//req.Header.Add("content-type", "application/json;charset=UTF-8")
+		//req.Header.Add("origin", "https://www.aliyundrive.com")
+		req.Header.Add("referer", "https://www.aliyundrive.com/")
+		req.Header.Add("Authorization", "Bearer "+token)
+		setUserAgent(req)
+		req.Header.Add("range", rangeStr)
+		req.Header.Add("if-range", ifRange)
+		return req, nil
+	}
+	req, err := newRequest(url)
 
 	if err != nil {
-		fmt.Println(err)
-		return false
+		Logln(ctx, err)
+		return errGetFailed
 	}
-	//req.Header.Add("accept", "application/json, text/plain, */*")
-	//req.Header.Add("user-agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/92.0.4515.159 Safari/537.36")
-	//req.Header.Add("content-type", "application/json;charset=UTF-8")
-	//req.Header.Add("origin", "https://www.aliyundrive.com")
-	req.Header.Add("referer", "https://www.aliyundrive.com/")
-	req.Header.Add("Authorization", "Bearer "+token)
-	req.Header.Add("range", rangeStr)
-	req.Header.Add("if-range", ifRange)
 
+	renewed := false
 	for i := 0; i < 5; i++ {
 		res, err := client.Do(req)
 		if err != nil {
-			fmt.Println("❌  ", err)
-			fmt.Println("🐛  Retrying...in 5 seconds")
-			time.Sleep(5 * time.Second)
+			if ctx.Err() != nil {
+				return errGetFailed
+			}
+			Logln(ctx, "❌  ", err)
+			if !retryAfter(ctx, 5*time.Second) {
+				return errGetFailed
+			}
 			continue
 		}
-		io.Copy(w, res.Body)
+		debugLog(req, nil, res.StatusCode, nil)
+		if res.StatusCode == http.StatusForbidden && renew != nil && !renewed {
+			res.Body.Close()
+			renewed = true
+			Logln(ctx, "⚠️  Download URL rejected, renewing")
+			if req, err = newRequest(renew()); err != nil {
+				Logln(ctx, err)
+				return errGetFailed
+			}
+			continue
+		}
+		if rangeStr != "" && ifRange == "" && res.StatusCode == http.StatusOK {
+			res.Body.Close()
+			Logln(ctx, "⚠️  Range ignored by upstream", rangeStr)
+			return ErrRangeIgnored
+		}
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+			res.Body.Close()
+			Logln(ctx, "❌  Download failed", res.StatusCode)
+			return errGetFailed
+		}
+		copyWithIdleTimeout(w, res.Body, cancel)
 		res.Body.Close()
-		return true
+		return nil
 	}
-	return false
+	return errGetFailed
 }
+
+// IdleTimeout 下载时超过该时长没有任何数据流动就断开与OSS的连接，0表示不限制
+var IdleTimeout = 2 * time.Minute
+
+// copyWithIdleTimeout 与io.Copy相同，但超过IdleTimeout没有读写任何数据时调用cancel中断下载
+func copyWithIdleTimeout(dst io.Writer, src io.Reader, cancel context.CancelFunc) (int64, error) {
+	if IdleTimeout <= 0 {
+		return io.Copy(dst, src)
+	}
+	timer := time.AfterFunc(IdleTimeout, cancel)
+	defer timer.Stop()
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			timer.Reset(IdleTimeout)
+			m, werr := dst.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
 func GetProxy(w http.ResponseWriter, req *http.Request, urlStr, token string) []byte {
 
 	//method := "GET"
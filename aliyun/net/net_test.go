@@ -0,0 +1,223 @@
+package net
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureStdout returns what f prints to the standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestDebugLog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"secret-access","file_id":"f1"}`))
+	}))
+	defer srv.Close()
+	defer func(old bool) { Debug = old }(Debug)
+	post := func() {
+		PostExpectStatus(context.Background(), srv.URL+"/v2/file/get?x-oss-signature=secret-signature", "secret-token",
+			[]byte(`{"refresh_token":"secret-refresh","proof_code":"secret-proof","name":"a.txt"}`))
+	}
+
+	Debug = true
+	out := captureStdout(t, post)
+	for _, want := range []string{"/v2/file/get", "200", `"name":"a.txt"`, `"file_id":"f1"`, `"proof_code":"***"`, "Authorization:[***]"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("debug log lacks %s:\n%s", want, out)
+		}
+	}
+	for _, secret := range []string{"secret-token", "secret-access", "secret-refresh", "secret-proof", "secret-signature"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("debug log shows %s:\n%s", secret, out)
+		}
+	}
+
+	Debug = false
+	if out := captureStdout(t, post); out != "" {
+		t.Errorf("logged with Debug off:\n%s", out)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	//OSS签名地址中的AccessKeyId、签名和STS临时令牌
+	u := redactURL("https://bj29.cn-beijing.data.alicloudccp.com/a.txt?OSSAccessKeyId=LTAI-secret-id&Expires=1700000000&Signature=secret-signature&security-token=secret-sts&x-oss-access-key-id=secret-key&response-content-disposition=attachment")
+	for _, secret := range []string{"secret-id", "secret-signature", "secret-sts", "secret-key"} {
+		if strings.Contains(u, secret) {
+			t.Errorf("redacted url shows %s: %s", secret, u)
+		}
+	}
+	for _, want := range []string{"/a.txt", "Expires=1700000000", "response-content-disposition=attachment"} {
+		if !strings.Contains(u, want) {
+			t.Errorf("redacted url lacks %s: %s", want, u)
+		}
+	}
+}
+
+func TestRedactBodyTruncates(t *testing.T) {
+	body := strings.Repeat("x", 3*debugBodyLimit)
+	if s := redactBody([]byte(body)); len(s) > debugBodyLimit+32 || !strings.Contains(s, "3072 bytes") {
+		t.Errorf("redactBody kept %d bytes: %q", len(s), s[len(s)-20:])
+	}
+}
+
+const ossError = `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code></Error>`
+
+func TestGetRenewsRejectedUrl(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/expired" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(ossError))
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer srv.Close()
+
+	renewed := 0
+	renew := func() string {
+		renewed++
+		return srv.URL + "/fresh"
+	}
+	var buf strings.Builder
+	if err := GetRange(context.Background(), &buf, srv.URL+"/expired", "token", "", "", renew); err != nil {
+		t.Fatalf("GetRange: %v", err)
+	}
+	if buf.String() != "content" || renewed != 1 {
+		t.Errorf("got %q after %d renewals, want the content after one", buf.String(), renewed)
+	}
+
+	//重新获取的地址仍被拒绝时只重试一次
+	buf.Reset()
+	renewed = 0
+	renew = func() string {
+		renewed++
+		return srv.URL + "/expired"
+	}
+	if err := GetRange(context.Background(), &buf, srv.URL+"/expired", "token", "", "", renew); err == nil {
+		t.Error("GetRange succeeded with rejected urls")
+	}
+	if buf.Len() != 0 || renewed != 1 {
+		t.Errorf("wrote %q after %d renewals, want nothing after one", buf.String(), renewed)
+	}
+}
+
+func TestGetUpstreamError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(ossError))
+	}))
+	defer srv.Close()
+
+	var buf strings.Builder
+	if Get(context.Background(), &buf, srv.URL, "token", "", "", nil) {
+		t.Error("Get succeeded on a 500")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote the OSS error body %q", buf.String())
+	}
+}
+
+// signalWriter reports the first write on wrote.
+type signalWriter struct {
+	once  sync.Once
+	wrote chan struct{}
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.wrote) })
+	return len(p), nil
+}
+
+// streamingServer sends one chunk and then holds the response open until the
+// client goes away, which it reports on closed.
+func streamingServer(closed chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first chunk"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(closed)
+	}))
+}
+
+func TestGetStopsWhenClientGoesAway(t *testing.T) {
+	closed := make(chan struct{})
+	srv := streamingServer(closed)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &signalWriter{wrote: make(chan struct{})}
+	done := make(chan bool)
+	go func() { done <- Get(ctx, w, srv.URL, "token", "", "", nil) }()
+	<-w.wrote
+	cancel()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream connection still open after the client went away")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get still reading after the client went away")
+	}
+}
+
+func TestGetIdleTimeout(t *testing.T) {
+	defer func(old time.Duration) { IdleTimeout = old }(IdleTimeout)
+	IdleTimeout = 50 * time.Millisecond
+	closed := make(chan struct{})
+	srv := streamingServer(closed)
+	defer srv.Close()
+
+	done := make(chan bool)
+	go func() { done <- Get(context.Background(), ioutil.Discard, srv.URL, "token", "", "", nil) }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled upstream connection not closed")
+	}
+	<-done
+}
+
+func TestRetryStopsAtDeadline(t *testing.T) {
+	//连接被拒绝时会等待5秒后重试，请求时限先到时应立即返回
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, code := PostExpectStatus(ctx, url, "token", []byte("{}")); code != -1 {
+		t.Errorf("Post to a closed server = %d, want -1", code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Post kept retrying for %v after the deadline", elapsed)
+	}
+}
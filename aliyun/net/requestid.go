@@ -0,0 +1,44 @@
+package net
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// RequestIDHeader 请求ID的请求头，客户端传入时沿用，否则由服务端生成
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID 将请求ID放入ctx，之后使用该ctx的接口调用都会带上这个请求ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID 返回ctx中的请求ID，没有时返回空字符串
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Detached 返回不随ctx取消、但保留其请求ID的context，用于请求结束后仍在后台进行的调用
+func Detached(ctx context.Context) context.Context {
+	return WithRequestID(context.Background(), RequestID(ctx))
+}
+
+// NewRequestID 生成一个随机的请求ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Logln 与fmt.Println相同，ctx中有请求ID时在末尾加上request_id=，日志可以对应到客户端的请求
+func Logln(ctx context.Context, a ...interface{}) {
+	if id := RequestID(ctx); id != "" {
+		a = append(a, "request_id="+id)
+	}
+	fmt.Println(a...)
+}
@@ -0,0 +1,58 @@
+package net
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultUserAgent 未配置轮换时调用阿里云接口使用的User-Agent
+const DefaultUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/92.0.4515.159 Safari/537.36"
+
+var userAgents = struct {
+	sync.Mutex
+	list []string
+	next int
+	rand *rand.Rand
+}{}
+
+// SetUserAgents 设置每次请求轮换使用的User-Agent，list为空时恢复为只用DefaultUserAgent。
+// random为false时按顺序依次使用，为true时每次随机选取：seed不为0时以其为种子，
+// 相同的seed得到相同的序列，便于排查问题；seed为0时以当前时间为种子
+func SetUserAgents(list []string, random bool, seed int64) {
+	userAgents.Lock()
+	defer userAgents.Unlock()
+	userAgents.list = append([]string(nil), list...)
+	userAgents.next = 0
+	userAgents.rand = nil
+	if random {
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		userAgents.rand = rand.New(rand.NewSource(seed))
+	}
+}
+
+// userAgent 返回本次请求使用的User-Agent，rotating表示是否配置了轮换
+func userAgent() (ua string, rotating bool) {
+	userAgents.Lock()
+	defer userAgents.Unlock()
+	if len(userAgents.list) == 0 {
+		return DefaultUserAgent, false
+	}
+	i := userAgents.next
+	if userAgents.rand != nil {
+		i = userAgents.rand.Intn(len(userAgents.list))
+	} else {
+		userAgents.next = (i + 1) % len(userAgents.list)
+	}
+	return userAgents.list[i], true
+}
+
+// setUserAgent 为下载、上传分片等原本不带User-Agent的请求设置轮换的User-Agent，未配置轮换时不设置
+func setUserAgent(req *http.Request) {
+	if ua, rotating := userAgent(); rotating {
+		req.Header.Set("User-Agent", ua)
+	}
+}
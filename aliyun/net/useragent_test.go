@@ -0,0 +1,67 @@
+package net
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestUserAgentRotation(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("User-Agent"))
+		mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	defer SetUserAgents(nil, false, 0)
+	// uas sends n API calls and n downloads in turn and returns the
+	// User-Agents they carried.
+	uas := func(n int) []string {
+		mu.Lock()
+		seen = nil
+		mu.Unlock()
+		for i := 0; i < n; i++ {
+			Post(context.Background(), srv.URL+"/v2/file/get", "token", []byte(`{}`))
+			Get(context.Background(), ioutil.Discard, srv.URL+"/download", "token", "", "", nil)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), seen...)
+	}
+
+	if got := uas(2); got[0] != DefaultUserAgent || got[2] != DefaultUserAgent {
+		t.Errorf("API calls without rotation sent %q, want %s", got, DefaultUserAgent)
+	}
+
+	SetUserAgents([]string{"ua-a", "ua-b", "ua-c"}, false, 0)
+	if got, want := uas(3), []string{"ua-a", "ua-b", "ua-c", "ua-a", "ua-b", "ua-c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("round-robin sent %q, want %q", got, want)
+	}
+
+	// The same seed gives the same sequence.
+	SetUserAgents([]string{"ua-a", "ua-b", "ua-c"}, true, 42)
+	first := uas(10)
+	SetUserAgents([]string{"ua-a", "ua-b", "ua-c"}, true, 42)
+	if again := uas(10); !reflect.DeepEqual(first, again) {
+		t.Errorf("random with the same seed sent %q, then %q", first, again)
+	}
+	used := map[string]bool{}
+	for _, ua := range first {
+		used[ua] = true
+	}
+	if len(used) < 2 || used[DefaultUserAgent] {
+		t.Errorf("random sent %q, want several of the configured ones", first)
+	}
+
+	SetUserAgents(nil, false, 0)
+	if got := uas(1); got[0] != DefaultUserAgent || got[1] == DefaultUserAgent {
+		t.Errorf("after resetting sent %q, want the default for API calls only", got)
+	}
+}
@@ -0,0 +1,158 @@
+package aliyun
+
+import (
+	"context"
+	"encoding/json"
+	"go-aliyun-webdav/aliyun/net"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 分片全部上传后、调用UploadFileComplete之前把上传记录保存到临时目录，
+// 进程在此时崩溃或完成失败时，重启后或客户端重试同样的上传时直接完成，不必重新上传分片
+var ResumeUploads = false
+
+// 上传记录文件名，不以tempFilePrefix开头，不会被CleanTempFiles清理
+const pendingUploadsFile = "aliyun-pending-uploads.json"
+
+// 超过该时长的上传记录不再尝试完成，阿里云的upload_id早已失效
+const pendingUploadMaxAge = 7 * 24 * time.Hour
+
+// pendingUpload 分片已全部上传、尚未完成的上传
+type pendingUpload struct {
+	DriveId  string    `json:"drive_id"`
+	ParentId string    `json:"parent_id"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Sha1     string    `json:"sha1"`
+	UploadId string    `json:"upload_id"`
+	FileId   string    `json:"file_id"`
+	Time     time.Time `json:"time"`
+}
+
+func (p pendingUpload) key() string {
+	return p.DriveId + "/" + p.ParentId + "/" + p.Name
+}
+
+var pendingMu sync.Mutex
+
+func pendingUploadsPath() string {
+	return filepath.Join(tempDir(), pendingUploadsFile)
+}
+
+// loadPendingUploads 读取上传记录，调用时需持有pendingMu
+func loadPendingUploads(ctx context.Context) map[string]pendingUpload {
+	pending := map[string]pendingUpload{}
+	data, err := ioutil.ReadFile(pendingUploadsPath())
+	if err != nil {
+		return pending
+	}
+	if err := json.Unmarshal(data, &pending); err != nil {
+		net.Logln(ctx, "⚠️  上传记录已损坏，忽略", pendingUploadsPath(), err)
+	}
+	return pending
+}
+
+// savePendingUploads 先写入临时文件再改名，崩溃时不会留下写了一半的记录，调用时需持有pendingMu
+func savePendingUploads(ctx context.Context, pending map[string]pendingUpload) {
+	file := pendingUploadsPath()
+	if len(pending) == 0 {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			net.Logln(ctx, "⚠️  删除上传记录失败", err)
+		}
+		return
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		net.Logln(ctx, "⚠️  保存上传记录失败", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		net.Logln(ctx, "⚠️  保存上传记录失败", err)
+	}
+}
+
+func updatePendingUploads(ctx context.Context, update func(pending map[string]pendingUpload)) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	pending := loadPendingUploads(ctx)
+	update(pending)
+	savePendingUploads(ctx, pending)
+}
+
+// findPendingUpload 查找上传到同一位置、大小和内容摘要都相同的未完成上传
+func findPendingUpload(ctx context.Context, driveId string, parentId string, fileName string, size int64, sha1 string) (pendingUpload, bool) {
+	if !ResumeUploads {
+		return pendingUpload{}, false
+	}
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	p, ok := loadPendingUploads(ctx)[pendingUpload{DriveId: driveId, ParentId: parentId, Name: fileName}.key()]
+	if !ok || p.Size != size || !strings.EqualFold(p.Sha1, sha1) || time.Since(p.Time) > pendingUploadMaxAge {
+		return pendingUpload{}, false
+	}
+	return p, true
+}
+
+// completeUpload 调用UploadFileComplete完成上传，返回阿里云使用的文件名。
+// 开启ResumeUploads时先保存上传记录，完成失败时保留记录并返回ErrUploadFailed
+func completeUpload(ctx context.Context, token string, p pendingUpload) (string, error) {
+	if !ResumeUploads {
+		return UploadFileComplete(ctx, token, p.DriveId, p.UploadId, p.FileId, p.ParentId), nil
+	}
+	p.Time = time.Now()
+	updatePendingUploads(ctx, func(pending map[string]pendingUpload) {
+		pending[p.key()] = p
+	})
+	completed := UploadFileComplete(ctx, token, p.DriveId, p.UploadId, p.FileId, p.ParentId)
+	if completed == "" {
+		net.Logln(ctx, "❌  完成上传失败，分片已保存，重试或重启后会直接完成", p.Name, p.UploadId)
+		return "", ErrUploadFailed
+	}
+	updatePendingUploads(ctx, func(pending map[string]pendingUpload) {
+		if pending[p.key()].UploadId == p.UploadId {
+			delete(pending, p.key())
+		}
+	})
+	return completed, nil
+}
+
+// ResumePendingUploads 启动时完成上次退出前分片已全部上传、但没有完成的上传，
+// 内容摘要与记录不一致的文件只打印日志，无法完成的记录直接丢弃
+func ResumePendingUploads(ctx context.Context, token string, driveId string) {
+	if !ResumeUploads {
+		return
+	}
+	pendingMu.Lock()
+	pending := loadPendingUploads(ctx)
+	pendingMu.Unlock()
+	done := map[string]string{}
+	for k, p := range pending {
+		if p.DriveId != driveId {
+			continue
+		}
+		done[k] = p.UploadId
+		if time.Since(p.Time) > pendingUploadMaxAge {
+			continue
+		}
+		if completed := UploadFileComplete(ctx, token, p.DriveId, p.UploadId, p.FileId, p.ParentId); completed == "" {
+			net.Logln(ctx, "❌  无法完成上次未完成的上传", p.Name, p.UploadId)
+		} else {
+			net.Logln(ctx, "♻️  已完成上次未完成的上传", completed, p.Size)
+		}
+	}
+	updatePendingUploads(ctx, func(current map[string]pendingUpload) {
+		for k, uploadId := range done {
+			if current[k].UploadId == uploadId {
+				delete(current, k)
+			}
+		}
+	})
+}
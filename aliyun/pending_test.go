@@ -0,0 +1,111 @@
+package aliyun
+
+import (
+	"bytes"
+	"context"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// failComplete 让完成上传的请求失败，模拟分片上传完后进程在完成前崩溃
+func failComplete(s *aliyuntest.Server) {
+	s.Handle("/v2/file/complete", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+}
+
+func usePendingUploads(t *testing.T) {
+	t.Helper()
+	old := ResumeUploads
+	t.Cleanup(func() { ResumeUploads = old })
+	ResumeUploads = true
+	TempDir = t.TempDir()
+}
+
+func TestPendingUploadRetry(t *testing.T) {
+	s := newFake(t)
+	usePendingUploads(t)
+	content := binaryContent(40)
+	failComplete(s)
+
+	r := httptest.NewRequest("PUT", "/a.bin", bytes.NewReader(content))
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "a.bin"); err != ErrUploadFailed {
+		t.Fatalf("ContentHandle with a failing completion = %v, want ErrUploadFailed", err)
+	}
+	if _, err := os.Stat(pendingUploadsPath()); err != nil {
+		t.Fatalf("no pending upload record: %v", err)
+	}
+	if _, ok := s.Lookup("a.bin"); ok {
+		t.Fatal("file stored without completion")
+	}
+
+	//内容不同的重试不使用记录，新的上传同样完成失败时记录被替换
+	other := append([]byte(nil), content...)
+	other[0] ^= 0xFF
+	r = httptest.NewRequest("PUT", "/a.bin", bytes.NewReader(other))
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "a.bin"); err != ErrUploadFailed {
+		t.Fatalf("ContentHandle of other content = %v", err)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 2 {
+		t.Errorf("other content created %d uploads, want a new one", n)
+	}
+
+	//同样内容的重试直接完成，不再上传分片
+	s.Handle("/v2/file/complete", nil)
+	r = httptest.NewRequest("PUT", "/a.bin", bytes.NewReader(other))
+	fileId, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "a.bin")
+	if err != nil {
+		t.Fatalf("retried ContentHandle: %v", err)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 2 {
+		t.Errorf("retry created %d uploads, want it to complete the pending one", n)
+	}
+	if f, ok := s.File(fileId); !ok || !bytes.Equal(f.Content, other) {
+		t.Error("retry did not store the uploaded content")
+	}
+	pendingMu.Lock()
+	pending := loadPendingUploads(context.Background())
+	pendingMu.Unlock()
+	if len(pending) != 0 {
+		t.Errorf("pending records after completion: %+v", pending)
+	}
+}
+
+func TestResumePendingUploads(t *testing.T) {
+	s := newFake(t)
+	usePendingUploads(t)
+	content := binaryContent(40)
+	failComplete(s)
+	r := httptest.NewRequest("PUT", "/a.bin", bytes.NewReader(content))
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "a.bin"); err != ErrUploadFailed {
+		t.Fatalf("ContentHandle with a failing completion = %v, want ErrUploadFailed", err)
+	}
+	s.Handle("/v2/file/complete", nil)
+
+	//其他网盘的记录不处理
+	ResumePendingUploads(context.Background(), "token", "2")
+	if _, ok := s.Lookup("a.bin"); ok {
+		t.Fatal("resumed an upload of another drive")
+	}
+
+	//重启后直接完成
+	ResumePendingUploads(context.Background(), "token", aliyuntest.DriveId)
+	if f, ok := s.Lookup("a.bin"); !ok || !bytes.Equal(f.Content, content) {
+		t.Error("pending upload not completed at startup")
+	}
+	if _, err := os.Stat(pendingUploadsPath()); !os.IsNotExist(err) {
+		t.Errorf("pending upload record kept after completion: %v", err)
+	}
+
+	//关闭时不记录也不恢复
+	ResumeUploads = false
+	failComplete(s)
+	r = httptest.NewRequest("PUT", "/b.bin", bytes.NewReader(content))
+	ContentHandle(r, "token", aliyuntest.DriveId, "root", "b.bin")
+	if _, err := os.Stat(pendingUploadsPath()); !os.IsNotExist(err) {
+		t.Errorf("pending upload recorded with ResumeUploads off: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package aliyun
+
+import (
+	"go-aliyun-webdav/aliyun/model"
+	"sort"
+	"sync"
+	"time"
+)
+
+// uploads 正在进行中的上传任务，以中间文件名为key
+var uploads = struct {
+	sync.Mutex
+	m map[string]*model.UploadProgress
+}{m: make(map[string]*model.UploadProgress)}
+
+func startUpload(key string, p model.UploadProgress) {
+	uploads.Lock()
+	defer uploads.Unlock()
+	uploads.m[key] = &p
+}
+
+func partDone(key string, partSize int64) {
+	uploads.Lock()
+	defer uploads.Unlock()
+	if p, ok := uploads.m[key]; ok {
+		p.PartsDone++
+		p.BytesDone += partSize
+	}
+}
+
+func finishUpload(key string) {
+	uploads.Lock()
+	defer uploads.Unlock()
+	delete(uploads.m, key)
+}
+
+// Uploads 返回当前所有进行中的上传任务，按开始时间排序
+func Uploads() []model.UploadProgress {
+	uploads.Lock()
+	defer uploads.Unlock()
+	list := make([]model.UploadProgress, 0, len(uploads.m))
+	for _, p := range uploads.m {
+		progress := *p
+		if elapsed := time.Since(progress.StartTime).Seconds(); elapsed > 0 {
+			progress.Speed = int64(float64(progress.BytesDone) / elapsed)
+		}
+		list = append(list, progress)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
+	return list
+}
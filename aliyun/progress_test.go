@@ -0,0 +1,94 @@
+package aliyun
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUploadProgress(t *testing.T) {
+	s := newFake(t)
+	TempDir = t.TempDir()
+	content := binaryContent(20*1024*1024 + 5)
+
+	//第2、3个分片等到放行后才上传完
+	reached := make(chan int)
+	proceed := make(chan struct{})
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		s.Default(rec, r)
+		var created struct {
+			UploadId string `json:"upload_id"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &created)
+		for part := 2; part <= 3 && created.UploadId != ""; part++ {
+			part := part
+			s.Handle("/oss/upload/"+created.UploadId+"/"+strconv.Itoa(part), func(w http.ResponseWriter, r *http.Request) {
+				reached <- part
+				<-proceed
+				s.Default(w, r)
+			})
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+
+	done := make(chan error)
+	go func() {
+		r := httptest.NewRequest("PUT", "/big.bin", bytes.NewReader(content))
+		_, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "big.bin")
+		done <- err
+	}()
+
+	for part := 2; part <= 3; part++ {
+		if got := <-reached; got != part {
+			t.Fatalf("uploading part %d, want %d", got, part)
+		}
+		list := Uploads()
+		if len(list) != 1 {
+			t.Fatalf("%d uploads in progress, want 1", len(list))
+		}
+		p := list[0]
+		if p.Name != "big.bin" || p.Size != int64(len(content)) || p.Parts != 3 {
+			t.Errorf("progress = %+v, want big.bin of %d bytes in 3 parts", p, len(content))
+		}
+		if p.PartsDone != part-1 || p.BytesDone != int64(part-1)*10485760 {
+			t.Errorf("while uploading part %d: %d parts, %d bytes done", part, p.PartsDone, p.BytesDone)
+		}
+		proceed <- struct{}{}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ContentHandle: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload not finished")
+	}
+	if list := Uploads(); len(list) != 0 {
+		t.Errorf("finished upload still listed: %+v", list)
+	}
+}
+
+func TestUploadProgressRemovedOnFailure(t *testing.T) {
+	s := newFake(t)
+	TempDir = t.TempDir()
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		if len(Uploads()) != 1 {
+			t.Errorf("%d uploads in progress, want 1", len(Uploads()))
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	r := httptest.NewRequest("PUT", "/a.bin", bytes.NewReader(binaryContent(40)))
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "a.bin"); err == nil {
+		t.Fatal("ContentHandle succeeded")
+	}
+	if list := Uploads(); len(list) != 0 {
+		t.Errorf("failed upload still listed: %+v", list)
+	}
+}
@@ -0,0 +1,96 @@
+package aliyun
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// ErrResumeOffset 续传的起始位置与已保存的字节数不一致
+var ErrResumeOffset = errors.New("aliyun: upload offset does not match the bytes already received")
+
+// ErrResumeBusy 同一个续传会话正在接收另一个请求的内容
+var ErrResumeBusy = errors.New("aliyun: resumable upload is receiving another request")
+
+var resumeBusy = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// resumeFileName 续传会话的文件名由上传目标、文件总大小和上传ID决定，同一路径同样大小的两次上传互不干扰，
+// 客户端带着同一个上传ID继续时找到同一个会话。以tempFilePrefix开头，长期没有完成的会话会被CleanTempFiles清理
+func resumeFileName(driveId string, reqPath string, total int64, uploadId string) string {
+	h := sha1.Sum([]byte(driveId + "/" + reqPath + "/" + strconv.FormatInt(total, 10) + "/" + uploadId))
+	return filepath.Join(tempDir(), tempFilePrefix+"resume-"+hex.EncodeToString(h[:8]))
+}
+
+// ResumeOffset 返回reqPath的续传会话已保存的字节数，没有会话时为0
+func ResumeOffset(driveId string, reqPath string, total int64, uploadId string) int64 {
+	info, err := os.Stat(resumeFileName(driveId, reqPath, total, uploadId))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// AppendResume 把请求中从offset开始的length字节追加到续传会话，offset必须等于已保存的字节数。
+// 客户端中途断开时已收到的内容仍然保留，返回追加后已保存的字节数，客户端从该位置继续
+func AppendResume(driveId string, reqPath string, total int64, uploadId string, offset int64, length int64, body io.Reader) (int64, error) {
+	file := resumeFileName(driveId, reqPath, total, uploadId)
+	resumeBusy.Lock()
+	if resumeBusy.m[file] {
+		resumeBusy.Unlock()
+		return ResumeOffset(driveId, reqPath, total, uploadId), ErrResumeBusy
+	}
+	resumeBusy.m[file] = true
+	resumeBusy.Unlock()
+	defer func() {
+		resumeBusy.Lock()
+		delete(resumeBusy.m, file)
+		resumeBusy.Unlock()
+	}()
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, ErrNoIntermediateFile
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return info.Size(), ErrResumeOffset
+	}
+	n, copyErr := io.CopyN(f, body, length)
+	//只有写入磁盘的内容才算已保存
+	if err := f.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return offset + n, copyErr
+}
+
+// OpenResume 打开已接收完整的续传会话，内容上传到网盘后调用RemoveResume删除
+func OpenResume(driveId string, reqPath string, total int64, uploadId string) (*os.File, error) {
+	return os.Open(resumeFileName(driveId, reqPath, total, uploadId))
+}
+
+// RemoveResume 删除续传会话
+func RemoveResume(driveId string, reqPath string, total int64, uploadId string) {
+	os.Remove(resumeFileName(driveId, reqPath, total, uploadId))
+}
+
+// UploadResume 把已接收完整的续传会话f直接上传到网盘，不再复制到另一个中间文件，
+// 返回新文件的file_id及阿里云实际使用的文件名。会话文件由调用者关闭，上传成功后再调用RemoveResume
+func UploadResume(ctx context.Context, token string, driveId string, parentId string, fileName string, f *os.File, size int64) (fileId string, name string, err error) {
+	if len(parentId) == 0 {
+		parentId = RootFileId()
+	}
+	return uploadBuffered(ctx, token, driveId, parentId, fileName, f, size)
+}
@@ -1,13 +1,12 @@
 package aliyun
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
-	"fmt"
-	"github.com/google/uuid"
+	"errors"
 	"github.com/tidwall/gjson"
-	"go-aliyun-webdav/aliyun/cache"
 	"go-aliyun-webdav/aliyun/model"
 	"go-aliyun-webdav/aliyun/net"
 	"go-aliyun-webdav/utils"
@@ -15,180 +14,521 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-//处理内容
-func ContentHandle(r *http.Request, token string, driveId string, parentId string, fileName string) string {
+//上传地址过期后续期的最大尝试次数及每次尝试的间隔
+var (
+	UploadUrlRenewRetries  = 10
+	UploadUrlRenewInterval = 10 * time.Second
+)
+
+//上传失败时保留中间文件，便于排查问题
+var KeepFailedUploads = false
+
+//大小已知的上传不写中间文件，边接收边按分片上传，不使用闪传
+var StreamUpload = false
+
+//不使用闪传的文件扩展名(小写，带.)，闪传会把文件内容的摘要发送给阿里云做去重
+var NoRapidUploadExts = map[string]bool{}
+
+// SetNoRapidUploadExts 设置不使用闪传的文件扩展名，exts以逗号分隔，如".gpg,.kdbx"
+func SetNoRapidUploadExts(exts string) {
+	NoRapidUploadExts = map[string]bool{}
+	for _, ext := range strings.Split(exts, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		NoRapidUploadExts[ext] = true
+	}
+}
+
+func rapidUploadAllowed(fileName string) bool {
+	return !NoRapidUploadExts[strings.ToLower(filepath.Ext(fileName))]
+}
+
+//中间文件名前缀，启动时据此清理崩溃后遗留的中间文件
+const tempFilePrefix = "aliyun-upload-"
+
+// tempFileName 中间文件名只由上传目标(网盘、目录、文件名)和大小决定，
+// 崩溃后遗留的文件可以对应回是哪次上传，重启时据此续传
+func tempFileName(driveId string, parentId string, fileName string, size int64) string {
+	h := sha1.Sum([]byte(driveId + "/" + parentId + "/" + fileName + "/" + strconv.FormatInt(size, 10)))
+	return tempFilePrefix + hex.EncodeToString(h[:8])
+}
+
+// CleanTempFiles 处理临时目录及系统临时目录下修改时间早于maxAge的中间文件，这些文件是进程崩溃或被强制退出时遗留的。
+// 开启ResumeUploads时，已完整接收的上传在后台用token重新上传到原来的位置，其余的直接删除
+func CleanTempFiles(ctx context.Context, token string, maxAge time.Duration) {
+	for _, dir := range intermediateDirs() {
+		cleanTempDir(ctx, token, dir, maxAge)
+	}
+}
+
+func cleanTempDir(ctx context.Context, token string, dir string, maxAge time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		net.Logln(ctx, "清理中间文件失败", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), tempFilePrefix) || strings.HasSuffix(entry.Name(), tempMetaSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		if meta, ok := readTempMeta(file); ok && ResumeUploads && meta.Size == info.Size() {
+			net.Logln(ctx, "♻️  续传崩溃前已接收完的上传", meta.Name, meta.Size)
+			go resumeTempFile(ctx, token, file, acquireTempName(entry.Name()), meta)
+			continue
+		}
+		os.Remove(file + tempMetaSuffix)
+		if err := os.Remove(file); err != nil {
+			net.Logln(ctx, "清理中间文件失败", entry.Name(), err)
+			continue
+		}
+		net.Logln(ctx, "🧹  清理遗留的中间文件", entry.Name())
+	}
+	//中间文件已被删除的记录
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, tempFilePrefix) && strings.HasSuffix(name, tempMetaSuffix) {
+			if _, err := os.Stat(filepath.Join(dir, strings.TrimSuffix(name, tempMetaSuffix))); os.IsNotExist(err) {
+				os.Remove(filepath.Join(dir, name))
+			}
+		}
+	}
+}
+
+// resumeTempFile 把崩溃前已完整接收的中间文件file上传到meta记录的位置，完成后删除
+func resumeTempFile(ctx context.Context, token string, file string, tempName string, meta tempMeta) {
+	defer releaseTempName(tempName)
+	f, err := os.Open(file)
+	if err != nil {
+		net.Logln(ctx, "❌  续传失败", meta.Name, err)
+		return
+	}
+	defer f.Close()
+	fileId, _, err := uploadBuffered(ctx, token, meta.DriveId, meta.ParentId, meta.Name, f, meta.Size)
+	if err != nil {
+		//保留中间文件，下次启动时再试
+		net.Logln(ctx, "❌  续传失败", meta.Name, err)
+		return
+	}
+	net.Logln(ctx, "✅  续传完成", meta.Name, fileId)
+	os.Remove(file + tempMetaSuffix)
+	os.Remove(file)
+}
+
+// fileSha1 计算文件内容的SHA1，大写十六进制
+func fileSha1(f io.ReadSeeker) (string, error) {
+	h := sha1.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+//上传中间文件最多占用的磁盘空间(字节)，0为不限制
+var TempDiskLimit int64
+
+// ErrUploadFailed 上传失败，具体原因见日志
+var ErrUploadFailed = errors.New("aliyun: upload failed")
+
+// ErrTempDiskFull 进行中的上传的中间文件已占满TempDiskLimit
+var ErrTempDiskFull = errors.New("aliyun: temp file disk budget exhausted")
+
+var (
+	tempDiskMu   sync.Mutex
+	tempDiskUsed int64
+)
+
+// ReserveTempDisk 为一个大小为size的上传预留中间文件的磁盘空间，上传结束后调用release归还。
+// 大小未知(chunked上传)或开启StreamUpload(不写中间文件)时不做限制
+func ReserveTempDisk(size int64) (release func(), err error) {
+	if TempDiskLimit <= 0 || size <= 0 || StreamUpload {
+		return func() {}, nil
+	}
+	tempDiskMu.Lock()
+	defer tempDiskMu.Unlock()
+	if tempDiskUsed+size > TempDiskLimit {
+		return nil, ErrTempDiskFull
+	}
+	tempDiskUsed += size
+	return func() {
+		tempDiskMu.Lock()
+		tempDiskUsed -= size
+		tempDiskMu.Unlock()
+	}, nil
+}
+
+//处理内容，返回新文件的file_id及阿里云实际使用的文件名
+func ContentHandle(r *http.Request, token string, driveId string, parentId string, fileName string) (fileId string, name string, err error) {
+	ctx := r.Context()
 	//需要判断参数里面的有效期
 	//默认截取长度10485760
 	//const DEFAULT int64 = 10485760
 	const DEFAULT int64 = 10485760
-	var count float64 = 1
 
 	if len(parentId) == 0 {
-		parentId = "root"
+		parentId = RootFileId()
 	}
-	if r.ContentLength > 0 {
-		count = math.Ceil(float64(r.ContentLength) / float64(DEFAULT))
-	} else {
-		//dataTemp, _ := io.ReadAll(r.Body)
-		//r.ContentLength = int64(len(dataTemp))
-		return ""
+	if r.ContentLength == 0 {
+		return CreateEmptyFile(ctx, token, driveId, parentId, fileName)
+	}
+	if StreamUpload && r.ContentLength > 0 {
+		return streamUpload(r, token, driveId, parentId, fileName, r.ContentLength, DEFAULT)
 	}
 
-	//proof 偏移量
-	var offset int64 = 0
-	//proof内容base64
-	var proof string = ""
-	//是否闪传
-	var flashUpload bool = false
-	//status code
-	var code int
-	var uploadUrl []gjson.Result
-	var uploadId string
-	var uploadFileId string
-	var uid = uuid.New().String()
-	var intermediateFile, err = os.Create(uid)
+	tempName := acquireTempName(tempFileName(driveId, parentId, fileName, r.ContentLength))
+	defer releaseTempName(tempName)
+	intermediateFile, err := createIntermediateFile(ctx, tempName, r.ContentLength)
 	if err != nil {
-		return ""
+		net.Logln(ctx, "❌  Error creating intermediate file ", fileName, err)
+		return "", "", err
 	}
-	defer func(create *os.File) {
+	defer func(create uploadBuffer) {
 		err := create.Close()
 		if err != nil {
-			fmt.Println(err)
+			net.Logln(ctx, err)
 		}
 	}(intermediateFile)
+	if _, onDisk := intermediateFile.(*os.File); onDisk {
+		//记录上传目标，崩溃后重启时可以找回这次上传
+		writeTempMeta(ctx, intermediateFile.Name(), tempMeta{DriveId: driveId, ParentId: parentId, Name: fileName, Size: r.ContentLength})
+	}
 	defer func(name string) {
+		if _, onDisk := intermediateFile.(*os.File); !onDisk {
+			return
+		}
+		os.Remove(name + tempMetaSuffix)
+		if fileId == "" && KeepFailedUploads {
+			if abs, err := filepath.Abs(name); err == nil {
+				name = abs
+			}
+			net.Logln(ctx, "🗂  Upload failed, intermediate file kept at", name, fileName)
+			return
+		}
 		err := os.Remove(name)
 		if err != nil {
-			fmt.Println(err, name)
+			net.Logln(ctx, err, name)
 		}
 	}(intermediateFile.Name())
 	//写入中间文件
-	_, copyError := io.Copy(intermediateFile, r.Body)
+	//chunked方式上传时ContentLength为-1，以实际写入中间文件的大小为准
+	size, copyError := io.Copy(intermediateFile, r.Body)
 	if copyError != nil {
-		fmt.Println("❌  Error creating intermediate file ", fileName, intermediateFile.Name(), r.ContentLength)
-		return ""
+		net.Logln(ctx, "❌  Error creating intermediate file ", fileName, intermediateFile.Name(), r.ContentLength)
+		return "", "", ErrUploadFailed
+	}
+	if size == 0 {
+		return CreateEmptyFile(ctx, token, driveId, parentId, fileName)
 	}
+	return uploadBuffered(ctx, token, driveId, parentId, fileName, intermediateFile, size)
+}
+
+// uploadBuffered 把已完整写入中间文件的内容上传到网盘，返回新文件的file_id及阿里云实际使用的文件名
+func uploadBuffered(ctx context.Context, token string, driveId string, parentId string, fileName string, intermediateFile uploadBuffer, size int64) (fileId string, name string, err error) {
+	const DEFAULT int64 = 10485760
+	var count float64 = 1
+	//是否闪传
+	var flashUpload bool = false
+	//status code
+	var code int
+	var uploadUrl []gjson.Result
+	var uploadId string
+	var uploadFileId string
+	var createErr error
+	//开启ResumeUploads时按内容摘要查找之前已上传完所有分片的同一文件
+	var contentSha1 string
+	if ResumeUploads {
+		if contentSha1, err = fileSha1(intermediateFile); err != nil {
+			net.Logln(ctx, "Error calculate SHA1", err, fileName, intermediateFile.Name(), size)
+			return "", "", ErrUploadFailed
+		}
+	}
+	if p, ok := findPendingUpload(ctx, driveId, parentId, fileName, size, contentSha1); ok {
+		//同样的内容之前已上传完所有分片，只是没有完成
+		net.Logln(ctx, "♻️  分片已在之前上传，直接完成上传", fileName, p.UploadId)
+		if completed, err := completeUpload(ctx, token, p); err == nil {
+			name = actualName(ctx, fileName, completed)
+			cacheUploaded(parentId, uploadedItem(driveId, parentId, p.FileId, name, size, contentSha1))
+			return p.FileId, name, nil
+		}
+	}
+	count = math.Ceil(float64(size) / float64(DEFAULT))
+	startUpload(intermediateFile.Name(), model.UploadProgress{
+		Name:      fileName,
+		ParentId:  parentId,
+		Size:      size,
+		Parts:     int(count),
+		StartTime: time.Now(),
+	})
+	defer finishUpload(intermediateFile.Name())
 	//大于150K小于25G的才开启闪传
 	//由于webdav协议的局限性，使用中间文件，服务求要有足够的存储，否则会将硬盘撑爆掉
-	if r.ContentLength > 1024*150 && r.ContentLength <= 1024*1024*1024*25 {
+	if size > 1024*150 && size <= 1024*1024*1024*25 && rapidUploadAllowed(fileName) {
 		preHashDataBytes := make([]byte, 1024)
 		_, err := intermediateFile.ReadAt(preHashDataBytes, 0)
 		if err != nil {
-			fmt.Println("error reading file", intermediateFile.Name(), err)
-			return ""
+			net.Logln(ctx, "error reading file", intermediateFile.Name(), err)
+			return "", "", ErrUploadFailed
 		}
 		h := sha1.New()
 		h.Write(preHashDataBytes)
 		//检查是否可以极速上传，逻辑如下
 		//取文件的前1K字节，做SHA1摘要，调用创建文件接口，pre_hash参数为SHA1摘要，如果返回409，则这个文件可以极速上传
-		preHashRequest := `{"drive_id":"` + driveId + `","parent_file_id":"` + parentId + `","name":"` + fileName + `","type":"file","check_name_mode":"overwrite","size":` + strconv.FormatInt(r.ContentLength, 10) + `,"pre_hash":"` + hex.EncodeToString(h.Sum(nil)) + `","proof_version":"v1"}`
-		_, code = net.PostExpectStatus(model.APIFILEUPLOAD, token, []byte(preHashRequest))
+		preHashRequest := `{"drive_id":"` + driveId + `","parent_file_id":"` + parentId + `","name":"` + fileName + `","type":"file","check_name_mode":"overwrite","size":` + strconv.FormatInt(size, 10) + `,"pre_hash":"` + hex.EncodeToString(h.Sum(nil)) + `","proof_version":"v1"}`
+		_, code = net.PostExpectStatus(ctx, model.APIFILEUPLOAD, token, []byte(preHashRequest))
 		if code == 409 {
-			md := md5.New()
-			tokenBytes := []byte(token)
-			md.Write(tokenBytes)
-			tokenMd5 := hex.EncodeToString(md.Sum(nil))
-			first16 := tokenMd5[:16]
-			f, err := strconv.ParseUint(first16, 16, 64)
-			if err != nil {
-				fmt.Println(err)
-			}
-			offset = int64(f % uint64(r.ContentLength))
-			end := math.Min(float64(offset+8), float64(r.ContentLength))
-			off := make([]byte, int64(end)-offset)
-			_, offerr := intermediateFile.ReadAt(off, offset)
-			if offerr != nil {
-				fmt.Println("Can't calculate proof", offerr)
-				return ""
-			}
-			proof = utils.GetProof(off)
 			flashUpload = true
 		}
-		_, seekError := intermediateFile.Seek(0, 0)
-		if seekError != nil {
-			fmt.Println("回不去了...", seekError, fileName, intermediateFile.Name())
-			return ""
+		contentHash, proof, err := uploadHashes(intermediateFile, token, size)
+		if err != nil {
+			net.Logln(ctx, "Error calculate SHA1", err, fileName, intermediateFile.Name(), size)
+			return "", "", ErrUploadFailed
 		}
-		h2 := sha1.New()
-		_, sha1Error := io.Copy(h2, intermediateFile)
-		if sha1Error != nil {
-			fmt.Println("Error calculate SHA1", sha1Error, fileName, intermediateFile.Name(), r.ContentLength)
-			return ""
+		rapidAttempt := flashUpload
+		uploadUrl, uploadId, uploadFileId, flashUpload, name, createErr = UpdateFileFile(ctx, token, driveId, fileName, parentId, strconv.FormatInt(size, 10), int(count), contentHash, proof, flashUpload)
+		if rapidAttempt && !flashUpload && (len(uploadUrl) == 0 || uploadFileId == "") {
+			//校验未通过可能是读取中间文件出错导致摘要算错，重新计算一次，结果不同时用新的结果再试一次
+			if retryHash, retryProof, err := uploadHashes(intermediateFile, token, size); err == nil && (retryHash != contentHash || retryProof != proof) {
+				net.Logln(ctx, "⚠️  Rapid upload hash changed after recalculating, retrying", fileName, size)
+				uploadUrl, uploadId, uploadFileId, flashUpload, name, createErr = UpdateFileFile(ctx, token, driveId, fileName, parentId, strconv.FormatInt(size, 10), int(count), retryHash, retryProof, true)
+			}
 		}
-		uploadUrl, uploadId, uploadFileId, flashUpload = UpdateFileFile(token, driveId, fileName, parentId, strconv.FormatInt(r.ContentLength, 10), int(count), strings.ToUpper(hex.EncodeToString(h2.Sum(nil))), proof, flashUpload)
 		if flashUpload && (uploadFileId != "") {
-			fmt.Println("⚡️⚡️  Rapid Upload ", fileName, r.ContentLength)
-			//UploadFileComplete(token, driveId, uploadId, uploadFileId, parentId)
-			cache.GoCache.Delete(parentId)
-			return uploadFileId
+			net.Logln(ctx, "⚡️⚡️  Rapid Upload ", fileName, size)
+			//UploadFileComplete(ctx, token, driveId, uploadId, uploadFileId, parentId)
+			name = actualName(ctx, fileName, name)
+			//闪传的文件信息可能稍后才更新，记下上传的大小，紧接着的Range请求不会按旧的大小计算
+			cacheUploaded(parentId, uploadedItem(driveId, parentId, uploadFileId, name, size, contentHash))
+			return uploadFileId, name, nil
+		}
+		//闪传校验未通过时，返回结果里不一定带有分片上传地址，重新按普通上传创建文件
+		if rapidAttempt && (len(uploadUrl) == 0 || uploadFileId == "") {
+			net.Logln(ctx, "⚠️  Rapid upload rejected, falling back to normal upload", fileName, size)
+			uploadUrl, uploadId, uploadFileId, flashUpload, name, createErr = UpdateFileFile(ctx, token, driveId, fileName, parentId, strconv.FormatInt(size, 10), int(count), "", "", false)
 		}
 		//intermediateFile.Write(readBytes)
 		//readBytes = nil
 	} else {
-		uploadUrl, uploadId, uploadFileId, flashUpload = UpdateFileFile(token, driveId, fileName, parentId, strconv.FormatInt(r.ContentLength, 10), int(count), "", "", false)
+		uploadUrl, uploadId, uploadFileId, flashUpload, name, createErr = UpdateFileFile(ctx, token, driveId, fileName, parentId, strconv.FormatInt(size, 10), int(count), "", "", false)
 	}
 
 	if len(uploadUrl) == 0 {
-		return ""
+		if createErr == nil {
+			createErr = ErrUploadFailed
+		}
+		return "", "", createErr
 	}
 	var bg time.Time = time.Now()
-	stat, err := intermediateFile.Stat()
-	if err != nil {
-		fmt.Println(err)
-		return ""
-	}
-
-	fmt.Println("📢  Normal upload ", fileName, uploadId, r.ContentLength, stat.Size())
+	net.Logln(ctx, "📢  Normal upload ", fileName, uploadId, size)
 	intermediateFile.Seek(0, 0)
 	for i := 0; i < int(count); i++ {
-		fmt.Println("📢  Uploading part:", i+1, "total:", count, fileName, "total size:", r.ContentLength)
+		net.Logln(ctx, "📢  Uploading part:", i+1, "total:", count, fileName, "total size:", size)
 		pstart := time.Now()
 		var dataByte []byte
 		if int(count) == 1 {
-			dataByte = make([]byte, r.ContentLength)
+			dataByte = make([]byte, size)
 		} else if i == int(count)-1 {
-			dataByte = make([]byte, r.ContentLength-int64(i)*DEFAULT)
+			dataByte = make([]byte, size-int64(i)*DEFAULT)
 		} else {
 			dataByte = make([]byte, DEFAULT)
 		}
 		_, err := io.ReadFull(intermediateFile, dataByte)
 		if err != nil {
-			fmt.Println("❌  err reading from temp file", err, intermediateFile.Name(), fileName, uploadId)
-			return ""
-		}
-		//check if upload url has expired
-		uri := uploadUrl[i].Str
-		idx := strings.Index(uri, "x-oss-expires=") + len("x-oss-expires=")
-		idx2 := strings.Index(uri[idx:], "&")
-		exp := uri[idx : idx2+idx]
-		expire, _ := strconv.ParseInt(exp, 10, 64)
-		if time.Now().UnixMilli()/1000 > expire {
-			fmt.Println("⚠️     Now:", time.Now().UnixMilli()/1000)
-			fmt.Println("⚠️  Expire:", exp)
-			fmt.Println("⚠️  Uploading URL expired, renewing", uploadId, uploadFileId, fileName)
-			uploadUrl = GetUploadUrls(token, driveId, uploadFileId, uploadId, int(count))
+			net.Logln(ctx, "❌  err reading from temp file", err, intermediateFile.Name(), fileName, uploadId)
+			return "", "", ErrUploadFailed
+		}
+		if uploadUrlExpired(uploadUrl[i].Str) {
+			net.Logln(ctx, "⚠️  Uploading URL expired, renewing", uploadId, uploadFileId, fileName)
+			uploadUrl = renewUploadUrls(ctx, token, driveId, uploadFileId, uploadId, int(count))
 			if len(uploadUrl) == 0 {
-				fmt.Println("❌  Renew Uploading URL failed", fileName, uploadId, uploadFileId, "cancel upload")
-				return ""
+				net.Logln(ctx, "❌  Renew Uploading URL failed", fileName, uploadId, uploadFileId, "cancel upload")
+				return "", "", ErrUploadFailed
 			} else {
-				//fmt.Println("ℹ️  从头再来 💃🤔⬆️‼️ Resetting upload part")
+				//net.Logln(ctx, "ℹ️  从头再来 💃🤔⬆️‼️ Resetting upload part")
 				//i = 0
 			}
 		}
-		if ok := UploadFile(uploadUrl[i].Str, token, dataByte); !ok {
-			fmt.Println("❌  Upload part failed", fileName, "part", i+1, "cancel upload")
-			return ""
+		if ok := UploadFile(ctx, uploadUrl[i].Str, token, dataByte); !ok {
+			net.Logln(ctx, "❌  Upload part failed", fileName, "part", i+1, "cancel upload")
+			return "", "", ErrUploadFailed
+		}
+		partDone(intermediateFile.Name(), int64(len(dataByte)))
+		net.Logln(ctx, "✅  Done part:", i+1, "total:", count+1, fileName, "total size:", size, "time elapsed:", time.Now().Sub(pstart).String())
+
+	}
+	net.Logln(ctx, "✅  Done, elapsed ", time.Now().Sub(bg).String(), fileName, size)
+	completed, err := completeUpload(ctx, token, pendingUpload{DriveId: driveId, ParentId: parentId, Name: fileName, Size: size, Sha1: contentSha1, UploadId: uploadId, FileId: uploadFileId})
+	if err != nil {
+		return "", "", err
+	}
+	if completed != "" {
+		name = actualName(ctx, fileName, completed)
+	}
+	if name == "" {
+		name = fileName
+	}
+	cacheUploaded(parentId, uploadedItem(driveId, parentId, uploadFileId, name, size, contentSha1))
+	return uploadFileId, name, nil
+}
+
+// streamUpload 边接收边上传：先按ContentLength创建文件取得各分片的上传地址，每读满一个分片就上传，
+// 内存中只保留一个分片，不写入磁盘，也不使用闪传
+func streamUpload(r *http.Request, token string, driveId string, parentId string, fileName string, size int64, partSize int64) (string, string, error) {
+	ctx := r.Context()
+	count := int((size + partSize - 1) / partSize)
+	uploadUrl, uploadId, uploadFileId, _, name, err := UpdateFileFile(ctx, token, driveId, fileName, parentId, strconv.FormatInt(size, 10), count, "", "", false)
+	if len(uploadUrl) == 0 || uploadFileId == "" {
+		if err == nil {
+			err = ErrUploadFailed
 		}
-		fmt.Println("✅  Done part:", i+1, "total:", count+1, fileName, "total size:", r.ContentLength, "time elapsed:", time.Now().Sub(pstart).String())
+		return "", "", err
+	}
+	key := acquireTempName(tempFileName(driveId, parentId, fileName, size))
+	defer releaseTempName(key)
+	startUpload(key, model.UploadProgress{
+		Name:      fileName,
+		ParentId:  parentId,
+		Size:      size,
+		Parts:     count,
+		StartTime: time.Now(),
+	})
+	defer finishUpload(key)
 
+	bg := time.Now()
+	net.Logln(ctx, "📢  Streaming upload ", fileName, uploadId, size)
+	body := r.Body
+	buf := make([]byte, partSize)
+	for i := 0; i < count; i++ {
+		part := buf
+		if i == count-1 {
+			part = buf[:size-int64(i)*partSize]
+		}
+		if _, err := io.ReadFull(body, part); err != nil {
+			net.Logln(ctx, "❌  Error reading request body", fileName, "part", i+1, err)
+			return "", "", ErrUploadFailed
+		}
+		if uploadUrlExpired(uploadUrl[i].Str) {
+			net.Logln(ctx, "⚠️  Uploading URL expired, renewing", uploadId, uploadFileId, fileName)
+			if uploadUrl = renewUploadUrls(ctx, token, driveId, uploadFileId, uploadId, count); len(uploadUrl) == 0 {
+				net.Logln(ctx, "❌  Renew Uploading URL failed", fileName, uploadId, uploadFileId, "cancel upload")
+				return "", "", ErrUploadFailed
+			}
+		}
+		if ok := UploadFile(ctx, uploadUrl[i].Str, token, part); !ok {
+			net.Logln(ctx, "❌  Upload part failed", fileName, "part", i+1, "cancel upload")
+			return "", "", ErrUploadFailed
+		}
+		partDone(key, int64(len(part)))
+	}
+	net.Logln(ctx, "✅  Done, elapsed ", time.Now().Sub(bg).String(), fileName, size)
+	completed, err := completeUpload(ctx, token, pendingUpload{DriveId: driveId, ParentId: parentId, Name: fileName, Size: size, UploadId: uploadId, FileId: uploadFileId})
+	if err != nil {
+		return "", "", err
+	}
+	if completed != "" {
+		name = actualName(ctx, fileName, completed)
+	}
+	if name == "" {
+		name = fileName
+	}
+	cacheUploaded(parentId, uploadedItem(driveId, parentId, uploadFileId, name, size, ""))
+	return uploadFileId, name, nil
+}
+
+// uploadUrlExpired 分片上传地址中的x-oss-expires(秒)是否已过
+func uploadUrlExpired(uri string) bool {
+	idx := strings.Index(uri, "x-oss-expires=")
+	if idx < 0 {
+		return false
+	}
+	exp := uri[idx+len("x-oss-expires="):]
+	if end := strings.Index(exp, "&"); end >= 0 {
+		exp = exp[:end]
+	}
+	expire, _ := strconv.ParseInt(exp, 10, 64)
+	return time.Now().Unix() > expire
+}
+
+// uploadHashes 从中间文件计算闪传所需的整个文件的SHA1及proof。
+// proof取文件中的8个字节，位置由token的MD5决定
+func uploadHashes(f io.ReaderAt, token string, size int64) (contentHash string, proof string, err error) {
+	md := md5.New()
+	md.Write([]byte(token))
+	tokenMd5 := hex.EncodeToString(md.Sum(nil))
+	first16, err := strconv.ParseUint(tokenMd5[:16], 16, 64)
+	if err != nil {
+		return "", "", err
+	}
+	offset := int64(first16 % uint64(size))
+	end := math.Min(float64(offset+8), float64(size))
+	off := make([]byte, int64(end)-offset)
+	if _, err := f.ReadAt(off, offset); err != nil {
+		return "", "", err
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return "", "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), utils.GetProof(off), nil
+}
+
+// CreateEmptyFile 创建空文件，同名文件已存在时覆盖，
+// 这样客户端先PUT一个空文件占位再上传内容时，占位文件会被正常替换
+func CreateEmptyFile(ctx context.Context, token string, driveId string, parentId string, fileName string) (string, string, error) {
+	uploadUrl, uploadId, uploadFileId, _, name, err := UpdateFileFile(ctx, token, driveId, fileName, parentId, "0", 1, "", "", false)
+	if len(uploadUrl) == 0 || uploadFileId == "" {
+		net.Logln(ctx, "❌  Create empty file failed", fileName)
+		if err == nil {
+			err = ErrUploadFailed
+		}
+		return "", "", err
+	}
+	if ok := UploadFile(ctx, uploadUrl[0].Str, token, []byte{}); !ok {
+		net.Logln(ctx, "❌  Create empty file failed", fileName)
+		return "", "", ErrUploadFailed
+	}
+	if completed := UploadFileComplete(ctx, token, driveId, uploadId, uploadFileId, parentId); completed != "" {
+		name = actualName(ctx, fileName, completed)
+	}
+	net.Logln(ctx, "✅  Empty file created", name)
+	return uploadFileId, name, nil
+}
+
+// renewUploadUrls 重新获取分片上传地址，失败时按UploadUrlRenewInterval间隔重试，客户端断开时立即放弃
+func renewUploadUrls(ctx context.Context, token string, driveId string, fileId string, uploadId string, length int) []gjson.Result {
+	for i := 0; i < UploadUrlRenewRetries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(UploadUrlRenewInterval):
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		uploadUrl := GetUploadUrls(ctx, token, driveId, fileId, uploadId, length)
+		if len(uploadUrl) > 0 {
+			return uploadUrl
+		}
+		net.Logln(ctx, "⚠️  Renew Uploading URL failed, attempt", i+1, "of", UploadUrlRenewRetries, fileId, uploadId)
 	}
-	fmt.Println("✅  Done, elapsed ", time.Now().Sub(bg).String(), fileName, r.ContentLength)
-	UploadFileComplete(token, driveId, uploadId, uploadFileId, parentId)
-	cache.GoCache.Delete(parentId)
-	return uploadFileId
+	return nil
 }
@@ -0,0 +1,619 @@
+package aliyun
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/tidwall/gjson"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// binaryContent 带BOM、CRLF换行和NUL字节的内容，重复到至少size字节
+func binaryContent(size int) []byte {
+	unit := []byte("\xEF\xBB\xBFline1\r\nline2\x00\x00end\r\n\xFF\xFE")
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		buf.Write(unit)
+	}
+	return buf.Bytes()
+}
+
+func sha1Hex(b []byte) string {
+	h := sha1.Sum(b)
+	return strings.ToUpper(hex.EncodeToString(h[:]))
+}
+
+func TestContentHandleByteExact(t *testing.T) {
+	cases := []struct {
+		name   string
+		size   int
+		stream bool
+	}{
+		{"small", 40, false},
+		{"rapid-candidate", 200 * 1024, false},
+		{"multipart", 10*1024*1024 + 3, false},
+		{"stream", 200 * 1024, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newFake(t)
+			TempDir = t.TempDir()
+			defer func(old bool) { StreamUpload = old }(StreamUpload)
+			StreamUpload = c.stream
+			content := binaryContent(c.size)
+
+			r := httptest.NewRequest("PUT", "/bom.txt", bytes.NewReader(content))
+			fileId, name, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "bom.txt")
+			if err != nil {
+				t.Fatalf("ContentHandle: %v", err)
+			}
+			if name != "bom.txt" {
+				t.Errorf("name = %q, want bom.txt", name)
+			}
+			f, ok := s.File(fileId)
+			if !ok {
+				t.Fatalf("file %s not stored", fileId)
+			}
+			if !bytes.Equal(f.Content, content) {
+				t.Errorf("stored %d bytes differ from the %d uploaded", len(f.Content), len(content))
+			}
+			if f.Sha1() != sha1Hex(content) {
+				t.Errorf("stored sha1 %s, want %s", f.Sha1(), sha1Hex(content))
+			}
+		})
+	}
+}
+
+func TestContentHandleRapidUploadByteExact(t *testing.T) {
+	s := newFake(t)
+	TempDir = t.TempDir()
+	content := binaryContent(200 * 1024)
+	s.Put("root", "original.txt", content)
+
+	r := httptest.NewRequest("PUT", "/copy.txt", bytes.NewReader(content))
+	fileId, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "copy.txt")
+	if err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if n := s.Calls("/v2/file/complete"); n != 0 {
+		t.Errorf("rapid upload completed %d uploads, want none", n)
+	}
+	f, ok := s.File(fileId)
+	if !ok || !bytes.Equal(f.Content, content) {
+		t.Fatalf("rapid upload stored different content")
+	}
+}
+
+func TestContentHandleChunked(t *testing.T) {
+	for _, size := range []int{40, 200 * 1024, 10*1024*1024 + 3} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			s := newFake(t)
+			TempDir = t.TempDir()
+			content := binaryContent(size)
+
+			//chunked方式上传时没有Content-Length
+			r := httptest.NewRequest("PUT", "/chunked.bin", bytes.NewReader(content))
+			r.ContentLength = -1
+			r.TransferEncoding = []string{"chunked"}
+			fileId, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "chunked.bin")
+			if err != nil {
+				t.Fatalf("ContentHandle: %v", err)
+			}
+			f, ok := s.File(fileId)
+			if !ok || !bytes.Equal(f.Content, content) {
+				t.Errorf("stored %d bytes, want the %d uploaded", len(f.Content), len(content))
+			}
+		})
+	}
+}
+
+func TestContentHandleChunkedRapidUpload(t *testing.T) {
+	s := newFake(t)
+	TempDir = t.TempDir()
+	content := binaryContent(200 * 1024)
+	s.Put("root", "original.bin", content)
+
+	r := httptest.NewRequest("PUT", "/copy.bin", bytes.NewReader(content))
+	r.ContentLength = -1
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "copy.bin"); err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if n := s.Calls("/v2/file/complete"); n != 0 {
+		t.Errorf("chunked upload of known content completed %d uploads, want a rapid upload", n)
+	}
+}
+
+func TestRenewUploadUrls(t *testing.T) {
+	s := newFake(t)
+	defer func(retries int, interval time.Duration) {
+		UploadUrlRenewRetries, UploadUrlRenewInterval = retries, interval
+	}(UploadUrlRenewRetries, UploadUrlRenewInterval)
+	UploadUrlRenewRetries, UploadUrlRenewInterval = 3, time.Millisecond
+
+	//前两次获取不到上传地址，第三次成功
+	attempts := 0
+	s.Handle("/v2/file/get_upload_url", func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"part_info_list":[{"part_number":1,"upload_url":"https://oss/1"},{"part_number":2,"upload_url":"https://oss/2"}]}`))
+	})
+	urls := renewUploadUrls(context.Background(), "token", aliyuntest.DriveId, "f1", "u1", 2)
+	if len(urls) != 2 || urls[1].Str != "https://oss/2" || attempts != 3 {
+		t.Fatalf("renewed %v after %d attempts, want two urls after 3", urls, attempts)
+	}
+
+	//超过重试次数后放弃
+	attempts = -10
+	if urls := renewUploadUrls(context.Background(), "token", aliyuntest.DriveId, "f1", "u1", 2); urls != nil {
+		t.Errorf("renewed %v, want nil after %d failed attempts", urls, UploadUrlRenewRetries)
+	}
+	if attempts != -10+UploadUrlRenewRetries {
+		t.Errorf("made %d attempts, want %d", attempts+10, UploadUrlRenewRetries)
+	}
+}
+
+func TestRenewUploadUrlsCanceled(t *testing.T) {
+	s := newFake(t)
+	defer func(interval time.Duration) { UploadUrlRenewInterval = interval }(UploadUrlRenewInterval)
+	UploadUrlRenewInterval = time.Hour
+	s.Handle("/v2/file/get_upload_url", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	done := make(chan []gjson.Result)
+	go func() { done <- renewUploadUrls(ctx, "token", aliyuntest.DriveId, "f1", "u1", 1) }()
+	select {
+	case urls := <-done:
+		if urls != nil {
+			t.Errorf("renewed %v after the client went away", urls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("renewal still waiting after the request context ended")
+	}
+}
+
+func TestContentHandleRapidUploadRejected(t *testing.T) {
+	s := newFake(t)
+	TempDir = t.TempDir()
+	content := binaryContent(200 * 1024)
+	//前1K相同、大小相同但内容不同：pre_hash匹配，闪传校验不通过
+	other := append([]byte(nil), content...)
+	other[len(other)-1] ^= 0xFF
+	s.Put("root", "other.bin", other)
+
+	//闪传校验不通过时返回结果不带分片上传地址
+	rejected := 0
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if gjson.GetBytes(data, "proof_code").Str != "" {
+			rejected++
+			w.Write([]byte(`{"rapid_upload":false}`))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		s.Default(w, r)
+	})
+
+	r := httptest.NewRequest("PUT", "/new.bin", bytes.NewReader(content))
+	fileId, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "new.bin")
+	if err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if rejected == 0 {
+		t.Fatal("rapid upload not attempted")
+	}
+	//重新计算的摘要相同时不再重试闪传
+	if rejected != 1 {
+		t.Errorf("rapid upload attempted %d times with the same hash, want once", rejected)
+	}
+	f, ok := s.File(fileId)
+	if !ok || !bytes.Equal(f.Content, content) {
+		t.Errorf("fallback upload stored %d bytes, want the uploaded content", len(f.Content))
+	}
+	if n := s.Calls("/v2/file/complete"); n != 1 {
+		t.Errorf("completed %d uploads, want one normal upload", n)
+	}
+}
+
+func TestContentHandleRapidUploadRehash(t *testing.T) {
+	s := newFake(t)
+	TempDir = t.TempDir()
+	content := binaryContent(200 * 1024)
+	s.Put("root", "original.bin", content)
+
+	//flip 改变中间文件的最后一个字节，模拟计算摘要时读取出错
+	flip := func() {
+		files, _ := filepath.Glob(filepath.Join(TempDir, "*"))
+		for _, name := range files {
+			if strings.HasSuffix(name, tempMetaSuffix) {
+				continue
+			}
+			f, err := os.OpenFile(name, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 1)
+			f.ReadAt(b, int64(len(content)-1))
+			b[0] ^= 0xFF
+			f.WriteAt(b, int64(len(content)-1))
+			f.Close()
+		}
+	}
+	var hashes []string
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		switch {
+		case gjson.GetBytes(data, "pre_hash").Str != "":
+			flip()
+		case len(hashes) == 0:
+			//第一次按读错的内容计算，闪传校验不通过
+			hashes = append(hashes, gjson.GetBytes(data, "content_hash").Str)
+			flip()
+			w.Write([]byte(`{"rapid_upload":false}`))
+			return
+		default:
+			hashes = append(hashes, gjson.GetBytes(data, "content_hash").Str)
+		}
+		s.Default(w, r)
+	})
+
+	r := httptest.NewRequest("PUT", "/copy.bin", bytes.NewReader(content))
+	fileId, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "copy.bin")
+	if err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if len(hashes) != 2 || hashes[0] == sha1Hex(content) || hashes[1] != sha1Hex(content) {
+		t.Errorf("submitted hashes %v, want a wrong one and then %s", hashes, sha1Hex(content))
+	}
+	if n := s.Calls("/v2/file/complete"); n != 0 {
+		t.Errorf("completed %d uploads, want the retried rapid upload", n)
+	}
+	if f, ok := s.File(fileId); !ok || !bytes.Equal(f.Content, content) {
+		t.Errorf("stored %d bytes, want the uploaded content", len(f.Content))
+	}
+}
+
+func TestNoRapidUploadExts(t *testing.T) {
+	defer SetNoRapidUploadExts("")
+	SetNoRapidUploadExts(" .GPG, kdbx ,")
+	for _, name := range []string{"a.gpg", "B.Gpg", "c.kdbx"} {
+		if rapidUploadAllowed(name) {
+			t.Errorf("rapidUploadAllowed(%q) = true, want false", name)
+		}
+	}
+	if !rapidUploadAllowed("d.zip") {
+		t.Error("rapidUploadAllowed(d.zip) = false, want true")
+	}
+
+	s := newFake(t)
+	TempDir = t.TempDir()
+	content := binaryContent(200 * 1024)
+	s.Put("root", "original.gpg", content)
+
+	//记录每次创建请求是否带了闪传的摘要
+	hashed := 0
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if gjson.GetBytes(data, "pre_hash").Str != "" || gjson.GetBytes(data, "proof_code").Str != "" {
+			hashed++
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		s.Default(w, r)
+	})
+
+	r := httptest.NewRequest("PUT", "/secret.gpg", bytes.NewReader(content))
+	fileId, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "secret.gpg")
+	if err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if hashed != 0 {
+		t.Errorf("sent a content digest %d times for a denylisted extension", hashed)
+	}
+	if n := s.Calls("/v2/file/complete"); n != 1 {
+		t.Errorf("completed %d uploads, want one normal upload", n)
+	}
+	if f, ok := s.File(fileId); !ok || !bytes.Equal(f.Content, content) {
+		t.Error("normal upload stored different content")
+	}
+
+	//不在列表中的扩展名照常闪传
+	r = httptest.NewRequest("PUT", "/copy.bin", bytes.NewReader(content))
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "copy.bin"); err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if hashed == 0 {
+		t.Error("rapid upload not attempted for an extension outside the list")
+	}
+}
+
+func TestReserveTempDisk(t *testing.T) {
+	defer func(limit int64, stream bool) { TempDiskLimit, StreamUpload = limit, stream }(TempDiskLimit, StreamUpload)
+	TempDiskLimit, StreamUpload = 100, false
+
+	release, err := ReserveTempDisk(60)
+	if err != nil {
+		t.Fatalf("first reservation: %v", err)
+	}
+	if _, err := ReserveTempDisk(60); err != ErrTempDiskFull {
+		t.Errorf("reservation beyond the limit = %v, want ErrTempDiskFull", err)
+	}
+	//大小未知时不限制
+	if _, err := ReserveTempDisk(-1); err != nil {
+		t.Errorf("reservation of an unknown size: %v", err)
+	}
+	release()
+	release, err = ReserveTempDisk(100)
+	if err != nil {
+		t.Fatalf("reservation after release: %v", err)
+	}
+	release()
+
+	//边接收边上传时不写中间文件
+	StreamUpload = true
+	if _, err := ReserveTempDisk(1000); err != nil {
+		t.Errorf("streamed upload reservation: %v", err)
+	}
+}
+
+func TestStreamUpload(t *testing.T) {
+	s := newFake(t)
+	TempDir = t.TempDir()
+	content := binaryContent(3000)[:3000]
+
+	//不做闪传；第1个分片上传到OSS后才写入剩下的请求内容
+	hashed := false
+	partOne := make(chan struct{})
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		hashed = gjson.GetBytes(data, "pre_hash").Exists() || gjson.GetBytes(data, "content_hash").Exists()
+		rec := httptest.NewRecorder()
+		s.Default(rec, r)
+		uploadId := gjson.GetBytes(rec.Body.Bytes(), "upload_id").Str
+		s.Handle("/oss/upload/"+uploadId+"/1", func(w http.ResponseWriter, r *http.Request) {
+			s.Default(w, r)
+			close(partOne)
+		})
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(content[:1024])
+		select {
+		case <-partOne:
+			pw.Write(content[1024:])
+			pw.Close()
+		case <-time.After(5 * time.Second):
+			pw.CloseWithError(errors.New("part 1 not uploaded before the rest of the body"))
+		}
+	}()
+
+	r := httptest.NewRequest("PUT", "/s.bin", pr)
+	r.ContentLength = int64(len(content))
+	fileId, _, err := streamUpload(r, "token", aliyuntest.DriveId, "root", "s.bin", r.ContentLength, 1024)
+	if err != nil {
+		t.Fatalf("streamUpload: %v", err)
+	}
+	if hashed {
+		t.Error("streamed upload sent content hashes")
+	}
+	if f, ok := s.File(fileId); !ok || !bytes.Equal(f.Content, content) {
+		t.Errorf("streamed upload stored %d bytes, want the uploaded content", len(f.Content))
+	}
+	if n := s.Calls("/v2/file/complete"); n != 1 {
+		t.Errorf("completed %d uploads, want one", n)
+	}
+	if files, _ := ioutil.ReadDir(TempDir); len(files) != 0 {
+		t.Errorf("streamed upload wrote %d intermediate files", len(files))
+	}
+
+	//请求内容不完整时不完成上传
+	s.Handle("/adrive/v2/file/createWithFolders", nil)
+	r = httptest.NewRequest("PUT", "/short.bin", bytes.NewReader(content[:2000]))
+	r.ContentLength = int64(len(content))
+	if _, _, err := streamUpload(r, "token", aliyuntest.DriveId, "root", "short.bin", r.ContentLength, 1024); err != ErrUploadFailed {
+		t.Errorf("streamUpload of a short body = %v, want ErrUploadFailed", err)
+	}
+	if n := s.Calls("/v2/file/complete"); n != 1 {
+		t.Errorf("completed %d uploads after a short body, want still one", n)
+	}
+}
+
+func TestContentHandleRenamed(t *testing.T) {
+	s := newFake(t)
+	TempDir = t.TempDir()
+	//模拟阿里云自动重命名：创建的文件名与请求的不同
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		body["name"] = "a(1).txt"
+		data, _ := json.Marshal(body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		rec := httptest.NewRecorder()
+		s.Default(rec, r)
+		var created map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &created)
+		created["file_name"] = "a(1).txt"
+		json.NewEncoder(w).Encode(created)
+	})
+
+	content := binaryContent(40)
+	r := httptest.NewRequest("PUT", "/a.txt", bytes.NewReader(content))
+	fileId, name, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "a.txt")
+	if err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if name != "a(1).txt" {
+		t.Errorf("name = %q, want the name Aliyun created", name)
+	}
+	if f, ok := s.Lookup("a(1).txt"); !ok || f.Id != fileId || !bytes.Equal(f.Content, content) {
+		t.Errorf("renamed file not stored with the uploaded content")
+	}
+
+	//没有返回文件名时沿用请求的名称
+	if got := actualName(context.Background(), "b.txt", ""); got != "b.txt" {
+		t.Errorf("actualName without a returned name = %q, want b.txt", got)
+	}
+}
+
+func TestKeepFailedUploads(t *testing.T) {
+	defer func(old bool) { KeepFailedUploads = old }(KeepFailedUploads)
+	KeepFailedUploads = true
+	s := newFake(t)
+	TempDir = t.TempDir()
+	content := binaryContent(40)
+
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	r := httptest.NewRequest("PUT", "/fail.bin", bytes.NewReader(content))
+	if fileId, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "fail.bin"); err == nil {
+		t.Fatalf("ContentHandle = %s, want an error", fileId)
+	}
+	kept, _ := filepath.Glob(filepath.Join(TempDir, "*"))
+	if len(kept) != 1 {
+		t.Fatalf("temp dir holds %v after a failed upload, want the intermediate file", kept)
+	}
+	if data, _ := ioutil.ReadFile(kept[0]); !bytes.Equal(data, content) {
+		t.Errorf("kept file holds %d bytes, want the uploaded content", len(data))
+	}
+
+	s.Handle("/adrive/v2/file/createWithFolders", nil)
+	TempDir = t.TempDir()
+	r = httptest.NewRequest("PUT", "/ok.bin", bytes.NewReader(content))
+	if _, _, err := ContentHandle(r, "token", aliyuntest.DriveId, "root", "ok.bin"); err != nil {
+		t.Fatalf("ContentHandle: %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(TempDir, "*")); len(left) != 0 {
+		t.Errorf("temp dir holds %v after a successful upload", left)
+	}
+}
+
+func TestTempFileName(t *testing.T) {
+	name := tempFileName("1", "root", "a.bin", 100)
+	if name != tempFileName("1", "root", "a.bin", 100) {
+		t.Error("temp file name differs for the same upload")
+	}
+	for _, other := range []string{
+		tempFileName("2", "root", "a.bin", 100),
+		tempFileName("1", "f1", "a.bin", 100),
+		tempFileName("1", "root", "b.bin", 100),
+		tempFileName("1", "root", "a.bin", 101),
+	} {
+		if other == name {
+			t.Errorf("temp file name %s shared by different uploads", name)
+		}
+	}
+	if !strings.HasPrefix(name, tempFilePrefix) {
+		t.Errorf("temp file name %s lacks the prefix %s", name, tempFilePrefix)
+	}
+}
+
+// writeOrphan writes a temp file left by a crash an hour ago, with its meta
+// file if meta is not nil.
+func writeOrphan(t *testing.T, name string, content []byte, meta *tempMeta) string {
+	t.Helper()
+	file := filepath.Join(TempDir, name)
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if meta != nil {
+		writeTempMeta(context.Background(), file, *meta)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(file, old, old)
+	return file
+}
+
+func TestCleanTempFiles(t *testing.T) {
+	newFake(t)
+	TempDir = t.TempDir()
+	orphan := writeOrphan(t, tempFileName("1", "root", "a.bin", 3), []byte("abc"), &tempMeta{DriveId: "1", ParentId: "root", Name: "a.bin", Size: 3})
+	recent := filepath.Join(TempDir, tempFileName("1", "root", "b.bin", 3))
+	ioutil.WriteFile(recent, []byte("abc"), 0600)
+	other := writeOrphan(t, "unrelated.txt", []byte("x"), nil)
+	staleMeta := filepath.Join(TempDir, tempFileName("1", "root", "gone.bin", 3)) + tempMetaSuffix
+	ioutil.WriteFile(staleMeta, []byte("{}"), 0600)
+
+	CleanTempFiles(context.Background(), "token", 10*time.Minute)
+
+	for _, f := range []string{orphan, orphan + tempMetaSuffix, staleMeta} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s not cleaned up", filepath.Base(f))
+		}
+	}
+	for _, f := range []string{recent, other} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("%s removed: %v", filepath.Base(f), err)
+		}
+	}
+}
+
+func TestCleanTempFilesSystemTempDir(t *testing.T) {
+	newFake(t)
+	sys := t.TempDir()
+	//配置的临时目录不可写时中间文件会落在系统临时目录
+	useTempDirs(t, sys, t.TempDir())
+	orphan := writeOrphan(t, tempFileName("1", "root", "a.bin", 3), []byte("abc"), nil)
+	useTempDirs(t, t.TempDir(), sys)
+
+	CleanTempFiles(context.Background(), "token", 10*time.Minute)
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan in the system temp dir not cleaned up: %v", err)
+	}
+}
+
+func TestCleanTempFilesResumes(t *testing.T) {
+	defer func(old bool) { ResumeUploads = old }(ResumeUploads)
+	ResumeUploads = true
+	s := newFake(t)
+	TempDir = t.TempDir()
+	content := binaryContent(40)
+	orphan := writeOrphan(t, tempFileName("1", "root", "a.bin", int64(len(content))), content,
+		&tempMeta{DriveId: aliyuntest.DriveId, ParentId: "root", Name: "a.bin", Size: int64(len(content))})
+	//没有接收完的上传无法续传，直接删除
+	partial := writeOrphan(t, tempFileName("1", "root", "b.bin", 100), content,
+		&tempMeta{DriveId: aliyuntest.DriveId, ParentId: "root", Name: "b.bin", Size: 100})
+
+	CleanTempFiles(context.Background(), "token", 10*time.Minute)
+
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial upload not removed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(orphan); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("complete orphan not resumed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f, ok := s.Lookup("a.bin"); !ok || !bytes.Equal(f.Content, content) {
+		t.Error("resumed upload not stored at its target")
+	}
+	if _, ok := s.Lookup("b.bin"); ok {
+		t.Error("partial upload stored")
+	}
+}
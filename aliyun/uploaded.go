@@ -0,0 +1,104 @@
+package aliyun
+
+import (
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"path"
+	"strings"
+	"time"
+)
+
+//上传完成后阿里云的文件列表可能还没有反映新文件的大小(闪传时尤其明显)，紧接着的Range请求会按旧的大小计算。
+//上传完成时记下已知的文件信息，写入目录列表缓存，并在一段时间内修正阿里云返回的列表中的同一文件，不需要再查询文件详情
+
+// uploadedTTL 上传的文件信息用来修正文件列表的时长
+const uploadedTTL = time.Minute
+
+func uploadedKey(driveId string, parentId string) string {
+	return "UPLOADED_" + driveId + "_" + parentId
+}
+
+// uploadedItem 上传完成的文件的列表项
+func uploadedItem(driveId string, parentId string, fileId string, name string, size int64, contentHash string) model.ListModel {
+	now := model.Time{Time: time.Now()}
+	return model.ListModel{
+		DriveId:       driveId,
+		FileId:        fileId,
+		Name:          name,
+		Type:          "file",
+		Status:        "available",
+		ParentFileId:  parentId,
+		FileExtension: strings.TrimPrefix(path.Ext(name), "."),
+		Size:          size,
+		ContentHash:   strings.ToUpper(contentHash),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+}
+
+// cacheUploaded 记下刚上传完成的文件，已缓存的目录列表中替换同名项，未缓存时下次获取列表时修正
+func cacheUploaded(parentId string, fi model.ListModel) {
+	items := []model.ListModel{fi}
+	if v, ok := cache.GoCache.Get(uploadedKey(fi.DriveId, parentId)); ok {
+		for _, item := range v.([]model.ListModel) {
+			if item.Name != fi.Name && item.FileId != fi.FileId {
+				items = append(items, item)
+			}
+		}
+	}
+	cache.GoCache.Set(uploadedKey(fi.DriveId, parentId), items, uploadedTTL)
+
+	v, ok := cache.GoCache.Get(cache.ListKey(fi.DriveId, parentId))
+	if !ok {
+		return
+	}
+	list, ok := v.(model.FileListModel)
+	if !ok {
+		cache.GoCache.Delete(cache.ListKey(fi.DriveId, parentId))
+		return
+	}
+	patched := make([]model.ListModel, 0, len(list.Items)+1)
+	patched = append(patched, fi)
+	for _, item := range list.Items {
+		if item.Name != fi.Name && item.FileId != fi.FileId {
+			patched = append(patched, item)
+		}
+	}
+	list.Items = patched
+	cache.SetDefault(cache.ListKey(fi.DriveId, parentId), list)
+}
+
+// withUploaded 用刚上传完成的文件信息修正阿里云返回的列表中的同一文件。
+// 只修正列表中已有的文件，上传后被删除的文件不会重新出现
+func withUploaded(driveId string, parentId string, list model.FileListModel) model.FileListModel {
+	v, ok := cache.GoCache.Get(uploadedKey(driveId, parentId))
+	if !ok {
+		return list
+	}
+	uploaded := v.([]model.ListModel)
+	for i, item := range list.Items {
+		list.Items[i] = patchUploaded(item, uploaded)
+	}
+	return list
+}
+
+// withUploadedDetail 用刚上传完成的文件信息修正阿里云返回的文件详情
+func withUploadedDetail(driveId string, item model.ListModel) model.ListModel {
+	v, ok := cache.GoCache.Get(uploadedKey(driveId, item.ParentFileId))
+	if !ok {
+		return item
+	}
+	return patchUploaded(item, v.([]model.ListModel))
+}
+
+func patchUploaded(item model.ListModel, uploaded []model.ListModel) model.ListModel {
+	for _, fi := range uploaded {
+		if item.FileId == fi.FileId && item.UpdatedAt.Before(fi.UpdatedAt.Time) {
+			item.Size = fi.Size
+			if fi.ContentHash != "" {
+				item.ContentHash = fi.ContentHash
+			}
+		}
+	}
+	return item
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/net"
+	"net/http"
+	"os"
+)
+
+// JSON接口返回的错误码，供客户端程序判断错误类型，发布后不再修改
+const (
+	codeBadRequest       = "bad_request"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeAuthFailed       = "auth_failed"
+	codeAuthUnavailable  = "auth_unavailable"
+	codePermissionDenied = "permission_denied"
+	codeNotFound         = "not_found"
+	codeConflict         = "conflict"
+	codeQuotaExceeded    = "quota_exceeded"
+	codeRiskControl      = "risk_control"
+	codeUpstreamError    = "upstream_error"
+)
+
+type apiErrorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// apiError 以{"error":{"code":"...","message":"..."}}的格式返回JSON接口的错误
+func apiError(w http.ResponseWriter, status int, code string, message string) {
+	var body apiErrorBody
+	body.Error.Code = code
+	body.Error.Message = message
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// apiErrorFrom 根据阿里云接口返回的错误确定状态码和错误码，无法识别的错误按上游错误处理
+func apiErrorFrom(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, net.ErrRiskControl):
+		w.Header().Set("Retry-After", "300")
+		apiError(w, http.StatusServiceUnavailable, codeRiskControl, net.ErrRiskControl.Error())
+	case errors.Is(err, net.ErrPermissionDenied):
+		apiError(w, http.StatusForbidden, codePermissionDenied, err.Error())
+	case errors.Is(err, aliyun.ErrTempDiskFull):
+		apiError(w, http.StatusInsufficientStorage, codeQuotaExceeded, err.Error())
+	case errors.Is(err, os.ErrNotExist):
+		apiError(w, http.StatusNotFound, codeNotFound, err.Error())
+	default:
+		apiError(w, http.StatusBadGateway, codeUpstreamError, err.Error())
+	}
+}
+
+// methodNotAllowed 返回405及允许的方法
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	apiError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+}
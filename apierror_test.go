@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// decodeAPIError 解析JSON接口返回的错误
+func decodeAPIError(t *testing.T, w *httptest.ResponseRecorder) apiErrorBody {
+	t.Helper()
+	var body apiErrorBody
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q, want JSON", ct)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q: %v", w.Body, err)
+	}
+	if body.Error.Message == "" {
+		t.Errorf("error %s without a message", body.Error.Code)
+	}
+	return body
+}
+
+func TestAPIErrorFrom(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("walk: %w", os.ErrNotExist), http.StatusNotFound, codeNotFound},
+		{fmt.Errorf("list: %w", net.ErrPermissionDenied), http.StatusForbidden, codePermissionDenied},
+		{fmt.Errorf("upload: %w", aliyun.ErrTempDiskFull), http.StatusInsufficientStorage, codeQuotaExceeded},
+		{net.ErrRiskControl, http.StatusServiceUnavailable, codeRiskControl},
+		{errors.New("connection reset"), http.StatusBadGateway, codeUpstreamError},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		apiErrorFrom(w, c.err)
+		if w.Code != c.status {
+			t.Errorf("%v: status = %d, want %d", c.err, w.Code, c.status)
+		}
+		if body := decodeAPIError(t, w); body.Error.Code != c.code {
+			t.Errorf("%v: code = %q, want %q", c.err, body.Error.Code, c.code)
+		}
+	}
+}
+
+func TestAPIErrorEnvelope(t *testing.T) {
+	h, _, s := newTestServer(t, nil)
+	s.Put("root", "a.txt", []byte("a"))
+	s.Put("root", "b.txt", []byte("b"))
+
+	form := func(values url.Values) *strings.Reader { return strings.NewReader(values.Encode()) }
+	cases := []struct {
+		name   string
+		w      *httptest.ResponseRecorder
+		status int
+		code   string
+	}{
+		{"without credentials", func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/admin/drives", nil))
+			return w
+		}(), http.StatusUnauthorized, codeAuthFailed},
+		{"wrong method", call(h, "DELETE", "/api/rename", nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{"missing name", call(h, "POST", "/api/rename", form(url.Values{"path": {"a.txt"}})), http.StatusBadRequest, codeBadRequest},
+		{"missing file", call(h, "POST", "/api/rename", form(url.Values{"path": {"missing.txt"}, "new_name": {"c.txt"}})), http.StatusNotFound, codeNotFound},
+		{"existing name", call(h, "POST", "/api/rename", form(url.Values{"path": {"a.txt"}, "new_name": {"b.txt"}})), http.StatusConflict, codeConflict},
+		{"unknown drive", call(h, "POST", "/admin/drive", form(url.Values{"drive_id": {"404"}})), http.StatusNotFound, codeNotFound},
+	}
+	for _, c := range cases {
+		if c.w.Code != c.status {
+			t.Errorf("%s: status = %d, want %d", c.name, c.w.Code, c.status)
+			continue
+		}
+		if body := decodeAPIError(t, c.w); body.Error.Code != c.code {
+			t.Errorf("%s: code = %q, want %q", c.name, body.Error.Code, c.code)
+		}
+	}
+
+	//阿里云接口出错
+	s.Handle("/v2/drive/list_my_drives", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	w := call(h, "GET", "/admin/drives", nil)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("drives with a failing upstream = %d, want 502", w.Code)
+	}
+	if body := decodeAPIError(t, w); body.Error.Code != codeUpstreamError {
+		t.Errorf("code = %q, want %q", body.Error.Code, codeUpstreamError)
+	}
+
+	//风控只影响命中风控的请求，其他错误的错误码不变
+	s.Handle("/v2/drive/list_my_drives", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":"NeedCaptcha","message":"need captcha"}`))
+	})
+	w = call(h, "GET", "/admin/drives", nil)
+	if body := decodeAPIError(t, w); w.Code != http.StatusServiceUnavailable || body.Error.Code != codeRiskControl {
+		t.Errorf("drives under risk control = %d %q, want 503 %q", w.Code, body.Error.Code, codeRiskControl)
+	}
+	if net.RiskControlled() == nil {
+		t.Fatal("risk control not recorded")
+	}
+	w = httptest.NewRecorder()
+	apiErrorFrom(w, fmt.Errorf("walk: %w", os.ErrNotExist))
+	if body := decodeAPIError(t, w); w.Code != http.StatusNotFound || body.Error.Code != codeNotFound {
+		t.Errorf("missing file under risk control = %d %q, want 404 %q", w.Code, body.Error.Code, codeNotFound)
+	}
+}
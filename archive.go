@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"go-aliyun-webdav/webdav"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// archiveWriter 将文件依次写入压缩包，zip和tar共用同一套遍历逻辑
+type archiveWriter interface {
+	// create 新建一个条目，返回的Writer写入该条目的内容
+	create(name string, item model.ListModel) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (a zipArchive) create(name string, item model.ListModel) (io.Writer, error) {
+	header := &zip.FileHeader{Name: name, Method: zip.Store, Modified: item.UpdatedAt.Time}
+	if item.Type == "folder" {
+		header.Name += "/"
+	}
+	return a.CreateHeader(header)
+}
+
+type tarArchive struct{ *tar.Writer }
+
+func (a tarArchive) create(name string, item model.ListModel) (io.Writer, error) {
+	header := &tar.Header{Name: name, Mode: 0644, Size: item.Size, ModTime: item.UpdatedAt.Time, Typeflag: tar.TypeReg}
+	if item.Type == "folder" {
+		header.Name += "/"
+		header.Mode = 0755
+		header.Size = 0
+		header.Typeflag = tar.TypeDir
+	}
+	return a, a.WriteHeader(header)
+}
+
+// downloadFolder GET /api/download-folder?path=&format=zip|tar，边下载边打包整个文件夹，不在服务器上缓存
+func downloadFolder(fs *webdav.Handler, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar" {
+		apiError(w, http.StatusBadRequest, codeBadRequest, "format must be zip or tar")
+		return
+	}
+	folderPath := strings.Trim(req.URL.Query().Get("path"), "/")
+	var paths []string
+	if folderPath != "" {
+		paths = strings.Split(folderPath, "/")
+	}
+	item, _, err := aliyun.Walk(req.Context(), fs.CurrentConfig().Token, fs.CurrentConfig().DriveId, paths, "")
+	if err != nil || (len(paths) > 0 && item.Name != paths[len(paths)-1]) {
+		apiError(w, http.StatusNotFound, codeNotFound, "folder not found: "+folderPath)
+		return
+	}
+	if item.FileId == "" {
+		item.FileId = aliyun.RootFileId()
+	} else if item.Type != "folder" {
+		apiError(w, http.StatusBadRequest, codeBadRequest, "not a folder: "+folderPath)
+		return
+	}
+
+	name := path.Base("/" + folderPath)
+	if name == "/" {
+		name = "root"
+	}
+	var archive archiveWriter
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		archive = zipArchive{zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		archive = tarArchive{tar.NewWriter(w)}
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(name+"."+format))
+
+	net.Logln(req.Context(), "📦  打包下载", folderPath, format)
+	if err := addFolder(fs, req, archive, item.FileId, ""); err != nil {
+		//响应已经开始发送，无法再返回错误状态码，中断连接让客户端知道压缩包不完整
+		net.Logln(req.Context(), "❌  打包下载失败", folderPath, err)
+		panic(http.ErrAbortHandler)
+	}
+	archive.Close()
+}
+
+// addFolder 递归地将文件夹fileId中的内容以prefix为相对路径写入压缩包
+func addFolder(fs *webdav.Handler, req *http.Request, archive archiveWriter, fileId string, prefix string) error {
+	list, err := aliyun.GetList(req.Context(), fs.CurrentConfig().Token, fs.CurrentConfig().DriveId, fileId)
+	if err != nil {
+		return err
+	}
+	for _, item := range list.Items {
+		if err := req.Context().Err(); err != nil {
+			return err
+		}
+		name := prefix + item.Name
+		entry, err := archive.create(name, item)
+		if err != nil {
+			return err
+		}
+		if item.Type == "folder" {
+			if err := addFolder(fs, req, archive, item.FileId, name+"/"); err != nil {
+				return err
+			}
+			continue
+		}
+		if item.Size == 0 {
+			continue
+		}
+		downloadUrl := aliyun.GetDownloadUrl(req.Context(), fs.CurrentConfig().Token, fs.CurrentConfig().DriveId, item.FileId)
+		if !aliyun.GetFile(req.Context(), entry, downloadUrl, fs.CurrentConfig().Token, fs.CurrentConfig().DriveId, item.FileId, "", "") {
+			return errors.New("download failed: " + name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+// folderTree 在假网盘中建立测试用的文件夹，返回打包后应有的条目及内容，文件夹以/结尾
+func folderTree(s *aliyuntest.Server) map[string]string {
+	docs := s.Mkdir("root", "docs")
+	sub := s.Mkdir(docs, "sub")
+	s.Mkdir(sub, "deeper")
+	s.Put(docs, "a.txt", []byte("file a"))
+	s.Put(docs, "empty.txt", nil)
+	s.Put(sub, "b.txt", []byte("file b in sub"))
+	s.Put("root", "outside.txt", []byte("not in docs"))
+	return map[string]string{
+		"a.txt":       "file a",
+		"empty.txt":   "",
+		"sub/":        "",
+		"sub/b.txt":   "file b in sub",
+		"sub/deeper/": "",
+	}
+}
+
+func readZip(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("not a zip archive: %v", err)
+	}
+	entries := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		entries[f.Name] = string(content)
+	}
+	return entries
+}
+
+func readTar(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	tr := tar.NewReader(bytes.NewReader(data))
+	entries := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("not a tar archive: %v", err)
+		}
+		if header.Typeflag == tar.TypeDir && header.Name[len(header.Name)-1] != '/' {
+			t.Errorf("folder %s without a trailing slash", header.Name)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		entries[header.Name] = string(content)
+	}
+}
+
+func sameEntries(t *testing.T, format string, got, want map[string]string) {
+	t.Helper()
+	var names []string
+	for name := range got {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(got) != len(want) {
+		t.Errorf("%s entries %v, want %d entries", format, names, len(want))
+	}
+	for name, content := range want {
+		if c, ok := got[name]; !ok || c != content {
+			t.Errorf("%s entry %s = %q (present %v), want %q", format, name, c, ok, content)
+		}
+	}
+}
+
+func TestDownloadFolder(t *testing.T) {
+	h, _, s := newTestServer(t, nil)
+	want := folderTree(s)
+
+	w := call(h, "GET", "/api/download-folder?path=/docs", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("zip download = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != "attachment; filename*=UTF-8''docs.zip" {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	sameEntries(t, "zip", readZip(t, w.Body.Bytes()), want)
+
+	w = call(h, "GET", "/api/download-folder?path=docs/&format=tar", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("tar download = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	sameEntries(t, "tar", readTar(t, w.Body.Bytes()), want)
+
+	//不带path时打包整个网盘
+	w = call(h, "GET", "/api/download-folder", nil)
+	entries := readZip(t, w.Body.Bytes())
+	if entries["docs/sub/b.txt"] != "file b in sub" || entries["outside.txt"] != "not in docs" {
+		t.Errorf("root archive entries %v", entries)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != "attachment; filename*=UTF-8''root.zip" {
+		t.Errorf("root Content-Disposition = %q", cd)
+	}
+}
+
+func TestDownloadFolderErrors(t *testing.T) {
+	h, _, s := newTestServer(t, nil)
+	folderTree(s)
+	for target, want := range map[string]int{
+		"/api/download-folder?path=docs&format=rar": http.StatusBadRequest,
+		"/api/download-folder?path=missing":         http.StatusNotFound,
+		"/api/download-folder?path=docs/a.txt":      http.StatusBadRequest,
+	} {
+		if w := call(h, "GET", target, nil); w.Code != want {
+			t.Errorf("GET %s = %d, want %d", target, w.Code, want)
+		}
+	}
+	if w := call(h, "POST", "/api/download-folder?path=docs", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want 405", w.Code)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/api/download-folder?path=docs", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous download = %d, want 401", w.Code)
+	}
+}
+
+func TestDownloadFolderAborts(t *testing.T) {
+	h, _, s := newTestServer(t, nil)
+	folderTree(s)
+	b, _ := s.Lookup("docs/sub/b.txt")
+	s.Handle("/oss/download/"+b.Id, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusInternalServerError)
+	})
+
+	//响应已经开始发送，下载失败时中断连接，客户端得不到完整的压缩包
+	server := httptest.NewServer(h)
+	defer server.Close()
+	r, _ := http.NewRequest("GET", server.URL+"/api/download-folder?path=docs", nil)
+	r.SetBasicAuth("admin", "secret")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		if _, zerr := zip.NewReader(bytes.NewReader(data), int64(len(data))); zerr == nil {
+			t.Error("failed download produced a complete archive")
+		}
+	}
+}
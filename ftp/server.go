@@ -0,0 +1,516 @@
+package ftp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	anet "go-aliyun-webdav/aliyun/net"
+	"go-aliyun-webdav/webdav"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server 以FTP协议对外提供网盘服务，与WebDav共用同一个Handler，
+// 因此token、刷新、只读模式等都与WebDav保持一致。只支持被动模式(PASV/EPSV)
+type Server struct {
+	Addr    string
+	Handler *webdav.Handler
+	Auth    webdav.Authenticator
+}
+
+// ListenAndServe 监听Addr并为每个控制连接启动一个会话
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+type session struct {
+	s          *Server
+	conn       net.Conn
+	r          *bufio.Reader
+	user       string
+	authed     bool
+	cwd        string
+	pasv       net.Listener
+	renameFrom string
+	restOffset int64
+	//当前命令的context，带有该命令的请求ID，控制连接关闭时取消
+	ctx context.Context
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	connCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ss := &session{s: s, conn: conn, r: bufio.NewReader(conn), cwd: "/", ctx: connCtx}
+	defer ss.closePasv()
+	ss.reply(220, "go-aliyun-webdav FTP ready")
+	for {
+		line, err := ss.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		cmd = strings.ToUpper(cmd)
+		if cmd == "QUIT" {
+			ss.reply(221, "Bye")
+			return
+		}
+		ss.ctx = anet.WithRequestID(connCtx, anet.NewRequestID())
+		ss.handle(cmd, arg)
+	}
+}
+
+func (ss *session) reply(code int, msg string) {
+	fmt.Fprintf(ss.conn, "%d %s\r\n", code, msg)
+}
+
+func (ss *session) config() model.Config {
+	return ss.s.Handler.CurrentConfig()
+}
+
+func (ss *session) handle(cmd string, arg string) {
+	switch cmd {
+	case "USER":
+		ss.user, ss.authed = arg, false
+		ss.reply(331, "Password required")
+		return
+	case "PASS":
+		ok, err := ss.s.Auth.Authenticate(ss.user, arg)
+		if err != nil {
+			anet.Logln(ss.ctx, "❌  鉴权失败", err)
+			ss.reply(421, "Authentication unavailable")
+			return
+		}
+		if !ok {
+			ss.reply(530, "Login incorrect")
+			return
+		}
+		ss.authed = true
+		ss.reply(230, "Login successful")
+		return
+	case "SYST":
+		ss.reply(215, "UNIX Type: L8")
+		return
+	case "FEAT":
+		fmt.Fprint(ss.conn, "211-Features:\r\n EPSV\r\n PASV\r\n SIZE\r\n MDTM\r\n REST STREAM\r\n UTF8\r\n211 End\r\n")
+		return
+	case "OPTS":
+		ss.reply(200, "OK")
+		return
+	case "NOOP":
+		ss.reply(200, "OK")
+		return
+	}
+	if !ss.authed {
+		ss.reply(530, "Please login with USER and PASS")
+		return
+	}
+	if ss.s.Handler.ReadOnly {
+		switch cmd {
+		case "STOR", "DELE", "RMD", "XRMD", "MKD", "XMKD", "RNFR", "RNTO":
+			ss.reply(550, "Read-only server")
+			return
+		}
+	}
+	switch cmd {
+	case "PWD", "XPWD":
+		ss.reply(257, strconv.Quote(ss.cwd))
+	case "CWD", "XCWD":
+		ss.changeDir(arg)
+	case "CDUP", "XCUP":
+		ss.changeDir("..")
+	case "TYPE":
+		ss.reply(200, "Type set")
+	case "MODE", "STRU":
+		ss.reply(200, "OK")
+	case "PASV":
+		ss.passive(false)
+	case "EPSV":
+		ss.passive(true)
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || offset < 0 {
+			ss.reply(501, "Invalid offset")
+			return
+		}
+		ss.restOffset = offset
+		ss.reply(350, "Restarting at "+arg)
+	case "LIST", "NLST":
+		ss.list(cmd == "NLST", arg)
+	case "SIZE":
+		item, err := ss.stat(arg)
+		if err != nil || isDir(item) {
+			ss.reply(550, "No such file")
+			return
+		}
+		ss.reply(213, strconv.FormatInt(item.Size, 10))
+	case "MDTM":
+		item, err := ss.stat(arg)
+		if err != nil || isDir(item) {
+			ss.reply(550, "No such file")
+			return
+		}
+		ss.reply(213, item.UpdatedAt.UTC().Format("20060102150405"))
+	case "RETR":
+		ss.retr(arg)
+	case "STOR":
+		ss.stor(arg)
+	case "DELE", "RMD", "XRMD":
+		item, err := ss.stat(arg)
+		if err != nil || item.FileId == "" {
+			ss.reply(550, "No such file or directory")
+			return
+		}
+		if err := aliyun.RemoveTrash(ss.ctx, ss.config().Token, ss.config().DriveId, item.FileId, item.ParentFileId); err != nil {
+			if errors.Is(err, anet.ErrPermissionDenied) {
+				ss.reply(550, "Permission denied")
+			} else {
+				ss.reply(450, "Delete failed")
+			}
+			return
+		}
+		ss.forgetPath(ss.abs(arg))
+		ss.reply(250, "Deleted")
+	case "MKD", "XMKD":
+		ss.mkd(arg)
+	case "RNFR":
+		if _, err := ss.stat(arg); err != nil {
+			ss.reply(550, "No such file or directory")
+			return
+		}
+		ss.renameFrom = ss.abs(arg)
+		ss.reply(350, "Ready for RNTO")
+	case "RNTO":
+		ss.rnto(arg)
+	default:
+		ss.reply(502, "Command not implemented")
+	}
+}
+
+// abs 将FTP客户端传入的路径转换为以/开头的绝对路径
+func (ss *session) abs(p string) string {
+	if strings.HasPrefix(p, "/") {
+		return path.Clean(p)
+	}
+	return path.Join(ss.cwd, p)
+}
+
+// stat 查找路径对应的文件，根目录返回FileId为空的项目
+func (ss *session) stat(p string) (model.ListModel, error) {
+	item, _, err := ss.walk(ss.abs(p))
+	return item, err
+}
+
+func (ss *session) walk(p string) (model.ListModel, model.FileListModel, error) {
+	config := ss.config()
+	p = strings.Trim(p, "/")
+	var paths []string
+	if p != "" {
+		paths = strings.Split(p, "/")
+	}
+	item, list, err := aliyun.Walk(ss.ctx, config.Token, config.DriveId, paths, "")
+	if err != nil {
+		return item, list, err
+	}
+	if len(paths) > 0 && item.Name != paths[len(paths)-1] {
+		return item, list, errors.New("not found")
+	}
+	return item, list, nil
+}
+
+func isDir(item model.ListModel) bool {
+	return item.FileId == "" || item.Type == "folder"
+}
+
+func (ss *session) changeDir(p string) {
+	target := ss.abs(p)
+	item, err := ss.stat(target)
+	if err != nil || !isDir(item) {
+		ss.reply(550, "No such directory")
+		return
+	}
+	ss.cwd = target
+	ss.reply(250, "Directory changed to "+target)
+}
+
+func (ss *session) mkd(p string) {
+	target := ss.abs(p)
+	parent, err := ss.stat(path.Dir(target))
+	if err != nil || !isDir(parent) {
+		ss.reply(550, "No such directory")
+		return
+	}
+	config := ss.config()
+	fi := aliyun.MakeDir(ss.ctx, config.Token, config.DriveId, path.Base(target), parentId(parent))
+	if fi.FileId == "" {
+		ss.reply(550, "Create directory failed")
+		return
+	}
+	ss.reply(257, strconv.Quote(target)+" created")
+}
+
+func (ss *session) rnto(p string) {
+	from := ss.renameFrom
+	ss.renameFrom = ""
+	if from == "" {
+		ss.reply(503, "RNFR required first")
+		return
+	}
+	to := ss.abs(p)
+	item, err := ss.stat(from)
+	if err != nil || item.FileId == "" {
+		ss.reply(550, "No such file or directory")
+		return
+	}
+	config := ss.config()
+	if path.Dir(from) != path.Dir(to) {
+		parent, err := ss.stat(path.Dir(to))
+		if err != nil || !isDir(parent) {
+			ss.reply(550, "No such directory")
+			return
+		}
+		if !aliyun.BatchFile(ss.ctx, config.Token, config.DriveId, item.FileId, parentId(parent)) {
+			ss.reply(550, "Move failed")
+			return
+		}
+		ss.forgetPath(from)
+	}
+	//目标目录中已有同名项等情况下重命名失败
+	if path.Base(from) != path.Base(to) && !aliyun.ReName(ss.ctx, config.Token, config.DriveId, path.Base(to), item.FileId) {
+		ss.reply(550, "Rename failed")
+		return
+	}
+	ss.forgetPath(from)
+	ss.forgetPath(to)
+	cache.GoCache.Set(cache.FileIdKey(config.DriveId, strings.Trim(to, "/")), item.FileId, -1)
+	ss.reply(250, "Rename successful")
+}
+
+// forgetPath 删除WebDav为p及其下级路径缓存的FileId，p被删除、改名或替换后这些缓存不再有效
+func (ss *session) forgetPath(p string) {
+	key := strings.Trim(p, "/")
+	cache.GoCache.Delete(cache.FileIdKey(ss.config().DriveId, key))
+	cache.GoCache.DeletePrefix(cache.FileIdKey(ss.config().DriveId, key+"/"))
+}
+
+func parentId(item model.ListModel) string {
+	if item.FileId == "" {
+		return aliyun.RootFileId()
+	}
+	return item.FileId
+}
+
+// passive 开启一个数据端口等待客户端连接
+func (ss *session) passive(extended bool) {
+	ss.closePasv()
+	host, _, _ := net.SplitHostPort(ss.conn.LocalAddr().String())
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		ss.reply(425, "Can't open data connection")
+		return
+	}
+	ss.pasv = ln
+	port := ln.Addr().(*net.TCPAddr).Port
+	if extended {
+		ss.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		ss.closePasv()
+		ss.reply(425, "Use EPSV for IPv6")
+		return
+	}
+	ss.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+func (ss *session) closePasv() {
+	if ss.pasv != nil {
+		ss.pasv.Close()
+		ss.pasv = nil
+	}
+}
+
+// dataConn 等待客户端连接PASV/EPSV打开的数据端口
+func (ss *session) dataConn() (net.Conn, error) {
+	if ss.pasv == nil {
+		return nil, errors.New("no passive listener")
+	}
+	ln := ss.pasv
+	defer ss.closePasv()
+	if tl, ok := ln.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+	client := remoteIP(ss.conn)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		//只接受与控制连接来自同一地址的数据连接，其他主机不能抢先连上数据端口读取或写入文件
+		if ip := remoteIP(conn); ip != nil && ip.Equal(client) {
+			return conn, nil
+		}
+		anet.Logln(ss.ctx, "⚠️  拒绝来自其他地址的数据连接", conn.RemoteAddr(), "控制连接来自", ss.conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// remoteIP 返回连接对方的IP地址
+func remoteIP(conn net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (ss *session) list(namesOnly bool, arg string) {
+	//忽略ls风格的参数，如-la
+	if strings.HasPrefix(arg, "-") {
+		arg = ""
+	}
+	item, list, err := ss.walk(ss.abs(arg))
+	if err != nil {
+		ss.reply(550, "No such file or directory")
+		return
+	}
+	items := list.Items
+	if !isDir(item) {
+		items = []model.ListModel{item}
+	}
+	conn, err := ss.dataConn()
+	if err != nil {
+		ss.reply(425, "Can't open data connection")
+		return
+	}
+	ss.reply(150, "Here comes the directory listing")
+	w := bufio.NewWriter(conn)
+	for _, v := range items {
+		if namesOnly {
+			fmt.Fprintf(w, "%s\r\n", v.Name)
+			continue
+		}
+		mode := "-rw-r--r--"
+		if v.Type == "folder" {
+			mode = "drwxr-xr-x"
+		}
+		fmt.Fprintf(w, "%s 1 owner group %d %s %s\r\n", mode, v.Size, listTime(v.UpdatedAt.Time), v.Name)
+	}
+	w.Flush()
+	conn.Close()
+	ss.reply(226, "Directory send OK")
+}
+
+// listTime 按ls -l的格式输出时间，半年以内的显示时分，否则显示年份
+func listTime(t time.Time) string {
+	if time.Since(t) > 180*24*time.Hour {
+		return t.Format("Jan _2  2006")
+	}
+	return t.Format("Jan _2 15:04")
+}
+
+func (ss *session) retr(p string) {
+	offset := ss.restOffset
+	ss.restOffset = 0
+	item, err := ss.stat(p)
+	if err != nil || isDir(item) {
+		ss.reply(550, "No such file")
+		return
+	}
+	conn, err := ss.dataConn()
+	if err != nil {
+		ss.reply(425, "Can't open data connection")
+		return
+	}
+	defer conn.Close()
+	ss.reply(150, "Opening data connection")
+	if item.Size == 0 {
+		conn.Close()
+		ss.reply(226, "Transfer complete")
+		return
+	}
+	config := ss.config()
+	downloadUrl := aliyun.GetDownloadUrl(ss.ctx, config.Token, config.DriveId, item.FileId)
+	rangeStr := ""
+	if offset > 0 {
+		rangeStr = "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	}
+	if !aliyun.GetFile(ss.ctx, conn, downloadUrl, config.Token, config.DriveId, item.FileId, rangeStr, "") {
+		ss.reply(451, "Download failed")
+		return
+	}
+	conn.Close()
+	ss.reply(226, "Transfer complete")
+}
+
+func (ss *session) stor(p string) {
+	ss.restOffset = 0
+	target := ss.abs(p)
+	parent, err := ss.stat(path.Dir(target))
+	if err != nil || !isDir(parent) {
+		ss.reply(550, "No such directory")
+		return
+	}
+	config := ss.config()
+	//上传以overwrite方式创建文件，已存在的同名文件在上传完成时才被替换，上传失败时保持不变
+	if item, err := ss.stat(target); err == nil && item.FileId != "" && isDir(item) {
+		ss.reply(550, "Is a directory")
+		return
+	}
+	conn, err := ss.dataConn()
+	if err != nil {
+		ss.reply(425, "Can't open data connection")
+		return
+	}
+	defer conn.Close()
+	ss.reply(150, "Ok to send data")
+	//复用WebDav的上传流程，长度未知时按分块上传处理
+	req, err := http.NewRequestWithContext(ss.ctx, http.MethodPut, target, io.NopCloser(conn))
+	if err != nil {
+		ss.reply(451, "Upload failed")
+		return
+	}
+	req.ContentLength = -1
+	fileId, name, err := aliyun.ContentHandle(req, config.Token, config.DriveId, parentId(parent), path.Base(target))
+	if errors.Is(err, anet.ErrPermissionDenied) {
+		ss.reply(550, "Permission denied")
+		return
+	}
+	if fileId == "" {
+		ss.reply(451, "Upload failed")
+		return
+	}
+	stored := path.Join(path.Dir(target), name)
+	ss.forgetPath(stored)
+	cache.GoCache.Set(cache.FileIdKey(config.DriveId, strings.Trim(stored, "/")), fileId, -1)
+	if name != path.Base(target) {
+		ss.reply(226, "Transfer complete, stored as "+name)
+		return
+	}
+	ss.reply(226, "Transfer complete")
+}
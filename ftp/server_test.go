@@ -0,0 +1,411 @@
+package ftp
+
+import (
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/webdav"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client 测试用的FTP客户端，只使用EPSV被动模式
+type client struct {
+	t    *testing.T
+	conn *textproto.Conn
+	host string
+}
+
+// startServer 启动一个使用假阿里云接口的FTP服务并建立控制连接，账户为admin/secret，
+// setup不为nil时在启动前修改服务配置
+func startServer(t *testing.T, setup func(*Server)) (*aliyuntest.Server, *client) {
+	t.Helper()
+	cache.GoCache = cache.New(cache.DefaultExpiration, 0)
+	tempDir := aliyun.TempDir
+	t.Cleanup(func() { aliyun.TempDir = tempDir })
+	aliyun.TempDir = t.TempDir()
+	s := aliyuntest.New()
+	t.Cleanup(s.Close)
+	aliyun.SetRoot("root", "/")
+
+	server := &Server{
+		Handler: &webdav.Handler{
+			Prefix:     "/",
+			LockSystem: webdav.NewMemLS(),
+			Config: model.Config{
+				RefreshToken: "refresh",
+				Token:        "token",
+				DriveId:      aliyuntest.DriveId,
+				ExpireTime:   time.Now().Add(time.Hour).Unix(),
+			},
+		},
+		Auth: webdav.StaticAuth{User: "admin", Password: "secret"},
+	}
+	if setup != nil {
+		setup(server)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	conn, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &client{t: t, conn: conn, host: "127.0.0.1"}
+	c.expect(220)
+	return s, c
+}
+
+// cmd 发送一条命令并返回应答的状态码和内容
+func (c *client) cmd(format string, args ...interface{}) (int, string) {
+	c.t.Helper()
+	if _, err := c.conn.Cmd(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	code, msg, err := c.conn.ReadResponse(0)
+	if err != nil && code == 0 {
+		c.t.Fatal(err)
+	}
+	return code, msg
+}
+
+func (c *client) expect(code int) string {
+	c.t.Helper()
+	got, msg, err := c.conn.ReadResponse(0)
+	if err != nil && got == 0 {
+		c.t.Fatal(err)
+	}
+	if got != code {
+		c.t.Fatalf("reply %d %s, want %d", got, msg, code)
+	}
+	return msg
+}
+
+func (c *client) login() {
+	c.t.Helper()
+	c.cmd("USER admin")
+	if code, msg := c.cmd("PASS secret"); code != 230 {
+		c.t.Fatalf("PASS = %d %s, want 230", code, msg)
+	}
+}
+
+var epsvPort = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+
+// data 打开数据连接后发送命令，返回数据连接和命令的应答
+func (c *client) data(format string, args ...interface{}) (net.Conn, int, string) {
+	c.t.Helper()
+	code, msg := c.cmd("EPSV")
+	if code != 229 {
+		c.t.Fatalf("EPSV = %d %s", code, msg)
+	}
+	port, _ := strconv.Atoi(epsvPort.FindStringSubmatch(msg)[1])
+	conn, err := net.Dial("tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	code, msg = c.cmd(format, args...)
+	return conn, code, msg
+}
+
+// read 读取数据连接的全部内容，并等待传输完成的应答
+func (c *client) read(format string, args ...interface{}) string {
+	c.t.Helper()
+	conn, code, msg := c.data(format, args...)
+	defer conn.Close()
+	if code != 150 {
+		c.t.Fatalf("%s = %d %s, want 150", format, code, msg)
+	}
+	body, _ := ioutil.ReadAll(conn)
+	c.expect(226)
+	return string(body)
+}
+
+// write 通过数据连接上传content，返回传输完成的应答
+func (c *client) write(content string, format string, args ...interface{}) (int, string) {
+	c.t.Helper()
+	conn, code, msg := c.data(format, args...)
+	if code != 150 {
+		conn.Close()
+		return code, msg
+	}
+	io.WriteString(conn, content)
+	conn.Close()
+	code, msg, _ = c.conn.ReadResponse(0)
+	return code, msg
+}
+
+// TestWebDavCache checks that changes made over FTP drop the FileIds WebDav
+// cached for the changed paths.
+func TestWebDavCache(t *testing.T) {
+	s, c := startServer(t, nil)
+	dir := s.Mkdir("root", "dir")
+	id := s.Put(dir, "a.txt", []byte("a"))
+	c.login()
+	key := func(p string) string { return cache.FileIdKey(aliyuntest.DriveId, p) }
+	cached := func(p string) interface{} {
+		v, _ := cache.GoCache.Get(key(p))
+		return v
+	}
+
+	cache.GoCache.Set(key("dir"), dir, -1)
+	cache.GoCache.Set(key("dir/a.txt"), id, -1)
+	c.cmd("RNFR dir")
+	if code, _ := c.cmd("RNTO moved"); code != 250 {
+		t.Fatalf("RNTO = %d, want 250", code)
+	}
+	if v := cached("dir"); v != nil {
+		t.Errorf("renamed folder still cached as %v", v)
+	}
+	if v := cached("dir/a.txt"); v != nil {
+		t.Errorf("file below the renamed folder still cached as %v", v)
+	}
+	if v := cached("moved"); v != dir {
+		t.Errorf("new name cached as %v, want %s", v, dir)
+	}
+
+	cache.GoCache.Set(key("moved/b.txt"), "stale", -1)
+	if code, msg := c.write("b", "STOR moved/b.txt"); code != 226 {
+		t.Fatalf("STOR = %d %s", code, msg)
+	}
+	if f, _ := s.Lookup("moved/b.txt"); cached("moved/b.txt") != f.Id {
+		t.Errorf("uploaded file cached as %v, want %s", cached("moved/b.txt"), f.Id)
+	}
+
+	cache.GoCache.Set(key("moved/a.txt"), id, -1)
+	if code, _ := c.cmd("DELE moved/a.txt"); code != 250 {
+		t.Fatalf("DELE = %d, want 250", code)
+	}
+	if v := cached("moved/a.txt"); v != nil {
+		t.Errorf("deleted file still cached as %v", v)
+	}
+}
+
+// TestDataConnFromOtherHost checks that a data connection from another
+// address than the control connection is refused.
+func TestDataConnFromOtherHost(t *testing.T) {
+	s, c := startServer(t, nil)
+	s.Put("root", "a.txt", []byte("secret content"))
+	c.login()
+
+	code, msg := c.cmd("EPSV")
+	if code != 229 {
+		t.Fatalf("EPSV = %d %s", code, msg)
+	}
+	port := epsvPort.FindStringSubmatch(msg)[1]
+	//127.0.0.2同样指向本机，但与控制连接的地址不同
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	other, err := dialer.Dial("tcp", net.JoinHostPort(c.host, port))
+	if err != nil {
+		t.Skip("cannot connect from 127.0.0.2:", err)
+	}
+	defer other.Close()
+	own, err := net.Dial("tcp", net.JoinHostPort(c.host, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer own.Close()
+	if code, msg := c.cmd("RETR a.txt"); code != 150 {
+		t.Fatalf("RETR = %d %s", code, msg)
+	}
+	body, _ := ioutil.ReadAll(own)
+	c.expect(226)
+	if string(body) != "secret content" {
+		t.Errorf("data connection of the client got %q", body)
+	}
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	if stolen, _ := ioutil.ReadAll(other); len(stolen) > 0 {
+		t.Errorf("connection from another address got %q", stolen)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	_, c := startServer(t, nil)
+	if code, _ := c.cmd("PWD"); code != 530 {
+		t.Errorf("PWD before login = %d, want 530", code)
+	}
+	c.cmd("USER admin")
+	if code, _ := c.cmd("PASS wrong"); code != 530 {
+		t.Errorf("PASS with a wrong password = %d, want 530", code)
+	}
+	c.login()
+	if code, msg := c.cmd("PWD"); code != 257 || msg != `"/"` {
+		t.Errorf("PWD = %d %s, want 257 \"/\"", code, msg)
+	}
+}
+
+func TestList(t *testing.T) {
+	s, c := startServer(t, nil)
+	dir := s.Mkdir("root", "dir")
+	s.Put("root", "a.txt", []byte("hello"))
+	s.Put(dir, "b.txt", []byte("in dir"))
+	c.login()
+
+	listing := c.read("LIST")
+	lines := strings.Split(strings.TrimSpace(listing), "\r\n")
+	if len(lines) != 2 {
+		t.Fatalf("LIST returned %d entries, want 2:\n%s", len(lines), listing)
+	}
+	for _, want := range []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^-rw-r--r-- 1 owner group 5 .* a\.txt\r$`),
+		regexp.MustCompile(`(?m)^drwxr-xr-x 1 owner group 0 .* dir\r$`),
+	} {
+		if !want.MatchString(listing) {
+			t.Errorf("LIST missing %s:\n%s", want, listing)
+		}
+	}
+
+	if got := c.read("NLST dir"); got != "b.txt\r\n" {
+		t.Errorf("NLST dir = %q, want b.txt", got)
+	}
+	if code, _ := c.cmd("CWD dir"); code != 250 {
+		t.Fatalf("CWD dir = %d, want 250", code)
+	}
+	if got := c.read("LIST -la"); !strings.Contains(got, " b.txt\r\n") {
+		t.Errorf("LIST in dir = %q, want b.txt", got)
+	}
+	if code, _ := c.cmd("LIST missing"); code != 550 {
+		t.Errorf("LIST of a missing path = %d, want 550", code)
+	}
+}
+
+func TestRetr(t *testing.T) {
+	s, c := startServer(t, nil)
+	s.Put("root", "a.txt", []byte("0123456789"))
+	s.Put("root", "empty.txt", nil)
+	c.login()
+
+	if got := c.read("RETR a.txt"); got != "0123456789" {
+		t.Errorf("RETR = %q, want the file content", got)
+	}
+	if code, _ := c.cmd("REST 4"); code != 350 {
+		t.Fatalf("REST = %d, want 350", code)
+	}
+	if got := c.read("RETR /a.txt"); got != "456789" {
+		t.Errorf("RETR after REST 4 = %q, want 456789", got)
+	}
+	if got := c.read("RETR empty.txt"); got != "" {
+		t.Errorf("RETR of an empty file = %q", got)
+	}
+	if code, msg := c.cmd("SIZE a.txt"); code != 213 || msg != "10" {
+		t.Errorf("SIZE = %d %s, want 213 10", code, msg)
+	}
+	if code, _ := c.cmd("RETR missing.txt"); code != 550 {
+		t.Errorf("RETR of a missing file = %d, want 550", code)
+	}
+}
+
+func TestStor(t *testing.T) {
+	s, c := startServer(t, nil)
+	s.Mkdir("root", "dir")
+	s.Put("root", "a.txt", []byte("old"))
+	c.login()
+
+	if code, msg := c.write("new file", "STOR dir/b.txt"); code != 226 {
+		t.Fatalf("STOR = %d %s, want 226", code, msg)
+	}
+	if f, ok := s.Lookup("dir/b.txt"); !ok || string(f.Content) != "new file" {
+		t.Errorf("stored file = %q, want the uploaded content", f.Content)
+	}
+
+	//覆盖已存在的文件
+	if code, msg := c.write("replaced", "STOR a.txt"); code != 226 {
+		t.Fatalf("STOR over a file = %d %s, want 226", code, msg)
+	}
+	if f, ok := s.Lookup("a.txt"); !ok || string(f.Content) != "replaced" {
+		t.Errorf("overwritten file = %q, want the new content", f.Content)
+	}
+	if code, _ := c.cmd("STOR dir"); code != 550 {
+		t.Errorf("STOR over a folder = %d, want 550", code)
+	}
+	if code, _ := c.cmd("STOR missing/c.txt"); code != 550 {
+		t.Errorf("STOR into a missing folder = %d, want 550", code)
+	}
+}
+
+func TestModify(t *testing.T) {
+	s, c := startServer(t, nil)
+	s.Mkdir("root", "dir")
+	id := s.Put("root", "a.txt", []byte("a"))
+	c.login()
+
+	if code, _ := c.cmd("MKD new"); code != 257 {
+		t.Errorf("MKD = %d, want 257", code)
+	}
+	if f, ok := s.Lookup("new"); !ok || f.Type != "folder" {
+		t.Error("folder not created")
+	}
+
+	c.cmd("RNFR a.txt")
+	if code, _ := c.cmd("RNTO b.txt"); code != 250 {
+		t.Errorf("RNTO = %d, want 250", code)
+	}
+	if f, ok := s.Lookup("b.txt"); !ok || f.Id != id {
+		t.Error("file not renamed")
+	}
+	c.cmd("RNFR b.txt")
+	if code, _ := c.cmd("RNTO dir/b.txt"); code != 250 {
+		t.Errorf("RNTO into a folder = %d, want 250", code)
+	}
+	if f, ok := s.Lookup("dir/b.txt"); !ok || f.Id != id {
+		t.Error("file not moved")
+	}
+	if code, _ := c.cmd("RNTO c.txt"); code != 503 {
+		t.Errorf("RNTO without RNFR = %d, want 503", code)
+	}
+	//目标名称已被占用时重命名失败
+	dir, _ := s.Lookup("dir")
+	s.Put(dir.Id, "taken.txt", []byte("t"))
+	c.cmd("RNFR dir/b.txt")
+	if code, _ := c.cmd("RNTO dir/taken.txt"); code != 550 {
+		t.Errorf("RNTO onto a taken name = %d, want 550", code)
+	}
+
+	if code, _ := c.cmd("DELE dir/b.txt"); code != 250 {
+		t.Errorf("DELE = %d, want 250", code)
+	}
+	if f, _ := s.File(id); !f.Trashed {
+		t.Error("file not moved to the recycle bin")
+	}
+	if code, _ := c.cmd("DELE dir/b.txt"); code != 550 {
+		t.Errorf("DELE of a deleted file = %d, want 550", code)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s, c := startServer(t, func(server *Server) { server.Handler.ReadOnly = true })
+	s.Put("root", "a.txt", []byte("a"))
+	c.login()
+
+	for _, cmd := range []string{"STOR b.txt", "DELE a.txt", "MKD dir", "RNFR a.txt"} {
+		if code, _ := c.cmd(cmd); code != 550 {
+			t.Errorf("%s on a read-only server = %d, want 550", cmd, code)
+		}
+	}
+	if got := c.read("RETR a.txt"); got != "a" {
+		t.Errorf("RETR on a read-only server = %q, want a", got)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 0 {
+		t.Errorf("created %d files on a read-only server", n)
+	}
+}
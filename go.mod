@@ -7,4 +7,5 @@ require (
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/tidwall/gjson v1.9.0
 	github.com/tidwall/pretty v1.2.0 // indirect
+	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f
 )
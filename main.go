@@ -1,21 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
 	"go-aliyun-webdav/aliyun"
 	"go-aliyun-webdav/aliyun/cache"
 	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"go-aliyun-webdav/ftp"
+	"go-aliyun-webdav/utils"
 	"go-aliyun-webdav/webdav"
+	"io"
 	"reflect"
 
 	//"gorm.io/driver/sqlite"
 	//"gorm.io/gorm"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -37,8 +44,69 @@ func main() {
 	var user *string
 	var pwd *string
 	var versin *bool
+	var versionJson *bool
 	var log *bool
 	var check *string
+	var redirectDownload *bool
+	var attachment *bool
+	var renewRetries *int
+	var renewInterval *int
+	var keepFailedUploads *bool
+	var readOnly *bool
+	var rootFolder *string
+	var maxConcurrent *int
+	var cacheJitter *float64
+	var tempMaxAge *int
+	var debugHttp *bool
+	var idleTimeout *int
+	var noInlineRefresh *bool
+	var wellKnown *bool
+	var rejectEmpty *bool
+	var noRapidExt *string
+	var timeZone *string
+	var idempotentMkcol *bool
+	var ftpPort *string
+	var shortcutFile *string
+	var maxNameLength *int
+	var maxPerClient *int
+	var ffmpeg *string
+	var tempDiskLimit *int64
+	var warmupPaths *string
+	var warmupBlocking *bool
+	var ignoreNames *string
+	var omitFolderLength *bool
+	var maxXMLBody *int64
+	var requestTimeout *int
+	var diskCacheDir *string
+	var diskCacheSize *int64
+	var listPageSize *int
+	var downloadUrlFields *string
+	var tempDir *string
+	var memoryUploadLimit *int64
+	var streamUpload *bool
+	var virtualFile *string
+	var folderSizes *bool
+	var logRepeatInterval *int
+	var gzipUploads *bool
+	var propfindFlush *int
+	var rejectExpired *bool
+	var localPrefix *string
+	var logoutOnExit *bool
+	var downloadConnections *int
+	var moveIntoFolder *bool
+	var uploadWebhook *string
+	var resumeUploads *bool
+	var propfindLimit *int
+	var resumableUploads *bool
+	var unsafeNames *string
+	var userAgentFile *string
+	var userAgentOrder *string
+	var userAgentSeed *int64
+	var maxDownloads *int
+	var maxUploads *int
+	var maxMetadata *int
+	var truncateLongNames *bool
+	var corsOrigins *string
 
 	//
 	port = flag.String("port", "8085", "默认8085")
@@ -46,20 +114,166 @@ func main() {
 	user = flag.String("user", "admin", "用户名")
 	pwd = flag.String("pwd", "123456", "密码")
 	versin = flag.Bool("V", false, "显示版本")
+	versionJson = flag.Bool("json", false, "与-V一起使用，以JSON格式输出版本信息")
 	log = flag.Bool("v", false, "是否显示日志(默认不显示)")
 	//log = flag.Bool("v", true, "是否显示日志(默认不显示)")
 	refreshToken = flag.String("rt", "", "refresh_token")
 
 	check = flag.String("crt", "", "检查refreshToken是否过期")
+	attachment = flag.Bool("attachment", false, "下载时默认以附件形式保存而不是在浏览器中打开(也可在链接后加?download=1)")
+	renewRetries = flag.Int("renew-retries", 10, "上传地址过期后续期的最大尝试次数")
+	renewInterval = flag.Int("renew-interval", 10, "上传地址续期失败后的重试间隔(秒)")
+	keepFailedUploads = flag.Bool("keep-failed-uploads", false, "上传失败时保留中间文件用于排查问题")
+	rootFolder = flag.String("root-folder", "", "以网盘中的某个目录作为根目录，如/Media，默认为网盘根目录")
+	maxConcurrent = flag.Int("max-concurrent", 0, "同时处理的最大请求数，超出的请求排队等待，默认0不限制")
+	maxPerClient = flag.Int("max-per-client", 0, "单个客户端IP同时处理的最大请求数(包括下载)，超出时返回429，默认0不限制")
+	cacheJitter = flag.Float64("cache-jitter", 0.1, "缓存过期时间的随机浮动比例，避免缓存集中过期")
+	tempDiskLimit = flag.Int64("temp-disk-limit", 0, "进行中的上传的中间文件最多占用的磁盘空间(MB)，超出时返回503，默认0不限制")
+	tempMaxAge = flag.Int("temp-max-age", 24, "启动时清理超过该时长(小时)的上传中间文件，开启-resume-uploads时已接收完整的上传改为续传")
+	debugHttp = flag.Bool("debug-http", false, "打印阿里云接口的请求和响应内容(隐藏token等敏感信息)，用于排查问题")
+	idleTimeout = flag.Int("download-idle-timeout", 120, "下载时超过该时长(秒)没有数据流动则断开与阿里云的连接，0为不限制")
+	noInlineRefresh = flag.Bool("no-inline-refresh", false, "token过期时不在请求中同步刷新，只依赖后台定时刷新")
+	wellKnown = flag.Bool("well-known", true, "直接响应/favicon.ico和/robots.txt，不再查询阿里云")
+	rejectEmpty = flag.Bool("reject-empty", false, "拒绝上传大小为0的文件")
+	noRapidExt = flag.String("no-rapid-ext", "", "不使用闪传的文件扩展名，逗号分隔，如.gpg,.kdbx")
+	timeZone = flag.String("tz", "", "文件时间使用的时区，如Asia/Shanghai，默认为GMT，仅用于不会自动转换时区的客户端")
+	idempotentMkcol = flag.Bool("mkcol-idempotent", false, "新建已存在的文件夹时返回成功而不是405")
+	ftpPort = flag.String("ftp-port", "", "同时以FTP协议提供服务的端口(仅支持被动模式)，默认不开启")
+	shortcutFile = flag.String("shortcuts", "", "快捷方式的保存文件，如shortcuts.json，默认不开启快捷方式")
+	maxNameLength = flag.Int("max-name-length", 1024, "文件名的最大长度(字符数)，超出时拒绝上传，0为不检查")
+	truncateLongNames = flag.Bool("truncate-long-names", false, "文件名超出最大长度时截断(保留扩展名)而不是拒绝")
+	ffmpeg = flag.String("ffmpeg", "", "ffmpeg可执行文件路径，设置后为没有缩略图的视频截取一帧作为缩略图，默认不开启")
+	warmupPaths = flag.String("warmup", "", "启动时预先列出的目录及其下一级子目录，逗号分隔，如/,/电影，默认不预热")
+	warmupBlocking = flag.Bool("warmup-blocking", false, "预热完成后才开始提供服务，默认在后台预热")
+	ignoreNames = flag.String("ignore", "", "不上传的文件名，逗号分隔，支持通配符，如._*,.DS_Store，上传时直接返回成功")
+	omitFolderLength = flag.Bool("omit-folder-length", false, "文件夹不返回getcontentlength属性，默认返回0")
+	maxXMLBody = flag.Int64("max-xml-body", 1024, "PROPFIND、PROPPATCH、LOCK请求体的最大大小(KB)，超出时返回413，0为不限制")
+	requestTimeout = flag.Int("request-timeout", 60, "单个请求的最长处理时间(秒)，超出时返回504，上传和下载不受限制，0为不限制")
+	diskCacheDir = flag.String("disk-cache-dir", "", "视频拖动播放时的本地缓存目录，设置后收到Range请求的文件会在后台下载到本地，默认不开启")
+	diskCacheSize = flag.Int64("disk-cache-size", 10240, "本地缓存最多占用的磁盘空间(MB)，超出时删除最久未使用的文件")
+	listPageSize = flag.Int("list-page-size", aliyun.MaxListPageSize, "列出目录时每页的条数，1-200，越大请求阿里云的次数越少")
+	downloadUrlFields = flag.String("download-url", "url", "优先使用的下载地址，逗号分隔依次尝试，可选cdn_url、url、internal_url，都没有时使用url")
+	tempDir = flag.String("temp-dir", "", "上传中间文件所在的目录，默认当前目录，无法写入时依次尝试系统临时目录、内存")
+	memoryUploadLimit = flag.Int64("memory-upload-limit", 16, "临时目录都无法写入时，不超过该大小(MB)的上传在内存中缓冲，0为不使用内存")
+	streamUpload = flag.Bool("stream-upload", false, "上传时不写中间文件，边接收边按分片上传到阿里云，不使用闪传")
+	virtualFile = flag.String("virtual-files", "", "虚拟文件的配置文件，JSON格式的路径到内容的映射，如{\"/共享/README.txt\":\"仅供内部使用\"}，这些文件出现在目录列表中但不存在于网盘，只读")
+	folderSizes = flag.Bool("folder-size", false, "PROPFIND时按需计算文件夹内所有文件的总大小(ownCloud的size属性)，需要列出所有子目录，较慢")
+	logRepeatInterval = flag.Int("log-repeat-interval", 60, "刷新token连续失败时相同的日志只打印一次，之后每隔该时长(分钟)汇总打印重复次数，0为每次都打印")
+	gzipUploads = flag.Bool("gzip-uploads", false, "上传请求带有Content-Encoding: gzip时先解压再保存，网盘中保存的是原始内容")
+	propfindFlush = flag.Int("propfind-flush", 64, "PROPFIND响应每生成该大小(KB)就立即发送给客户端，文件很多的目录边生成边发送，0为由系统决定")
+	rejectExpired = flag.Bool("reject-expired-token", false, "token已过期且刷新失败时，所有请求直接返回503，直到刷新成功")
+	localPrefix = flag.String("local-prefix", "", "把服务器上-path指定的本地目录挂载到该路径下(如/local)，该路径下的请求读写本地文件而不是网盘")
+	logoutOnExit = flag.Bool("logout-on-exit", false, "收到退出信号时清除内存中的token，-rt为token文件时删除该文件")
+	downloadConnections = flag.Int("download-connections", 1, "下载时同时使用的连接数，大于1时把文件或客户端请求的范围按4MB分片并行下载")
+	moveIntoFolder = flag.Bool("move-into-folder", false, "移动文件到已存在的文件夹时放入该文件夹中，而不是按WebDAV标准替换该文件夹")
+	uploadWebhook = flag.String("upload-webhook", "", "文件上传成功后在后台向该地址POST一条JSON通知(路径、fileId、大小、sha1)，失败时重试")
+	resumeUploads = flag.Bool("resume-uploads", false, "分片全部上传后保存上传记录，完成上传前崩溃或完成失败时，重启或客户端重试时直接完成，不再重新上传")
+	propfindLimit = flag.Int("propfind-limit", 0, "PROPFIND最多返回的子项数，超出时截断并告知客户端结果不完整，0为不限制")
+	resumableUploads = flag.Bool("resumable-uploads", false, "接受带Content-Range的分段PUT上传，中断后客户端可以查询已保存的字节数并从该处继续")
+	unsafeNames = flag.String("unsafe-names", "escape", "名称为.或..的文件的处理方式：escape以%2E代替.列出，hide不列出")
+	userAgentFile = flag.String("user-agents", "", "调用阿里云接口时轮换使用的User-Agent列表文件，每行一个，默认只使用一个固定的User-Agent")
+	userAgentOrder = flag.String("user-agent-order", "round-robin", "User-Agent的轮换方式：round-robin依次使用，random随机选取")
+	userAgentSeed = flag.Int64("user-agent-seed", 0, "random方式的随机数种子，相同的种子得到相同的顺序，便于排查问题，0为每次启动不同")
+	maxDownloads = flag.Int("max-downloads", 0, "同时处理的最大下载(GET)请求数，超出的排队等待，默认0不单独限制")
+	maxUploads = flag.Int("max-uploads", 0, "同时处理的最大上传(PUT)请求数，超出的排队等待，默认0不单独限制")
+	maxMetadata = flag.Int("max-metadata", 0, "同时处理的最大列目录等其它请求数，超出的排队等待，默认0不单独限制")
+	readOnly = flag.Bool("readonly", false, "只读模式，禁止上传、删除、移动等修改操作")
+	redirectDownload = flag.Bool("redirect-download", false, "下载时302跳转到阿里云下载地址而不经过服务器中转")
+	corsOrigins = flag.String("cors-origins", "", "允许带账户密码跨域访问的网页来源，多个以逗号分隔，如https://player.example.com，默认允许任何来源但不带账户密码")
 
 	flag.Parse()
 	if *versin {
-		fmt.Println(Version)
+		printVersion(*versionJson)
 		return
 	}
 
+	aliyun.UploadUrlRenewRetries = *renewRetries
+	aliyun.UploadUrlRenewInterval = time.Duration(*renewInterval) * time.Second
+	aliyun.KeepFailedUploads = *keepFailedUploads
+	aliyun.TempDiskLimit = *tempDiskLimit * 1024 * 1024
+	aliyun.TempDir = *tempDir
+	aliyun.MemoryUploadLimit = *memoryUploadLimit * 1024 * 1024
+	aliyun.StreamUpload = *streamUpload
+	aliyun.SetNoRapidUploadExts(*noRapidExt)
+	cache.Jitter = *cacheJitter
+	net.Debug = *debugHttp
+	net.IdleTimeout = time.Duration(*idleTimeout) * time.Second
+	webdav.OmitFolderContentLength = *omitFolderLength
+	webdav.FolderSizes = *folderSizes
+	aliyun.RefreshLog.Interval = time.Duration(*logRepeatInterval) * time.Minute
+	if *listPageSize < 1 || *listPageSize > aliyun.MaxListPageSize {
+		fmt.Println("❌  -list-page-size必须在1到", aliyun.MaxListPageSize, "之间")
+		return
+	}
+	aliyun.ListPageSize = *listPageSize
+	if fields := splitList(*downloadUrlFields); len(fields) > 0 {
+		for _, field := range fields {
+			if !aliyun.KnownDownloadUrlFields[field] {
+				fmt.Println("❌  -download-url不支持", field, "，可选cdn_url、url、internal_url")
+				return
+			}
+		}
+		aliyun.DownloadUrlFields = fields
+	}
+	if *unsafeNames != "escape" && *unsafeNames != "hide" {
+		fmt.Println("❌  -unsafe-names不支持", *unsafeNames, "，可选escape、hide")
+		return
+	}
+	aliyun.UnsafeNames = *unsafeNames
+	if len(*userAgentFile) > 0 {
+		if *userAgentOrder != "round-robin" && *userAgentOrder != "random" {
+			fmt.Println("❌  -user-agent-order不支持", *userAgentOrder, "，可选round-robin、random")
+			return
+		}
+		data, err := os.ReadFile(*userAgentFile)
+		if err != nil {
+			fmt.Println("❌  User-Agent列表文件读取失败", err)
+			return
+		}
+		var agents []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				agents = append(agents, line)
+			}
+		}
+		net.SetUserAgents(agents, *userAgentOrder == "random", *userAgentSeed)
+		fmt.Println("🎭  轮换使用", len(agents), "个User-Agent", *userAgentOrder)
+	}
+	if len(*diskCacheDir) > 0 {
+		aliyun.DiskCacheDir = *diskCacheDir
+		aliyun.DiskCacheLimit = *diskCacheSize * 1024 * 1024
+		if err := aliyun.InitDiskCache(); err != nil {
+			fmt.Println("❌  本地缓存目录不可用", err)
+			return
+		}
+	}
+
+	for _, secret := range []*string{refreshToken, pwd} {
+		value, err := fromSecret(*secret)
+		if err != nil {
+			fmt.Println("❌  读取密钥失败", *secret, err)
+			return
+		}
+		*secret = value
+	}
+	*refreshToken = fromEnv(*refreshToken)
+	if len(*refreshToken) == 0 {
+		*refreshToken = os.Getenv("ALIYUN_REFRESH_TOKEN")
+	}
+	*pwd = fromEnv(*pwd)
+	*check = fromEnv(*check)
+
+	if len(*timeZone) > 0 {
+		loc, err := time.LoadLocation(*timeZone)
+		if err != nil {
+			fmt.Println("时区设置错误", err)
+			return
+		}
+		webdav.TimeZone = loc
+	}
+
 	if len(*check) > 0 {
-		refreshResult := aliyun.RefreshToken(*check)
+		refreshResult := aliyun.RefreshToken(context.Background(), *check)
 		if reflect.DeepEqual(refreshResult, model.RefreshTokenModel{}) {
 
 			fmt.Println("refreshToken已过期")
@@ -70,7 +284,7 @@ func main() {
 	}
 
 	if len(*refreshToken) == 0 {
-		fmt.Println("rt为必填项,请输入refreshToken")
+		fmt.Println("rt为必填项,请输入refreshToken或设置环境变量ALIYUN_REFRESH_TOKEN")
 		return
 	}
 	if len(os.Args) > 2 && os.Args[1] == "rt" {
@@ -83,7 +297,7 @@ func main() {
 
 		address = "0.0.0.0:" + *port
 	}
-	refreshResult := aliyun.RefreshToken(*refreshToken)
+	refreshResult := aliyun.RefreshToken(context.Background(), *refreshToken)
 	if reflect.DeepEqual(refreshResult, model.RefreshTokenModel{}) {
 		fmt.Println("refreshToken已过期")
 		return
@@ -98,71 +312,298 @@ func main() {
 		ExpireTime:   time.Now().Unix() + refreshResult.ExpiresIn,
 	}
 
-	fs := &webdav.Handler{
-		Prefix:     "/",
-		FileSystem: webdav.Dir(*path),
-		LockSystem: webdav.NewMemLS(),
-		Config:     config,
+	if err := aliyun.SetRootFolder(context.Background(), config.Token, config.DriveId, *rootFolder); err != nil {
+		fmt.Println("根目录设置失败", err)
+		return
 	}
 
-	//fmt.p
+	aliyun.ResumeUploads = *resumeUploads
+	aliyun.CleanTempFiles(context.Background(), config.Token, time.Duration(*tempMaxAge)*time.Hour)
+	aliyun.ResumePendingUploads(context.Background(), config.Token, config.DriveId)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		// 获取用户名/密码
-		username, password, ok := req.BasicAuth()
-		if !ok {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			w.WriteHeader(http.StatusUnauthorized)
+	fs := &webdav.Handler{
+		Prefix:              "/",
+		FileSystem:          webdav.Dir(*path),
+		LockSystem:          webdav.NewMemLS(),
+		Config:              config,
+		RedirectDownload:    *redirectDownload,
+		AttachmentDownload:  *attachment,
+		ReadOnly:            *readOnly,
+		MaxConcurrent:       *maxConcurrent,
+		MaxDownloads:        *maxDownloads,
+		MaxUploads:          *maxUploads,
+		MaxMetadata:         *maxMetadata,
+		MaxPerClient:        *maxPerClient,
+		NoInlineRefresh:     *noInlineRefresh,
+		RejectEmptyFiles:    *rejectEmpty,
+		IdempotentMkcol:     *idempotentMkcol,
+		MaxNameLength:       *maxNameLength,
+		TruncateLongNames:   *truncateLongNames,
+		IgnoreNames:         splitList(*ignoreNames),
+		MaxXMLBodySize:      *maxXMLBody << 10,
+		RequestTimeout:      time.Duration(*requestTimeout) * time.Second,
+		DecodeGzipUploads:   *gzipUploads,
+		PropfindFlushBytes:  *propfindFlush << 10,
+		RejectExpiredToken:  *rejectExpired,
+		LocalPrefix:         *localPrefix,
+		DownloadConnections: *downloadConnections,
+		MoveIntoFolder:      *moveIntoFolder,
+		UploadWebhook:       *uploadWebhook,
+		PropfindLimit:       *propfindLimit,
+		ResumableUploads:    *resumableUploads,
+	}
+
+	if len(*shortcutFile) > 0 {
+		store, err := webdav.NewShortcutStore(*shortcutFile)
+		if err != nil {
+			fmt.Println("读取快捷方式失败", err)
 			return
 		}
-		//	 验证用户名/密码
-		if username != *user || password != *pwd {
-			http.Error(w, "WebDAV: need authorized!", http.StatusUnauthorized)
+		fs.Shortcuts = store
+	}
+	if len(*virtualFile) > 0 {
+		files, err := webdav.LoadVirtualFiles(*virtualFile)
+		if err != nil {
+			fmt.Println("读取虚拟文件失败", err)
 			return
 		}
+		fs.VirtualFiles = files
+	}
 
-		// Add CORS headers before any operation so even on a 401 unauthorized status, CORS will work.
+	//fmt.p
 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+	var auth webdav.Authenticator = webdav.StaticAuth{User: *user, Password: *pwd}
 
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE,UPDATE")
+	server := NewServer(ServerConfig{
+		Addr:        address,
+		Handler:     fs,
+		Auth:        auth,
+		RootFolder:  *rootFolder,
+		FFmpeg:      *ffmpeg,
+		WellKnown:   *wellKnown,
+		Log:         *log,
+		CORSOrigins: splitList(*corsOrigins),
+	})
 
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	if len(*ftpPort) > 0 {
+		ftpServer := &ftp.Server{Addr: ":" + *ftpPort, Handler: fs, Auth: auth}
+		go func() {
+			if err := ftpServer.ListenAndServe(); err != nil {
+				fmt.Println("❌  FTP服务启动失败", err)
+			}
+		}()
+	}
+	if len(*warmupPaths) > 0 {
+		if *warmupBlocking {
+			warmup(fs.CurrentConfig(), strings.Split(*warmupPaths, ","))
+		} else {
+			go warmup(fs.CurrentConfig(), strings.Split(*warmupPaths, ","))
+		}
+	}
+	refreshCtx, cancelRefresh := context.WithCancel(context.Background())
+	refreshDone := make(chan struct{})
+	go func() {
+		defer close(refreshDone)
+		refresh(refreshCtx, fs)
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	stopRefresh := func() {
+		cancelRefresh()
+		<-refreshDone
+	}
+	if err := runServer(server, server.ListenAndServe, sig, stopRefresh); err != nil {
+		fmt.Println("❌  服务启动失败", err)
+	}
+	//服务已完全停止，后台刷新也已结束，不会再有请求使用token或重新写入token文件
+	if *logoutOnExit {
+		clearCredentials(fs, *refreshToken)
+	}
+}
 
-		if req.Method == "GET" && strings.HasPrefix(req.URL.Path, fs.Prefix) {
-			info, err := fs.FileSystem.Stat(context.TODO(), strings.TrimPrefix(req.URL.Path, fs.Prefix))
-			if err == nil && info.IsDir() {
-				req.Method = "PROPFIND"
+// shutdownTimeout 收到退出信号后等待进行中的请求完成的最长时间
+var shutdownTimeout = 10 * time.Second
 
-				if req.Header.Get("Depth") == "" {
-					req.Header.Add("Depth", "1")
-				}
-			}
+// runServer 调用listen提供服务直到收到退出信号，然后先停止后台刷新token，再等待进行中的请求完成(最多shutdownTimeout)。
+// 返回时服务已完全停止
+func runServer(server *http.Server, listen func() error, sig <-chan os.Signal, stopRefresh func()) error {
+	listenDone := make(chan struct{})
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		select {
+		case <-sig:
+		case <-listenDone:
+			//服务启动失败
+			stopRefresh()
+			return
 		}
-		if *log {
-			fmt.Println(req.URL)
-			fmt.Println(req.Method)
+		stopRefresh()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	err := listen()
+	close(listenDone)
+	//开始Shutdown时listen就会返回，等待Shutdown完成
+	<-shutdownDone
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// clearCredentials 退出时清除内存中的token及缓存，tokenFile为token文件时删除该文件，
+// 停止的容器的磁盘上不再留有可用的token
+func clearCredentials(fs *webdav.Handler, tokenFile string) {
+	fs.UpdateConfig(func(model.Config) model.Config { return model.Config{} })
+	cache.GoCache.Flush()
+	if info, err := os.Stat(tokenFile); err == nil && !info.IsDir() {
+		if err := os.Remove(tokenFile); err != nil {
+			fmt.Println("❌  删除token文件失败", err)
+			return
 		}
-		fs.ServeHTTP(w, req)
-	})
-	go refresh(fs)
-	http.ListenAndServe(address, nil)
+		fmt.Println("🔒  已删除token文件", tokenFile)
+	}
+}
 
+// fromEnv 参数值形如env:NAME时从环境变量NAME中读取，避免在进程列表中暴露敏感信息
+func fromEnv(value string) string {
+	if strings.HasPrefix(value, "env:") {
+		return os.Getenv(strings.TrimPrefix(value, "env:"))
+	}
+	return value
 }
-func refresh(fs *webdav.Handler) {
+
+// stdin -rt和-pwd都从标准输入读取时共用，依次读取两行
+var stdin = bufio.NewReader(os.Stdin)
+
+// fromSecret 参数值为-时从标准输入读取一行，为pipe:路径时从该命名管道读取一行，
+// 由密钥管理工具注入的密钥不会出现在命令行、环境变量或磁盘文件中
+func fromSecret(value string) (string, error) {
+	if value == "-" {
+		return readSecretLine(stdin)
+	}
+	if strings.HasPrefix(value, "pipe:") {
+		f, err := os.Open(strings.TrimPrefix(value, "pipe:"))
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return readSecretLine(bufio.NewReader(f))
+	}
+	return value, nil
+}
+
+func readSecretLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// splitList 拆分逗号分隔的参数值，忽略空项
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// authorized 校验WebDav账户密码，未通过时直接写入401响应
+func authorized(w http.ResponseWriter, req *http.Request, auth webdav.Authenticator) bool {
+	status, message := checkAuth(w, req, auth)
+	if status == 0 {
+		return true
+	}
+	if message == "" {
+		w.WriteHeader(status)
+	} else {
+		http.Error(w, message, status)
+	}
+	return false
+}
+
+// apiAuthorized 与authorized相同，但以JSON接口的错误格式返回
+func apiAuthorized(w http.ResponseWriter, req *http.Request, auth webdav.Authenticator) bool {
+	status, message := checkAuth(w, req, auth)
+	if status == 0 {
+		return true
+	}
+	code := codeAuthFailed
+	if status == http.StatusServiceUnavailable {
+		code = codeAuthUnavailable
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	apiError(w, status, code, message)
+	return false
+}
+
+// checkAuth 校验账户密码，通过时返回0，否则返回状态码及错误信息
+func checkAuth(w http.ResponseWriter, req *http.Request, auth webdav.Authenticator) (int, string) {
+	// 获取用户名/密码
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		return http.StatusUnauthorized, ""
+	}
+	//	 验证用户名/密码
+	ok, err := auth.Authenticate(username, password)
+	if err != nil {
+		fmt.Println("❌  鉴权失败", err)
+		return http.StatusServiceUnavailable, "WebDAV: authentication unavailable"
+	}
+	if !ok {
+		return http.StatusUnauthorized, "WebDAV: need authorized!"
+	}
+	return 0, ""
+}
+
+// refreshCheckInterval 后台按墙上时间检查token是否需要刷新的间隔
+var refreshCheckInterval = time.Minute
+
+// wallClock 返回当前的墙上时间，测试时替换以模拟系统休眠醒来后的时钟跳变
+var wallClock = time.Now
+
+// refresh 在后台定时刷新token，ctx结束时返回
+func refresh(ctx context.Context, fs *webdav.Handler) {
 	//每隔10小时刷新一下RefreshToken
-	timer := time.NewTimer(10 * time.Hour)
+	//系统休眠时单调时钟会暂停，定时器可能远晚于预期才触发，所以每分钟按墙上时间检查一次是否已过期
+	ticker := time.NewTicker(refreshCheckInterval)
+	defer ticker.Stop()
+	lastRefresh := wallClock().Unix()
+	failures := &utils.RepeatLogger{Interval: aliyun.RefreshLog.Interval}
 	for {
-		timer.Reset(10 * time.Hour)
 		select {
-		case <-timer.C:
-			refreshResult := aliyun.RefreshToken(fs.Config.RefreshToken)
-			fs.Config = model.Config{
-				RefreshToken: refreshResult.RefreshToken,
-				Token:        refreshResult.AccessToken,
-				DriveId:      refreshResult.DefaultDriveId,
-				ExpireTime:   time.Now().Unix() + refreshResult.ExpiresIn,
-			}
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := wallClock().Unix()
+		if !needRefresh(now, fs.CurrentConfig().ExpireTime, lastRefresh) {
+			continue
 		}
+		refreshResult := aliyun.RefreshToken(ctx, fs.CurrentConfig().RefreshToken)
+		if ctx.Err() != nil {
+			return
+		}
+		if reflect.DeepEqual(refreshResult, model.RefreshTokenModel{}) {
+			failures.Println("刷新token失败,稍后重试")
+			continue
+		}
+		failures.Reset()
+		fs.UpdateConfig(func(c model.Config) model.Config { return c.Refresh(refreshResult) })
+		lastRefresh = now
 	}
 }
+
+// needRefresh 判断是否需要刷新token：accessToken即将过期(提前5分钟)或距上次刷新已超过10小时
+func needRefresh(now int64, expireTime int64, lastRefresh int64) bool {
+	return now >= expireTime-300 || now-lastRefresh >= 10*3600
+}
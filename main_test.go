@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/webdav"
+	"io/ioutil"
+	stdnet "net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClearCredentials(t *testing.T) {
+	cache.GoCache = cache.New(cache.DefaultExpiration, 0)
+	cache.GoCache.Set("k", "v", -1)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("refresh"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := &webdav.Handler{Config: model.Config{RefreshToken: "refresh", Token: "token", DriveId: "1"}}
+
+	clearCredentials(fs, tokenFile)
+
+	if _, err := os.Stat(tokenFile); !os.IsNotExist(err) {
+		t.Errorf("token file still there: %v", err)
+	}
+	if c := fs.CurrentConfig(); c != (model.Config{}) {
+		t.Errorf("config not cleared: %+v", c)
+	}
+	if _, ok := cache.GoCache.Get("k"); ok {
+		t.Error("cache not flushed")
+	}
+}
+
+func TestRefreshStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		refresh(ctx, &webdav.Handler{})
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresh loop still running after its context ended")
+	}
+}
+
+func TestRunServerWaitsForRequests(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})}
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make(chan os.Signal, 1)
+	refreshStopped := make(chan struct{})
+	stopRefresh := func() { close(refreshStopped) }
+	returned := make(chan error, 1)
+	go func() {
+		returned <- runServer(server, func() error { return server.Serve(ln) }, sig, stopRefresh)
+	}()
+	responded := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			responded <- 0
+			return
+		}
+		res.Body.Close()
+		responded <- res.StatusCode
+	}()
+	<-entered
+
+	sig <- os.Interrupt
+	select {
+	case <-returned:
+		t.Fatal("runServer returned while a request was in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-refreshStopped:
+	default:
+		t.Error("refresh loop not stopped before waiting for requests")
+	}
+	close(release)
+	if err := <-returned; err != nil {
+		t.Errorf("runServer = %v, want nil", err)
+	}
+	if code := <-responded; code != http.StatusOK {
+		t.Errorf("in-flight request got %d, want 200", code)
+	}
+}
+
+func TestRunServerListenFails(t *testing.T) {
+	stopped := false
+	err := runServer(&http.Server{}, func() error { return os.ErrPermission }, make(chan os.Signal), func() { stopped = true })
+	if err != os.ErrPermission || !stopped {
+		t.Errorf("runServer = %v, refresh stopped %v; want the listen error and a stopped refresh", err, stopped)
+	}
+}
+
+func TestNeedRefreshAfterClockJump(t *testing.T) {
+	start := time.Now().Unix()
+	expire := start + 7200
+	if needRefresh(start+60, expire, start) {
+		t.Error("refresh one minute after the last one")
+	}
+	//休眠12小时后醒来：token已过期，第一次检查就要刷新
+	if !needRefresh(start+12*3600, expire, start) {
+		t.Error("no refresh after waking past the expiry")
+	}
+	//token未过期但距上次刷新已超过10小时
+	if !needRefresh(start+10*3600, start+24*3600, start) {
+		t.Error("no refresh 10 hours after the last one")
+	}
+	if !needRefresh(start+7200-299, expire, start) {
+		t.Error("no refresh within 5 minutes of the expiry")
+	}
+}
+
+// TestRefreshAfterWake checks that the background loop refreshes the token
+// once on its first check after the wall clock jumped past the expiry, as it
+// does when the system wakes from sleep.
+func TestRefreshAfterWake(t *testing.T) {
+	h, fs, s := newTestServer(t, nil)
+	s.Handle("/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"fresh","refresh_token":"refresh2","expires_in":86400}`))
+	})
+	var jump int64
+	oldClock, oldInterval := wallClock, refreshCheckInterval
+	t.Cleanup(func() { wallClock, refreshCheckInterval = oldClock, oldInterval })
+	wallClock = func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&jump))) }
+	refreshCheckInterval = 5 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		refresh(ctx, fs)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := s.Calls("/token/refresh"); n != 0 {
+		t.Fatalf("refreshed %d times before the token expired", n)
+	}
+
+	//休眠3小时后醒来，1小时后过期的token已经过期
+	atomic.StoreInt64(&jump, int64(3*time.Hour))
+	for deadline := time.Now().Add(time.Second); fs.CurrentConfig().Token != "fresh" && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if token := fs.CurrentConfig().Token; token != "fresh" {
+		t.Fatalf("token after waking = %q, want it refreshed", token)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := s.Calls("/token/refresh"); n != 1 {
+		t.Errorf("refreshed %d times after waking, want once", n)
+	}
+	//醒来后的请求直接使用新的token，不需要在请求中刷新
+	if w := call(h, "PROPFIND", "/", nil); w.Code != http.StatusMultiStatus {
+		t.Errorf("PROPFIND after waking = %d", w.Code)
+	}
+	if n := s.Calls("/token/refresh"); n != 1 {
+		t.Errorf("the request refreshed again: %d refreshes", n)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	defer os.Unsetenv("ALIYUN_REFRESH_TOKEN")
+	os.Setenv("ALIYUN_REFRESH_TOKEN", "token-from-env")
+
+	for value, want := range map[string]string{
+		"env:ALIYUN_REFRESH_TOKEN": "token-from-env",
+		"env:MISSING_TEST_VAR":     "",
+		"plain-token":              "plain-token",
+		"":                         "",
+	} {
+		if got := fromEnv(value); got != want {
+			t.Errorf("fromEnv(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestFromSecretStdin(t *testing.T) {
+	cache.GoCache = cache.New(cache.DefaultExpiration, 0)
+	s := aliyuntest.New()
+	defer s.Close()
+
+	//-rt和-pwd都为-时从标准输入依次读取两行
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *bufio.Reader) { stdin = old }(stdin)
+	stdin = bufio.NewReader(r)
+	go func() {
+		w.Write([]byte("piped-refresh\r\npiped-password"))
+		w.Close()
+	}()
+	rt, err := fromSecret("-")
+	if err != nil || rt != "piped-refresh" {
+		t.Fatalf("refresh token from stdin = %q, %v", rt, err)
+	}
+	if pwd, err := fromSecret("-"); err != nil || pwd != "piped-password" {
+		t.Errorf("password from stdin = %q, %v; want the second line", pwd, err)
+	}
+	if _, err := fromSecret("-"); err == nil {
+		t.Error("reading past the end of stdin succeeded")
+	}
+
+	//读取的token用于刷新
+	if refresh := aliyun.RefreshToken(context.Background(), rt); refresh.AccessToken != "access-piped-refresh" {
+		t.Errorf("refresh with the piped token = %+v", refresh)
+	}
+}
+
+func TestFromSecretPipe(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fifo")
+	if err := ioutil.WriteFile(file, []byte("file-refresh\nignored\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := fromSecret("pipe:" + file); err != nil || v != "file-refresh" {
+		t.Errorf("fromSecret(pipe:) = %q, %v; want the first line", v, err)
+	}
+	if _, err := fromSecret("pipe:" + filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("reading a missing pipe succeeded")
+	}
+	//其他值原样返回
+	for _, v := range []string{"plain-token", "", "env:X", "--"} {
+		if got, err := fromSecret(v); err != nil || got != v {
+			t.Errorf("fromSecret(%q) = %q, %v", v, got, err)
+		}
+	}
+}
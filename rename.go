@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/net"
+	"go-aliyun-webdav/webdav"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// renameFile POST /api/rename，参数file_id(或网盘中的路径path)及new_name，原地重命名，
+// 给出file_id或路径已缓存时不需要从根目录逐级查找
+func renameFile(fs *webdav.Handler, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	fileId, newName := req.FormValue("file_id"), req.FormValue("new_name")
+	if newName == "" {
+		apiError(w, http.StatusBadRequest, codeBadRequest, "new_name is required")
+		return
+	}
+	if fileId == "" {
+		filePath := strings.Trim(req.FormValue("path"), "/")
+		if filePath == "" {
+			apiError(w, http.StatusBadRequest, codeBadRequest, "file_id or path is required")
+			return
+		}
+		if fid, ok := cache.GoCache.Get(cache.FileIdKey(fs.CurrentConfig().DriveId, filePath)); ok {
+			fileId = fid.(string)
+		} else {
+			paths := strings.Split(filePath, "/")
+			item, _, err := aliyun.Walk(req.Context(), fs.CurrentConfig().Token, fs.CurrentConfig().DriveId, paths, "")
+			if err != nil || item.Name != paths[len(paths)-1] {
+				apiError(w, http.StatusNotFound, codeNotFound, "file not found: "+filePath)
+				return
+			}
+			fileId = item.FileId
+		}
+	}
+	err := fs.Rename(req.Context(), fileId, newName)
+	switch {
+	case err == nil:
+		net.Logln(req.Context(), "✏️  重命名", fileId, newName)
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, os.ErrExist):
+		apiError(w, http.StatusConflict, codeConflict, "name already exists: "+newName)
+	case errors.Is(err, aliyun.ErrUnexpectedResponse), errors.Is(err, os.ErrNotExist):
+		apiErrorFrom(w, err)
+	default:
+		apiError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"github.com/tidwall/gjson"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/cache"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// countRootLists 统计列出根目录的次数
+func countRootLists(s *aliyuntest.Server) *int {
+	n := new(int)
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if gjson.GetBytes(data, "parent_file_id").Str == "root" {
+			*n++
+		}
+		s.Default(w, r)
+	})
+	return n
+}
+
+func TestRenameAPI(t *testing.T) {
+	h, _, s := newTestServer(t, nil)
+	dir := s.Mkdir("root", "dir")
+	sub := s.Mkdir(dir, "sub")
+	a := s.Put(sub, "a.txt", []byte("a"))
+	rootLists := countRootLists(s)
+	rename := func(values url.Values) int {
+		return call(h, "POST", "/api/rename", strings.NewReader(values.Encode())).Code
+	}
+
+	//按file_id重命名不需要查找路径
+	if code := rename(url.Values{"file_id": {a}, "new_name": {"b.txt"}}); code != http.StatusNoContent {
+		t.Fatalf("rename by file_id = %d, want 204", code)
+	}
+	if f, _ := s.File(a); f.Name != "b.txt" {
+		t.Errorf("file named %q, want b.txt", f.Name)
+	}
+	if *rootLists != 0 {
+		t.Errorf("rename by file_id listed the root folder %d times", *rootLists)
+	}
+
+	//路径已缓存时同样不从根目录查找，缓存的路径随之更新
+	cache.GoCache.Set(cache.FileIdKey(aliyuntest.DriveId, "dir"), dir, -1)
+	cache.GoCache.Set(cache.FileIdKey(aliyuntest.DriveId, "dir/sub"), sub, -1)
+	cache.GoCache.Set(cache.FileIdKey(aliyuntest.DriveId, "dir/sub/b.txt"), a, -1)
+	if code := rename(url.Values{"path": {"/dir/sub"}, "new_name": {"renamed"}}); code != http.StatusNoContent {
+		t.Fatalf("rename by cached path = %d, want 204", code)
+	}
+	if f, _ := s.File(sub); f.Name != "renamed" {
+		t.Errorf("folder named %q, want renamed", f.Name)
+	}
+	if *rootLists != 0 {
+		t.Errorf("rename by cached path listed the root folder %d times", *rootLists)
+	}
+	if id, ok := cache.GoCache.Get(cache.FileIdKey(aliyuntest.DriveId, "dir/renamed")); !ok || id != sub {
+		t.Errorf("renamed folder cached as %v, want %s", id, sub)
+	}
+	for _, p := range []string{"dir/sub", "dir/sub/b.txt"} {
+		if _, ok := cache.GoCache.Get(cache.FileIdKey(aliyuntest.DriveId, p)); ok {
+			t.Errorf("old path %s still cached", p)
+		}
+	}
+
+	//未缓存的路径从根目录查找
+	cache.GoCache.Flush()
+	if code := rename(url.Values{"path": {"dir/renamed/b.txt"}, "new_name": {"c.txt"}}); code != http.StatusNoContent {
+		t.Fatalf("rename by uncached path = %d, want 204", code)
+	}
+	if f, _ := s.File(a); f.Name != "c.txt" {
+		t.Errorf("file named %q, want c.txt", f.Name)
+	}
+	if *rootLists == 0 {
+		t.Error("uncached path resolved without a walk")
+	}
+}
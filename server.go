@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"go-aliyun-webdav/aliyun/net"
+	"go-aliyun-webdav/webdav"
+	"net/http"
+	"strings"
+)
+
+// ServerConfig 构建HTTP服务所需的配置
+type ServerConfig struct {
+	Addr    string
+	Handler *webdav.Handler
+	Auth    webdav.Authenticator
+	// RootFolder 切换网盘后重新解析的根目录
+	RootFolder string
+	// FFmpeg 生成视频缩略图使用的ffmpeg，为空时不生成
+	FFmpeg string
+	// WellKnown 直接响应/favicon.ico和/robots.txt
+	WellKnown bool
+	// Log 打印每个请求的地址和方法
+	Log bool
+	// CORSOrigins 允许带账户密码跨域访问的网页来源(如https://player.example.com)，
+	// 为空时允许任何来源，但浏览器不会带上账户密码
+	CORSOrigins []string
+}
+
+// NewServer 创建提供WebDav及管理接口的HTTP服务，使用独立的ServeMux而不是http.DefaultServeMux，
+// 因此同一进程中(如测试)可以运行多个实例，各自使用自己的Handler、账户和端口。
+// 实例之间仍共用进程级的状态：缓存cache.GoCache(键按网盘区分，不同网盘的实例互不影响)，
+// 以及网盘中对外提供服务的根目录(aliyun.SetRoot)，任一实例通过/admin/drive切换网盘都会替换所有实例的根目录
+func NewServer(cfg ServerConfig) *http.Server {
+	fs, auth := cfg.Handler, cfg.Auth
+	mux := http.NewServeMux()
+
+	if cfg.WellKnown {
+		//浏览器和爬虫会请求这两个路径，直接响应避免无谓的鉴权失败和阿里云接口调用
+		mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			w.WriteHeader(http.StatusNoContent)
+		})
+		mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("User-agent: *\nDisallow: /\n"))
+		})
+	}
+
+	admin := &driveAdmin{fs: fs, rootFolder: cfg.RootFolder}
+	mux.HandleFunc("/admin/drives", func(w http.ResponseWriter, req *http.Request) {
+		if apiAuthorized(w, req, auth) {
+			admin.listDrives(w, req)
+		}
+	})
+	mux.HandleFunc("/admin/drive", func(w http.ResponseWriter, req *http.Request) {
+		if apiAuthorized(w, req, auth) {
+			admin.switchDrive(w, req)
+		}
+	})
+
+	mux.HandleFunc("/admin/uploads", func(w http.ResponseWriter, req *http.Request) {
+		if apiAuthorized(w, req, auth) {
+			listUploads(w, req)
+		}
+	})
+
+	mux.HandleFunc("/api/download-folder", func(w http.ResponseWriter, req *http.Request) {
+		if apiAuthorized(w, req, auth) {
+			downloadFolder(fs, w, req)
+		}
+	})
+
+	if !fs.ReadOnly {
+		mux.HandleFunc("/api/rename", func(w http.ResponseWriter, req *http.Request) {
+			if apiAuthorized(w, req, auth) {
+				renameFile(fs, w, req)
+			}
+		})
+	}
+
+	thumbnails := newThumbnailer(fs, cfg.FFmpeg)
+	mux.HandleFunc("/api/thumbnail", func(w http.ResponseWriter, req *http.Request) {
+		if apiAuthorized(w, req, auth) {
+			thumbnails.serve(w, req)
+		}
+	})
+
+	if fs.Shortcuts != nil {
+		mux.HandleFunc("/admin/shortcuts", func(w http.ResponseWriter, req *http.Request) {
+			if apiAuthorized(w, req, auth) {
+				shortcuts(fs, w, req)
+			}
+		})
+	}
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		// Add CORS headers before any operation so even on a 401 unauthorized status, CORS will work.
+		setCORSHeaders(w, req, fs.Methods(), cfg.CORSOrigins)
+		//浏览器的预检请求不带账户密码，直接放行，实际的请求仍然需要认证
+		if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !authorized(w, req, auth) {
+			return
+		}
+
+		if req.Method == "GET" && strings.HasPrefix(req.URL.Path, fs.Prefix) {
+			info, err := fs.FileSystem.Stat(req.Context(), strings.TrimPrefix(req.URL.Path, fs.Prefix))
+			if err == nil && info.IsDir() {
+				req.Method = "PROPFIND"
+
+				if req.Header.Get("Depth") == "" {
+					req.Header.Add("Depth", "1")
+				}
+			}
+		}
+		if cfg.Log {
+			fmt.Println(req.URL)
+			fmt.Println(req.Method)
+		}
+		fs.ServeHTTP(w, req)
+	})
+
+	return &http.Server{Addr: cfg.Addr, Handler: withRequestID(mux)}
+}
+
+// withRequestID 为每个请求分配请求ID(客户端传入X-Request-ID时沿用)并放入请求的context，
+// 管理接口和WebDav请求调用阿里云接口时都会带上它，日志也可以按请求ID对应
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(net.RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = net.NewRequestID()
+		}
+		w.Header().Set(net.RequestIDHeader, id)
+		next.ServeHTTP(w, req.WithContext(net.WithRequestID(req.Context(), id)))
+	})
+}
+
+// setCORSHeaders 允许浏览器中的网页(如HLS播放器)跨域访问。origins为空时允许任何来源(*)，但不允许带账户密码；
+// 否则只有origins中的来源原样返回并允许带账户密码，其他网页不能借用浏览器保存的账户密码访问网盘。
+// Range等请求头需要允许，Content-Range等响应头需要公开，播放器才能分段读取视频。
+// methods为当前开启的方法，只读模式下不含修改操作
+func setCORSHeaders(w http.ResponseWriter, req *http.Request, methods []string, origins []string) {
+	if len(origins) == 0 {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Add("Vary", "Origin")
+		origin := req.Header.Get("Origin")
+		if !allowedOrigin(origin, origins) {
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Range, If-Range, Content-Type, Depth, Destination, Overwrite")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Length, Accept-Ranges, ETag")
+}
+
+// allowedOrigin 判断请求的Origin是否在允许的来源中，忽略大小写及末尾的/
+func allowedOrigin(origin string, origins []string) bool {
+	origin = strings.TrimSuffix(origin, "/")
+	if origin == "" || origin == "null" {
+		return false
+	}
+	for _, o := range origins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
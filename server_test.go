@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/webdav"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestServer builds a server for the drive of a fake Aliyun API, which is
+// closed at the end of the test, with the user admin and password secret.
+// setup, if not nil, changes the config before the server is built.
+func newTestServer(t *testing.T, setup func(cfg *ServerConfig)) (http.Handler, *webdav.Handler, *aliyuntest.Server) {
+	t.Helper()
+	cache.GoCache = cache.New(cache.DefaultExpiration, 0)
+	s := aliyuntest.New()
+	t.Cleanup(s.Close)
+	aliyun.SetRoot("root", "/")
+	fs := &webdav.Handler{
+		Prefix:     "/",
+		FileSystem: webdav.Dir(t.TempDir()),
+		LockSystem: webdav.NewMemLS(),
+		Config: model.Config{
+			RefreshToken: "refresh",
+			Token:        "token",
+			DriveId:      aliyuntest.DriveId,
+			ExpireTime:   time.Now().Add(time.Hour).Unix(),
+		},
+	}
+	cfg := ServerConfig{Handler: fs, Auth: webdav.StaticAuth{User: "admin", Password: "secret"}}
+	if setup != nil {
+		setup(&cfg)
+	}
+	return NewServer(cfg).Handler, fs, s
+}
+
+// call sends an authenticated request to h and returns the recorded response.
+func call(h http.Handler, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	r.SetBasicAuth("admin", "secret")
+	if method == "POST" && body != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// preflight sends a CORS preflight request from origin to a server built
+// with the given allowed origins.
+func preflight(origins []string, origin string) http.Header {
+	server := NewServer(ServerConfig{
+		Handler:     &webdav.Handler{Prefix: "/", LockSystem: webdav.NewMemLS()},
+		Auth:        webdav.StaticAuth{User: "admin", Password: "secret"},
+		CORSOrigins: origins,
+	})
+	r := httptest.NewRequest("OPTIONS", "/video.m3u8", nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, r)
+	return w.Header()
+}
+
+func TestCORSWithoutAllowList(t *testing.T) {
+	hdr := preflight(nil, "https://evil.example.com")
+	if got := hdr.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := hdr.Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q without an allow-list", got)
+	}
+}
+
+func TestCORSAllowList(t *testing.T) {
+	origins := []string{"https://player.example.com"}
+	hdr := preflight(origins, "https://player.example.com")
+	if got := hdr.Get("Access-Control-Allow-Origin"); got != "https://player.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q for an allowed origin", got)
+	}
+	if got := hdr.Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q for an allowed origin, want true", got)
+	}
+
+	for _, origin := range []string{"https://evil.example.com", "null", ""} {
+		hdr := preflight(origins, origin)
+		if got := hdr.Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("origin %q reflected as %q", origin, got)
+		}
+		if got := hdr.Get("Access-Control-Allow-Credentials"); got != "" {
+			t.Errorf("credentials allowed for origin %q", origin)
+		}
+	}
+}
+
+func TestWellKnownPaths(t *testing.T) {
+	h, _, s := newTestServer(t, func(cfg *ServerConfig) { cfg.WellKnown = true })
+	for _, p := range []string{"/favicon.ico", "/robots.txt"} {
+		//浏览器和爬虫不带账户密码
+		r := httptest.NewRequest("GET", p, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code >= 300 {
+			t.Errorf("GET %s = %d", p, w.Code)
+		}
+	}
+	r := httptest.NewRequest("GET", "/robots.txt", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if body := w.Body.String(); body != "User-agent: *\nDisallow: /\n" {
+		t.Errorf("robots.txt = %q, want everything disallowed", body)
+	}
+	if n := s.Calls("/adrive/v3/file/list"); n != 0 {
+		t.Errorf("well-known paths made %d list calls", n)
+	}
+
+	h, _, _ = newTestServer(t, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/robots.txt", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /robots.txt with the option off = %d, want 401", w.Code)
+	}
+}
+
+// recordingAuth accepts the token "ldap-token" for any user and remembers
+// the users it was asked about. The user "broken" simulates an unavailable
+// backend.
+type recordingAuth struct {
+	users []string
+}
+
+func (a *recordingAuth) Authenticate(user, pass string) (bool, error) {
+	a.users = append(a.users, user)
+	if user == "broken" {
+		return false, errors.New("ldap unavailable")
+	}
+	return pass == "ldap-token", nil
+}
+
+func TestCustomAuthenticator(t *testing.T) {
+	auth := &recordingAuth{}
+	h, _, _ := newTestServer(t, func(cfg *ServerConfig) { cfg.Auth = auth })
+
+	for _, c := range []struct {
+		user, pass string
+		want       int
+	}{
+		{"alice", "ldap-token", http.StatusMultiStatus},
+		{"alice", "wrong", http.StatusUnauthorized},
+		//默认账户不再生效
+		{"admin", "secret", http.StatusUnauthorized},
+		{"broken", "ldap-token", http.StatusServiceUnavailable},
+	} {
+		r := httptest.NewRequest("PROPFIND", "/", nil)
+		r.Header.Set("Depth", "0")
+		r.SetBasicAuth(c.user, c.pass)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s/%s = %d, want %d", c.user, c.pass, w.Code, c.want)
+		}
+	}
+	if len(auth.users) != 4 {
+		t.Errorf("authenticator called for %v, want every request", auth.users)
+	}
+
+	//没有带账户密码的请求不调用鉴权
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PROPFIND", "/", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("anonymous request = %d, want 401 with a challenge", w.Code)
+	}
+	if len(auth.users) != 4 {
+		t.Errorf("authenticator called without credentials")
+	}
+}
+
+func TestServerRequestID(t *testing.T) {
+	h, _, s := newTestServer(t, nil)
+	r := httptest.NewRequest("PROPFIND", "/", nil)
+	r.Header.Set("Depth", "1")
+	r.Header.Set("X-Request-ID", "trace-2")
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("X-Request-ID"); got != "trace-2" {
+		t.Errorf("X-Request-ID = %q, want trace-2", got)
+	}
+	if ids := s.RequestIDs("/adrive/v3/file/list"); len(ids) == 0 || ids[len(ids)-1] != "trace-2" {
+		t.Errorf("file list sent request ids %v, want trace-2", ids)
+	}
+
+	//未通过鉴权的请求也带请求ID
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PROPFIND", "/", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("X-Request-ID") == "" {
+		t.Errorf("401 response = %d without a request id", w.Code)
+	}
+}
+
+func TestTwoServers(t *testing.T) {
+	_, _, s := newTestServer(t, nil)
+	s.Put("root", "a.txt", []byte("hello"))
+	//两个服务各有一个Handler，网盘、本地目录和账户都不同，各自监听一个端口
+	users := []webdav.StaticAuth{{User: "admin", Password: "secret"}, {User: "other", Password: "pass"}}
+	urls := make([]string, len(users))
+	for i, auth := range users {
+		dir := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(dir, "local.txt"), []byte(auth.User), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fs := &webdav.Handler{
+			Prefix:      "/",
+			LocalPrefix: "/local",
+			FileSystem:  webdav.Dir(dir),
+			LockSystem:  webdav.NewMemLS(),
+			Config: model.Config{
+				RefreshToken: "refresh",
+				Token:        "token",
+				DriveId:      strconv.Itoa(i + 1),
+				ExpireTime:   time.Now().Add(time.Hour).Unix(),
+			},
+		}
+		server := NewServer(ServerConfig{Handler: fs, Auth: auth})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(ln)
+		t.Cleanup(func() { server.Close() })
+		urls[i] = "http://" + ln.Addr().String()
+	}
+	if urls[0] == urls[1] {
+		t.Fatal("both servers listen on the same address")
+	}
+
+	get := func(url string, auth webdav.StaticAuth, p string) (int, string) {
+		r, _ := http.NewRequest("GET", url+p, nil)
+		r.SetBasicAuth(auth.User, auth.Password)
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	for i, url := range urls {
+		if code, body := get(url, users[i], "/a.txt"); code != http.StatusOK || body != "hello" {
+			t.Errorf("server %d GET = %d %q, want the file", i, code, body)
+		}
+		if code, body := get(url, users[i], "/local/local.txt"); code != http.StatusOK || body != users[i].User {
+			t.Errorf("server %d GET /local/local.txt = %d %q, want its own local file", i, code, body)
+		}
+		if code, _ := get(url, users[1-i], "/a.txt"); code != http.StatusUnauthorized {
+			t.Errorf("server %d accepted the account of the other server: %d", i, code)
+		}
+	}
+
+	//两个网盘的根目录列表分别缓存
+	for _, driveId := range []string{"1", "2"} {
+		if _, ok := cache.GoCache.Get(cache.ListKey(driveId, "root")); !ok {
+			t.Errorf("drive %s did not cache its root listing", driveId)
+		}
+	}
+
+	//路由不能注册到全局的DefaultServeMux
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/a.txt", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("DefaultServeMux served %d, want nothing registered", w.Code)
+	}
+}
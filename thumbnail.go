@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/webdav"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// thumbnailer 提供文件缩略图：优先使用阿里云生成的缩略图，视频没有缩略图时可选用ffmpeg截取一帧
+type thumbnailer struct {
+	fs *webdav.Handler
+	// ffmpeg ffmpeg可执行文件的路径，为空时不生成缩略图
+	ffmpeg string
+	// sem 限制同时运行的ffmpeg进程数
+	sem chan struct{}
+}
+
+func newThumbnailer(fs *webdav.Handler, ffmpeg string) *thumbnailer {
+	t := &thumbnailer{fs: fs, sem: make(chan struct{}, 2)}
+	if ffmpeg == "" {
+		return t
+	}
+	path, err := exec.LookPath(ffmpeg)
+	if err != nil {
+		fmt.Println("⚠️  未找到ffmpeg，不生成视频缩略图", err)
+		return t
+	}
+	t.ffmpeg = path
+	return t
+}
+
+// serve GET /api/thumbnail?path=
+func (t *thumbnailer) serve(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	filePath := strings.Trim(req.URL.Query().Get("path"), "/")
+	if filePath == "" {
+		apiError(w, http.StatusBadRequest, codeBadRequest, "path is required")
+		return
+	}
+	paths := strings.Split(filePath, "/")
+	item, _, err := aliyun.Walk(req.Context(), t.fs.CurrentConfig().Token, t.fs.CurrentConfig().DriveId, paths, "")
+	if err != nil || item.Name != paths[len(paths)-1] || item.Type == "folder" {
+		apiError(w, http.StatusNotFound, codeNotFound, "file not found: "+filePath)
+		return
+	}
+	if item.Thumbnail != "" {
+		http.Redirect(w, req, item.Thumbnail, http.StatusFound)
+		return
+	}
+	if item.Category != "video" || t.ffmpeg == "" {
+		apiError(w, http.StatusNotFound, codeNotFound, "no thumbnail")
+		return
+	}
+	data, err := t.videoFrame(req.Context(), item.FileId)
+	if err != nil {
+		fmt.Println("❌  生成缩略图失败", filePath, err)
+		apiError(w, http.StatusNotFound, codeNotFound, "no thumbnail")
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+}
+
+// videoFrame 用ffmpeg从视频的下载地址截取一帧作为缩略图，按FileId缓存
+func (t *thumbnailer) videoFrame(ctx context.Context, fileId string) ([]byte, error) {
+	if data, ok := cache.GoCache.Get("THUMB_" + fileId); ok {
+		return data.([]byte), nil
+	}
+	select {
+	case t.sem <- struct{}{}:
+		defer func() { <-t.sem }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	downloadUrl := aliyun.GetDownloadUrl(ctx, t.fs.CurrentConfig().Token, t.fs.CurrentConfig().DriveId, fileId)
+	//-ss放在-i之前，ffmpeg只会按需用Range请求读取视频头和目标位置附近的数据
+	cmd := exec.CommandContext(ctx, t.ffmpeg, "-loglevel", "error",
+		"-headers", "Referer: https://www.aliyundrive.com/\r\n",
+		"-ss", "10", "-i", downloadUrl,
+		"-frames:v", "1", "-vf", "scale=300:-2", "-f", "image2", "-c:v", "mjpeg", "-")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		//视频短于10秒时截取不到，不缓存，交给客户端显示默认图标
+		return nil, fmt.Errorf("empty frame")
+	}
+	data := stdout.Bytes()
+	cache.GoCache.Set("THUMB_"+fileId, data, 24*time.Hour)
+	return data, nil
+}
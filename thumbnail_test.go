@@ -0,0 +1,115 @@
+package main
+
+import (
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeFFmpeg 写一个代替ffmpeg的脚本，输出output作为截取的帧，返回脚本路径及运行次数
+func fakeFFmpeg(t *testing.T, output string) (string, func() int) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "ffmpeg")
+	content := "#!/bin/sh\necho run >> " + runs + "\nprintf '" + output + "'\n"
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script, func() int {
+		data, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(data), "run")
+	}
+}
+
+func putVideo(s *aliyuntest.Server, name string) string {
+	id := s.Put("root", name, []byte("not really a video"))
+	s.Update(id, func(f *aliyuntest.File) { f.Category = "video" })
+	return id
+}
+
+func TestThumbnailFromAliyun(t *testing.T) {
+	h, _, s := newTestServer(t, nil)
+	id := s.Put("root", "photo.jpg", []byte("jpeg"))
+	s.Update(id, func(f *aliyuntest.File) { f.Thumbnail = "https://thumbnail.example.com/photo" })
+
+	w := call(h, "GET", "/api/thumbnail?path=/photo.jpg", nil)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://thumbnail.example.com/photo" {
+		t.Errorf("thumbnail = %d %s, want a redirect to Aliyun's thumbnail", w.Code, w.Header().Get("Location"))
+	}
+	for target, want := range map[string]int{
+		"/api/thumbnail":                  http.StatusBadRequest,
+		"/api/thumbnail?path=missing.jpg": http.StatusNotFound,
+	} {
+		if w := call(h, "GET", target, nil); w.Code != want {
+			t.Errorf("GET %s = %d, want %d", target, w.Code, want)
+		}
+	}
+}
+
+func TestThumbnailWithoutFFmpeg(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "no-such-ffmpeg")
+	h, _, s := newTestServer(t, func(cfg *ServerConfig) { cfg.FFmpeg = missing })
+	putVideo(s, "movie.mp4")
+
+	w := call(h, "GET", "/api/thumbnail?path=movie.mp4", nil)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "no thumbnail") {
+		t.Errorf("video thumbnail without ffmpeg = %d %s, want 404", w.Code, w.Body.String())
+	}
+	if n := s.Calls("/v2/file/get_download_url"); n != 0 {
+		t.Errorf("fetched %d download urls without ffmpeg", n)
+	}
+}
+
+func TestThumbnailFFmpegCache(t *testing.T) {
+	ffmpeg, runs := fakeFFmpeg(t, "JPEG frame")
+	h, _, s := newTestServer(t, func(cfg *ServerConfig) { cfg.FFmpeg = ffmpeg })
+	putVideo(s, "a.mp4")
+	putVideo(s, "b.mp4")
+	s.Put("root", "doc.txt", []byte("text"))
+
+	for i := 0; i < 2; i++ {
+		w := call(h, "GET", "/api/thumbnail?path=a.mp4", nil)
+		if w.Code != http.StatusOK || w.Body.String() != "JPEG frame" || w.Header().Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("video thumbnail = %d %s %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("ffmpeg ran %d times for one video, want the frame cached", n)
+	}
+	if w := call(h, "GET", "/api/thumbnail?path=b.mp4", nil); w.Code != http.StatusOK {
+		t.Errorf("second video thumbnail = %d, want 200", w.Code)
+	}
+	if n := runs(); n != 2 {
+		t.Errorf("ffmpeg ran %d times for two videos, want 2", n)
+	}
+	//不是视频的文件不生成缩略图
+	if w := call(h, "GET", "/api/thumbnail?path=doc.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("thumbnail of a text file = %d, want 404", w.Code)
+	}
+	if n := runs(); n != 2 {
+		t.Errorf("ffmpeg ran for a text file")
+	}
+}
+
+func TestThumbnailEmptyFrame(t *testing.T) {
+	//视频太短截取不到帧时返回404，不缓存
+	ffmpeg, runs := fakeFFmpeg(t, "")
+	h, _, s := newTestServer(t, func(cfg *ServerConfig) { cfg.FFmpeg = ffmpeg })
+	putVideo(s, "short.mp4")
+	for i := 0; i < 2; i++ {
+		if w := call(h, "GET", "/api/thumbnail?path=short.mp4", nil); w.Code != http.StatusNotFound {
+			t.Errorf("thumbnail of a short video = %d, want 404", w.Code)
+		}
+	}
+	if n := runs(); n != 2 {
+		t.Errorf("ffmpeg ran %d times, want the failure not cached", n)
+	}
+}
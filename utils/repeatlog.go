@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RepeatLogger 连续重复的相同日志只打印第一次，之后每隔Interval汇总打印一次重复的次数，
+// 断网时不断重试的失败日志不会刷屏。Interval为0时不合并，每条都打印
+type RepeatLogger struct {
+	Interval time.Duration
+
+	mu      sync.Mutex
+	last    string
+	repeats int
+	since   time.Time
+}
+
+// Println 与fmt.Println相同，但与上一条相同的日志会被合并
+func (l *RepeatLogger) Println(a ...interface{}) {
+	msg := fmt.Sprintln(a...)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Interval <= 0 {
+		fmt.Print(msg)
+		return
+	}
+	now := time.Now()
+	if msg == l.last {
+		l.repeats++
+		if now.Sub(l.since) >= l.Interval {
+			l.summary()
+			l.since = now
+		}
+		return
+	}
+	l.summary()
+	l.last, l.since = msg, now
+	fmt.Print(msg)
+}
+
+// Reset 问题恢复后调用，打印尚未汇总的重复次数，之后相同的日志会重新打印
+func (l *RepeatLogger) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.summary()
+	l.last = ""
+}
+
+// summary 打印上一条日志尚未汇总的重复次数，调用时需持有l.mu
+func (l *RepeatLogger) summary() {
+	if l.repeats > 0 {
+		fmt.Printf("🔁  上一条日志在%s内又重复了%d次: %s\n", time.Since(l.since).Round(time.Second), l.repeats, strings.TrimSpace(l.last))
+		l.repeats = 0
+	}
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureStdout 返回fn打印到标准输出的内容
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+	done := make(chan []byte)
+	go func() {
+		out, _ := ioutil.ReadAll(r)
+		done <- out
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+func TestRepeatLogger(t *testing.T) {
+	l := &RepeatLogger{Interval: 50 * time.Millisecond}
+	out := captureStdout(t, func() {
+		for i := 0; i < 5; i++ {
+			l.Println("刷新token失败", "timeout")
+		}
+	})
+	//连续相同的日志只打印一次
+	if out != "刷新token失败 timeout\n" {
+		t.Errorf("5 identical lines printed %q, want one line", out)
+	}
+
+	//超过Interval后汇总打印重复的次数
+	time.Sleep(60 * time.Millisecond)
+	out = captureStdout(t, func() {
+		l.Println("刷新token失败", "timeout")
+		l.Println("刷新token失败", "timeout")
+	})
+	if strings.Count(out, "\n") != 1 || !strings.Contains(out, "又重复了5次: 刷新token失败 timeout") {
+		t.Errorf("after the interval printed %q, want one summary of 5 repeats", out)
+	}
+
+	//不同的日志先汇总上一条，再打印
+	out = captureStdout(t, func() {
+		l.Println("刷新token失败", "refused")
+	})
+	want := []string{"又重复了1次: 刷新token失败 timeout", "刷新token失败 refused"}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], want[0]) || lines[1] != want[1] {
+		t.Errorf("different line printed %q, want %q", out, want)
+	}
+
+	//恢复后汇总，之后相同的日志重新打印
+	out = captureStdout(t, func() {
+		l.Println("刷新token失败", "refused")
+		l.Reset()
+		l.Reset()
+		l.Println("刷新token失败", "refused")
+	})
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "又重复了1次") || lines[1] != "刷新token失败 refused" {
+		t.Errorf("after Reset printed %q, want a summary and the line again", out)
+	}
+}
+
+func TestRepeatLoggerDisabled(t *testing.T) {
+	l := &RepeatLogger{}
+	out := captureStdout(t, func() {
+		for i := 0; i < 3; i++ {
+			l.Println("刷新token失败")
+		}
+		l.Reset()
+	})
+	if out != strings.Repeat("刷新token失败\n", 3) {
+		t.Errorf("Interval 0 printed %q, want every line", out)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+)
+
+// 以下变量在编译时通过-ldflags "-X main.Commit=... -X main.BuildDate=..."注入
+var Commit = "unknown"
+var BuildDate = "unknown"
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// printVersion 输出版本信息，asJSON为true时输出JSON格式便于脚本解析
+func printVersion(asJSON bool) {
+	info := currentBuildInfo()
+	if asJSON {
+		data, _ := json.Marshal(info)
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Println(info.Version)
+	fmt.Println("commit:    ", info.Commit)
+	fmt.Println("build date:", info.BuildDate)
+	fmt.Println("go version:", info.GoVersion)
+	fmt.Println("platform:  ", info.Platform)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// captureStdout 返回f执行期间输出到标准输出的内容
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestPrintVersion(t *testing.T) {
+	defer func(commit, date string) { Commit, BuildDate = commit, date }(Commit, BuildDate)
+	Commit, BuildDate = "abc1234", "2021-09-01T08:30:15Z"
+
+	var info map[string]string
+	out := captureStdout(t, func() { printVersion(true) })
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		t.Fatalf("-V -json output is not JSON: %v\n%s", err, out)
+	}
+	for field, want := range map[string]string{
+		"version":    Version,
+		"commit":     "abc1234",
+		"build_date": "2021-09-01T08:30:15Z",
+		"go_version": runtime.Version(),
+		"platform":   runtime.GOOS + "/" + runtime.GOARCH,
+	} {
+		if info[field] != want {
+			t.Errorf("%s = %q, want %q", field, info[field], want)
+		}
+	}
+
+	out = captureStdout(t, func() { printVersion(false) })
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 5 || lines[0] != Version {
+		t.Fatalf("-V output:\n%s", out)
+	}
+	for _, want := range []string{"abc1234", "2021-09-01T08:30:15Z", runtime.Version()} {
+		if !strings.Contains(out, want) {
+			t.Errorf("-V output missing %s:\n%s", want, out)
+		}
+	}
+}
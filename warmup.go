@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"strings"
+	"time"
+)
+
+// warmup 预先列出paths中的目录及其下一级子目录，填充目录列表和FID_缓存，
+// 避免重启后第一次浏览常用目录时等待
+func warmup(config model.Config, paths []string) {
+	start := time.Now()
+	count := 0
+	for _, p := range paths {
+		p = strings.Trim(p, "/")
+		var parts []string
+		if p != "" {
+			parts = strings.Split(p, "/")
+		}
+		item, list, err := aliyun.Walk(context.Background(), config.Token, config.DriveId, parts, "")
+		if err != nil || (len(parts) > 0 && item.Name != parts[len(parts)-1]) {
+			fmt.Println("⚠️  预热目录不存在", "/"+p)
+			continue
+		}
+		if item.FileId != "" && item.Type != "folder" {
+			continue
+		}
+		cacheIds(config.DriveId, p, item, list)
+		count++
+		for _, child := range list.Items {
+			if child.Type != "folder" {
+				continue
+			}
+			childList, err := aliyun.GetList(context.Background(), config.Token, config.DriveId, child.FileId)
+			if err != nil {
+				continue
+			}
+			cacheIds(config.DriveId, strings.TrimPrefix(p+"/"+child.Name, "/"), child, childList)
+			count++
+		}
+	}
+	fmt.Println("🔥  缓存预热完成", count, "个目录", time.Since(start).Round(time.Millisecond))
+}
+
+// cacheIds 与PROPFIND相同，记录目录及其子项路径对应的FileId
+func cacheIds(driveId string, dirPath string, dir model.ListModel, list model.FileListModel) {
+	items := make(map[string]interface{}, len(list.Items)+1)
+	if dir.FileId != "" {
+		items[cache.FileIdKey(driveId, dirPath)] = dir.FileId
+	}
+	prefix := dirPath + "/"
+	if dirPath == "" {
+		prefix = ""
+	}
+	for _, i := range list.Items {
+		items[cache.FileIdKey(driveId, prefix+i.Name)] = i.FileId
+	}
+	cache.SetMany(items)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/cache"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	h, fs, s := newTestServer(t, nil)
+	media := s.Mkdir("root", "media")
+	movies := s.Mkdir(media, "movies")
+	s.Mkdir(media, "music")
+	s.Put(media, "a.txt", []byte("a"))
+	s.Put(movies, "film.mp4", []byte("film"))
+	docs := s.Mkdir("root", "docs")
+	s.Put(docs, "x.txt", []byte("x"))
+
+	warmup(fs.CurrentConfig(), []string{"/media", "/missing", "/media/a.txt"})
+
+	for p, want := range map[string]bool{
+		"media":        true,
+		"media/movies": true,
+		"media/music":  true,
+		"media/a.txt":  true,
+		//预热的目录下一级子目录中的文件
+		"media/movies/film.mp4": true,
+		"docs/x.txt":            false,
+	} {
+		if _, ok := cache.GoCache.Get(cache.FileIdKey(aliyuntest.DriveId, p)); ok != want {
+			t.Errorf("path %s cached = %v, want %v", p, ok, want)
+		}
+	}
+	//预热过的目录浏览时不再调用阿里云
+	lists := s.Calls("/adrive/v3/file/list")
+	r := httptest.NewRequest("PROPFIND", "/media/movies/", nil)
+	r.Header.Set("Depth", "1")
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "film.mp4") {
+		t.Fatalf("PROPFIND /media/movies/ = %d", w.Code)
+	}
+	if n := s.Calls("/adrive/v3/file/list") - lists; n != 0 {
+		t.Errorf("PROPFIND of a warmed folder listed %d folders, want none", n)
+	}
+}
+
+func TestWarmupRoot(t *testing.T) {
+	_, fs, s := newTestServer(t, nil)
+	dir := s.Mkdir("root", "dir")
+	s.Put(dir, "b.txt", []byte("b"))
+
+	warmup(fs.CurrentConfig(), []string{"/"})
+	for _, p := range []string{"dir", "dir/b.txt"} {
+		if _, ok := cache.GoCache.Get(cache.FileIdKey(aliyuntest.DriveId, p)); !ok {
+			t.Errorf("path %s not cached after warming up the root", p)
+		}
+	}
+}
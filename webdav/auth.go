@@ -0,0 +1,24 @@
+package webdav
+
+import "crypto/subtle"
+
+// An Authenticator checks the credentials of a Basic auth request. It lets
+// operators plug in an external service (LDAP, OIDC token introspection,
+// ...) instead of the single static account.
+type Authenticator interface {
+	// Authenticate reports whether user and pass are valid. A non-nil error
+	// means the decision could not be made, e.g. the backend is unavailable.
+	Authenticate(user, pass string) (bool, error)
+}
+
+// StaticAuth is an Authenticator accepting a single fixed account.
+type StaticAuth struct {
+	User     string
+	Password string
+}
+
+func (a StaticAuth) Authenticate(user, pass string) (bool, error) {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.User)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.Password)) == 1
+	return userOK && passOK, nil
+}
@@ -0,0 +1,22 @@
+package webdav
+
+import "testing"
+
+func TestStaticAuth(t *testing.T) {
+	auth := StaticAuth{User: "admin", Password: "secret"}
+	for _, c := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"admin", "secret", true},
+		{"admin", "Secret", false},
+		{"Admin", "secret", false},
+		{"admin", "", false},
+		{"", "", false},
+	} {
+		ok, err := auth.Authenticate(c.user, c.pass)
+		if err != nil || ok != c.want {
+			t.Errorf("Authenticate(%q, %q) = %v, %v; want %v", c.user, c.pass, ok, err, c.want)
+		}
+	}
+}
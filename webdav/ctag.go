@@ -0,0 +1,55 @@
+package webdav
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/model"
+	"sort"
+	"strconv"
+)
+
+// http://svn.calendarserver.org/repository/calendarserver/CalendarServer/trunk/doc/Extensions/caldav-ctag.txt
+var ctagProp = xml.Name{Space: "http://calendarserver.org/ns/", Local: "getctag"}
+
+// folderLister returns the children of the folder fileId. handlePropfind
+// passes it to findCTag through the context, as the property functions have
+// no access to the Handler.
+type folderLister func(ctx context.Context, fileId string) (model.FileListModel, error)
+
+type folderListerKey struct{}
+
+func (h *Handler) listFolder(ctx context.Context, fileId string) (model.FileListModel, error) {
+	if err := ctx.Err(); err != nil {
+		return model.FileListModel{}, err
+	}
+	return aliyun.GetList(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fileId)
+}
+
+// findCTag returns a tag of a folder that changes whenever a child is added,
+// removed, renamed or modified, so sync clients can skip listing folders
+// whose tag is unchanged. Changes deeper down are not reflected.
+func findCTag(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
+	lister, ok := ctx.Value(folderListerKey{}).(folderLister)
+	if !ok {
+		return "", errPropUnavailable
+	}
+	fileId := fi.FileId
+	if fileId == "" {
+		fileId = aliyun.RootFileId()
+	}
+	list, err := lister(ctx, fileId)
+	if err != nil {
+		return "", errPropUnavailable
+	}
+	items := make([]model.ListModel, len(list.Items))
+	copy(items, list.Items)
+	sort.Slice(items, func(i, j int) bool { return items[i].FileId < items[j].FileId })
+	h := sha1.New()
+	for _, item := range items {
+		h.Write([]byte(item.FileId + "\x00" + item.Name + "\x00" + strconv.FormatInt(item.UpdatedAt.UnixNano(), 10) + "\x00" + strconv.FormatInt(item.Size, 10) + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,230 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// downloadPartSize is the length of the sub-range each connection of a
+// parallel download fetches at a time.
+const downloadPartSize = 4 * 1024 * 1024
+
+// byteRange is a range of bytes of a file, both ends included.
+type byteRange struct {
+	start, end int64
+}
+
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+func (br byteRange) header() string {
+	return "bytes=" + strconv.FormatInt(br.start, 10) + "-" + strconv.FormatInt(br.end, 10)
+}
+
+// parseByteRange parses the Range header hdr of a request for a file of the
+// given size. ok is false when the whole file is to be served: without a
+// header, and for multiple or malformed ranges, which RFC 7233 allows a
+// server to ignore. A range starting past the end of the file yields
+// errRangeNotSatisfiable.
+func parseByteRange(hdr string, size int64) (br byteRange, ok bool, err error) {
+	if !strings.HasPrefix(hdr, "bytes=") || strings.Contains(hdr, ",") {
+		return byteRange{}, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(hdr, "bytes="))
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return byteRange{}, false, nil
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if first == "" {
+		//bytes=-n 表示最后n个字节
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, false, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{start: size - n, end: size - 1}, true, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return byteRange{}, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return byteRange{}, false, errRangeNotSatisfiable
+	}
+	return byteRange{start: start, end: end}, true, nil
+}
+
+// ifRangeMatches reports whether the If-Range header hdr still names the
+// file whose current ETag and modification time are given, that is whether
+// the requested range may be served instead of the whole file.
+func ifRangeMatches(hdr, etag string, modTime time.Time) bool {
+	if hdr == "" {
+		return true
+	}
+	if strings.HasPrefix(hdr, `"`) || strings.HasPrefix(hdr, "W/") {
+		return hdr == etag
+	}
+	t, err := http.ParseTime(hdr)
+	return err == nil && modTime.Truncate(time.Second).Equal(t)
+}
+
+// headerWriter writes the response headers with the given status on the
+// first byte of the body, so that a download failing before it has sent
+// anything can still be answered with an error status.
+type headerWriter struct {
+	w       http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (hw *headerWriter) Write(p []byte) (int, error) {
+	if hw.written == 0 && len(p) > 0 {
+		hw.w.WriteHeader(hw.status)
+	}
+	n, err := hw.w.Write(p)
+	hw.written += int64(n)
+	return n, err
+}
+
+// serveDownload sends the content of the file fi, or of the single range
+// the client asked for, from downloadUrl. Partial content is answered with
+// 206 and a Content-Range in the client's byte positions. With more than
+// one DownloadConnections, ranges longer than downloadPartSize are split
+// into sub-ranges fetched in parallel and written back in order.
+func (h *Handler) serveDownload(w http.ResponseWriter, r *http.Request, downloadUrl string, reqPath string, fi model.ListModel) (int, error) {
+	etag, err := findETag(r.Context(), h.FileSystem, h.LockSystem, reqPath, fi)
+	if err == nil {
+		w.Header().Set("ETag", etag)
+	}
+	br, partial, err := parseByteRange(r.Header.Get("Range"), fi.Size)
+	if (partial || err != nil) && !ifRangeMatches(r.Header.Get("If-Range"), etag, fi.UpdatedAt.Time) {
+		//文件已经变化，按RFC 7233返回整个文件
+		partial, err = false, nil
+	}
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fi.Size))
+		return http.StatusRequestedRangeNotSatisfiable, err
+	}
+	parallel := h.DownloadConnections > 1 && fi.Size > downloadPartSize
+	if !partial {
+		br = byteRange{start: 0, end: fi.Size - 1}
+	}
+	if parallel && br.length() <= downloadPartSize {
+		parallel = false
+	}
+
+	hw := &headerWriter{w: w, status: http.StatusOK}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if partial {
+		hw.status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, fi.Size))
+	}
+	if partial || parallel {
+		//此时fi是刚获取的文件详情，大小可信；目录列表缓存中的大小可能已过时，不发送Content-Length
+		w.Header().Set("Content-Length", strconv.FormatInt(br.length(), 10))
+	}
+
+	if parallel {
+		err = h.downloadParallel(r.Context(), hw, downloadUrl, fi.FileId, br)
+	} else if partial {
+		err = aliyun.GetFileRange(r.Context(), hw, downloadUrl, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.FileId, br.header())
+	} else if !aliyun.GetFile(r.Context(), hw, downloadUrl, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.FileId, "", "") {
+		err = errDownloadFailed
+	}
+	if errors.Is(err, net.ErrRangeIgnored) && hw.written == 0 {
+		//OSS不支持Range时不能把整个文件当作206返回，改为以200返回整个文件
+		w.Header().Del("Content-Range")
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size, 10))
+		hw.status = http.StatusOK
+		err = nil
+		if !aliyun.GetFile(r.Context(), hw, downloadUrl, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.FileId, "", "") {
+			err = errDownloadFailed
+		}
+	}
+	if err != nil {
+		if hw.written > 0 {
+			//已经发送了部分内容，只能中断连接
+			return 0, errDownloadFailed
+		}
+		for _, k := range []string{"Content-Disposition", "Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag"} {
+			w.Header().Del(k)
+		}
+		return http.StatusBadGateway, errDownloadFailed
+	}
+	if hw.written == 0 {
+		w.WriteHeader(hw.status)
+	}
+	return 0, nil
+}
+
+// downloadParallel writes the range br of the file fileId to w, fetching up
+// to DownloadConnections sub-ranges of downloadPartSize at once. Each
+// sub-range is buffered until all those before it have been written.
+func (h *Handler) downloadParallel(ctx context.Context, w *headerWriter, downloadUrl string, fileId string, br byteRange) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type part struct {
+		br   byteRange
+		done chan error
+		buf  bytes.Buffer
+	}
+	parts := make(chan *part, h.DownloadConnections-1)
+	go func() {
+		defer close(parts)
+		for start := br.start; start <= br.end; start += downloadPartSize {
+			p := &part{br: byteRange{start: start, end: start + downloadPartSize - 1}, done: make(chan error, 1)}
+			if p.br.end > br.end {
+				p.br.end = br.end
+			}
+			select {
+			case parts <- p:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				err := aliyun.GetFileRange(ctx, &p.buf, downloadUrl, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fileId, p.br.header())
+				if err == nil && int64(p.buf.Len()) != p.br.length() {
+					err = errDownloadFailed
+				}
+				p.done <- err
+			}()
+		}
+	}()
+	//正在写出的分片加上parts中缓冲的分片，同时下载的分片数不超过DownloadConnections
+	for p := range parts {
+		if err := <-p.done; err != nil {
+			net.Logln(ctx, "❌  分片下载失败", fileId, p.br.header())
+			return err
+		}
+		if _, err := w.Write(p.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,109 @@
+package webdav
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// patterned returns n bytes that differ at every offset modulo 251, so a
+// misplaced range shows up in the content.
+func patterned(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestDownloadRange(t *testing.T) {
+	for _, connections := range []int{0, 3} {
+		t.Run("connections="+strconv.Itoa(connections), func(t *testing.T) {
+			h, s := newTestHandler(t)
+			h.DownloadConnections = connections
+			content := patterned(3*downloadPartSize + 12345)
+			s.Put("root", "big.bin", content)
+
+			w := serve(h, "GET", "/big.bin", nil, "Range", "bytes=1000000-9000000")
+			if w.Code != http.StatusPartialContent {
+				t.Fatalf("GET = %d, want 206", w.Code)
+			}
+			if got, want := w.Header().Get("Content-Range"), "bytes 1000000-9000000/"+strconv.Itoa(len(content)); got != want {
+				t.Errorf("Content-Range = %q, want %q", got, want)
+			}
+			if !bytes.Equal(w.Body.Bytes(), content[1000000:9000001]) {
+				t.Errorf("body of %d bytes is not the requested range", w.Body.Len())
+			}
+		})
+	}
+}
+
+func TestDownloadRangeIgnoredUpstream(t *testing.T) {
+	for _, connections := range []int{0, 3} {
+		t.Run("connections="+strconv.Itoa(connections), func(t *testing.T) {
+			h, s := newTestHandler(t)
+			h.DownloadConnections = connections
+			content := patterned(2*downloadPartSize + 10)
+			id := s.Put("root", "big.bin", content)
+			//OSS忽略Range，总是返回整个文件
+			s.Handle("/oss/download/"+id, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				w.Write(content)
+			})
+
+			w := serve(h, "GET", "/big.bin", nil, "Range", "bytes=100-5000000")
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET = %d, want 200 when the upstream ignores ranges", w.Code)
+			}
+			if cr := w.Header().Get("Content-Range"); cr != "" {
+				t.Errorf("Content-Range = %q on a full response", cr)
+			}
+			if !bytes.Equal(w.Body.Bytes(), content) {
+				t.Errorf("body of %d bytes is not the whole file of %d", w.Body.Len(), len(content))
+			}
+		})
+	}
+}
+
+func TestDownloadRenewsRejectedUrl(t *testing.T) {
+	h, s := newTestHandler(t)
+	id := s.Put("root", "a.bin", []byte("content"))
+	rejected := false
+	s.Handle("/oss/download/"+id, func(w http.ResponseWriter, r *http.Request) {
+		if !rejected {
+			rejected = true
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<?xml version="1.0"?><Error><Code>AccessDenied</Code></Error>`))
+			return
+		}
+		s.Default(w, r)
+	})
+
+	w := serve(h, "GET", "/a.bin", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Errorf("GET = %d %q, want the content", w.Code, w.Body.String())
+	}
+	if n := s.Calls("/v2/file/get_download_url"); n != 2 {
+		t.Errorf("fetched %d download urls, want a fresh one after the 403", n)
+	}
+}
+
+func TestDownloadUpstreamError(t *testing.T) {
+	h, s := newTestHandler(t)
+	id := s.Put("root", "a.bin", []byte("content"))
+	const ossError = `<?xml version="1.0"?><Error><Code>InternalError</Code></Error>`
+	s.Handle("/oss/download/"+id, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(ossError))
+	})
+
+	w := serve(h, "GET", "/a.bin", nil)
+	if w.Code < 500 {
+		t.Errorf("GET = %d, want a 5xx", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "InternalError") {
+		t.Errorf("OSS error body sent as the file: %q", w.Body.String())
+	}
+}
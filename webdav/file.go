@@ -772,9 +772,12 @@ func walkFS(ctx context.Context, fs FileSystem, depth int, parent model.ListMode
 	// Read directory names.
 
 	for _, fileInfo := range info.Items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		//filename := path.Join(parent.Name, fileInfo.Name)
 		//fileInfo, err := fs.Stat(ctx, filename)
-		//fileList, err := aliyun.GetList(token, driver, fileInfo.FileId)
+		//fileList, err := aliyun.GetList(ctx, token, driver, fileInfo.FileId)
 		var fileList model.FileListModel
 		if err != nil {
 			if err := walkFn(fileInfo, fileList, err); err != nil && err != filepath.SkipDir {
@@ -783,7 +786,15 @@ func walkFS(ctx context.Context, fs FileSystem, depth int, parent model.ListMode
 		} else {
 			cheng += 1
 			if fileInfo.Type == "folder" && !strings.Contains(userAgent, "RaiDrive") && cheng < 2 {
-				info, _ := aliyun.GetList(token, driver, fileInfo.FileId)
+				info, listErr := aliyun.GetList(ctx, token, driver, fileInfo.FileId)
+				if listErr != nil {
+					//偶发的失败重试一次，仍失败时只报告该目录，不影响其它结果
+					info, listErr = aliyun.GetList(ctx, token, driver, fileInfo.FileId)
+				}
+				if listErr != nil {
+					walkFn(fileInfo, info, listErr)
+					continue
+				}
 				walkFS(ctx, fs, depth, fileInfo, info, walkFn, token, driver, userAgent, cheng)
 			} else {
 				err = walkFS(ctx, fs, depth, fileInfo, fileList, walkFn, token, driver, userAgent, cheng)
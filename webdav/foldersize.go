@@ -0,0 +1,74 @@
+package webdav
+
+import (
+	"context"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+)
+
+// FolderSizes reports the total size of the files inside a folder, at any
+// depth, in the ownCloud size property. Computing it lists every subfolder,
+// so it is off by default.
+var FolderSizes = false
+
+// Bounds of the folder size computations of a single PROPFIND. All the
+// folders it sizes share the maxFolderSizeFolders listings, so a Depth: 1
+// PROPFIND of a folder with many subfolders can't list the whole drive.
+// Bigger trees are reported without a size.
+var (
+	maxFolderSizeDepth   = 16
+	maxFolderSizeFolders = 1000
+)
+
+// folderSizer returns the total size of the files inside the folder fileId.
+// handlePropfind passes it to findFolderSize through the context, as the
+// property functions have no access to the Handler.
+type folderSizer func(ctx context.Context, fileId string) (int64, error)
+
+type folderSizerKey struct{}
+
+// newFolderSizer returns the folderSizer of one PROPFIND. It computes the
+// total size of the files inside a folder with a walk of its subfolders,
+// all walks together listing at most maxFolderSizeFolders folders. Every
+// folder walked is cached, so the sizes of the subfolders listed next are
+// free and don't count.
+func (h *Handler) newFolderSizer() folderSizer {
+	visited := 0
+	return func(ctx context.Context, fileId string) (int64, error) {
+		return h.sumFolder(ctx, fileId, 0, &visited)
+	}
+}
+
+func (h *Handler) sumFolder(ctx context.Context, fileId string, depth int, visited *int) (int64, error) {
+	key := "DIRSIZE_" + h.CurrentConfig().DriveId + "_" + fileId
+	if v, ok := cache.GoCache.Get(key); ok {
+		return v.(int64), nil
+	}
+	if depth > maxFolderSizeDepth {
+		return 0, errRecursionTooDeep
+	}
+	if *visited++; *visited > maxFolderSizeFolders {
+		return 0, errFolderTooLarge
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	list, err := aliyun.GetList(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fileId)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, item := range list.Items {
+		if item.Type != "folder" {
+			size += item.Size
+			continue
+		}
+		sub, err := h.sumFolder(ctx, item.FileId, depth+1, visited)
+		if err != nil {
+			return 0, err
+		}
+		size += sub
+	}
+	cache.SetDefault(key, size)
+	return size, nil
+}
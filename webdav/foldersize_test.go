@@ -0,0 +1,65 @@
+package webdav
+
+import (
+	"regexp"
+	"testing"
+)
+
+const folderSizeBody = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:" xmlns:oc="http://owncloud.org/ns"><D:prop><oc:size/></D:prop></D:propfind>`
+
+// folderSizes returns the ownCloud size of every href of a multistatus
+// response that has one.
+func folderSizes(body string) map[string]string {
+	sizes := map[string]string{}
+	re := regexp.MustCompile(`(?s)<D:href>([^<]*)</D:href>.*?</D:response>`)
+	size := regexp.MustCompile(`<size xmlns="http://owncloud.org/ns">(\d+)</size>`)
+	for _, m := range re.FindAllStringSubmatch(body, -1) {
+		if s := size.FindStringSubmatch(m[0]); s != nil {
+			sizes[m[1]] = s[1]
+		}
+	}
+	return sizes
+}
+
+func TestFolderSize(t *testing.T) {
+	h, s := newTestHandler(t)
+	defer func(old bool) { FolderSizes = old }(FolderSizes)
+	FolderSizes = true
+	a := s.Mkdir("root", "a")
+	s.Put(a, "one", make([]byte, 10))
+	b := s.Mkdir(a, "b")
+	s.Put(b, "two", make([]byte, 32))
+	s.Put(s.Mkdir(b, "c"), "three", make([]byte, 100))
+
+	w := doPropfind(h, "/a/", "1", folderSizeBody)
+	if w.Code != 207 {
+		t.Fatalf("PROPFIND = %d, want 207: %s", w.Code, w.Body)
+	}
+	sizes := folderSizes(w.Body.String())
+	for href, want := range map[string]string{"/a/": "142", "/a/b/": "132", "/a/one": "10"} {
+		if sizes[href] != want {
+			t.Errorf("size of %s = %q, want %s (%v)", href, sizes[href], want, sizes)
+		}
+	}
+}
+
+func TestFolderSizeBudgetPerRequest(t *testing.T) {
+	h, s := newTestHandler(t)
+	defer func(old bool, n int) { FolderSizes, maxFolderSizeFolders = old, n }(FolderSizes, maxFolderSizeFolders)
+	FolderSizes = true
+	maxFolderSizeFolders = 3
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		s.Put(s.Mkdir("root", name), "f", make([]byte, 1))
+	}
+
+	w := doPropfind(h, "/", "1", folderSizeBody)
+	if w.Code != 207 {
+		t.Fatalf("PROPFIND = %d, want 207: %s", w.Code, w.Body)
+	}
+	if n := s.Calls("/adrive/v3/file/list"); n > maxFolderSizeFolders {
+		t.Errorf("PROPFIND listed %d folders, want at most %d", n, maxFolderSizeFolders)
+	}
+	if sizes := folderSizes(w.Body.String()); len(sizes) >= 6 {
+		t.Errorf("every folder was sized past the budget: %v", sizes)
+	}
+}
@@ -0,0 +1,78 @@
+package webdav
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const lockBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>test</D:owner></D:lockinfo>`
+
+const proppatchBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><D:displayname>a</D:displayname></D:prop></D:set></D:propertyupdate>`
+
+// putIfTarget adds /a.txt to the drive and to the local file system, which
+// PROPPATCH, the request used to check the If header, stats.
+func putIfTarget(t *testing.T) *Handler {
+	h, s := newTestHandler(t)
+	s.Put("root", "a.txt", []byte("a"))
+	if err := ioutil.WriteFile(filepath.Join(string(h.FileSystem.(Dir)), "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestIfHeaderETags(t *testing.T) {
+	h := putIfTarget(t)
+	etag := serve(h, "HEAD", "/a.txt", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag for /a.txt")
+	}
+
+	for _, c := range []struct {
+		name, ifHeader string
+		want           int
+	}{
+		{"matching etag", `([` + etag + `])`, http.StatusMultiStatus},
+		{"other etag", `(["other"])`, http.StatusPreconditionFailed},
+		{"not other etag", `(Not ["other"])`, http.StatusMultiStatus},
+		{"not matching etag", `(Not [` + etag + `])`, http.StatusPreconditionFailed},
+		{"second list matches", `(["other"]) ([` + etag + `])`, http.StatusMultiStatus},
+		{"tagged list", `<http://example.com/a.txt> ([` + etag + `])`, http.StatusMultiStatus},
+		{"missing resource", `</b.txt> (["other"])`, http.StatusPreconditionFailed},
+	} {
+		w := serve(h, "PROPPATCH", "/a.txt", strings.NewReader(proppatchBody), "If", c.ifHeader)
+		if w.Code != c.want {
+			t.Errorf("%s: If %s = %d, want %d", c.name, c.ifHeader, w.Code, c.want)
+		}
+	}
+}
+
+func TestIfHeaderLockAndETag(t *testing.T) {
+	h := putIfTarget(t)
+	etag := serve(h, "HEAD", "/a.txt", nil).Header().Get("ETag")
+	w := serve(h, "LOCK", "/a.txt", strings.NewReader(lockBody), "Timeout", "Second-60")
+	token := w.Header().Get("Lock-Token")
+	if (w.Code != http.StatusOK && w.Code != http.StatusCreated) || token == "" {
+		t.Fatalf("LOCK = %d with token %q", w.Code, token)
+	}
+
+	for _, c := range []struct {
+		name, ifHeader string
+		want           int
+	}{
+		{"lock and matching etag", `(` + token + ` [` + etag + `])`, http.StatusMultiStatus},
+		{"lock and other etag", `(` + token + ` ["other"])`, http.StatusPreconditionFailed},
+		{"wrong lock and matching etag", `(<urn:uuid:wrong> [` + etag + `])`, http.StatusPreconditionFailed},
+		//只有ETag的条件不代表持有锁
+		{"etag without the lock", `([` + etag + `])`, http.StatusLocked},
+	} {
+		w := serve(h, "PROPPATCH", "/a.txt", strings.NewReader(proppatchBody), "If", c.ifHeader)
+		if w.Code != c.want {
+			t.Errorf("%s: If %s = %d, want %d", c.name, c.ifHeader, w.Code, c.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package webdav
+
+import (
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockedDownloads holds the downloads of some files of the fake Aliyun API
+// until released, and tracks how many of them are in flight at once.
+type blockedDownloads struct {
+	mu       sync.Mutex
+	inFlight int
+	max      int
+	release  chan struct{}
+}
+
+// blockDownloads adds n files to the root of s whose downloads block, and
+// returns their paths.
+func blockDownloads(s *aliyuntest.Server, n int) (*blockedDownloads, []string) {
+	b := &blockedDownloads{release: make(chan struct{})}
+	var paths []string
+	for i := 0; i < n; i++ {
+		name := "file" + strconv.Itoa(i) + ".bin"
+		id := s.Put("root", name, []byte(name))
+		paths = append(paths, "/"+name)
+		s.Handle("/oss/download/"+id, func(w http.ResponseWriter, r *http.Request) {
+			b.mu.Lock()
+			if b.inFlight++; b.inFlight > b.max {
+				b.max = b.inFlight
+			}
+			b.mu.Unlock()
+			<-b.release
+			b.mu.Lock()
+			b.inFlight--
+			b.mu.Unlock()
+			w.Write([]byte(name))
+		})
+	}
+	return b, paths
+}
+
+// wait waits until n downloads are in flight and lets the others, if any,
+// catch up. It returns the largest number seen in flight.
+func (b *blockedDownloads) wait(t *testing.T, n int) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		inFlight := b.inFlight
+		b.mu.Unlock()
+		if inFlight >= n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d downloads in flight, want %d", inFlight, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.max
+}
+
+// getAll sends a GET for every path at the same time and returns the status
+// codes once all are done.
+func getAll(h http.Handler, paths []string) <-chan []int {
+	done := make(chan []int, 1)
+	go func() {
+		codes := make([]int, len(paths))
+		var wg sync.WaitGroup
+		for i, p := range paths {
+			wg.Add(1)
+			go func(i int, p string) {
+				defer wg.Done()
+				codes[i] = serve(h, "GET", p, nil).Code
+			}(i, p)
+		}
+		wg.Wait()
+		done <- codes
+	}()
+	return done
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.MaxConcurrent = 2
+	b, paths := blockDownloads(s, 6)
+
+	done := getAll(h, paths)
+	if max := b.wait(t, 2); max != 2 {
+		t.Errorf("%d requests reached Aliyun at once, want the limit of 2", max)
+	}
+	close(b.release)
+	for i, code := range <-done {
+		if code != http.StatusOK {
+			t.Errorf("queued GET %s = %d, want 200", paths[i], code)
+		}
+	}
+}
+
+func TestMaxConcurrentQueueTimeout(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.MaxConcurrent, h.QueueTimeout = 1, 20*time.Millisecond
+	b, paths := blockDownloads(s, 1)
+
+	done := getAll(h, paths)
+	b.wait(t, 1)
+	w := serve(h, "PROPFIND", "/", nil, "Depth", "0")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("request beyond the limit = %d, Retry-After %q; want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(b.release)
+	<-done
+}
+
+func TestMaxDownloads(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.MaxDownloads, h.MaxConcurrent, h.QueueTimeout = 2, 3, time.Second
+	b, paths := blockDownloads(s, 4)
+
+	//两个下载占满下载名额，另外两个排队等待下载名额，不占用总名额
+	done := getAll(h, paths)
+	if max := b.wait(t, 2); max != 2 {
+		t.Errorf("%d downloads reached Aliyun at once, want the limit of 2", max)
+	}
+	start := time.Now()
+	if w := serve(h, "PROPFIND", "/", nil, "Depth", "0"); w.Code != StatusMulti {
+		t.Errorf("PROPFIND while downloads are saturated = %d, want 207", w.Code)
+	}
+	if w := serve(h, "PUT", "/up.txt", nil); w.Code != http.StatusCreated {
+		t.Errorf("PUT while downloads are saturated = %d, want 201", w.Code)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("metadata and upload requests waited %v behind the downloads", d)
+	}
+	close(b.release)
+	for i, code := range <-done {
+		if code != http.StatusOK {
+			t.Errorf("queued GET %s = %d, want 200", paths[i], code)
+		}
+	}
+	if max := b.wait(t, 0); max != 2 {
+		t.Errorf("%d downloads in flight at once, want at most 2", max)
+	}
+}
+
+func TestMaxMetadata(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.MaxMetadata, h.QueueTimeout = 1, 20*time.Millisecond
+	b, paths := blockDownloads(s, 1)
+
+	//下载不受元数据名额限制
+	done := getAll(h, paths)
+	b.wait(t, 1)
+	if w := serve(h, "PROPFIND", "/", nil, "Depth", "0"); w.Code != StatusMulti {
+		t.Errorf("PROPFIND with a download in flight = %d, want 207", w.Code)
+	}
+	close(b.release)
+	<-done
+
+	//占满元数据名额时排队超时
+	release, ok := h.acquire(httptest.NewRequest("PROPFIND", "/", nil))
+	if !ok {
+		t.Fatal("first metadata slot not acquired")
+	}
+	if w := serve(h, "PROPFIND", "/", nil, "Depth", "0"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("PROPFIND beyond MaxMetadata = %d, want 503", w.Code)
+	}
+	if w := serve(h, "GET", paths[0], nil); w.Code != http.StatusOK {
+		t.Errorf("GET with the metadata slots taken = %d, want 200", w.Code)
+	}
+	release()
+}
+
+func TestMaxPerClient(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.MaxPerClient, h.MaxConcurrent = 2, 10
+	b, paths := blockDownloads(s, 2)
+
+	//httptest的请求都来自192.0.2.1，两个下载占满该IP的名额
+	done := getAll(h, paths)
+	b.wait(t, 2)
+	propfind := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PROPFIND", "/", nil)
+		r.Header.Set("Depth", "0")
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	//同一IP的其他端口也计入
+	for _, addr := range []string{"192.0.2.1:1234", "192.0.2.1:5678"} {
+		if w := propfind(addr); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Errorf("request from %s beyond the client limit = %d, want 429 with Retry-After", addr, w.Code)
+		}
+	}
+	if w := propfind("198.51.100.7:1234"); w.Code != http.StatusMultiStatus {
+		t.Errorf("request from another client = %d, want 207", w.Code)
+	}
+
+	close(b.release)
+	for i, code := range <-done {
+		if code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", paths[i], code)
+		}
+	}
+	//下载结束后释放名额
+	if w := propfind("192.0.2.1:1234"); w.Code != http.StatusMultiStatus {
+		t.Errorf("request after the downloads finished = %d, want 207", w.Code)
+	}
+}
@@ -0,0 +1,84 @@
+package webdav
+
+import (
+	"context"
+	xwebdav "golang.org/x/net/webdav"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// localPath returns the path of reqPath, a request path with the Handler
+// prefix stripped, inside FileSystem if it lies under LocalPrefix.
+func (h *Handler) localPath(reqPath string) (string, bool) {
+	if h.LocalPrefix == "" {
+		return "", false
+	}
+	prefix := canonicalPath(h.LocalPrefix)
+	reqPath = canonicalPath(reqPath)
+	if reqPath != prefix && !strings.HasPrefix(reqPath, prefix+"/") {
+		return "", false
+	}
+	return slashClean(strings.TrimPrefix(reqPath, prefix)), true
+}
+
+// requestLocalPath is localPath for the path of r.
+func (h *Handler) requestLocalPath(r *http.Request) (string, bool) {
+	reqPath, _, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return "", false
+	}
+	return h.localPath(reqPath)
+}
+
+// localFileSystem adapts FileSystem to the golang.org/x/net/webdav
+// interface, whose File has the same methods under another name.
+type localFileSystem struct {
+	FileSystem
+}
+
+func (fs localFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (xwebdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// serveLocal serves a request under LocalPrefix from FileSystem with the
+// golang.org/x/net/webdav handler, which provides the full WebDAV class 2
+// method set, locking included, on the local tree.
+func (h *Handler) serveLocal(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		if u, err := url.Parse(r.Header.Get("Destination")); err == nil && u.Path != "" && (u.Host == "" || u.Host == r.Host) {
+			dst, _, err := h.stripPrefix(h.canonicalURLPath(u.Path))
+			if err != nil {
+				//目标不在本Handler的前缀下，属于别的服务
+				return http.StatusBadGateway, err
+			}
+			if _, local := h.localPath(dst); !local {
+				//目标在网盘中，读取本地文件后上传
+				if dst = strings.TrimLeft(dst, "/"); dst == "" {
+					return http.StatusBadGateway, errInvalidDestination
+				}
+				if dst, status, err = h.limitName(w, r, dst); err != nil {
+					return status, err
+				}
+				name, _ := h.requestLocalPath(r)
+				return h.transferFromLocal(r, name, dst)
+			}
+		}
+	}
+	h.localLocksOnce.Do(func() { h.localLocks = xwebdav.NewMemLS() })
+	local := &xwebdav.Handler{
+		Prefix:     path.Join(h.Prefix, canonicalPath(h.LocalPrefix)),
+		FileSystem: localFileSystem{h.FileSystem},
+		LockSystem: h.localLocks,
+		Logger:     func(_ *http.Request, e error) { err = e },
+	}
+	//响应由local写出，返回的错误只用于记录日志
+	local.ServeHTTP(w, r)
+	return 0, err
+}
@@ -0,0 +1,123 @@
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLocalPrefixReadWrite(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.LocalPrefix = "/local"
+
+	if w := serve(h, "PUT", "/local/note.txt", strings.NewReader("kept on the host")); w.Code != 201 {
+		t.Fatalf("PUT = %d, want 201: %s", w.Code, w.Body)
+	}
+	w := serve(h, "GET", "/local/note.txt", nil)
+	if w.Code != 200 || w.Body.String() != "kept on the host" {
+		t.Fatalf("GET = %d %q, want 200 with the uploaded content", w.Code, w.Body)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 0 {
+		t.Errorf("local PUT reached the drive %d times", n)
+	}
+	if w := doPropfind(h, "/local/", "1", ""); w.Code != 207 || !strings.Contains(w.Body.String(), "/local/note.txt") {
+		t.Errorf("PROPFIND = %d, want 207 listing note.txt: %s", w.Code, w.Body)
+	}
+}
+
+func TestLocalPrefixCrossMove(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.LocalPrefix = "/local"
+	id := s.Put("root", "remote.txt", []byte("on the drive"))
+	s.Put(s.Mkdir("root", "dir"), "inner.txt", []byte("inner"))
+	serve(h, "PUT", "/local/host.txt", strings.NewReader("on the host"))
+
+	//网盘到本地目录：COPY保留网盘中的文件，MOVE删除
+	if w := serve(h, "COPY", "/remote.txt", nil, "Destination", "http://example.com/local/copy.txt"); w.Code != 201 {
+		t.Errorf("COPY from the drive to the local tree = %d, want 201", w.Code)
+	}
+	if f, ok := s.File(id); !ok || f.Trashed {
+		t.Error("COPY removed the drive file")
+	}
+	if w := serve(h, "COPY", "/remote.txt", nil, "Destination", "http://example.com/local/copy.txt", "Overwrite", "F"); w.Code != 412 {
+		t.Errorf("COPY onto an existing local file with Overwrite: F = %d, want 412", w.Code)
+	}
+	//下载失败时保留被覆盖的本地文件
+	s.Handle("/oss/download/"+id, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if w := serve(h, "COPY", "/remote.txt", nil, "Destination", "http://example.com/local/copy.txt"); w.Code != 502 {
+		t.Errorf("COPY with a failing download = %d, want 502", w.Code)
+	}
+	if w := serve(h, "GET", "/local/copy.txt", nil); w.Code != 200 || w.Body.String() != "on the drive" {
+		t.Errorf("GET /local/copy.txt after a failed overwrite = %d %q, want the original", w.Code, w.Body)
+	}
+	if w := doPropfind(h, "/local/", "1", ""); strings.Contains(w.Body.String(), "replaced") {
+		t.Errorf("failed overwrite left the displaced file behind:\n%s", w.Body)
+	}
+	s.Handle("/oss/download/"+id, nil)
+	if w := serve(h, "MOVE", "/dir", nil, "Destination", "http://example.com/local/dir"); w.Code != 201 {
+		t.Errorf("MOVE of a folder from the drive to the local tree = %d, want 201", w.Code)
+	}
+	if _, ok := s.Lookup("dir"); ok {
+		t.Error("MOVE left the drive folder")
+	}
+	for target, want := range map[string]string{"/local/copy.txt": "on the drive", "/local/dir/inner.txt": "inner"} {
+		if w := serve(h, "GET", target, nil); w.Code != 200 || w.Body.String() != want {
+			t.Errorf("GET %s = %d %q, want %q", target, w.Code, w.Body, want)
+		}
+	}
+
+	//本地目录到网盘
+	if w := serve(h, "MOVE", "/local/host.txt", nil, "Destination", "http://example.com/remote.txt"); w.Code != 204 {
+		t.Errorf("MOVE from the local tree onto a drive file = %d, want 204", w.Code)
+	}
+	if f, ok := s.Lookup("remote.txt"); !ok || string(f.Content) != "on the host" {
+		t.Errorf("drive file not replaced by the local one: %+v", f)
+	}
+	if w := serve(h, "GET", "/local/host.txt", nil); w.Code != 404 {
+		t.Errorf("local file still there after MOVE: %d", w.Code)
+	}
+	if w := serve(h, "COPY", "/local/dir", nil, "Destination", "http://example.com/back"); w.Code != 201 {
+		t.Errorf("COPY of a local folder to the drive = %d, want 201", w.Code)
+	}
+	if f, ok := s.Lookup("back/inner.txt"); !ok || string(f.Content) != "inner" {
+		t.Error("local folder not copied to the drive")
+	}
+	if w := serve(h, "GET", "/local/dir/inner.txt", nil); w.Code != 200 {
+		t.Errorf("local folder gone after COPY: %d", w.Code)
+	}
+
+	//其它服务上的目标无法访问
+	if w := serve(h, "MOVE", "/local/copy.txt", nil, "Destination", "http://elsewhere.example.com/a.txt"); w.Code != 502 {
+		t.Errorf("MOVE to another server = %d, want 502", w.Code)
+	}
+}
+
+func TestLocalPrefixLocking(t *testing.T) {
+	h, _ := newTestHandler(t)
+	h.LocalPrefix = "/local"
+
+	if w := serve(h, "OPTIONS", "/local/", nil); !strings.Contains(w.Header().Get("DAV"), "2") || !strings.Contains(w.Header().Get("Allow"), "LOCK") {
+		t.Errorf("OPTIONS DAV %q Allow %q, want class 2 with LOCK", w.Header().Get("DAV"), w.Header().Get("Allow"))
+	}
+	const lockBody = `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+	w := serve(h, "LOCK", "/local/doc.txt", strings.NewReader(lockBody))
+	token := w.Header().Get("Lock-Token")
+	if w.Code != 201 || token == "" {
+		t.Fatalf("LOCK = %d with token %q, want 201 and a token", w.Code, token)
+	}
+	if w := serve(h, "PUT", "/local/doc.txt", strings.NewReader("x")); w.Code != 423 {
+		t.Errorf("PUT without the lock token = %d, want 423", w.Code)
+	}
+	if w := serve(h, "PUT", "/local/doc.txt", strings.NewReader("x"), "If", "("+token+")"); w.Code != 201 {
+		t.Errorf("PUT with the lock token = %d, want 201", w.Code)
+	}
+	if w := serve(h, "UNLOCK", "/local/doc.txt", nil, "Lock-Token", token); w.Code != 204 {
+		t.Errorf("UNLOCK = %d, want 204", w.Code)
+	}
+	const patch = `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><D:displayname>x</D:displayname></D:prop></D:set></D:propertyupdate>`
+	if w := serve(h, "PROPPATCH", "/local/doc.txt", strings.NewReader(patch)); w.Code != 207 {
+		t.Errorf("PROPPATCH = %d, want 207", w.Code)
+	}
+}
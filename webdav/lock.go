@@ -93,6 +93,22 @@ type LockSystem interface {
 	Unlock(now time.Time, token string) error
 }
 
+// LockLister is an optional interface for a LockSystem. It reports the
+// active locks on a resource for the lockdiscovery property; a LockSystem
+// that does not implement it reports none.
+type LockLister interface {
+	// Locks returns the unexpired locks covering the named resource: a lock
+	// on the resource itself or an infinite depth lock on one of its
+	// ancestors. The Duration of each lock is the time left until it expires.
+	Locks(now time.Time, name string) []ActiveLock
+}
+
+// ActiveLock is a lock reported by a LockLister.
+type ActiveLock struct {
+	Token string
+	LockDetails
+}
+
 // LockDetails are a lock's metadata.
 type LockDetails struct {
 	// Root is the root resource name being locked. For a zero-depth lock, the
@@ -288,6 +304,27 @@ func (m *memLS) Unlock(now time.Time, token string) error {
 	return nil
 }
 
+func (m *memLS) Locks(now time.Time, name string) []ActiveLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(now)
+
+	var locks []ActiveLock
+	walkToRoot(slashClean(name), func(name0 string, first bool) bool {
+		n := m.byName[name0]
+		if n == nil || n.token == "" || (!first && n.details.ZeroDepth) {
+			return true
+		}
+		l := ActiveLock{Token: n.token, LockDetails: n.details}
+		if l.Duration >= 0 {
+			l.Duration = n.expiry.Sub(now)
+		}
+		locks = append(locks, l)
+		return true
+	})
+	return locks
+}
+
 func (m *memLS) canCreate(name string, zeroDepth bool) bool {
 	return walkToRoot(name, func(name0 string, first bool) bool {
 		n := m.byName[name0]
@@ -0,0 +1,83 @@
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const lockPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:lockdiscovery/><D:supportedlock/></D:prop></D:propfind>`
+
+// TestLockDiscovery checks that PROPFIND reports the locks held in the
+// LockSystem and the lock types supported.
+func TestLockDiscovery(t *testing.T) {
+	h := putIfTarget(t)
+	props := responseProps(t, doPropfind(h, "/a.txt", "0", lockPropfind).Body.Bytes())["/a.txt"]
+	if !strings.Contains(props, "<D:lockentry") || !strings.Contains(props, "<D:exclusive") || !strings.Contains(props, "<D:write") {
+		t.Errorf("supportedlock = %s, want an exclusive write lock", props)
+	}
+	if strings.Contains(props, "activelock") {
+		t.Errorf("unlocked resource reports %s", props)
+	}
+
+	w := serve(h, "LOCK", "/a.txt", strings.NewReader(lockBody), "Timeout", "Second-60")
+	token := strings.Trim(w.Header().Get("Lock-Token"), "<>")
+	if token == "" {
+		t.Fatalf("LOCK = %d without a token", w.Code)
+	}
+	props = responseProps(t, doPropfind(h, "/a.txt", "0", lockPropfind).Body.Bytes())["/a.txt"]
+	for _, want := range []string{"<D:activelock", "<D:href>" + token + "</D:href>", "<D:owner>test</D:owner>", "<D:depth>infinity</D:depth>", "<D:lockroot><D:href>/a.txt</D:href>"} {
+		if !strings.Contains(props, want) {
+			t.Errorf("lockdiscovery missing %s:\n%s", want, props)
+		}
+	}
+	if !strings.Contains(props, "<D:timeout>Second-60</D:timeout>") && !strings.Contains(props, "<D:timeout>Second-59</D:timeout>") {
+		t.Errorf("lockdiscovery timeout = %s, want about 60 seconds", props)
+	}
+	//allprop同样返回supportedlock
+	if props := responseProps(t, doPropfind(h, "/a.txt", "0", "").Body.Bytes())["/a.txt"]; !strings.Contains(props, "supportedlock") {
+		t.Errorf("allprop = %s, want supportedlock", props)
+	}
+
+	if w := serve(h, "UNLOCK", "/a.txt", nil, "Lock-Token", "<"+token+">"); w.Code != http.StatusNoContent {
+		t.Fatalf("UNLOCK = %d", w.Code)
+	}
+	props = responseProps(t, doPropfind(h, "/a.txt", "0", lockPropfind).Body.Bytes())["/a.txt"]
+	if strings.Contains(props, "activelock") {
+		t.Errorf("lockdiscovery after UNLOCK = %s", props)
+	}
+}
+
+// TestMemLSLocks checks which locks cover a resource.
+func TestMemLSLocks(t *testing.T) {
+	ls := NewMemLS()
+	now := time.Now()
+	deep, err := ls.Create(now, LockDetails{Root: "/dir", Duration: time.Minute, OwnerXML: "deep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Create(now, LockDetails{Root: "/other", Duration: -1, ZeroDepth: true}); err != nil {
+		t.Fatal(err)
+	}
+	ll := ls.(LockLister)
+
+	locks := ll.Locks(now.Add(10*time.Second), "/dir/sub/a.txt")
+	if len(locks) != 1 || locks[0].Token != deep || locks[0].OwnerXML != "deep" {
+		t.Fatalf("locks below an infinite lock = %+v", locks)
+	}
+	if locks[0].Duration != 50*time.Second {
+		t.Errorf("time left = %v, want 50s", locks[0].Duration)
+	}
+	if locks := ll.Locks(now, "/other"); len(locks) != 1 || locks[0].Duration >= 0 {
+		t.Errorf("locks of /other = %+v, want one without a timeout", locks)
+	}
+	//深度为0的锁不覆盖子项
+	if locks := ll.Locks(now, "/other/a.txt"); len(locks) != 0 {
+		t.Errorf("zero depth lock covers its child: %+v", locks)
+	}
+	if locks := ll.Locks(now.Add(2*time.Minute), "/dir"); len(locks) != 0 {
+		t.Errorf("expired lock reported: %+v", locks)
+	}
+}
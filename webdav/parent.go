@@ -0,0 +1,188 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"os"
+	"strings"
+	"sync"
+)
+
+// resolveOrCreateParent returns the file id of the folder dir, a request path
+// relative to the root folder, walking it one segment at a time. Every folder
+// on the way is cached under cache.FileIdKey, the same key the other
+// handlers read. If create is true, missing folders are created; otherwise
+// a missing folder yields os.ErrNotExist. A segment naming a file yields
+// errNotADirectory.
+//
+// A cached id may be stale when the folder was moved, renamed or deleted
+// outside this server. The cached id of dir itself is checked against the
+// drive, and a folder missing below a cached one is taken for a stale cache
+// rather than created there; either way the cached ids and listings are
+// dropped and dir is walked again from the root folder.
+func resolveOrCreateParent(ctx context.Context, token, driveId, dir string, create bool) (string, error) {
+	dir = strings.Trim(dir, "/")
+	if dir == "" {
+		return aliyun.RootFileId(), nil
+	}
+	fileId, err := resolveParent(ctx, token, driveId, dir, create, true)
+	if err == errStaleParent {
+		//缓存的列表同样可能已过期，重新查找前一并删除
+		cache.GoCache.Delete(cache.ListKey(driveId, aliyun.RootFileId()))
+		segments := strings.Split(dir, "/")
+		for i := range segments {
+			key := cache.FileIdKey(driveId, strings.Join(segments[:i+1], "/"))
+			if fid, ok := cache.GoCache.Get(key); ok {
+				cache.GoCache.Delete(cache.ListKey(driveId, fid.(string)))
+			}
+			cache.GoCache.Delete(key)
+		}
+		fileId, err = resolveParent(ctx, token, driveId, dir, create, false)
+	}
+	return fileId, err
+}
+
+// errStaleParent reports that a cached folder id no longer matches the drive.
+var errStaleParent = errors.New("webdav: stale cached folder")
+
+// resolveParent is resolveOrCreateParent walking dir once, starting from the
+// cached ids if useCache is true.
+func resolveParent(ctx context.Context, token, driveId, dir string, create, useCache bool) (string, error) {
+	segments := strings.Split(dir, "/")
+	if useCache {
+		if fid, ok := cache.GoCache.Get(cache.FileIdKey(driveId, dir)); ok {
+			fi, err := aliyun.GetFileDetail(ctx, token, driveId, fid.(string))
+			if err != nil || fi.Type != "folder" || fi.Status == "trashed" || fi.Name != segments[len(segments)-1] {
+				return "", errStaleParent
+			}
+			return fi.FileId, nil
+		}
+	}
+
+	parentFileId, cached := aliyun.RootFileId(), false
+	for i, name := range segments {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		prefix := strings.Join(segments[:i+1], "/")
+		if useCache {
+			if fid, ok := cache.GoCache.Get(cache.FileIdKey(driveId, prefix)); ok {
+				parentFileId, cached = fid.(string), true
+				continue
+			}
+		}
+		item, err := findChild(ctx, token, driveId, parentFileId, name)
+		if err != nil {
+			return "", err
+		}
+		if item.FileId == "" {
+			if cached {
+				return "", errStaleParent
+			}
+			if !create {
+				return "", os.ErrNotExist
+			}
+			item, err = makeDirOnce(ctx, token, driveId, parentFileId, name)
+			if err != nil {
+				return "", err
+			}
+		} else if item.Type != "folder" {
+			return "", errNotADirectory
+		}
+		cache.GoCache.Set(cache.FileIdKey(driveId, prefix), item.FileId, -1)
+		parentFileId, cached = item.FileId, false
+	}
+	return parentFileId, nil
+}
+
+// findChild returns the item called name in the folder parentFileId, or an
+// empty ListModel if there is none.
+func findChild(ctx context.Context, token, driveId, parentFileId, name string) (model.ListModel, error) {
+	list, err := aliyun.GetList(ctx, token, driveId, parentFileId)
+	if err != nil {
+		return model.ListModel{}, err
+	}
+	for _, v := range list.Items {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	return model.ListModel{}, nil
+}
+
+// makeDirOnce creates the folder name in parentFileId unless a concurrent
+// request already did, in which case that folder is returned.
+func makeDirOnce(ctx context.Context, token, driveId, parentFileId, name string) (model.ListModel, error) {
+	unlock := mkdirLocks.lock(driveId + "/" + parentFileId + "/" + name)
+	defer unlock()
+	item, err := findChild(ctx, token, driveId, parentFileId, name)
+	if err != nil || item.FileId != "" {
+		return item, err
+	}
+	item = aliyun.MakeDir(ctx, token, driveId, name, parentFileId)
+	if item.FileId == "" {
+		return item, errCreateDirectory
+	}
+	cache.GoCache.Delete(cache.ListKey(driveId, parentFileId))
+	return item, nil
+}
+
+// mkdirLocks serializes the creation of each folder. Aliyun happily creates
+// two folders with the same name, so concurrent requests must not both get
+// past the existence check before one of them has created the folder.
+var mkdirLocks = keyedMutex{locks: make(map[string]*keyedLock)}
+
+// keyedMutex is a set of mutexes created on demand, one per key.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks the mutex of key and returns the function unlocking it.
+func (k *keyedMutex) lock(key string) (unlock func()) {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.waiters++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		if l.waiters--; l.waiters == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// pathBelow returns the names of the folders leading from the folder scopeId
+// down to the file fileId, and false if the file is not below that folder.
+func (h *Handler) pathBelow(ctx context.Context, fileId string, scopeId string) ([]string, bool) {
+	config := h.CurrentConfig()
+	items, err := aliyun.FilePathItems(ctx, config.Token, config.DriveId, fileId)
+	if err != nil || len(items) == 0 {
+		return nil, false
+	}
+	var dirs []string
+	for _, item := range items[1:] {
+		if item.FileId == scopeId {
+			return dirs, true
+		}
+		dirs = append([]string{aliyun.SafeName(item.Name)}, dirs...)
+	}
+	//网盘根目录不在路径中
+	return dirs, scopeId == "root"
+}
@@ -0,0 +1,127 @@
+package webdav
+
+import (
+	"context"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/cache"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func resolve(dir string, create bool) (string, error) {
+	return resolveOrCreateParent(context.Background(), "token", aliyuntest.DriveId, dir, create)
+}
+
+func TestResolveExisting(t *testing.T) {
+	_, s := newTestHandler(t)
+	a := s.Mkdir("root", "a")
+	b := s.Mkdir(a, "b")
+
+	for _, dir := range []string{"", "/"} {
+		if id, err := resolve(dir, false); err != nil || id != "root" {
+			t.Errorf("resolve(%q) = %q, %v; want the root folder", dir, id, err)
+		}
+	}
+	if id, err := resolve("/a/b/", false); err != nil || id != b {
+		t.Fatalf("resolve(a/b) = %q, %v; want %q", id, err, b)
+	}
+	//经过的每一级目录都使用其它处理共用的缓存键
+	for p, want := range map[string]string{"a": a, "a/b": b} {
+		if id, ok := cache.GoCache.Get(cache.FileIdKey(aliyuntest.DriveId, p)); !ok || id != want {
+			t.Errorf("cached id of %s = %v, want %s", p, id, want)
+		}
+	}
+	if _, err := resolve("a/b", false); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Calls("/adrive/v3/file/list"); n != 2 {
+		t.Errorf("resolving twice listed %d folders, want the cached ids reused", n)
+	}
+}
+
+func TestResolveMissing(t *testing.T) {
+	_, s := newTestHandler(t)
+	s.Mkdir("root", "a")
+	s.Put("root", "f.txt", []byte("f"))
+
+	if _, err := resolve("a/missing/c", false); err != os.ErrNotExist {
+		t.Errorf("resolve of a missing folder = %v, want os.ErrNotExist", err)
+	}
+	if _, err := resolve("f.txt/c", true); err != errNotADirectory {
+		t.Errorf("resolve below a file = %v, want errNotADirectory", err)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 0 {
+		t.Errorf("created %d folders without create", n)
+	}
+}
+
+func TestResolveCreate(t *testing.T) {
+	_, s := newTestHandler(t)
+	a := s.Mkdir("root", "a")
+
+	id, err := resolve("a/b/c", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := s.Lookup("a/b/c")
+	if !ok || c.Id != id || c.Type != "folder" {
+		t.Fatalf("resolve(a/b/c) = %q, want the created folder", id)
+	}
+	if b, _ := s.Lookup("a/b"); b.ParentId != a {
+		t.Error("b not created in a")
+	}
+
+	//并发创建同一个目录时只创建一次
+	var wg sync.WaitGroup
+	ids := make([]string, 8)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], _ = resolve("x/y", true)
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id == "" || id != ids[0] {
+			t.Fatalf("concurrent resolves = %v, want one folder", ids)
+		}
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 4 {
+		t.Errorf("created %d folders, want 4", n)
+	}
+}
+
+func TestResolveStaleCache(t *testing.T) {
+	h, s := newTestHandler(t)
+	a := s.Mkdir("root", "a")
+	b := s.Mkdir(a, "b")
+	if _, err := resolve("a/b", false); err != nil {
+		t.Fatal(err)
+	}
+
+	//在其它地方改名后，缓存的id已经不对应这个路径
+	s.Update(b, func(f *aliyuntest.File) { f.Name = "renamed" })
+	if _, err := resolve("a/b", false); err != os.ErrNotExist {
+		t.Errorf("resolve of a renamed folder = %v, want os.ErrNotExist", err)
+	}
+	newB := s.Mkdir(a, "b")
+	if id, err := resolve("a/b", false); err != nil || id != newB {
+		t.Errorf("resolve after the folder was replaced = %q, %v; want %q", id, err, newB)
+	}
+
+	//缓存的上级目录被删除后，不应在旧目录中创建
+	cache.GoCache.Delete(cache.FileIdKey(aliyuntest.DriveId, "a/b"))
+	s.Update(a, func(f *aliyuntest.File) { f.Trashed = true })
+	s.Mkdir("root", "a")
+	w := serve(h, "PUT", "/a/b/new.txt", strings.NewReader("new"))
+	if w.Code != http.StatusCreated && w.Code != http.StatusConflict {
+		t.Fatalf("PUT below a replaced folder = %d", w.Code)
+	}
+	if f, ok := s.Lookup("a/b/new.txt"); ok && f.ParentId == newB {
+		t.Error("file uploaded into the trashed folder")
+	}
+}
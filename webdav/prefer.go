@@ -0,0 +1,109 @@
+package webdav
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// propfindPrefs are the preferences of a PROPFIND request, sent in Prefer
+// headers (RFC 7240), that this handler honors.
+type propfindPrefs struct {
+	// minimal is "return=minimal": RFC 8144 section 3.1 lets the server
+	// leave out the propstat of properties that were not found.
+	minimal bool
+	// noRoot is "depth-noroot": RFC 8144 section 3.2 leaves out the
+	// response for the collection itself.
+	noRoot bool
+	// maxResults is "max-results=N", an extension asking for at most N
+	// child responses, as PropfindLimit does for every request.
+	maxResults int
+}
+
+// parsePrefer returns the preferences of r that apply to a PROPFIND.
+// Unknown preferences are ignored, as RFC 7240 requires.
+func parsePrefer(r *http.Request) propfindPrefs {
+	var prefs propfindPrefs
+	for _, hdr := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(hdr, ",") {
+			//偏好之后可以带有参数，如return=minimal; foo=bar，这里只看偏好本身
+			if i := strings.Index(pref, ";"); i >= 0 {
+				pref = pref[:i]
+			}
+			name, value := strings.TrimSpace(pref), ""
+			if i := strings.Index(name, "="); i >= 0 {
+				name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+			}
+			switch strings.ToLower(name) {
+			case "return":
+				prefs.minimal = strings.EqualFold(value, "minimal")
+			case "depth-noroot":
+				prefs.noRoot = true
+			case "max-results":
+				if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+					prefs.maxResults = n
+				}
+			}
+		}
+	}
+	return prefs
+}
+
+// limit returns how many child responses a PROPFIND may return given the
+// handler-wide cap, or 0 if there is no limit.
+func (p propfindPrefs) limit(handlerLimit int) int {
+	if p.maxResults > 0 && (handlerLimit <= 0 || p.maxResults < handlerLimit) {
+		return p.maxResults
+	}
+	if handlerLimit > 0 {
+		return handlerLimit
+	}
+	return 0
+}
+
+// applied returns the Preference-Applied header value of the preferences
+// honored, for a request on a collection if dir is set. return=minimal does
+// not apply to a propname request, whose responses have no missing
+// properties to leave out, and max-results reports the limit in effect,
+// which handlerLimit may have lowered.
+func (p propfindPrefs) applied(dir bool, propname bool, handlerLimit int) string {
+	var applied []string
+	if p.minimal && !propname {
+		applied = append(applied, "return=minimal")
+	}
+	if p.noRoot && dir {
+		applied = append(applied, "depth-noroot")
+	}
+	if p.maxResults > 0 && dir {
+		applied = append(applied, "max-results="+strconv.Itoa(p.limit(handlerLimit)))
+	}
+	return strings.Join(applied, ", ")
+}
+
+// minimalPropstats drops the propstats of properties that were not found.
+// A response must hold at least one propstat, so an empty one with status
+// 200 is kept when every property was missing.
+func minimalPropstats(pstats []Propstat) []Propstat {
+	kept := pstats[:0]
+	for _, p := range pstats {
+		if p.Status != http.StatusNotFound {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == 0 {
+		kept = append(kept, Propstat{Status: http.StatusOK})
+	}
+	return kept
+}
+
+// makeTruncatedResponse reports in the multistatus that the listing of the
+// collection at href was cut short, as RFC 5323 section 5.3 does for
+// searches returning too many results.
+func makeTruncatedResponse(href string) *response {
+	return &response{
+		Href:                []string{escapeHref(href)},
+		Status:              "HTTP/1.1 507 " + StatusText(StatusInsufficientStorage),
+		Error:               &xmlError{InnerXML: []byte("<D:number-of-matches-within-limits/>")},
+		ResponseDescription: errPropfindTruncated.Error(),
+	}
+}
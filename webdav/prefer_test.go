@@ -0,0 +1,69 @@
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPropfindPreferMaxResults(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		handlerLimit int
+		prefer       string
+		children     int
+		applied      string
+	}{
+		{"prefer", 0, "max-results=2", 2, "max-results=2"},
+		{"handler-lower", 1, "max-results=3", 1, "max-results=1"},
+		{"handler-only", 2, "", 2, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h, s := newTestHandler(t)
+			h.PropfindLimit = c.handlerLimit
+			dir := s.Mkdir("root", "dir")
+			for _, name := range []string{"a", "b", "c", "d", "e"} {
+				s.Put(dir, name, []byte(name))
+			}
+
+			w := doPropfind(h, "/dir/", "1", "", "Prefer", c.prefer)
+			if w.Code != http.StatusMultiStatus {
+				t.Fatalf("PROPFIND = %d, want 207", w.Code)
+			}
+			body := w.Body.String()
+			//请求的目录本身、c.children个子项，以及说明结果不完整的507响应
+			if n := strings.Count(body, "<D:response>"); n != c.children+2 {
+				t.Errorf("%d responses, want %d: %s", n, c.children+2, body)
+			}
+			if !strings.Contains(body, "507") {
+				t.Errorf("truncated listing not reported: %s", body)
+			}
+			if got := w.Header().Get("Preference-Applied"); got != c.applied {
+				t.Errorf("Preference-Applied = %q, want %q", got, c.applied)
+			}
+		})
+	}
+}
+
+func TestPropfindPreferMinimal(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "f", []byte("x"))
+	for _, c := range []struct {
+		body    string
+		applied string
+	}{
+		{`<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:getetag/><D:nope/></D:prop></D:propfind>`, "return=minimal"},
+		{`<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:propname/></D:propfind>`, ""},
+	} {
+		w := doPropfind(h, "/f", "0", c.body, "Prefer", "return=minimal")
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("PROPFIND = %d, want 207", w.Code)
+		}
+		if got := w.Header().Get("Preference-Applied"); got != c.applied {
+			t.Errorf("Preference-Applied = %q, want %q for %s", got, c.applied, c.body)
+		}
+		if c.applied != "" && strings.Contains(w.Body.String(), "nope") {
+			t.Errorf("missing property reported despite return=minimal: %s", w.Body)
+		}
+	}
+}
@@ -10,10 +10,16 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"go-aliyun-webdav/aliyun"
 	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Proppatch describes a property update instruction as defined in RFC 4918.
@@ -97,13 +103,18 @@ type DeadPropsHolder interface {
 	Patch([]Proppatch) ([]Propstat, error)
 }
 
+var folderSizeProp = xml.Name{Space: "http://owncloud.org/ns", Local: "size"}
+
 // liveProps contains all supported, protected DAV: properties.
 var liveProps = map[xml.Name]struct {
 	// findFn implements the propfind function of this property. If nil,
 	// it indicates a hidden property.
-	findFn func(context.Context, FileSystem, LockSystem, model.ListModel) (string, error)
+	findFn func(context.Context, FileSystem, LockSystem, string, model.ListModel) (string, error)
 	// dir is true if the property applies to directories.
 	dir bool
+	// extra is true if the property is not defined by RFC 4918, in which
+	// case allprop only computes it when it is named in 'include'.
+	extra bool
 }{
 	{Space: "DAV:", Local: "resourcetype"}: {
 		findFn: findResourceType,
@@ -115,7 +126,7 @@ var liveProps = map[xml.Name]struct {
 	},
 	{Space: "DAV:", Local: "getcontentlength"}: {
 		findFn: findContentLength,
-		dir:    false,
+		dir:    true,
 	},
 	{Space: "DAV:", Local: "getlastmodified"}: {
 		findFn: findLastModified,
@@ -157,9 +168,34 @@ var liveProps = map[xml.Name]struct {
 		dir: false,
 	},
 
-	// TODO: The lockdiscovery property requires LockSystem to list the
-	// active locks on a resource.
-	{Space: "DAV:", Local: "lockdiscovery"}: {},
+	// http://tools.ietf.org/html/rfc5842#section-3.1
+	// The Aliyun FileId survives renames and moves, so clients can use it to
+	// tell a renamed resource from a replaced one.
+	{Space: "DAV:", Local: "resource-id"}: {
+		findFn: findResourceId,
+		dir:    true,
+		extra:  true,
+	},
+
+	// ownCloud clients show the size of folders from this property. See
+	// FolderSizes.
+	folderSizeProp: {
+		findFn: findFolderSize,
+		dir:    true,
+		extra:  true,
+	},
+
+	// Sync clients skip folders whose tag has not changed.
+	ctagProp: {
+		findFn: findCTag,
+		dir:    true,
+		extra:  true,
+	},
+
+	{Space: "DAV:", Local: "lockdiscovery"}: {
+		findFn: findLockDiscovery,
+		dir:    true,
+	},
 	{Space: "DAV:", Local: "supportedlock"}: {
 		findFn: findSupportedLock,
 		dir:    true,
@@ -172,7 +208,7 @@ var liveProps = map[xml.Name]struct {
 //
 // Each Propstat has a unique status and each property name will only be part
 // of one Propstat element.
-func props(ctx context.Context, fs FileSystem, ls LockSystem, pnames []xml.Name, item model.ListModel) ([]Propstat, error) {
+func props(ctx context.Context, fs FileSystem, ls LockSystem, name string, pnames []xml.Name, item model.ListModel) ([]Propstat, error) {
 	//f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
 	//if err != nil {
 	//	return nil, err
@@ -206,9 +242,15 @@ func props(ctx context.Context, fs FileSystem, ls LockSystem, pnames []xml.Name,
 			continue
 		}
 		// Otherwise, it must either be a live property or we don't know it.
-		if prop := liveProps[pn]; prop.findFn != nil && (prop.dir || !isDir) {
-			innerXML, err := prop.findFn(ctx, fs, ls, item)
+		if prop := liveProps[pn]; prop.findFn != nil && livePropApplies(pn, prop.dir, isDir) {
+			innerXML, err := prop.findFn(ctx, fs, ls, name, item)
 			//innerXML := "这是属性"
+			if err == errPropUnavailable {
+				pstatNotFound.Props = append(pstatNotFound.Props, Property{
+					XMLName: pn,
+				})
+				continue
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -276,7 +318,7 @@ func propnames(item model.ListModel) ([]xml.Name, error) {
 
 	pnames := make([]xml.Name, 0, len(liveProps)+len(deadProps))
 	for pn, prop := range liveProps {
-		if prop.findFn != nil && (prop.dir || !isDir) {
+		if prop.findFn != nil && livePropApplies(pn, prop.dir, isDir) {
 			pnames = append(pnames, pn)
 		}
 	}
@@ -286,6 +328,28 @@ func propnames(item model.ListModel) ([]xml.Name, error) {
 	return pnames, nil
 }
 
+// OmitFolderContentLength leaves getcontentlength out for collections
+// instead of reporting it as 0, for clients that choke on either form.
+var OmitFolderContentLength = false
+
+// livePropApplies reports whether the live property pn, which applies to
+// directories when dir is true, is defined for a resource.
+func livePropApplies(pn xml.Name, dir bool, isDir bool) bool {
+	if pn == folderSizeProp {
+		return FolderSizes
+	}
+	if pn == ctagProp {
+		return isDir
+	}
+	if !isDir {
+		return true
+	}
+	if pn == (xml.Name{Space: "DAV:", Local: "getcontentlength"}) {
+		return !OmitFolderContentLength
+	}
+	return dir
+}
+
 // Allprop returns the properties defined for resource name and the properties
 // named in include.
 //
@@ -294,11 +358,19 @@ func propnames(item model.ListModel) ([]xml.Name, error) {
 // returned if they are named in 'include'.
 //
 // See http://www.webdav.org/specs/rfc4918.html#METHOD_PROPFIND
-func allprop(ctx context.Context, fs FileSystem, ls LockSystem, include []xml.Name, item model.ListModel) ([]Propstat, error) {
-	pnames, err := propnames(item)
+func allprop(ctx context.Context, fs FileSystem, ls LockSystem, name string, include []xml.Name, item model.ListModel) ([]Propstat, error) {
+	all, err := propnames(item)
 	if err != nil {
 		return nil, err
 	}
+	// Leave out the extra live properties unless they are named in include,
+	// so that they are not computed for every resource of a Depth: 1 listing.
+	pnames := all[:0]
+	for _, pn := range all {
+		if prop, ok := liveProps[pn]; !ok || !prop.extra {
+			pnames = append(pnames, pn)
+		}
+	}
 	// Add names from include if they are not already covered in pnames.
 	nameset := make(map[xml.Name]bool)
 	for _, pn := range pnames {
@@ -309,7 +381,7 @@ func allprop(ctx context.Context, fs FileSystem, ls LockSystem, include []xml.Na
 			pnames = append(pnames, pn)
 		}
 	}
-	return props(ctx, fs, ls, pnames, item)
+	return props(ctx, fs, ls, name, pnames, item)
 }
 
 // Patch patches the properties of resource name. The return values are
@@ -396,30 +468,56 @@ func escapeXML(s string) string {
 	return s
 }
 
-func findResourceType(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListModel) (string, error) {
+func findResourceType(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
 	if fi.Type == "folder" {
 		return `<D:collection xmlns:D="DAV:"/>`, nil
 	}
 	return "", nil
 }
 
-func findDisplayName(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListModel) (string, error) {
+// displayName returns the name of fi as stored on the drive. It differs
+// from the name used in paths only for names like ".." that are escaped
+// there. It is never percent-encoded, unlike the href of fi.
+func displayName(fi model.ListModel) string {
+	if fi.OriginalName != "" {
+		return fi.OriginalName
+	}
+	return fi.Name
+}
+
+func findDisplayName(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
 	if slashClean(fi.Name) == "/" {
 		// Hide the real name of a possibly prefixed root directory.
 		return "", nil
 	}
-	return escapeXML(fi.Name), nil
+	return escapeXML(displayName(fi)), nil
 }
 
-func findContentLength(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListModel) (string, error) {
+func findContentLength(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
+	// Aliyun reports no size for folders, but be explicit about it.
+	if fi.Type == "folder" {
+		return "0", nil
+	}
 	return strconv.FormatInt(fi.Size, 10), nil
 }
 
-func findLastModified(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListModel) (string, error) {
-	return fi.UpdatedAt.UTC().Format(http.TimeFormat), nil
+// TimeZone, if non-nil, makes getlastmodified and creationdate use this zone
+// instead of GMT. RFC 4918 dates should be GMT, but some clients display
+// them verbatim without converting to local time.
+var TimeZone *time.Location
+
+func formatTime(t time.Time) string {
+	if TimeZone == nil {
+		return t.UTC().Format(http.TimeFormat)
+	}
+	return t.In(TimeZone).Format(time.RFC1123Z)
 }
-func findCreate(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListModel) (string, error) {
-	return fi.CreatedAt.UTC().Format(http.TimeFormat), nil
+
+func findLastModified(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
+	return formatTime(fi.UpdatedAt.Time), nil
+}
+func findCreate(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
+	return formatTime(fi.CreatedAt.Time), nil
 }
 
 // func quota(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListModel) (string, error) {
@@ -456,7 +554,27 @@ type ContentTyper interface {
 	ContentType(ctx context.Context) (string, error)
 }
 
-func findContentType(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListModel) (string, error) {
+// streamingTypes are the content types of HLS and DASH files. Aliyun and
+// the system MIME tables often get them wrong (.ts is TypeScript or Qt
+// Linguist to them), which browser players reject.
+var streamingTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mpd":  "application/dash+xml",
+}
+
+func findContentType(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
+	if ctype, ok := streamingTypes[strings.ToLower(path.Ext(fi.Name))]; ok {
+		return ctype, nil
+	}
+	// Aliyun keeps the content type detected at upload time, so a rename that
+	// changes the extension would otherwise report a stale type.
+	if ext := path.Ext(fi.Name); ext != "" && !strings.EqualFold(ext[1:], fi.FileExtension) {
+		if ctype := mime.TypeByExtension(ext); ctype != "" {
+			return ctype, nil
+		}
+	}
 	return fi.ContentType, nil
 	//if do, ok := fi.(ContentTyper); ok {
 	//	ctype, err := do.ContentType(ctx)
@@ -504,7 +622,7 @@ type ETager interface {
 	ETag(ctx context.Context) (string, error)
 }
 
-func findETag(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListModel) (string, error) {
+func findETag(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
 	//if do, ok := fi.(ETager); ok {
 	//	etag, err := do.ETag(ctx)
 	//	if err != ErrNotImplemented {
@@ -517,10 +635,70 @@ func findETag(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListMo
 	return fmt.Sprintf(`"%x%x"`, fi.UpdatedAt.UnixNano(), fi.Size), nil
 }
 
-func findSupportedLock(ctx context.Context, fs FileSystem, ls LockSystem, fi model.ListModel) (string, error) {
+func findResourceId(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
+	fileId := fi.FileId
+	if fileId == "" {
+		fileId = aliyun.RootFileId()
+	}
+	return `<D:href xmlns:D="DAV:">urn:aliyundrive:` + escapeXML(fileId) + `</D:href>`, nil
+}
+
+// findFolderSize returns the size of a file, or the total size of the files
+// inside a folder. A folder too big to walk has no size.
+func findFolderSize(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
+	if fi.Type != "folder" {
+		return strconv.FormatInt(fi.Size, 10), nil
+	}
+	sizer, ok := ctx.Value(folderSizerKey{}).(folderSizer)
+	if !ok {
+		return "", errPropUnavailable
+	}
+	fileId := fi.FileId
+	if fileId == "" {
+		fileId = aliyun.RootFileId()
+	}
+	size, err := sizer(ctx, fileId)
+	if err != nil {
+		net.Logln(ctx, "⚠️  Folder size unavailable", name, err)
+		return "", errPropUnavailable
+	}
+	return strconv.FormatInt(size, 10), nil
+}
+
+func findSupportedLock(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
 	return `` +
 		`<D:lockentry xmlns:D="DAV:">` +
 		`<D:lockscope><D:exclusive/></D:lockscope>` +
 		`<D:locktype><D:write/></D:locktype>` +
 		`</D:lockentry>`, nil
 }
+
+func findLockDiscovery(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi model.ListModel) (string, error) {
+	ll, ok := ls.(LockLister)
+	if !ok {
+		return "", nil
+	}
+	var b strings.Builder
+	for _, l := range ll.Locks(time.Now(), name) {
+		depth := "infinity"
+		if l.ZeroDepth {
+			depth = "0"
+		}
+		timeout := "Infinite"
+		if l.Duration >= 0 {
+			timeout = "Second-" + strconv.FormatInt(int64(l.Duration/time.Second), 10)
+		}
+		fmt.Fprintf(&b, `<D:activelock xmlns:D="DAV:">`+
+			`<D:locktype><D:write/></D:locktype>`+
+			`<D:lockscope><D:exclusive/></D:lockscope>`+
+			`<D:depth>%s</D:depth>`+
+			`<D:owner>%s</D:owner>`+
+			`<D:timeout>%s</D:timeout>`+
+			`<D:locktoken><D:href>%s</D:href></D:locktoken>`+
+			`<D:lockroot><D:href>%s</D:href></D:lockroot>`+
+			`</D:activelock>`,
+			depth, l.OwnerXML, timeout, escape(l.Token), escape(escapeHref(l.Root)),
+		)
+	}
+	return b.String(), nil
+}
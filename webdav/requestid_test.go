@@ -0,0 +1,127 @@
+package webdav
+
+import (
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/net"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what f prints to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+var logRequestId = regexp.MustCompile(`request_id=(\S+)`)
+
+// loggedIds returns the distinct request ids found in log.
+func loggedIds(log string) map[string]bool {
+	ids := map[string]bool{}
+	for _, m := range logRequestId.FindAllStringSubmatch(log, -1) {
+		ids[m[1]] = true
+	}
+	return ids
+}
+
+func TestRequestID(t *testing.T) {
+	h, s := newTestHandler(t)
+
+	//沿用客户端传入的请求ID
+	var w *httptest.ResponseRecorder
+	log := captureStdout(t, func() {
+		w = serve(h, "PUT", "/a.txt", strings.NewReader("a"), "X-Request-ID", "trace-1")
+	})
+	if w.Code != http.StatusCreated || w.Header().Get("X-Request-ID") != "trace-1" {
+		t.Fatalf("PUT = %d with X-Request-ID %q, want trace-1", w.Code, w.Header().Get("X-Request-ID"))
+	}
+	if ids := loggedIds(log); len(ids) != 1 || !ids["trace-1"] {
+		t.Errorf("logged request ids %v, want only trace-1:\n%s", ids, log)
+	}
+	for _, p := range []string{"/adrive/v2/file/createWithFolders", "/v2/file/complete"} {
+		for _, id := range s.RequestIDs(p) {
+			if id != "trace-1" {
+				t.Errorf("%s sent X-Request-ID %q, want trace-1", p, id)
+			}
+		}
+	}
+
+	//没有请求ID时各自生成，同一个请求的日志和接口调用使用同一个ID
+	var first, second string
+	log = captureStdout(t, func() {
+		first = serve(h, "PUT", "/b.txt", strings.NewReader("b")).Header().Get("X-Request-ID")
+		second = serve(h, "PUT", "/c.txt", strings.NewReader("c")).Header().Get("X-Request-ID")
+	})
+	if first == "" || second == "" || first == second {
+		t.Fatalf("generated request ids %q and %q, want two different ids", first, second)
+	}
+	if ids := loggedIds(log); len(ids) != 2 || !ids[first] || !ids[second] {
+		t.Errorf("logged request ids %v, want %s and %s", ids, first, second)
+	}
+	calls := s.RequestIDs("/adrive/v2/file/createWithFolders")
+	if got := calls[len(calls)-2:]; got[0] != first || got[1] != second {
+		t.Errorf("upstream calls sent %v, want %s then %s", got, first, second)
+	}
+
+	//过长的请求ID不沿用
+	long := strings.Repeat("x", 200)
+	if id := serve(h, "PROPFIND", "/", nil, "X-Request-ID", long, "Depth", "0").Header().Get("X-Request-ID"); id == "" || id == long {
+		t.Errorf("over-long request id answered with %q, want a generated one", id)
+	}
+}
+
+// TestRequestIDUploadLogs checks that the debug, intermediate file and
+// pending upload log lines of an upload carry its request id.
+func TestRequestIDUploadLogs(t *testing.T) {
+	h, _ := newTestHandler(t)
+	defer func(old bool) { net.Debug = old }(net.Debug)
+	net.Debug = true
+	defer func(old bool) { aliyun.ResumeUploads = old }(aliyun.ResumeUploads)
+	aliyun.ResumeUploads = true
+	//配置的临时目录无法创建中间文件，上传记录也无法保存
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(notDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	aliyun.TempDir = notDir
+
+	var w *httptest.ResponseRecorder
+	log := captureStdout(t, func() {
+		w = serve(h, "PUT", "/a.txt", strings.NewReader("a"), "X-Request-ID", "trace-1")
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT = %d, want 201", w.Code)
+	}
+	for _, marker := range []string{"🔍", "无法创建中间文件", "保存上传记录失败"} {
+		if !strings.Contains(log, marker) {
+			t.Errorf("no %q line logged:\n%s", marker, log)
+		}
+	}
+	for _, line := range strings.Split(log, "\n") {
+		if strings.Contains(line, "🔍") || strings.Contains(line, "⚠️") {
+			if !strings.HasSuffix(line, "request_id=trace-1") {
+				t.Errorf("log line without the request id: %s", line)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package webdav
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"go-aliyun-webdav/aliyun"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// uploadOffsetHeader reports how many bytes of a resumable upload the
+// server holds, that is where the client resumes.
+const uploadOffsetHeader = "Upload-Offset"
+
+// uploadIdHeader names the session of a resumable upload. The client may
+// choose it; otherwise the server assigns one on the first chunk. Every
+// later chunk and offset query must send it back, so that two uploads of
+// the same path and size never share a session.
+const uploadIdHeader = "Upload-Id"
+
+// maxUploadIdLength is the longest Upload-Id accepted.
+const maxUploadIdLength = 128
+
+// newUploadId returns a random upload session id.
+func newUploadId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseUploadRange parses the Content-Range header of a resumable PUT:
+// "bytes first-last/total" for a chunk, or "bytes */total" to ask for the
+// current offset. first is -1 for the latter.
+func parseUploadRange(hdr string) (first, last, total int64, err error) {
+	spec := strings.TrimSpace(hdr)
+	if !strings.HasPrefix(spec, "bytes ") {
+		return 0, 0, 0, errInvalidContentRange
+	}
+	spec = strings.TrimSpace(strings.TrimPrefix(spec, "bytes "))
+	i := strings.Index(spec, "/")
+	if i < 0 {
+		return 0, 0, 0, errInvalidContentRange
+	}
+	if total, err = strconv.ParseInt(spec[i+1:], 10, 64); err != nil || total <= 0 {
+		return 0, 0, 0, errInvalidContentRange
+	}
+	if spec[:i] == "*" {
+		return -1, -1, total, nil
+	}
+	j := strings.Index(spec[:i], "-")
+	if j < 0 {
+		return 0, 0, 0, errInvalidContentRange
+	}
+	first, err1 := strconv.ParseInt(spec[:j], 10, 64)
+	last, err2 := strconv.ParseInt(spec[j+1:i], 10, 64)
+	if err1 != nil || err2 != nil || first < 0 || last < first || last >= total {
+		return 0, 0, 0, errInvalidContentRange
+	}
+	return first, last, total, nil
+}
+
+// resumePut handles a PUT of reqPath carrying a Content-Range. A chunk is
+// appended to the upload session named by the Upload-Id header, which must
+// already hold exactly the bytes before it; "bytes */total" only asks how
+// many bytes it holds. A first chunk without an Upload-Id starts a session
+// with an id assigned by the server. Either way the answer carries the
+// session id in an Upload-Id header and the offset to resume from in an
+// Upload-Offset header. Once the session holds the whole file it is
+// returned, open, along with its id, for handlePut to upload in place of
+// an intermediate file.
+func (h *Handler) resumePut(w http.ResponseWriter, r *http.Request, reqPath string) (*os.File, string, int, error) {
+	first, last, total, err := parseUploadRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, "", http.StatusBadRequest, err
+	}
+	uploadId := strings.TrimSpace(r.Header.Get(uploadIdHeader))
+	if len(uploadId) > maxUploadIdLength {
+		return nil, "", http.StatusBadRequest, errInvalidUploadId
+	}
+	if uploadId == "" {
+		if first != 0 {
+			//没有上传ID时无法确定是哪次上传
+			return nil, "", http.StatusBadRequest, errInvalidUploadId
+		}
+		uploadId = newUploadId()
+	}
+	w.Header().Set(uploadIdHeader, uploadId)
+	driveId := h.CurrentConfig().DriveId
+	offset := aliyun.ResumeOffset(driveId, reqPath, total, uploadId)
+	if first >= 0 {
+		if r.ContentLength >= 0 && r.ContentLength != last-first+1 {
+			return nil, "", http.StatusBadRequest, errInvalidContentRange
+		}
+		offset, err = aliyun.AppendResume(driveId, reqPath, total, uploadId, first, last-first+1, r.Body)
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	switch {
+	case errors.Is(err, aliyun.ErrResumeOffset), errors.Is(err, aliyun.ErrResumeBusy):
+		return nil, "", http.StatusConflict, err
+	case errors.Is(err, aliyun.ErrNoIntermediateFile):
+		return nil, "", http.StatusInsufficientStorage, err
+	case err != nil:
+		return nil, "", http.StatusBadRequest, err
+	case offset < total:
+		//内容还不完整，客户端从Upload-Offset继续
+		return nil, "", http.StatusAccepted, nil
+	}
+	f, err := aliyun.OpenResume(driveId, reqPath, total, uploadId)
+	if err != nil {
+		return nil, "", http.StatusInternalServerError, err
+	}
+	return f, uploadId, 0, nil
+}
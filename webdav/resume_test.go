@@ -0,0 +1,106 @@
+package webdav
+
+import (
+	"bytes"
+	"go-aliyun-webdav/aliyun"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// putRange sends a resumable PUT of body as the bytes first.. of a file of
+// total bytes, or an offset query if body is nil.
+func putRange(h http.Handler, target string, uploadId string, first int, body []byte, total int) *httptest.ResponseRecorder {
+	cr := "bytes */" + strconv.Itoa(total)
+	if body != nil {
+		cr = "bytes " + strconv.Itoa(first) + "-" + strconv.Itoa(first+len(body)-1) + "/" + strconv.Itoa(total)
+	}
+	hdr := []string{"Content-Range", cr}
+	if uploadId != "" {
+		hdr = append(hdr, "Upload-Id", uploadId)
+	}
+	return serve(h, "PUT", target, bytes.NewReader(body), hdr...)
+}
+
+func TestResumableUpload(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.ResumableUploads = true
+	content := patterned(1000)
+
+	w := putRange(h, "/a.bin", "", 0, content[:300], len(content))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("first chunk = %d, want 202", w.Code)
+	}
+	id := w.Header().Get("Upload-Id")
+	if id == "" {
+		t.Fatal("no Upload-Id assigned to a new upload")
+	}
+
+	//同一路径同样大小的另一次上传使用另一个会话
+	other := putRange(h, "/a.bin", "", 0, content[:100], len(content))
+	if other.Header().Get("Upload-Id") == id || other.Header().Get("Upload-Offset") != "100" {
+		t.Errorf("second upload shares the session: id %q offset %q", other.Header().Get("Upload-Id"), other.Header().Get("Upload-Offset"))
+	}
+	if w := putRange(h, "/a.bin", "", 0, nil, len(content)); w.Code != http.StatusBadRequest {
+		t.Errorf("offset query without Upload-Id = %d, want 400", w.Code)
+	}
+
+	w = putRange(h, "/a.bin", id, 0, nil, len(content))
+	if w.Code != http.StatusAccepted || w.Header().Get("Upload-Offset") != "300" {
+		t.Fatalf("offset query = %d offset %q, want 202 at 300", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := putRange(h, "/a.bin", id, 200, content[200:], len(content)); w.Code != http.StatusConflict {
+		t.Errorf("chunk at the wrong offset = %d, want 409", w.Code)
+	}
+	offset, _ := strconv.Atoi(w.Header().Get("Upload-Offset"))
+	if w := putRange(h, "/a.bin", id, offset, content[offset:], len(content)); w.Code != http.StatusCreated {
+		t.Fatalf("last chunk = %d, want 201: %s", w.Code, w.Body)
+	}
+	f, ok := s.Lookup("a.bin")
+	if !ok || !bytes.Equal(f.Content, content) {
+		t.Errorf("uploaded file differs from the chunks sent")
+	}
+}
+
+func TestResumableUploadFromSession(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.ResumableUploads = true
+	defer func(keep bool, limit int64) { aliyun.KeepFailedUploads, aliyun.TempDiskLimit = keep, limit }(aliyun.KeepFailedUploads, aliyun.TempDiskLimit)
+	aliyun.KeepFailedUploads = true
+	//会话文件占用的空间只计算一次
+	aliyun.TempDiskLimit = 1000
+	content := patterned(1000)
+
+	w := putRange(h, "/a.bin", "", 0, content[:400], len(content))
+	id := w.Header().Get("Upload-Id")
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if w := putRange(h, "/a.bin", id, 400, content[400:], len(content)); w.Code < 300 {
+		t.Fatalf("failed upload = %d", w.Code)
+	}
+	//会话文件直接上传，失败时不会留下另一个中间文件，会话保留供再次上传
+	entries, err := os.ReadDir(aliyun.TempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temp dir holds %d files, want only the session", len(entries))
+	}
+	if w := putRange(h, "/a.bin", id, 0, nil, len(content)); w.Header().Get("Upload-Offset") != "1000" {
+		t.Errorf("session offset after a failed upload = %q, want 1000", w.Header().Get("Upload-Offset"))
+	}
+
+	s.Handle("/adrive/v2/file/createWithFolders", nil)
+	if w := putRange(h, "/a.bin", id, 0, nil, len(content)); w.Code != http.StatusCreated {
+		t.Fatalf("upload of the complete session = %d, want 201: %s", w.Code, w.Body)
+	}
+	if f, ok := s.Lookup("a.bin"); !ok || !bytes.Equal(f.Content, content) {
+		t.Errorf("uploaded file differs from the chunks sent")
+	}
+	if entries, _ := os.ReadDir(aliyun.TempDir); len(entries) != 0 {
+		t.Errorf("temp dir holds %d files after the upload, want none", len(entries))
+	}
+}
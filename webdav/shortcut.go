@@ -0,0 +1,180 @@
+package webdav
+
+import (
+	"context"
+	"encoding/json"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/model"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Shortcut is a virtual entry in the WebDAV tree pointing at another file
+// or folder of the drive, or at an external URL such as a share link. Exactly
+// one of FileId and URL is set.
+type Shortcut struct {
+	Path   string `json:"path"`
+	FileId string `json:"file_id,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+// A ShortcutStore holds the shortcuts and persists them to a local JSON
+// file. A nil *ShortcutStore is valid and holds no shortcuts.
+type ShortcutStore struct {
+	mu    sync.RWMutex
+	file  string
+	items map[string]Shortcut
+}
+
+// NewShortcutStore returns a store backed by file, loading the shortcuts
+// already saved in it. A missing file is not an error.
+func NewShortcutStore(file string) (*ShortcutStore, error) {
+	s := &ShortcutStore{file: file, items: make(map[string]Shortcut)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Shortcut
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, sc := range list {
+		s.items[cleanShortcutPath(sc.Path)] = sc
+	}
+	return s, nil
+}
+
+// cleanShortcutPath normalizes p to the form of a stripped request path,
+// without leading or trailing slashes.
+func cleanShortcutPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// Add creates or replaces the shortcut at sc.Path and saves the store.
+func (s *ShortcutStore) Add(sc Shortcut) error {
+	sc.Path = cleanShortcutPath(sc.Path)
+	if sc.Path == "" || (sc.FileId == "") == (sc.URL == "") {
+		return errInvalidShortcut
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[sc.Path] = sc
+	return s.save()
+}
+
+// Remove deletes the shortcut at p and saves the store.
+func (s *ShortcutStore) Remove(p string) error {
+	p = cleanShortcutPath(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[p]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.items, p)
+	return s.save()
+}
+
+// Get returns the shortcut at the request path p.
+func (s *ShortcutStore) Get(p string) (Shortcut, bool) {
+	if s == nil {
+		return Shortcut{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sc, ok := s.items[cleanShortcutPath(p)]
+	return sc, ok
+}
+
+// List returns all shortcuts sorted by path.
+func (s *ShortcutStore) List() []Shortcut {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Shortcut, 0, len(s.items))
+	for _, sc := range s.items {
+		list = append(list, sc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// children returns the shortcuts placed directly inside the folder dir.
+func (s *ShortcutStore) children(dir string) []Shortcut {
+	var list []Shortcut
+	dir = cleanShortcutPath(dir)
+	for _, sc := range s.List() {
+		parent := path.Dir(sc.Path)
+		if parent == "." {
+			parent = ""
+		}
+		if parent == dir {
+			list = append(list, sc)
+		}
+	}
+	return list
+}
+
+// save writes the store to its file. The caller must hold s.mu.
+func (s *ShortcutStore) save() error {
+	list := make([]Shortcut, 0, len(s.items))
+	for _, sc := range s.items {
+		list = append(list, sc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// shortcutItem returns the item a shortcut stands for, named after the
+// shortcut itself. URL shortcuts appear as empty files.
+func (h *Handler) shortcutItem(ctx context.Context, sc Shortcut, parentFileId string) (model.ListModel, error) {
+	name := path.Base(sc.Path)
+	if sc.URL != "" {
+		return model.ListModel{Name: name, Type: "file", ParentFileId: parentFileId, Url: sc.URL}, nil
+	}
+	fi, err := aliyun.GetFileDetail(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId, sc.FileId)
+	if err != nil {
+		return fi, err
+	}
+	// A target moved to the recycle bin is still returned by file/get.
+	if fi.Status == "trashed" {
+		return model.ListModel{}, os.ErrNotExist
+	}
+	fi.Name = name
+	fi.ParentFileId = parentFileId
+	return fi, nil
+}
+
+// withShortcuts appends the shortcuts inside dir to list, whose folder has
+// the id dirId. The cached list is never modified.
+func (h *Handler) withShortcuts(ctx context.Context, dir, dirId string, list model.FileListModel) model.FileListModel {
+	children := h.Shortcuts.children(dir)
+	if len(children) == 0 {
+		return list
+	}
+	items := make([]model.ListModel, len(list.Items), len(list.Items)+len(children))
+	copy(items, list.Items)
+	for _, sc := range children {
+		if fi, err := h.shortcutItem(ctx, sc, dirId); err == nil {
+			items = append(items, fi)
+		}
+	}
+	list.Items = items
+	return list
+}
@@ -0,0 +1,98 @@
+package webdav
+
+import (
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShortcutStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "shortcuts.json")
+	s, err := NewShortcutStore(file)
+	if err != nil {
+		t.Fatalf("NewShortcutStore of a missing file: %v", err)
+	}
+	if err := s.Add(Shortcut{Path: "/links/a/", FileId: "f1"}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := s.Add(Shortcut{Path: "share", URL: "https://example.com/s/1"}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	for _, sc := range []Shortcut{
+		{Path: "/", FileId: "f1"},
+		{Path: "none"},
+		{Path: "both", FileId: "f1", URL: "https://example.com"},
+	} {
+		if err := s.Add(sc); err != errInvalidShortcut {
+			t.Errorf("Add(%+v) = %v, want errInvalidShortcut", sc, err)
+		}
+	}
+
+	//重新加载后内容不变
+	s, err = NewShortcutStore(file)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if sc, ok := s.Get("/links/a"); !ok || sc.FileId != "f1" {
+		t.Errorf("Get(/links/a) = %+v, %v after reload", sc, ok)
+	}
+	if list := s.List(); len(list) != 2 || list[0].Path != "links/a" || list[1].Path != "share" {
+		t.Errorf("List = %+v", list)
+	}
+	if err := s.Remove("links/a"); err != nil {
+		t.Errorf("Remove: %v", err)
+	}
+	if err := s.Remove("links/a"); err == nil {
+		t.Error("Remove of a missing shortcut succeeded")
+	}
+	if s, _ = NewShortcutStore(file); len(s.List()) != 1 {
+		t.Errorf("removal not saved: %+v", s.List())
+	}
+
+	var none *ShortcutStore
+	if _, ok := none.Get("share"); ok || none.List() != nil {
+		t.Error("nil store holds shortcuts")
+	}
+}
+
+func TestShortcutResolve(t *testing.T) {
+	h, s := newTestHandler(t)
+	media := s.Mkdir("root", "media")
+	movie := s.Put(media, "movie.txt", []byte("movie content"))
+	store, err := NewShortcutStore(filepath.Join(t.TempDir(), "shortcuts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Shortcuts = store
+	store.Add(Shortcut{Path: "fav.txt", FileId: movie})
+	store.Add(Shortcut{Path: "media-link", FileId: media})
+	store.Add(Shortcut{Path: "share", URL: "https://example.com/s/1"})
+
+	w := serve(h, "GET", "/fav.txt", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "movie content" {
+		t.Errorf("GET through a shortcut = %d %q, want the target content", w.Code, w.Body.String())
+	}
+	w = serve(h, "GET", "/share", nil)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com/s/1" {
+		t.Errorf("GET of a URL shortcut = %d %s, want a redirect", w.Code, w.Header().Get("Location"))
+	}
+
+	//快捷方式出现在所在文件夹的列表中，名称为快捷方式的名称
+	listing := doPropfind(h, "/", "1", "").Body.String()
+	for _, href := range []string{"/fav.txt", "/media-link/", "/share"} {
+		if !strings.Contains(listing, "<D:href>"+href+"</D:href>") {
+			t.Errorf("PROPFIND / missing %s:\n%s", href, listing)
+		}
+	}
+	if listing := doPropfind(h, "/media-link/", "1", "").Body.String(); !strings.Contains(listing, "<D:href>/media-link/movie.txt</D:href>") {
+		t.Errorf("PROPFIND of a folder shortcut missing its children:\n%s", listing)
+	}
+
+	//目标被删除后快捷方式失效
+	s.Update(movie, func(f *aliyuntest.File) { f.Trashed = true })
+	if w := serve(h, "GET", "/fav.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a dangling shortcut = %d, want 404", w.Code)
+	}
+}
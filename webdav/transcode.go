@@ -0,0 +1,100 @@
+package webdav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// transcodeTemplates maps the resolutions accepted in the transcode query
+// parameter to the Aliyun live transcoding template ids.
+var transcodeTemplates = map[string]string{
+	"360p":  "LD",
+	"540p":  "SD",
+	"720p":  "HD",
+	"1080p": "FHD",
+	"1440p": "QHD",
+}
+
+// playInfoTTL is how long the transcoded playlist URLs of a video are
+// cached. Aliyun signs them for a limited time.
+const playInfoTTL = 5 * time.Minute
+
+// serveTranscoded serves the transcoded HLS stream of the video fi in the
+// given quality instead of the original file. Without a segment query
+// parameter it serves the playlist, rewritten so that every segment is
+// fetched through this handler again; with one it proxies that segment.
+func (h *Handler) serveTranscoded(w http.ResponseWriter, r *http.Request, fi model.ListModel, quality string) (int, error) {
+	template, ok := transcodeTemplates[strings.ToLower(quality)]
+	if !ok {
+		template = strings.ToUpper(quality)
+	}
+	playlist, err := h.playlistUrl(r.Context(), fi.FileId, template)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	if playlist == "" {
+		return http.StatusNotFound, errTranscodeUnavailable
+	}
+	base, err := url.Parse(playlist)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+
+	if segment := r.URL.Query().Get("segment"); segment != "" {
+		//只代理与播放列表同一主机上的分片，避免被用来请求任意地址
+		target, err := base.Parse(segment)
+		if err != nil || target.Host != base.Host {
+			return http.StatusBadRequest, errTranscodeUnavailable
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		if !net.Get(r.Context(), w, target.String(), h.CurrentConfig().Token, "", "", nil) {
+			w.Header().Del("Content-Type")
+			return http.StatusBadGateway, errDownloadFailed
+		}
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+	if !net.Get(r.Context(), &buf, playlist, h.CurrentConfig().Token, "", "", nil) {
+		cache.GoCache.Delete("PLAY_" + fi.FileId)
+		return http.StatusBadGateway, errDownloadFailed
+	}
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			line = "?transcode=" + url.QueryEscape(quality) + "&segment=" + url.QueryEscape(line)
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(out.Bytes())
+	return 0, nil
+}
+
+// playlistUrl returns the URL of the transcoded playlist of fileId for the
+// given template, or "" if Aliyun has not transcoded it to that quality.
+func (h *Handler) playlistUrl(ctx context.Context, fileId string, template string) (string, error) {
+	key := "PLAY_" + fileId
+	if v, ok := cache.GoCache.Get(key); ok {
+		return v.(map[string]string)[template], nil
+	}
+	urls, err := aliyun.GetVideoPlayInfo(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fileId)
+	if err != nil {
+		return "", err
+	}
+	cache.GoCache.Set(key, urls, playInfoTTL)
+	return urls[template], nil
+}
@@ -0,0 +1,71 @@
+package webdav
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestTranscode checks that ?transcode= serves the playlist of the selected
+// quality with its segments proxied through the handler.
+func TestTranscode(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "a.mp4", []byte("original"))
+	s.Handle("/v2/file/get_video_preview_play_info", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"video_preview_play_info":{"live_transcoding_task_list":[
+			{"template_id":"SD","status":"finished","url":"` + s.URL + `/hls/SD/index.m3u8"},
+			{"template_id":"HD","status":"finished","url":"` + s.URL + `/hls/HD/index.m3u8"},
+			{"template_id":"FHD","status":"running","url":""}]}}`))
+	})
+	s.Handle("/hls/HD/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXTINF:10,\nseg0.ts\n#EXTINF:10,\nseg1.ts?sig=a&b\n#EXT-X-ENDLIST\n"))
+	})
+	s.Handle("/hls/HD/seg0.ts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment0"))
+	})
+
+	w := serve(h, "GET", "/a.mp4?transcode=720p", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET playlist = %d, want 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("playlist Content-Type = %q", ct)
+	}
+	//分片地址改写为经过本服务代理
+	want := "#EXTM3U\n#EXTINF:10,\n?transcode=720p&segment=seg0.ts\n#EXTINF:10,\n?transcode=720p&segment=" +
+		url.QueryEscape("seg1.ts?sig=a&b") + "\n#EXT-X-ENDLIST\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("playlist =\n%s\nwant\n%s", got, want)
+	}
+
+	w = serve(h, "GET", "/a.mp4?transcode=720p&segment=seg0.ts", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "segment0" {
+		t.Errorf("GET segment = %d %q, want the proxied segment", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "video/mp2t" {
+		t.Errorf("segment Content-Type = %q", ct)
+	}
+	//播放地址缓存，只获取一次
+	if n := s.Calls("/v2/file/get_video_preview_play_info"); n != 1 {
+		t.Errorf("fetched the play info %d times, want once", n)
+	}
+
+	//不在播放列表所在主机上的分片不代理
+	w = serve(h, "GET", "/a.mp4?transcode=720p&segment="+url.QueryEscape("http://example.com/x.ts"), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET segment on another host = %d, want 400", w.Code)
+	}
+	//还没有转码完成的清晰度
+	if w := serve(h, "GET", "/a.mp4?transcode=1080p", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET unfinished quality = %d, want 404", w.Code)
+	}
+	//模板id也可以直接使用
+	if w := serve(h, "GET", "/a.mp4?transcode=sd", nil); w.Code != http.StatusBadGateway {
+		t.Errorf("GET SD with a missing playlist = %d, want 502", w.Code)
+	}
+	//没有transcode参数时返回原文件
+	if w := serve(h, "GET", "/a.mp4", nil); !strings.Contains(w.Body.String(), "original") {
+		t.Errorf("GET without transcode = %d %q, want the original", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,247 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The drive and the LocalPrefix tree are two mounts of one Handler. There
+// is no server-side copy between them, so a COPY or MOVE from one to the
+// other downloads the resource and uploads it to the other side; a MOVE
+// then deletes the source once the copy is complete.
+
+// transferDepth returns the depth of a COPY or MOVE between the mounts.
+func transferDepth(r *http.Request) (int, error) {
+	depth := infiniteDepth
+	if hdr := r.Header.Get("Depth"); hdr != "" {
+		depth = parseDepth(hdr)
+	}
+	// Section 9.8.3 allows "0" and "infinity" for COPY, section 9.9.2
+	// only "infinity" for MOVE.
+	if depth != infiniteDepth && (depth != 0 || r.Method == "MOVE") {
+		return depth, errInvalidDepth
+	}
+	return depth, nil
+}
+
+// findDriveFile returns the drive item at reqPath, a path relative to the
+// root without leading slash, preferring its cached FileId.
+func (h *Handler) findDriveFile(ctx context.Context, reqPath string) (model.ListModel, int, error) {
+	config := h.CurrentConfig()
+	fi := h.findCachedFile(ctx, reqPath)
+	if fi.FileId == "" {
+		list, err := aliyun.GetList(ctx, config.Token, config.DriveId, "")
+		if err != nil {
+			return fi, http.StatusBadGateway, err
+		}
+		fi, err = findUrl(ctx, strings.Split(reqPath, "/"), config.Token, config.DriveId, list)
+		if errors.Is(err, net.ErrRiskControl) {
+			return fi, http.StatusServiceUnavailable, err
+		}
+		if err != nil {
+			return fi, http.StatusBadGateway, err
+		}
+	}
+	if fi.FileId == "" {
+		return fi, http.StatusNotFound, os.ErrNotExist
+	}
+	return fi, 0, nil
+}
+
+// transferToLocal copies the drive resource src to name in the local tree.
+func (h *Handler) transferToLocal(r *http.Request, src, name string) (status int, err error) {
+	depth, err := transferDepth(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	ctx := r.Context()
+	fi, status, err := h.findDriveFile(ctx, src)
+	if err != nil {
+		return status, err
+	}
+	if parent, err := h.FileSystem.Stat(ctx, path.Dir(name)); err != nil || !parent.IsDir() {
+		return http.StatusConflict, os.ErrNotExist
+	}
+	_, statErr := h.FileSystem.Stat(ctx, name)
+	existed := statErr == nil
+	//已有的目标先改名放在一边，下载完成后再删除，下载失败时恢复，与网盘中的checkOverwrite相同
+	aside := ""
+	if existed {
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed, os.ErrExist
+		}
+		aside = name + ".replaced-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		if err := h.FileSystem.Rename(ctx, name, aside); err != nil {
+			return http.StatusForbidden, err
+		}
+	}
+	if err := h.downloadTo(ctx, fi, name, depth); err != nil {
+		logln(r, "❌  复制到本地目录失败", src, name, err)
+		h.FileSystem.RemoveAll(ctx, name)
+		if aside != "" {
+			if err := h.FileSystem.Rename(ctx, aside, name); err != nil {
+				logln(r, "❌  恢复被替换的文件失败", name, "现在的名称为", aside)
+			}
+		}
+		return http.StatusBadGateway, err
+	}
+	if aside != "" {
+		if err := h.FileSystem.RemoveAll(ctx, aside); err != nil {
+			logln(r, "❌  删除被替换的文件失败", aside, err)
+		}
+	}
+	logln(r, "📥  复制到本地目录", src, name)
+	if r.Method == "MOVE" {
+		config := h.CurrentConfig()
+		if err := aliyun.RemoveTrash(ctx, config.Token, config.DriveId, fi.FileId, fi.ParentFileId); err != nil {
+			logln(r, "❌  删除已移动到本地目录的文件失败", src, err)
+			return http.StatusBadGateway, err
+		}
+		cache.GoCache.Delete(cache.FileIdKey(config.DriveId, src))
+		cache.GoCache.DeletePrefix(cache.FileIdKey(config.DriveId, src+"/"))
+	}
+	return moveStatus(existed), nil
+}
+
+// downloadTo writes the drive item fi to name in the local tree, with the
+// content of a folder down to depth.
+func (h *Handler) downloadTo(ctx context.Context, fi model.ListModel, name string, depth int) error {
+	config := h.CurrentConfig()
+	if fi.Type == "folder" {
+		if err := h.FileSystem.Mkdir(ctx, name, 0777); err != nil {
+			return err
+		}
+		if depth == 0 {
+			return nil
+		}
+		list, err := aliyun.GetList(ctx, config.Token, config.DriveId, fi.FileId)
+		if err != nil {
+			return err
+		}
+		for _, item := range list.Items {
+			if err := h.downloadTo(ctx, item, path.Join(name, item.Name), depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	f, err := h.FileSystem.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	ok := fi.Size == 0 || aliyun.GetFile(ctx, f, aliyun.GetDownloadUrl(ctx, config.Token, config.DriveId, fi.FileId), config.Token, config.DriveId, fi.FileId, "", "")
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if !ok {
+		return errDownloadFailed
+	}
+	return nil
+}
+
+// transferFromLocal copies name in the local tree to dst in the drive, a
+// path relative to the root without leading slash.
+func (h *Handler) transferFromLocal(r *http.Request, name, dst string) (status int, err error) {
+	depth, err := transferDepth(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	ctx, config := r.Context(), h.CurrentConfig()
+	if _, err := h.FileSystem.Stat(ctx, name); err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusForbidden, err
+	}
+	dir, base := path.Split(dst)
+	parentFileId, err := resolveOrCreateParent(ctx, config.Token, config.DriveId, dir, false)
+	if err != nil {
+		if os.IsNotExist(err) || err == errNotADirectory {
+			return http.StatusConflict, err
+		}
+		return http.StatusBadGateway, err
+	}
+	d, status, err := h.checkOverwrite(r, parentFileId, base, "")
+	if err != nil {
+		return status, err
+	}
+	cache.GoCache.Delete(cache.FileIdKey(config.DriveId, dst))
+	cache.GoCache.DeletePrefix(cache.FileIdKey(config.DriveId, dst+"/"))
+
+	fileId, err := h.uploadFrom(r, name, parentFileId, base, depth)
+	if err != nil {
+		logln(r, "❌  从本地目录复制失败", name, dst, err)
+		if fileId != "" {
+			aliyun.RemoveTrash(ctx, config.Token, config.DriveId, fileId, parentFileId)
+		}
+		d.restore(r)
+		return http.StatusBadGateway, err
+	}
+	logln(r, "📤  从本地目录复制", name, dst)
+	cache.GoCache.Set(cache.FileIdKey(config.DriveId, dst), fileId, -1)
+	d.discard(r)
+	if r.Method == "MOVE" {
+		if err := h.FileSystem.RemoveAll(ctx, name); err != nil {
+			logln(r, "❌  删除已移动到网盘的本地文件失败", name, err)
+			return http.StatusInternalServerError, err
+		}
+	}
+	return moveStatus(d.replaced()), nil
+}
+
+// uploadFrom uploads name in the local tree as base under parentFileId,
+// with the content of a folder down to depth. It returns the id of what it
+// created, also when failing halfway so that the caller can remove it.
+func (h *Handler) uploadFrom(r *http.Request, name, parentFileId, base string, depth int) (string, error) {
+	ctx, config := r.Context(), h.CurrentConfig()
+	f, err := h.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		//复用PUT的上传流程
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, "/"+base, io.NopCloser(f))
+		if err != nil {
+			return "", err
+		}
+		req.ContentLength = fi.Size()
+		fileId, _, err := aliyun.ContentHandle(req, config.Token, config.DriveId, parentFileId, base)
+		if fileId == "" && err == nil {
+			err = errUploadFailed
+		}
+		return fileId, err
+	}
+	folder := aliyun.MakeDir(ctx, config.Token, config.DriveId, base, parentFileId)
+	if folder.FileId == "" {
+		return "", errCreateDirectory
+	}
+	if depth == 0 {
+		return folder.FileId, nil
+	}
+	children, err := f.Readdir(-1)
+	if err != nil {
+		return folder.FileId, err
+	}
+	for _, child := range children {
+		if _, err := h.uploadFrom(r, path.Join(name, child.Name()), folder.FileId, child.Name(), depth); err != nil {
+			return folder.FileId, err
+		}
+	}
+	return folder.FileId, nil
+}
@@ -0,0 +1,248 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// trashFolder is the virtual folder standing for the Aliyun recycle bin.
+// Moving a resource into it trashes the resource and moving one out of it
+// restores it, which is how clients such as the macOS Finder delete. A real
+// folder of that name in the drive root takes precedence.
+const trashFolder = ".trash"
+
+// isTrashPath reports whether the stripped request path p is inside the
+// virtual trash folder.
+func isTrashPath(p string) bool {
+	return p == trashFolder || strings.HasPrefix(p, trashFolder+"/")
+}
+
+// virtualTrash reports whether p is inside the virtual trash folder, that is
+// inside trashFolder while the drive root holds no real folder of that name.
+func (h *Handler) virtualTrash(ctx context.Context, p string) (bool, error) {
+	if !isTrashPath(p) {
+		return false, nil
+	}
+	config := h.CurrentConfig()
+	list, err := aliyun.GetList(ctx, config.Token, config.DriveId, "")
+	if err != nil {
+		return false, err
+	}
+	for _, item := range list.Items {
+		if item.Name == trashFolder {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// moveToTrash moves the resource at src to the recycle bin.
+func (h *Handler) moveToTrash(ctx context.Context, src string) (status int, err error) {
+	config := h.CurrentConfig()
+	strArr := strings.Split(src, "/")
+	list, err := aliyun.GetList(ctx, config.Token, config.DriveId, "")
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	fi, err := findUrl(ctx, strArr, config.Token, config.DriveId, list)
+	if errors.Is(err, net.ErrRiskControl) {
+		return http.StatusServiceUnavailable, err
+	}
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	if fi.FileId == "" {
+		return http.StatusNotFound, os.ErrNotExist
+	}
+	if err := aliyun.RemoveTrash(ctx, config.Token, config.DriveId, fi.FileId, fi.ParentFileId); err != nil {
+		return http.StatusBadGateway, err
+	}
+	cache.GoCache.Delete(cache.FileIdKey(config.DriveId, src))
+	return http.StatusCreated, nil
+}
+
+// trashEntry is a trashed item and the name it has inside the trash folder.
+type trashEntry struct {
+	name string
+	item model.ListModel
+}
+
+// trashEntries lists the recycle bin, most recently trashed first. Items
+// sharing a name with another trashed item are told apart by their file id,
+// so that every entry names exactly one item.
+func (h *Handler) trashEntries(ctx context.Context) ([]trashEntry, error) {
+	config := h.CurrentConfig()
+	trash, err := aliyun.ListTrash(ctx, config.Token, config.DriveId)
+	if err != nil {
+		return nil, err
+	}
+	count := make(map[string]int, len(trash.Items))
+	for _, item := range trash.Items {
+		count[item.Name]++
+	}
+	entries := make([]trashEntry, 0, len(trash.Items))
+	for _, item := range trash.Items {
+		name := item.Name
+		if count[name] > 1 {
+			ext := path.Ext(name)
+			name = strings.TrimSuffix(name, ext) + " (" + item.FileId + ")" + ext
+		}
+		entries = append(entries, trashEntry{name: name, item: item})
+	}
+	return entries, nil
+}
+
+// findTrashed returns the trashed item that the path src inside the trash
+// folder names, either by its entry name or by its file id. A bare name
+// shared by several trashed items matches the one that was trashed from
+// dst, the path it is being restored to.
+func (h *Handler) findTrashed(ctx context.Context, src, dst string) (model.ListModel, int, error) {
+	rel := strings.TrimPrefix(src, trashFolder+"/")
+	if rel == src || rel == "" || strings.Contains(rel, "/") {
+		return model.ListModel{}, http.StatusNotFound, os.ErrNotExist
+	}
+	entries, err := h.trashEntries(ctx)
+	if err != nil {
+		return model.ListModel{}, http.StatusBadGateway, err
+	}
+	var named []model.ListModel
+	for _, e := range entries {
+		if e.name == rel || e.item.FileId == rel {
+			return e.item, 0, nil
+		}
+		if e.item.Name == rel {
+			named = append(named, e.item)
+		}
+	}
+	for _, item := range named {
+		if dirs, ok := h.pathBelow(ctx, item.FileId, aliyun.RootFileId()); ok && path.Join(append(dirs, item.Name)...) == dst {
+			return item, 0, nil
+		}
+	}
+	if len(named) > 0 {
+		return model.ListModel{}, http.StatusConflict, errTrashAmbiguous
+	}
+	return model.ListModel{}, http.StatusNotFound, os.ErrNotExist
+}
+
+// restoreFromTrash restores the trashed resource src names and moves it to
+// dst when that is not where it came from.
+func (h *Handler) restoreFromTrash(ctx context.Context, src, dst string) (status int, err error) {
+	item, status, err := h.findTrashed(ctx, src, dst)
+	if err != nil {
+		return status, err
+	}
+	config := h.CurrentConfig()
+	if err := aliyun.RestoreTrash(ctx, config.Token, config.DriveId, item.FileId, item.ParentFileId); err != nil {
+		return http.StatusBadGateway, err
+	}
+	dir := path.Dir(dst)
+	if dir == "." {
+		dir = ""
+	}
+	parentFileId, err := resolveOrCreateParent(ctx, config.Token, config.DriveId, dir, false)
+	if err != nil {
+		return http.StatusConflict, errInvalidDestination
+	}
+	if item.ParentFileId != parentFileId {
+		if !aliyun.BatchFile(ctx, config.Token, config.DriveId, item.FileId, parentFileId) {
+			return http.StatusBadGateway, errMoveFailed
+		}
+		cache.GoCache.Delete(cache.ListKey(config.DriveId, item.ParentFileId))
+		cache.GoCache.Delete(cache.ListKey(config.DriveId, parentFileId))
+	}
+	if path.Base(dst) != item.Name {
+		if !aliyun.ReName(ctx, config.Token, config.DriveId, path.Base(dst), item.FileId) {
+			return http.StatusBadGateway, errMoveFailed
+		}
+		cache.GoCache.Delete(cache.ListKey(config.DriveId, parentFileId))
+	}
+	cache.GoCache.Set(cache.FileIdKey(config.DriveId, dst), item.FileId, -1)
+	return http.StatusCreated, nil
+}
+
+// handleTrashPropfind lists the virtual trash folder, or describes one
+// entry of it, in answer to a PROPFIND of reqPath.
+func (h *Handler) handleTrashPropfind(w http.ResponseWriter, r *http.Request, reqPath string, body io.Reader) (status int, err error) {
+	depth := infiniteDepth
+	if hdr := r.Header.Get("Depth"); hdr != "" {
+		if depth = parseDepth(hdr); depth == invalidDepth {
+			return http.StatusBadRequest, errInvalidDepth
+		}
+	}
+	pf, status, err := readPropfind(body)
+	if err != nil {
+		return status, err
+	}
+	entries, err := h.trashEntries(r.Context())
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	folder := model.ListModel{Name: trashFolder, Type: "folder", ParentFileId: aliyun.RootFileId()}
+	//name为各响应的请求路径
+	var responses []trashEntry
+	if reqPath == trashFolder {
+		responses = append(responses, trashEntry{"/" + trashFolder + "/", folder})
+		if depth != 0 {
+			for _, e := range entries {
+				responses = append(responses, trashEntry{"/" + trashFolder + "/" + e.name, e.item})
+			}
+		}
+	} else {
+		for _, e := range entries {
+			if reqPath == trashFolder+"/"+e.name || reqPath == trashFolder+"/"+e.item.FileId {
+				responses = append(responses, trashEntry{"/" + reqPath, e.item})
+				break
+			}
+		}
+		if len(responses) == 0 {
+			return http.StatusNotFound, os.ErrNotExist
+		}
+	}
+
+	mw := multistatusWriter{w: w, flushBytes: h.PropfindFlushBytes}
+	ctx := r.Context()
+	for _, resp := range responses {
+		href := path.Join(h.Prefix, resp.name)
+		if resp.item.Type == "folder" {
+			href += "/"
+		}
+		var pstats []Propstat
+		if pf.Propname != nil {
+			var pnames []xml.Name
+			if pnames, err = propnames(resp.item); err == nil {
+				pstat := Propstat{Status: http.StatusOK}
+				for _, xmlname := range pnames {
+					pstat.Props = append(pstat.Props, Property{XMLName: xmlname})
+				}
+				pstats = append(pstats, pstat)
+			}
+		} else if pf.Allprop != nil {
+			pstats, err = allprop(ctx, h.FileSystem, h.LockSystem, resp.name, pf.Include, resp.item)
+		} else {
+			pstats, err = props(ctx, h.FileSystem, h.LockSystem, resp.name, pf.Prop, resp.item)
+		}
+		if err != nil {
+			err = mw.write(makeFailedResponse(href, http.StatusInternalServerError, err))
+		} else {
+			err = mw.write(makePropstatResponse(href, pstats))
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if err := mw.close(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,151 @@
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// move sends a MOVE of src to dst.
+func move(h http.Handler, src, dst string) int {
+	return serve(h, "MOVE", src, nil, "Destination", "http://example.com"+dst).Code
+}
+
+// TestMoveToTrash checks that a MOVE into /.trash trashes the source and a
+// MOVE out of it restores it.
+func TestMoveToTrash(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	id := s.Put(dir, "a.txt", []byte("a"))
+
+	if code := move(h, "/dir/a.txt", "/.trash/a.txt"); code != http.StatusCreated {
+		t.Fatalf("MOVE to /.trash = %d, want 201", code)
+	}
+	if f, _ := s.File(id); !f.Trashed {
+		t.Fatal("file not moved to the recycle bin")
+	}
+	if w := serve(h, "GET", "/dir/a.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET of the trashed file = %d, want 404", w.Code)
+	}
+	props := responseProps(t, doPropfind(h, "/.trash", "1", "").Body.Bytes())
+	if _, ok := props["/.trash/a.txt"]; !ok {
+		t.Errorf("PROPFIND /.trash = %v, want the trashed file", props)
+	}
+
+	if code := move(h, "/.trash/a.txt", "/dir/a.txt"); code != http.StatusCreated {
+		t.Fatalf("MOVE out of /.trash = %d, want 201", code)
+	}
+	if f, _ := s.File(id); f.Trashed || f.ParentId != dir || f.Name != "a.txt" {
+		t.Errorf("restored file = %+v, want a.txt back in dir", f)
+	}
+	if w := serve(h, "GET", "/dir/a.txt", nil); w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Errorf("GET of the restored file = %d %q", w.Code, w.Body)
+	}
+
+	if code := move(h, "/missing.txt", "/.trash/missing.txt"); code != http.StatusNotFound {
+		t.Errorf("MOVE of a missing file to /.trash = %d, want 404", code)
+	}
+	if code := move(h, "/.trash/missing.txt", "/missing.txt"); code != http.StatusNotFound {
+		t.Errorf("MOVE of a missing trashed file = %d, want 404", code)
+	}
+}
+
+// TestRestoreElsewhere checks restoring to another folder under another
+// name, and restoring one of several trashed items sharing a name.
+func TestRestoreElsewhere(t *testing.T) {
+	h, s := newTestHandler(t)
+	one := s.Mkdir("root", "one")
+	two := s.Mkdir("root", "two")
+	a := s.Put(one, "x.txt", []byte("one"))
+	b := s.Put(two, "x.txt", []byte("two"))
+	for _, src := range []string{"/one/x.txt", "/two/x.txt"} {
+		if code := move(h, src, "/.trash/x.txt"); code != http.StatusCreated {
+			t.Fatalf("MOVE %s to /.trash = %d, want 201", src, code)
+		}
+	}
+
+	//同名的已删除文件按恢复到的位置区分，无法区分时返回409
+	if code := move(h, "/.trash/x.txt", "/elsewhere.txt"); code != http.StatusConflict {
+		t.Errorf("MOVE of an ambiguous name = %d, want 409", code)
+	}
+	if code := move(h, "/.trash/x.txt", "/two/x.txt"); code != http.StatusCreated {
+		t.Fatalf("MOVE back to where it came from = %d, want 201", code)
+	}
+	if f, _ := s.File(b); f.Trashed {
+		t.Error("the file trashed from /two was not restored")
+	}
+	if f, _ := s.File(a); !f.Trashed {
+		t.Error("the file trashed from /one was restored")
+	}
+
+	//按文件id恢复到其它目录并改名
+	if code := move(h, "/.trash/"+a, "/two/y.txt"); code != http.StatusCreated {
+		t.Fatalf("MOVE by file id = %d, want 201", code)
+	}
+	if f, _ := s.File(a); f.Trashed || f.ParentId != two || f.Name != "y.txt" {
+		t.Errorf("restored file = %+v, want y.txt in two", f)
+	}
+}
+
+// TestRealTrashFolder checks that a real .trash folder in the drive root is
+// used as an ordinary folder.
+func TestRealTrashFolder(t *testing.T) {
+	h, s := newTestHandler(t)
+	trash := s.Mkdir("root", ".trash")
+	id := s.Put("root", "a.txt", []byte("a"))
+
+	if code := move(h, "/a.txt", "/.trash/a.txt"); code != http.StatusCreated {
+		t.Fatalf("MOVE into a real .trash = %d, want 201", code)
+	}
+	if f, _ := s.File(id); f.Trashed || f.ParentId != trash {
+		t.Errorf("file = %+v, want it moved into the folder", f)
+	}
+	if n := s.Calls("/v2/recyclebin/trash"); n != 0 {
+		t.Errorf("recycle bin used %d times", n)
+	}
+	if w := doPropfind(h, "/.trash/", "1", ""); !strings.Contains(w.Body.String(), "a.txt") {
+		t.Errorf("PROPFIND of the real folder = %s", w.Body)
+	}
+}
+
+// TestMoveToTrashFails checks that a refused trash request is reported.
+func TestMoveToTrashFails(t *testing.T) {
+	h, s := newTestHandler(t)
+	id := s.Put("root", "a.txt", []byte("a"))
+	s.Handle("/v2/recyclebin/trash", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if code := move(h, "/a.txt", "/.trash/a.txt"); code != http.StatusBadGateway {
+		t.Errorf("MOVE with a failing recycle bin = %d, want 502", code)
+	}
+	if f, _ := s.File(id); f.Trashed {
+		t.Error("file trashed")
+	}
+}
+
+// TestMoveToTrashLookupFails checks that a failure to look up the source is
+// reported as such rather than as a missing file.
+func TestMoveToTrashLookupFails(t *testing.T) {
+	h, s := newTestHandler(t)
+	id := s.Put(s.Mkdir("root", "dir"), "a.txt", []byte("a"))
+	//根目录的列表已缓存，查找dir中的文件时才请求失败
+	if w := doPropfind(h, "/", "1", ""); w.Code != StatusMulti {
+		t.Fatalf("PROPFIND / = %d", w.Code)
+	}
+	for body, want := range map[string]int{
+		`{"code":"InternalError","message":"failed"}`:    http.StatusBadGateway,
+		`{"code":"NeedSecondVerify","message":"verify"}`: http.StatusServiceUnavailable,
+	} {
+		body := body
+		s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(body))
+		})
+		if code := move(h, "/dir/a.txt", "/.trash/a.txt"); code != want {
+			t.Errorf("MOVE to the trash with the listing failing with %s = %d, want %d", body, code, want)
+		}
+	}
+	if f, _ := s.File(id); f.Trashed {
+		t.Error("file trashed")
+	}
+}
@@ -0,0 +1,145 @@
+package webdav
+
+import (
+	"encoding/json"
+	"go-aliyun-webdav/aliyun/model"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VirtualFiles are read-only text files, such as access notes, that appear
+// in the listings and can be downloaded without existing on the drive. A nil
+// *VirtualFiles is valid and holds no files.
+type VirtualFiles struct {
+	files   map[string]string
+	modTime time.Time
+}
+
+// LoadVirtualFiles reads a JSON object mapping paths, such as
+// "/共享/README.txt", to the content of the virtual file at that path.
+func LoadVirtualFiles(file string) (*VirtualFiles, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	v := &VirtualFiles{files: make(map[string]string, len(m)), modTime: time.Now()}
+	if info, err := os.Stat(file); err == nil {
+		v.modTime = info.ModTime()
+	}
+	for p, content := range m {
+		if p = cleanShortcutPath(p); p != "" {
+			v.files[p] = content
+		}
+	}
+	return v, nil
+}
+
+// Get returns the content of the virtual file at the request path p.
+func (v *VirtualFiles) Get(p string) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	content, ok := v.files[cleanShortcutPath(p)]
+	return content, ok
+}
+
+// item returns the listing entry of the virtual file at p.
+func (v *VirtualFiles) item(p, parentFileId string) model.ListModel {
+	name := path.Base(p)
+	ext := path.Ext(name)
+	ctype := mime.TypeByExtension(ext)
+	if ctype == "" {
+		ctype = "text/plain; charset=utf-8"
+	}
+	return model.ListModel{
+		Name:          name,
+		Type:          "file",
+		ParentFileId:  parentFileId,
+		Size:          int64(len(v.files[p])),
+		ContentType:   ctype,
+		FileExtension: strings.TrimPrefix(ext, "."),
+		CreatedAt:     model.Time{Time: v.modTime},
+		UpdatedAt:     model.Time{Time: v.modTime},
+	}
+}
+
+// children returns the entries of the virtual files placed directly inside
+// the folder dir, sorted by name.
+func (v *VirtualFiles) children(dir, dirId string) []model.ListModel {
+	if v == nil {
+		return nil
+	}
+	dir = cleanShortcutPath(dir)
+	var paths []string
+	for p := range v.files {
+		parent := path.Dir(p)
+		if parent == "." {
+			parent = ""
+		}
+		if parent == dir {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	items := make([]model.ListModel, 0, len(paths))
+	for _, p := range paths {
+		items = append(items, v.item(p, dirId))
+	}
+	return items
+}
+
+// withVirtualFiles appends the virtual files inside dir to list, whose
+// folder has the id dirId. Drive items of the same name are hidden by them.
+// The cached list is never modified.
+func (h *Handler) withVirtualFiles(dir, dirId string, list model.FileListModel) model.FileListModel {
+	children := h.VirtualFiles.children(dir, dirId)
+	if len(children) == 0 {
+		return list
+	}
+	virtual := make(map[string]bool, len(children))
+	for _, fi := range children {
+		virtual[fi.Name] = true
+	}
+	items := make([]model.ListModel, 0, len(list.Items)+len(children))
+	for _, fi := range list.Items {
+		if !virtual[fi.Name] {
+			items = append(items, fi)
+		}
+	}
+	list.Items = append(items, children...)
+	return list
+}
+
+// touchesVirtualFile reports whether the request r, or the Destination of a
+// COPY or MOVE, names a virtual file.
+func (h *Handler) touchesVirtualFile(r *http.Request) bool {
+	if h.VirtualFiles == nil {
+		return false
+	}
+	if p, _, err := h.stripPrefix(r.URL.Path); err == nil {
+		if _, ok := h.VirtualFiles.Get(p); ok {
+			return true
+		}
+	}
+	if hdr := r.Header.Get("Destination"); hdr != "" {
+		if u, err := url.Parse(hdr); err == nil {
+			if p, _, err := h.stripPrefix(h.canonicalURLPath(u.Path)); err == nil {
+				if _, ok := h.VirtualFiles.Get(p); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package webdav
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useVirtualFiles loads the virtual files described by the JSON object js
+// into h.
+func useVirtualFiles(t *testing.T, h *Handler, js string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "virtual.json")
+	if err := ioutil.WriteFile(file, []byte(js), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, err := LoadVirtualFiles(file)
+	if err != nil {
+		t.Fatalf("LoadVirtualFiles: %v", err)
+	}
+	h.VirtualFiles = v
+}
+
+func TestLoadVirtualFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "virtual.json")
+	if _, err := LoadVirtualFiles(file); err == nil {
+		t.Error("LoadVirtualFiles of a missing file succeeded")
+	}
+	ioutil.WriteFile(file, []byte(`not json`), 0644)
+	if _, err := LoadVirtualFiles(file); err == nil {
+		t.Error("LoadVirtualFiles of invalid JSON succeeded")
+	}
+	ioutil.WriteFile(file, []byte(`{"/share/README.txt":"notes","/":"root"}`), 0644)
+	v, err := LoadVirtualFiles(file)
+	if err != nil {
+		t.Fatalf("LoadVirtualFiles: %v", err)
+	}
+	//路径前后的/不影响匹配，根目录本身不能是虚拟文件
+	for _, p := range []string{"/share/README.txt", "share/README.txt", "/share/README.txt/"} {
+		if content, ok := v.Get(p); !ok || content != "notes" {
+			t.Errorf("Get(%s) = %q, %v", p, content, ok)
+		}
+	}
+	if _, ok := v.Get("/"); ok {
+		t.Error("the root folder is a virtual file")
+	}
+	var none *VirtualFiles
+	if _, ok := none.Get("share/README.txt"); ok || none.children("share", "") != nil {
+		t.Error("nil VirtualFiles holds files")
+	}
+}
+
+// TestVirtualFiles checks that virtual files are listed, served on GET and
+// refused on writes.
+func TestVirtualFiles(t *testing.T) {
+	h, s := newTestHandler(t)
+	share := s.Mkdir("root", "share")
+	s.Put(share, "a.txt", []byte("a"))
+	s.Put(share, "README.txt", []byte("drive readme"))
+	useVirtualFiles(t, h, `{"/share/README.txt":"access notes","/share/.info":"info"}`)
+
+	w := doPropfind(h, "/share/", "1", "")
+	props := responseProps(t, w.Body.Bytes())
+	if _, ok := props["/share/a.txt"]; !ok {
+		t.Errorf("drive file missing from the listing: %v", props)
+	}
+	if p := props["/share/README.txt"]; !strings.Contains(p, "<D:getcontentlength>12</D:getcontentlength>") {
+		t.Errorf("virtual README.txt listed as %s, want the virtual file hiding the drive one", p)
+	}
+	if _, ok := props["/share/.info"]; !ok {
+		t.Errorf("virtual .info missing from the listing: %v", props)
+	}
+	//其他目录中没有虚拟文件
+	if props := responseProps(t, doPropfind(h, "/", "1", "").Body.Bytes()); len(props) != 2 {
+		t.Errorf("root listing = %v, want itself and share", props)
+	}
+
+	w = serve(h, "GET", "/share/README.txt", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "access notes" {
+		t.Errorf("GET virtual file = %d %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("virtual file Content-Type = %q", ct)
+	}
+	if w := serve(h, "GET", "/share/README.txt", nil, "Range", "bytes=0-5"); w.Code != http.StatusPartialContent || w.Body.String() != "access" {
+		t.Errorf("GET range of a virtual file = %d %q", w.Code, w.Body.String())
+	}
+	props = responseProps(t, doPropfind(h, "/share/.info", "0", "").Body.Bytes())
+	if !strings.Contains(props["/share/.info"], "<D:getcontentlength>4</D:getcontentlength>") {
+		t.Errorf("PROPFIND of a virtual file = %v", props)
+	}
+
+	for _, c := range []struct {
+		method, target, dest string
+	}{
+		{"PUT", "/share/README.txt", ""},
+		{"DELETE", "/share/README.txt", ""},
+		{"PROPPATCH", "/share/.info", ""},
+		{"MOVE", "/share/README.txt", "/share/b.txt"},
+		{"COPY", "/share/a.txt", "/share/.info"},
+	} {
+		var hdr []string
+		if c.dest != "" {
+			hdr = []string{"Destination", "http://example.com" + c.dest}
+		}
+		if w := serve(h, c.method, c.target, strings.NewReader("x"), hdr...); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s = %d, want 403", c.method, c.target, w.Code)
+		}
+	}
+	if f, ok := s.Lookup("share/README.txt"); !ok || string(f.Content) != "drive readme" {
+		t.Error("writing to a virtual file changed the drive")
+	}
+}
@@ -6,12 +6,20 @@
 package webdav // import "golang.org/x/net/webdav"
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"go-aliyun-webdav/aliyun"
 	"go-aliyun-webdav/aliyun/cache"
 	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	xwebdav "golang.org/x/net/webdav"
+	"io"
 	"io/ioutil"
+	gonet "net"
 	"reflect"
 	"strconv"
 
@@ -20,7 +28,9 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 type Handler struct {
@@ -33,7 +43,169 @@ type Handler struct {
 	// Logger is an optional error logger. If non-nil, it will be called
 	// for all HTTP requests.
 	Logger func(*http.Request, error)
+	// Config holds the Aliyun credentials and drive requests are served
+	// with. Once the Handler is serving, read it with CurrentConfig and
+	// change it with UpdateConfig, since the token is refreshed while
+	// requests are in flight.
 	Config model.Config
+	// RedirectDownload makes GET respond with a 302 to the signed OSS
+	// download URL instead of proxying the content through this server.
+	RedirectDownload bool
+	// AttachmentDownload makes GET send "Content-Disposition: attachment" by
+	// default. A request can always ask for it with the "download=1" query.
+	AttachmentDownload bool
+	// ReadOnly refuses every method that would modify the drive and stops
+	// advertising them in OPTIONS.
+	ReadOnly bool
+	// NoInlineRefresh disables refreshing an expired token on the request
+	// path, leaving it entirely to the background refresher.
+	NoInlineRefresh bool
+	// RejectEmptyFiles refuses zero-byte PUTs instead of creating an empty
+	// file, for clients that misuse them.
+	RejectEmptyFiles bool
+	// IdempotentMkcol makes MKCOL of an existing folder succeed instead of
+	// failing with 405, for sync clients that re-create folders on every run.
+	IdempotentMkcol bool
+	// MaxNameLength is the longest file or folder name, in characters, that
+	// Aliyun accepts. Longer names are refused with 400 Bad Request, or
+	// shortened when TruncateLongNames is set. Zero means no check.
+	MaxNameLength     int
+	TruncateLongNames bool
+	// IgnoreNames are path.Match patterns of file names, such as "._*" for
+	// AppleDouble files, whose uploads are accepted but dropped whatever the
+	// client is.
+	IgnoreNames []string
+	// Shortcuts are virtual entries pointing at other files of the drive
+	// or at external URLs. It may be nil.
+	Shortcuts *ShortcutStore
+	// VirtualFiles are read-only files shown in the listings and served on
+	// GET without existing on the drive. Writing to them is refused with
+	// 403 Forbidden. It may be nil.
+	VirtualFiles *VirtualFiles
+	// DecodeGzipUploads makes PUT requests with Content-Encoding: gzip store
+	// the decompressed content, for clients compressing uploads over slow
+	// links. Other content codings are refused with 415.
+	DecodeGzipUploads bool
+	// MaxConcurrent caps how many requests are served at the same time, so
+	// a busy client can't flood the Aliyun API. Excess requests wait in line
+	// and get 503 Service Unavailable after QueueTimeout. Zero means no limit.
+	MaxConcurrent int
+	QueueTimeout  time.Duration
+	// MaxDownloads, MaxUploads and MaxMetadata cap, each on its own, the
+	// GET and POST requests, the PUT requests and all the others, such as
+	// PROPFIND, served at the same time, so a few big transfers can't hold
+	// up browsing. They queue like MaxConcurrent, which still applies to
+	// all of them together. Zero means no limit for the class.
+	MaxDownloads int
+	MaxUploads   int
+	MaxMetadata  int
+	// MaxPerClient caps the requests served at the same time for a single
+	// client IP, including long-running downloads. Excess requests get 429
+	// Too Many Requests right away. Zero means no limit.
+	MaxPerClient int
+	// MaxXMLBodySize caps the size, in bytes, of PROPFIND, PROPPATCH and
+	// LOCK bodies, which are read into memory. Larger bodies get 413
+	// Request Entity Too Large. Zero means no limit.
+	MaxXMLBodySize int64
+	// RequestTimeout is the time budget of a request. Once it runs out, the
+	// work left is abandoned and the client gets 504 Gateway Timeout.
+	// Uploads and downloads, long by nature, are exempt. Zero means no limit.
+	RequestTimeout time.Duration
+	// PropfindFlushBytes is how much of a multistatus response is written
+	// before it is flushed to the client. Responses are always encoded one
+	// resource at a time and never held in memory as a whole; flushing makes
+	// the listing of a huge folder reach the client while it is produced.
+	// Zero leaves flushing to net/http.
+	PropfindFlushBytes int
+	// RejectExpiredToken makes every request but OPTIONS fail with 503
+	// Service Unavailable while the access token is expired and could not
+	// be refreshed, instead of forwarding requests Aliyun will refuse with
+	// confusing 401s and 404s.
+	RejectExpiredToken bool
+	// LocalPrefix, if set, is a subtree of the WebDAV tree, such as
+	// "/local", served from FileSystem on the host instead of the drive.
+	LocalPrefix string
+	// DownloadConnections is how many connections a download, or the range
+	// of it a client asked for, is split across. The parts are fetched in
+	// parallel and sent to the client in order. Zero or one downloads over
+	// a single connection.
+	DownloadConnections int
+	// MoveIntoFolder makes a MOVE of a file onto an existing folder put the
+	// file inside that folder, as a file manager would, instead of replacing
+	// the folder as RFC 4918 prescribes.
+	MoveIntoFolder bool
+	// UploadWebhook, if set, is a URL that a JSON description of every
+	// successfully uploaded file is posted to in the background, retried a
+	// few times on failure. The PUT response never waits for it.
+	UploadWebhook string
+	// PropfindLimit is the most child responses a PROPFIND returns. Past it
+	// the listing stops and ends with a 507 (Insufficient Storage) response
+	// for the requested collection, telling the client it is incomplete.
+	// Clients can ask for fewer with "Prefer: max-results=N". Zero means
+	// no limit.
+	PropfindLimit int
+	// ResumableUploads accepts PUT requests carrying a Content-Range as
+	// chunks of an upload kept on disk until it is complete. Uploads are
+	// told apart by an Upload-Id header, chosen by the client or assigned
+	// on the first chunk. Every answer tells the client in an Upload-Offset
+	// header how many bytes are held, and "Content-Range: bytes */total"
+	// asks for it, so an interrupted upload resumes where it stopped.
+	ResumableUploads bool
+
+	configMu sync.RWMutex
+
+	semOnce   sync.Once
+	sem       chan struct{}
+	classSems map[requestClass]chan struct{}
+
+	clientMu sync.Mutex
+	clients  map[string]int
+
+	// reserved is the total size of the uploads in flight, protected by
+	// spaceMu. It is counted against the free space on the drive so that
+	// parallel uploads can't all pass the quota check and then overflow it.
+	spaceMu  sync.Mutex
+	reserved int64
+
+	// localLocks holds the locks taken on the LocalPrefix subtree.
+	localLocksOnce sync.Once
+	localLocks     xwebdav.LockSystem
+}
+
+// CurrentConfig returns the configuration requests are served with.
+func (h *Handler) CurrentConfig() model.Config {
+	h.configMu.RLock()
+	defer h.configMu.RUnlock()
+	return h.Config
+}
+
+// UpdateConfig replaces the configuration with the result of update, which
+// is called with the current one. Concurrent updates are serialized, so a
+// token refresh can't undo a drive switch.
+func (h *Handler) UpdateConfig(update func(model.Config) model.Config) {
+	h.configMu.Lock()
+	defer h.configMu.Unlock()
+	h.Config = update(h.Config)
+}
+
+// transferMethods are the methods moving file content, which are exempt
+// from the RequestTimeout.
+var transferMethods = map[string]bool{
+	"GET":  true,
+	"POST": true,
+	"PUT":  true,
+}
+
+// writeMethods are the methods refused when the Handler is read-only.
+var writeMethods = map[string]bool{
+	"PUT":       true,
+	"DELETE":    true,
+	"MKCOL":     true,
+	"COPY":      true,
+	"MOVE":      true,
+	"PROPPATCH": true,
+	"LOCK":      true,
+	"UNLOCK":    true,
 }
 
 func (h *Handler) stripPrefix(p string) (string, int, error) {
@@ -46,42 +218,258 @@ func (h *Handler) stripPrefix(p string) (string, int, error) {
 	return p, http.StatusNotFound, errPrefixMismatch
 }
 
+// canonicalPath returns the form of a URL path every handler works with:
+// cleaned, with a leading slash and no trailing one, so that "/a/b/" and
+// "/a//b" both name the resource "/a/b".
+func canonicalPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// canonicalURLPath canonicalizes the part of the URL path p below h.Prefix
+// and leaves the prefix itself alone, so that with Prefix "/one/" the
+// collection root "/one/" still carries the prefix. Paths outside the
+// prefix are returned unchanged.
+func (h *Handler) canonicalURLPath(p string) string {
+	rest, _, err := h.stripPrefix(p)
+	if err != nil {
+		return p
+	}
+	return strings.TrimSuffix(h.Prefix, "/") + canonicalPath(rest)
+}
+
+// limitedBody is a request body cut off after MaxXMLBodySize bytes. It
+// records whether the limit was hit, which the XML decoders would otherwise
+// report as a mere syntax error.
+type limitedBody struct {
+	io.ReadCloser
+	n, limit int64
+	tooLarge bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF && b.limit > 0 && b.n >= b.limit {
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+// limitBody replaces r.Body with one limited to MaxXMLBodySize bytes.
+func (h *Handler) limitBody(w http.ResponseWriter, r *http.Request) *limitedBody {
+	b := &limitedBody{ReadCloser: r.Body, limit: h.MaxXMLBodySize}
+	if h.MaxXMLBodySize > 0 {
+		b.ReadCloser = http.MaxBytesReader(w, r.Body, h.MaxXMLBodySize)
+	}
+	r.Body = b
+	return b
+}
+
+// requestClass groups requests sharing a MaxDownloads, MaxUploads or
+// MaxMetadata limit.
+type requestClass int
+
+const (
+	metadataRequest requestClass = iota
+	downloadRequest
+	uploadRequest
+)
+
+func classOf(r *http.Request) requestClass {
+	switch r.Method {
+	case "GET", "POST":
+		return downloadRequest
+	case "PUT":
+		return uploadRequest
+	}
+	return metadataRequest
+}
+
+func (h *Handler) initSems() {
+	h.semOnce.Do(func() {
+		if h.MaxConcurrent > 0 {
+			h.sem = make(chan struct{}, h.MaxConcurrent)
+		}
+		h.classSems = make(map[requestClass]chan struct{})
+		for class, n := range map[requestClass]int{metadataRequest: h.MaxMetadata, downloadRequest: h.MaxDownloads, uploadRequest: h.MaxUploads} {
+			if n > 0 {
+				h.classSems[class] = make(chan struct{}, n)
+			}
+		}
+	})
+}
+
+// acquire waits for a free request slot, first among the requests of the
+// class of r and then among all requests. It reports false if none became
+// available within QueueTimeout or the client went away while waiting.
+func (h *Handler) acquire(r *http.Request) (release func(), ok bool) {
+	h.initSems()
+	timeout := h.QueueTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	//先取得本类请求的名额再排队等待总名额，等待中的大文件传输不会占用总名额
+	releaseClass, ok := waitSlot(r, h.classSems[classOf(r)], timer)
+	if !ok {
+		return nil, false
+	}
+	releaseAll, ok := waitSlot(r, h.sem, timer)
+	if !ok {
+		releaseClass()
+		return nil, false
+	}
+	return func() {
+		releaseAll()
+		releaseClass()
+	}, true
+}
+
+// waitSlot takes a slot of sem, which is unlimited if nil, waiting until
+// timer fires or the client of r goes away.
+func waitSlot(r *http.Request, sem chan struct{}, timer *time.Timer) (release func(), ok bool) {
+	if sem == nil {
+		return func() {}, true
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true
+	case <-timer.C:
+		return nil, false
+	case <-r.Context().Done():
+		return nil, false
+	}
+}
+
+// acquireClient takes a request slot of the client IP of r. It reports false
+// if the client already has MaxPerClient requests in flight.
+func (h *Handler) acquireClient(r *http.Request) (release func(), ok bool) {
+	if h.MaxPerClient <= 0 {
+		return func() {}, true
+	}
+	ip, _, err := gonet.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	h.clientMu.Lock()
+	defer h.clientMu.Unlock()
+	if h.clients == nil {
+		h.clients = make(map[string]int)
+	}
+	if h.clients[ip] >= h.MaxPerClient {
+		return nil, false
+	}
+	h.clients[ip]++
+	return func() {
+		h.clientMu.Lock()
+		if h.clients[ip]--; h.clients[ip] <= 0 {
+			delete(h.clients, ip)
+		}
+		h.clientMu.Unlock()
+	}, true
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	releaseClient, ok := h.acquireClient(r)
+	if !ok {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		if h.Logger != nil {
+			h.Logger(r, errTooManyClientRequests)
+		}
+		return
+	}
+	defer releaseClient()
+
+	release, ok := h.acquire(r)
+	if !ok {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		if h.Logger != nil {
+			h.Logger(r, errTooManyRequests)
+		}
+		return
+	}
+	defer release()
+
+	//同一个请求会调用多次阿里云接口，用请求ID把它们的日志关联起来。嵌入的服务已分配请求ID时沿用
+	if net.RequestID(r.Context()) == "" {
+		id := r.Header.Get(net.RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = net.NewRequestID()
+		}
+		w.Header().Set(net.RequestIDHeader, id)
+		r = r.WithContext(net.WithRequestID(r.Context(), id))
+	}
+	if h.RequestTimeout > 0 && !transferMethods[r.Method] {
+		ctx, cancel := context.WithTimeout(r.Context(), h.RequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	//各处理函数看到的都是规范化的路径，不需要各自处理结尾的/
+	r.URL.Path, r.URL.RawPath = h.canonicalURLPath(r.URL.Path), ""
+
 	status, err := http.StatusBadRequest, errUnsupportedMethod
-	if h.Config.ExpireTime < time.Now().Unix()-100 {
-		refreshResult := aliyun.RefreshToken(h.Config.RefreshToken)
-		config := model.Config{
-			RefreshToken: refreshResult.RefreshToken,
-			Token:        refreshResult.AccessToken,
-			DriveId:      refreshResult.DefaultDriveId,
-			ExpireTime:   time.Now().Unix() + refreshResult.ExpiresIn,
+	if config := h.CurrentConfig(); !h.NoInlineRefresh && config.ExpireTime < time.Now().Unix()-100 {
+		//刷新失败时保留原来的配置，否则refresh_token会被清空，之后再也无法刷新
+		if refreshResult := aliyun.RefreshToken(r.Context(), config.RefreshToken); refreshResult.AccessToken != "" {
+			h.UpdateConfig(func(c model.Config) model.Config { return c.Refresh(refreshResult) })
 		}
-		h.Config = config
 	}
 
-	switch r.Method {
-	case "OPTIONS":
-		status, err = h.handleOptions(w, r)
-	case "GET", "HEAD", "POST":
-		status, err = h.handleGetHeadPost(w, r)
-	case "DELETE":
-		status, err = h.handleDelete(w, r)
-	case "PUT":
-		status, err = h.handlePut(w, r)
-	case "MKCOL":
-		status, err = h.handleMkcol(w, r)
-	case "COPY", "MOVE":
-		status, err = h.handleCopyMove(w, r)
-	case "LOCK":
-		status, err = h.handleLock(w, r)
-	case "UNLOCK":
-		status, err = h.handleUnlock(w, r)
-	case "PROPFIND":
-		status, err = h.handlePropfind(w, r)
-	case "PROPPATCH":
-		status, err = h.handleProppatch(w, r)
+	if h.RejectExpiredToken && r.Method != "OPTIONS" && h.CurrentConfig().ExpireTime <= time.Now().Unix() {
+		w.Header().Set("Retry-After", "60")
+		status, err = http.StatusServiceUnavailable, errTokenExpired
+	} else if h.ReadOnly && writeMethods[r.Method] {
+		status, err = http.StatusForbidden, errReadOnly
+	} else if writeMethods[r.Method] && h.touchesVirtualFile(r) {
+		status, err = http.StatusForbidden, errVirtualFile
+	} else if _, ok := h.requestLocalPath(r); ok {
+		status, err = h.serveLocal(w, r)
+	} else {
+		switch r.Method {
+		case "OPTIONS":
+			status, err = h.handleOptions(w, r)
+		case "GET", "HEAD", "POST":
+			status, err = h.handleGetHeadPost(w, r)
+		case "DELETE":
+			status, err = h.handleDelete(w, r)
+		case "PUT":
+			status, err = h.handlePut(w, r)
+		case "MKCOL":
+			status, err = h.handleMkcol(w, r)
+		case "COPY", "MOVE":
+			status, err = h.handleCopyMove(w, r)
+		case "LOCK":
+			status, err = h.handleLock(w, r)
+		case "UNLOCK":
+			status, err = h.handleUnlock(w, r)
+		case "PROPFIND":
+			status, err = h.handlePropfind(w, r)
+		case "PROPPATCH":
+			status, err = h.handleProppatch(w, r)
+		}
 	}
 
+	//阿里云风控时各接口返回的错误一路传上来，否则会表现为莫名其妙的404，统一返回503
+	if status >= 400 && errors.Is(err, net.ErrRiskControl) {
+		status, err = http.StatusServiceUnavailable, net.ErrRiskControl
+		w.Header().Set("Retry-After", "300")
+	}
+	//令牌没有权限时返回403，与令牌过期区分开，刷新令牌也无法解决
+	if status >= 400 && errors.Is(err, net.ErrPermissionDenied) {
+		status = http.StatusForbidden
+	}
+	//超出请求时限时中途放弃的请求返回504
+	if status >= 400 && (errors.Is(err, context.DeadlineExceeded) || r.Context().Err() == context.DeadlineExceeded) {
+		status, err = http.StatusGatewayTimeout, context.DeadlineExceeded
+	}
+	//阿里云返回了错误或无法识别的内容时不应表现为404
+	if status >= 400 && status != http.StatusServiceUnavailable && errors.Is(err, aliyun.ErrUnexpectedResponse) {
+		status = http.StatusBadGateway
+	}
 	if status != 0 {
 		w.WriteHeader(status)
 		if status != http.StatusNoContent {
@@ -108,6 +496,52 @@ func (h *Handler) lock(now time.Time, root string) (token string, status int, er
 	return token, 0, nil
 }
 
+// tempLocks locks src and dst, when not empty, for the duration of a request.
+func (h *Handler) tempLocks(src, dst string) (release func(), status int, err error) {
+	now, srcToken, dstToken := time.Now(), "", ""
+	if src != "" {
+		srcToken, status, err = h.lock(now, src)
+		if err != nil {
+			return nil, status, err
+		}
+	}
+	if dst != "" {
+		dstToken, status, err = h.lock(now, dst)
+		if err != nil {
+			if srcToken != "" {
+				h.LockSystem.Unlock(now, srcToken)
+			}
+			return nil, status, err
+		}
+	}
+
+	return func() {
+		if dstToken != "" {
+			h.LockSystem.Unlock(now, dstToken)
+		}
+		if srcToken != "" {
+			h.LockSystem.Unlock(now, srcToken)
+		}
+	}, 0, nil
+}
+
+// matchETag reports whether etag is the current entity tag of the resource
+// at reqPath. A missing resource matches no entity tag.
+func (h *Handler) matchETag(r *http.Request, reqPath, etag string) bool {
+	reqPath = strings.Trim(reqPath, "/")
+	fi := h.findCachedFile(r.Context(), reqPath)
+	if fi.FileId == "" && reqPath != "" {
+		paths := strings.Split(reqPath, "/")
+		item, _, err := aliyun.Walk(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, paths, "")
+		if err != nil || item.Name != paths[len(paths)-1] {
+			return false
+		}
+		fi = item
+	}
+	current, err := findETag(r.Context(), h.FileSystem, h.LockSystem, reqPath, fi)
+	return err == nil && current == etag
+}
+
 func (h *Handler) confirmLocks(r *http.Request, src, dst string) (release func(), status int, err error) {
 	hdr := r.Header.Get("If")
 	if hdr == "" {
@@ -116,31 +550,7 @@ func (h *Handler) confirmLocks(r *http.Request, src, dst string) (release func()
 		// the resources aren't locked by another client, so we create temporary
 		// locks that would conflict with another client's locks. These temporary
 		// locks are unlocked at the end of the HTTP request.
-		now, srcToken, dstToken := time.Now(), "", ""
-		if src != "" {
-			srcToken, status, err = h.lock(now, src)
-			if err != nil {
-				return nil, status, err
-			}
-		}
-		if dst != "" {
-			dstToken, status, err = h.lock(now, dst)
-			if err != nil {
-				if srcToken != "" {
-					h.LockSystem.Unlock(now, srcToken)
-				}
-				return nil, status, err
-			}
-		}
-
-		return func() {
-			if dstToken != "" {
-				h.LockSystem.Unlock(now, dstToken)
-			}
-			if srcToken != "" {
-				h.LockSystem.Unlock(now, srcToken)
-			}
-		}, 0, nil
+		return h.tempLocks(src, dst)
 	}
 
 	ih, ok := parseIfHeader(hdr)
@@ -165,7 +575,30 @@ func (h *Handler) confirmLocks(r *http.Request, src, dst string) (release func()
 				return nil, status, err
 			}
 		}
-		release, err = h.LockSystem.Confirm(time.Now(), lsrc, dst, l.conditions...)
+		// Section 10.4.8 says that entity tags in a list are matched
+		// against the current entity tag of the list's resource. They are
+		// evaluated here since the LockSystem only knows about state tokens.
+		var tokens []Condition
+		etagsMatch := true
+		for _, c := range l.conditions {
+			if c.ETag == "" {
+				tokens = append(tokens, c)
+				continue
+			}
+			if h.matchETag(r, lsrc, c.ETag) == c.Not {
+				etagsMatch = false
+				break
+			}
+		}
+		if !etagsMatch {
+			continue
+		}
+		if len(tokens) == 0 {
+			// A list of entity tags alone claims no lock, so the resources
+			// must still not be locked by another client.
+			return h.tempLocks(src, dst)
+		}
+		release, err = h.LockSystem.Confirm(time.Now(), lsrc, dst, tokens...)
 		if err == ErrConfirmationFailed {
 			continue
 		}
@@ -187,65 +620,145 @@ func (h *Handler) handleOptions(w http.ResponseWriter, r *http.Request) (status
 		return status, err
 	}
 	ctx := r.Context()
-	allow := "OPTIONS, LOCK, PUT, MKCOL"
+	allow := []string{"OPTIONS", "LOCK", "PUT", "MKCOL"}
 	if fi, err := h.FileSystem.Stat(ctx, reqPath); err == nil {
 		if fi.IsDir() {
-			allow = "OPTIONS, LOCK, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND"
+			allow = []string{"OPTIONS", "LOCK", "DELETE", "PROPPATCH", "COPY", "MOVE", "UNLOCK", "PROPFIND"}
 		} else {
-			allow = "OPTIONS, LOCK, GET, HEAD, POST, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND, PUT"
+			allow = []string{"OPTIONS", "LOCK", "GET", "HEAD", "POST", "DELETE", "PROPPATCH", "COPY", "MOVE", "UNLOCK", "PROPFIND", "PUT"}
 		}
 	}
-	w.Header().Set("Allow", allow)
+	allow = h.enabledMethods(allow)
+	w.Header().Set("Allow", strings.Join(allow, ", "))
 	// http://www.webdav.org/specs/rfc4918.html#dav.compliance.classes
-	w.Header().Set("DAV", "1, 2")
+	// Class 2 means LOCK is supported, which is not the case when read-only.
+	dav := "1, 2"
+	if !h.enabled("LOCK") {
+		dav = "1"
+	}
+	w.Header().Set("DAV", dav)
 	// http://msdn.microsoft.com/en-au/library/cc250217.aspx
-	w.Header().Set("MS-Author-Via", "DAV")
+	// Office only offers to save back to servers advertising authoring.
+	if !h.ReadOnly {
+		w.Header().Set("MS-Author-Via", "DAV")
+	}
 	return 0, nil
 }
 
+// allMethods are all the methods a Handler can serve.
+var allMethods = []string{"OPTIONS", "GET", "HEAD", "POST", "PUT", "DELETE", "MKCOL", "COPY", "MOVE", "PROPFIND", "PROPPATCH", "LOCK", "UNLOCK"}
+
+// Methods returns the methods the Handler serves with its current options,
+// for instance to answer CORS preflight requests.
+func (h *Handler) Methods() []string {
+	return h.enabledMethods(allMethods)
+}
+
+// enabled reports whether the Handler serves method with its current options.
+func (h *Handler) enabled(method string) bool {
+	switch {
+	case h.ReadOnly && writeMethods[method]:
+		return false
+	case h.LockSystem == nil && (method == "LOCK" || method == "UNLOCK"):
+		return false
+	}
+	return true
+}
+
+// enabledMethods filters methods down to those this Handler currently serves.
+func (h *Handler) enabledMethods(methods []string) []string {
+	enabled := make([]string, 0, len(methods))
+	for _, m := range methods {
+		if h.enabled(m) {
+			enabled = append(enabled, m)
+		}
+	}
+	return enabled
+}
+
 func (h *Handler) handleGetHeadPost(w http.ResponseWriter, r *http.Request) (status int, err error) {
 	//var data []byte
 	var fi model.ListModel
 	reqPath, status, err := h.stripPrefix(r.URL.Path)
-	if len(reqPath) > 0 && !strings.HasSuffix(reqPath, "/") {
+	if len(reqPath) > 0 {
 		strArr := strings.Split(reqPath, "/")
 
-		list, err := aliyun.GetList(h.Config.Token, h.Config.DriveId, "")
-		if err != nil {
-			return http.StatusNotFound, err
+		if content, ok := h.VirtualFiles.Get(reqPath); ok {
+			http.ServeContent(w, r, path.Base(reqPath), h.VirtualFiles.modTime, strings.NewReader(content))
+			return 0, nil
 		}
+		if sc, ok := h.Shortcuts.Get(reqPath); ok {
+			if sc.URL != "" {
+				http.Redirect(w, r, sc.URL, http.StatusFound)
+				return 0, nil
+			}
+			if fi, err = h.shortcutItem(r.Context(), sc, ""); err != nil {
+				return http.StatusNotFound, err
+			}
+		} else {
+			fi = h.findCachedFile(r.Context(), reqPath)
+		}
+		if fi.FileId == "" {
+			list, err := aliyun.GetList(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, "")
+			if err != nil {
+				return http.StatusNotFound, err
+			}
 
-		fi, err = findUrl(strArr, h.Config.Token, h.Config.DriveId, list)
-		if err != nil || fi.FileId == "" {
-			return http.StatusNotFound, err
+			fi, err = findUrl(r.Context(), strArr, h.CurrentConfig().Token, h.CurrentConfig().DriveId, list)
+			if err != nil || fi.FileId == "" {
+				return http.StatusNotFound, err
+			}
+		}
+		if quality := r.URL.Query().Get("transcode"); quality != "" && r.Method == "GET" && fi.Type != "folder" {
+			return h.serveTranscoded(w, r, fi, quality)
 		}
 		//url := fi.Thumbnail
 		//url := fi.Url
 		//if len(url) == 0 {
 		//url=fi.Url
 		//}
-		rangeStr := r.Header.Get("range")
-
-		if len(rangeStr) > 0 && strings.LastIndex(rangeStr, "-") > 0 {
-			rangeArr := strings.Split(rangeStr, "-")
-			rangEnd, _ := strconv.ParseInt(rangeArr[1], 10, 64)
-			if rangEnd >= fi.Size {
-				rangeStr = rangeStr[:strings.LastIndex(rangeStr, "-")+1]
-			}
-		}
-		//rangeStr = "bytes=0-" + strconv.Itoa(fi.Size)
 		if r.Method != "HEAD" {
-			if strings.Index(r.URL.String(), "025.jpg") > 0 {
+			if h.RedirectDownload && fi.Type != "folder" {
+				//客户端会对跳转后的地址重新发送Range请求头
+				downloadUrl := aliyun.GetDownloadUrl(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.FileId)
+				http.Redirect(w, r, downloadUrl, http.StatusFound)
+				return 0, nil
+			}
+			attachment := h.AttachmentDownload || r.URL.Query().Get("download") == "1"
+			w.Header().Set("Content-Disposition", contentDisposition(displayName(fi), attachment))
+			if ctype, _ := findContentType(r.Context(), h.FileSystem, h.LockSystem, reqPath, fi); ctype != "" {
+				w.Header().Set("Content-Type", ctype)
+			}
+			if r.Header.Get("Range") != "" && fi.Type != "folder" {
+				//拖动进度条产生的Range请求优先从本地缓存读取，不需要获取下载地址；未缓存时在后台开始缓存整个文件
+				if f, ok := aliyun.CachedFile(fi); ok {
+					defer f.Close()
+					if etag, err := findETag(r.Context(), h.FileSystem, h.LockSystem, reqPath, fi); err == nil {
+						w.Header().Set("ETag", etag)
+					}
+					http.ServeContent(w, r, fi.Name, fi.UpdatedAt.Time, f)
+					return 0, nil
+				}
+				aliyun.CacheFileAsync(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi)
+			}
+			if fi.Type != "folder" {
+				downloadUrl := aliyun.GetDownloadUrl(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.FileId)
+				return h.serveDownload(w, r, downloadUrl, reqPath, fi)
 			}
-			downloadUrl := aliyun.GetDownloadUrl(h.Config.Token, h.Config.DriveId, fi.FileId)
-			aliyun.GetFile(w, downloadUrl, h.Config.Token, rangeStr, r.Header.Get("if-range"))
 		}
 
 		if fi.Type == "folder" {
+			if r.Method == "HEAD" {
+				//部分客户端用HEAD探测目录是否存在，返回405会被当成不存在
+				w.Header().Set("Content-Type", "httpd/unix-directory")
+				w.Header().Set("Content-Length", "0")
+				w.Header().Set("Last-Modified", fi.UpdatedAt.UTC().Format(http.TimeFormat))
+				return 0, nil
+			}
 			return http.StatusMethodNotAllowed, nil
 		}
 		ctx := r.Context()
-		etag, err := findETag(ctx, h.FileSystem, h.LockSystem, fi)
+		etag, err := findETag(ctx, h.FileSystem, h.LockSystem, reqPath, fi)
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
@@ -280,7 +793,7 @@ func (h *Handler) handleGetHeadPost(w http.ResponseWriter, r *http.Request) (sta
 		return http.StatusMethodNotAllowed, nil
 	}
 	ctx1 := r.Context()
-	etag, err := findETag(ctx1, h.FileSystem, h.LockSystem, fi)
+	etag, err := findETag(ctx1, h.FileSystem, h.LockSystem, reqPath, fi)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
@@ -290,6 +803,50 @@ func (h *Handler) handleGetHeadPost(w http.ResponseWriter, r *http.Request) (sta
 	return 0, nil
 }
 
+// findCachedFile resolves reqPath through the FID_ cache with a single
+// GetFileDetail call. It returns an empty ListModel on a cache miss or when
+// the cached id no longer matches the path, so callers can fall back to a walk.
+func (h *Handler) findCachedFile(ctx context.Context, reqPath string) model.ListModel {
+	config := h.CurrentConfig()
+	fid, ok := cache.GoCache.Get(cache.FileIdKey(config.DriveId, reqPath))
+	if !ok {
+		return model.ListModel{}
+	}
+	fi, err := aliyun.GetFileDetail(ctx, config.Token, config.DriveId, fid.(string))
+	if err != nil || fi.FileId != fid.(string) || fi.Name != path.Base(reqPath) || fi.Status == "trashed" {
+		return model.ListModel{}
+	}
+	return fi
+}
+
+// contentDisposition builds a Content-Disposition header value for name. A
+// plain ASCII filename is always included for old clients and the exact name
+// is added as an RFC 5987 encoded filename* parameter.
+func contentDisposition(name string, attachment bool) string {
+	disposition := "inline"
+	if attachment {
+		disposition = "attachment"
+	}
+	var fallback, encoded strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c < 0x20 || c >= 0x7f || c == '"' || c == '\\':
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteByte(c)
+		}
+		// attr-char as defined by RFC 5987 section 3.2.1.
+		if ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return disposition + `; filename="` + fallback.String() + `"; filename*=UTF-8''` + encoded.String()
+}
+
 func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request) (status int, err error) {
 	reqPath, status, err := h.stripPrefix(r.URL.Path)
 	if err != nil {
@@ -298,31 +855,42 @@ func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request) (status i
 
 	var fi model.ListModel
 	if len(reqPath) > 0 {
-		if strings.HasSuffix(reqPath, "/") {
-			reqPath = reqPath[:len(reqPath)-1]
-		}
 		strArr := strings.Split(reqPath, "/")
 
-		fi = aliyun.GetFileDetail(h.Config.Token, h.Config.DriveId, getParentFileId(strArr))
-		if fi.Name == strArr[len(strArr)-1] {
-			aliyun.RemoveTrash(h.Config.Token, h.Config.DriveId, fi.FileId, fi.ParentFileId)
-			fmt.Println("🕺  删除", reqPath)
-			cache.GoCache.Delete("FID_" + reqPath)
-		} else {
-			fi, _, walkerr := aliyun.Walk(h.Config.Token, h.Config.DriveId, strArr, "root")
-			if walkerr == nil {
-				if fi.Name == strArr[len(strArr)-1] {
-					aliyun.RemoveTrash(h.Config.Token, h.Config.DriveId, fi.FileId, fi.ParentFileId)
-					fmt.Println("🕺  删除", reqPath)
-					cache.GoCache.Delete("FID_" + reqPath)
-				}
+		fi, _ = aliyun.GetFileDetail(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, getParentFileId(h.CurrentConfig().DriveId, strArr))
+		if fi.Name != strArr[len(strArr)-1] {
+			var walkerr error
+			fi, _, walkerr = aliyun.Walk(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, strArr, aliyun.RootFileId())
+			if errors.Is(walkerr, net.ErrRiskControl) {
+				return http.StatusServiceUnavailable, walkerr
+			}
+			if walkerr == nil && fi.Name != strArr[len(strArr)-1] || errors.Is(walkerr, os.ErrNotExist) {
+				return http.StatusNotFound, os.ErrNotExist
+			}
+			if walkerr != nil {
+				return http.StatusBadGateway, walkerr
 			}
 		}
 
-		if (fi != model.ListModel{}) {
-
+		// Section 9.6.1 says that "the DELETE method on a collection must act
+		// as if a "Depth: infinity" header was used on it. A client must not
+		// submit a Depth header with a DELETE on a collection with any value
+		// but infinity."
+		if hdr := r.Header.Get("Depth"); hdr != "" && fi.Type == "folder" {
+			if parseDepth(hdr) != infiniteDepth {
+				return http.StatusBadRequest, errInvalidDepth
+			}
 		}
-
+		if err := aliyun.RemoveTrash(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.FileId, fi.ParentFileId); err != nil {
+			logln(r, "❌  删除失败", reqPath, err)
+			if errors.Is(err, os.ErrNotExist) {
+				return http.StatusNotFound, err
+			}
+			//无权限及风控由ServeHTTP转换为403、503
+			return http.StatusBadGateway, err
+		}
+		logln(r, "🕺  删除", reqPath)
+		cache.GoCache.Delete(cache.FileIdKey(h.CurrentConfig().DriveId, reqPath))
 	}
 
 	return http.StatusNoContent, nil
@@ -336,64 +904,209 @@ func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) (status int,
 	if strings.Index(r.Header.Get("User-Agent"), "Darwin") > -1 && strings.Index(reqPath, "._") > -1 {
 		return status, err
 	}
+	if h.ignored(reqPath) {
+		logln(r, "🙈  Ignored", reqPath)
+		return http.StatusCreated, nil
+	}
+	if reqPath, status, err = h.limitName(w, r, reqPath); err != nil {
+		return status, err
+	}
+	var resumed *os.File
+	resumedPath, resumedId := "", ""
+	if h.ResumableUploads && r.Header.Get("Content-Range") != "" {
+		f, uploadId, status, err := h.resumePut(w, r, reqPath)
+		if f == nil {
+			return status, err
+		}
+		//续传的内容已全部收到，会话文件本身就是中间文件，以它的大小按普通上传继续
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		r.ContentLength = info.Size()
+		r.Header.Del("Content-Range")
+		r.Header.Del("Content-Encoding")
+		resumed, resumedPath, resumedId = f, reqPath, uploadId
+	}
+	//所有拒绝上传的检查都在读取请求内容之前完成，发送Expect: 100-continue的客户端不必先上传整个文件。
+	//不需要调用阿里云接口的检查放在最前面，尽快回复等待100 Continue的客户端
+	if r.ContentLength == 0 && h.RejectEmptyFiles {
+		return http.StatusForbidden, errEmptyFile
+	}
+	releaseDisk, err := aliyun.ReserveTempDisk(r.ContentLength)
+	if err != nil {
+		logln(r, "❌  Temp file disk budget exhausted", reqPath, r.ContentLength)
+		w.Header().Set("Retry-After", "60")
+		return http.StatusServiceUnavailable, err
+	}
+	defer releaseDisk()
 	lastIndex := strings.LastIndex(reqPath, "/")
 	fileName := reqPath[lastIndex+1:]
 	if lastIndex == -1 {
 		lastIndex = 0
 		fileName = reqPath
 	}
-	var fi model.ListModel
-	var walkerr error
-	if len(reqPath) > 0 && !strings.HasSuffix(reqPath, "/") {
-
-		strArr := strings.Split(reqPath[:lastIndex], "/")
-		fi = aliyun.GetFileDetail(h.Config.Token, h.Config.DriveId, getParentFileId(strArr))
-		if fi.Name != "" && fi.Name != "Default" {
-			cache.GoCache.Set("FID_"+strings.Join(strArr, "/"), fi.FileId, -1)
+	parentFileId, err := resolveOrCreateParent(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, reqPath[:lastIndex], false)
+	if err != nil {
+		logln(r, "🔥  Error: can't find parent folder", reqPath, err)
+		if os.IsNotExist(err) || err == errNotADirectory {
+			return http.StatusConflict, err
 		}
-		if fi.Name != strArr[len(strArr)-1] {
-			var parentFileId string
-			paths := strings.Split(reqPath, "/")
-			if len(paths) == 1 {
-				parentFileId = "root"
-			} else {
-				if pid, err := cache.GoCache.Get("FID_" + strings.Join(paths[:len(paths)-1], "/")); err {
-					parentFileId = pid.(string)
-				} else {
-					parentFileId = "root"
-				}
-			}
-			fi, _, walkerr = aliyun.Walk(h.Config.Token, h.Config.DriveId, strArr, parentFileId)
-			if walkerr == nil {
-				if fi.Name != strArr[len(strArr)-1] {
-					fmt.Println("🔥  Error: can't find parent folder", reqPath)
-					return http.StatusBadRequest, errors.New("parent folder does not exist,please create first")
-				} else {
-					cache.GoCache.Set("FID_"+strings.Join(strArr, "/"), fi.FileId, -1)
-				}
-			}
+		return http.StatusBadGateway, err
+	}
+	release, status, err := h.reserveSpace(r.Context(), r.ContentLength)
+	if err != nil {
+		logln(r, "❌  Not enough space", reqPath, r.ContentLength)
+		return status, err
+	}
+	defer release()
+	if h.DecodeGzipUploads {
+		if status, err := decodeBody(r); err != nil {
+			logln(r, "❌  Can't decode upload", reqPath, r.Header.Get("Content-Encoding"), err)
+			return status, err
 		}
 	}
-
-	if r.ContentLength == 0 {
-		return http.StatusCreated, nil
+	//大小未知(chunked或解压后)的上传读到内容才知道是否为空，在创建文件前再检查一次
+	if h.RejectEmptyFiles && r.ContentLength < 0 {
+		br := bufio.NewReader(r.Body)
+		if _, err := br.Peek(1); err == io.EOF {
+			return http.StatusForbidden, errEmptyFile
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{br, r.Body}
+	}
+	logln(r, "⬆️  Uploading ", reqPath, r.ContentLength)
+	var fileId, name string
+	if resumed != nil {
+		fileId, name, err = aliyun.UploadResume(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, parentFileId, fileName, resumed, r.ContentLength)
+	} else {
+		fileId, name, err = aliyun.ContentHandle(r, h.CurrentConfig().Token, h.CurrentConfig().DriveId, parentFileId, fileName)
+	}
+	if fileId != "" && name != fileName {
+		//阿里云以其他名称创建了文件，缓存实际的路径并告知客户端
+		reqPath = reqPath[:len(reqPath)-len(fileName)] + name
+		w.Header().Set("Location", escapeHref(path.Join("/", h.Prefix, reqPath)))
 	}
-	fmt.Println("⬆️  Uploading ", reqPath, r.ContentLength)
-	fileId := aliyun.ContentHandle(r, h.Config.Token, h.Config.DriveId, fi.FileId, fileName)
 	if fileId != "" {
-		cache.GoCache.Set("FID_"+reqPath, fileId, -1)
+		cache.GoCache.Set(cache.FileIdKey(h.CurrentConfig().DriveId, reqPath), fileId, -1)
+		if resumedPath != "" {
+			aliyun.RemoveResume(h.CurrentConfig().DriveId, resumedPath, r.ContentLength, resumedId)
+		}
+		h.notifyUpload(r.Context(), reqPath, fileId)
 	} else {
-		fmt.Println("❌  Upload failed", reqPath)
-		return http.StatusBadRequest, errors.New("Upload failed")
+		logln(r, "❌  Upload failed", reqPath, err)
+		if errors.Is(err, net.ErrPermissionDenied) {
+			return http.StatusForbidden, err
+		}
+		if errors.Is(err, aliyun.ErrNoIntermediateFile) {
+			return http.StatusInsufficientStorage, err
+		}
+		//风控、阿里云返回错误及超时由ServeHTTP转换为对应的状态码，其余按上游失败处理
+		return http.StatusBadGateway, fmt.Errorf("upload failed: %w", err)
 	}
 	return http.StatusCreated, nil
 }
 
+// decodeBody replaces the body of r, if it is gzip-encoded, with the
+// decompressed content. The decompressed size is unknown, so ContentLength
+// becomes -1 and the upload is buffered in the intermediate file.
+func decodeBody(r *http.Request) (int, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return 0, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{zr, r.Body}
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+		return 0, nil
+	default:
+		return http.StatusUnsupportedMediaType, errUnsupportedEncoding
+	}
+}
+
+// ignored reports whether the name of reqPath matches one of IgnoreNames.
+func (h *Handler) ignored(reqPath string) bool {
+	name := path.Base(reqPath)
+	for _, pattern := range h.IgnoreNames {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// logln is fmt.Println with the request ID of r appended, so that the lines
+// logged for one request can be told apart from concurrent ones.
+func logln(r *http.Request, a ...interface{}) {
+	net.Logln(r.Context(), a...)
+}
+
+// limitName applies MaxNameLength to the last element of reqPath, counted
+// in characters as Aliyun does. It returns reqPath with the name shortened
+// when TruncateLongNames is set, keeping the extension. Otherwise an
+// over-long name is refused with a message stating the limit.
+func (h *Handler) limitName(w http.ResponseWriter, r *http.Request, reqPath string) (string, int, error) {
+	dir, name := path.Split(reqPath)
+	if h.MaxNameLength <= 0 || utf8.RuneCountInString(name) <= h.MaxNameLength {
+		return reqPath, 0, nil
+	}
+	if !h.TruncateLongNames {
+		http.Error(w, fmt.Sprintf("webdav: name is longer than %d characters", h.MaxNameLength), http.StatusBadRequest)
+		return reqPath, 0, errNameTooLong
+	}
+	ext := path.Ext(name)
+	if utf8.RuneCountInString(ext) >= h.MaxNameLength {
+		ext = ""
+	}
+	base := []rune(strings.TrimSuffix(name, ext))
+	base = base[:h.MaxNameLength-utf8.RuneCountInString(ext)]
+	logln(r, "✂️  Name too long, truncated", reqPath)
+	return dir + string(base) + ext, 0, nil
+}
+
+// reserveSpace checks that size more bytes fit in the free space of the
+// drive, taking other uploads in flight into account, and reserves them
+// until release is called. An unknown size (chunked upload) or quota is not
+// checked.
+func (h *Handler) reserveSpace(ctx context.Context, size int64) (release func(), status int, err error) {
+	if size <= 0 {
+		return func() {}, 0, nil
+	}
+	total, used := aliyun.GetDriveSize(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId)
+	to, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return func() {}, 0, nil
+	}
+	us, err := strconv.ParseInt(used, 10, 64)
+	if err != nil {
+		return func() {}, 0, nil
+	}
+
+	h.spaceMu.Lock()
+	defer h.spaceMu.Unlock()
+	if us+h.reserved+size > to {
+		return nil, StatusInsufficientStorage, errInsufficientStorage
+	}
+	h.reserved += size
+	return func() {
+		h.spaceMu.Lock()
+		h.reserved -= size
+		h.spaceMu.Unlock()
+	}, 0, nil
+}
+
 func (h *Handler) handleMkcol(w http.ResponseWriter, r *http.Request) (status int, err error) {
 	reqPath, status, err := h.stripPrefix(r.URL.Path)
-	if strings.HasSuffix(reqPath, "/") {
-		reqPath = reqPath[:len(reqPath)-1]
-	}
 	if err != nil {
 		return status, err
 	}
@@ -401,34 +1114,50 @@ func (h *Handler) handleMkcol(w http.ResponseWriter, r *http.Request) (status in
 	if r.ContentLength > 0 {
 		return http.StatusUnsupportedMediaType, nil
 	}
+	if reqPath, status, err = h.limitName(w, r, reqPath); err != nil {
+		return status, err
+	}
 
 	if len(reqPath) > 0 {
-		parentFileId := "root"
-		var name string = reqPath
-		//var fi model.ListModel
-		index := strings.LastIndex(reqPath[0:len(reqPath)], "/")
-		if index > -1 {
-			strArr := strings.Split(reqPath, "/")
-			//try to get parent folder detail
-			pi := aliyun.GetFileDetail(h.Config.Token, h.Config.DriveId, getFileId(strArr))
-			if reflect.DeepEqual(pi, model.ListModel{}) {
-				return http.StatusBadGateway, errors.New("parent folder does not exist")
+		index := strings.LastIndex(reqPath, "/")
+		parentFileId, err := resolveOrCreateParent(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, reqPath[:index+1], false)
+		if err != nil {
+			// Section 9.3.1 says that a missing intermediate collection must
+			// fail with 409 (Conflict).
+			if os.IsNotExist(err) || err == errNotADirectory {
+				return http.StatusConflict, err
+			}
+			return http.StatusBadGateway, err
+		}
+		name := reqPath[index+1:]
+		// Section 9.3.1 says that MKCOL on an existing resource must fail with
+		// 405 (Method Not Allowed). Aliyun would happily create a second
+		// folder with the same name, so look before creating, holding the
+		// folder's lock so that a concurrent MKCOL sees the folder created.
+		unlock := mkdirLocks.lock(h.CurrentConfig().DriveId + "/" + parentFileId + "/" + name)
+		defer unlock()
+		list, err := aliyun.GetList(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, parentFileId)
+		if err != nil {
+			return http.StatusBadGateway, err
+		}
+		for _, item := range list.Items {
+			if item.Name != name {
+				continue
 			}
-			if pi.Type == "file" {
-				return http.StatusBadGateway, errors.New("parent need to be a folder")
+			if h.IdempotentMkcol && item.Type == "folder" {
+				cache.GoCache.Set(cache.FileIdKey(h.CurrentConfig().DriveId, reqPath), item.FileId, -1)
+				return http.StatusCreated, nil
 			}
-			parentFileId = pi.FileId
-			name = reqPath[index+1:]
+			return http.StatusMethodNotAllowed, os.ErrExist
 		}
-		fmt.Println("📁  Creating Directory", reqPath)
-		dir := aliyun.MakeDir(h.Config.Token, h.Config.DriveId, name, parentFileId)
+		logln(r, "📁  Creating Directory", reqPath)
+		dir := aliyun.MakeDir(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, name, parentFileId)
 		if (dir != model.ListModel{}) {
-			cache.GoCache.Set("FID_"+reqPath, dir.FileId, -1)
-			cache.GoCache.Set("parent"+reqPath, dir.ParentFileId, -1)
-			cache.GoCache.Delete(parentFileId)
-			fmt.Println("✅  Directory created", reqPath)
+			cache.GoCache.Set(cache.FileIdKey(h.CurrentConfig().DriveId, reqPath), dir.FileId, -1)
+			cache.GoCache.Delete(cache.ListKey(h.CurrentConfig().DriveId, parentFileId))
+			logln(r, "✅  Directory created", reqPath)
 		} else {
-			fmt.Println("❌  Create Directory Failed", reqPath)
+			logln(r, "❌  Create Directory Failed", reqPath)
 			return http.StatusBadGateway, errors.New("create directory failed: " + reqPath)
 		}
 	}
@@ -453,19 +1182,45 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) (status
 	if err != nil {
 		return status, err
 	}
-	src = strings.TrimRight(src, "/")
 	src = strings.TrimLeft(src, "/")
 
-	dst, status, err := h.stripPrefix(u.Path)
+	dst, _, err := h.stripPrefix(h.canonicalURLPath(u.Path))
 	if err != nil {
-		return status, err
+		//目标不在本Handler的前缀下，属于别的服务，无法访问，按RFC 4918 9.8.5返回502
+		return http.StatusBadGateway, err
+	}
+	if name, local := h.localPath(dst); local {
+		//目标在本地目录下，下载后写入本地目录
+		return h.transferToLocal(r, src, name)
 	}
-	dst = strings.TrimRight(dst, "/")
 	dst = strings.TrimLeft(dst, "/")
 
 	if dst == "" {
 		return http.StatusBadGateway, errInvalidDestination
 	}
+	if dst, status, err = h.limitName(w, r, dst); err != nil {
+		return status, err
+	}
+	if r.Method == "MOVE" && isTrashPath(src) != isTrashPath(dst) {
+		trashPath := src
+		if isTrashPath(dst) {
+			trashPath = dst
+		}
+		virtual, err := h.virtualTrash(r.Context(), trashPath)
+		if err != nil {
+			return http.StatusBadGateway, err
+		}
+		if virtual && trashPath == dst {
+			return h.moveToTrash(r.Context(), src)
+		}
+		if virtual {
+			return h.restoreFromTrash(r.Context(), src, dst)
+		}
+	}
+
+	if r.Method == "COPY" {
+		return h.copyResource(r, src, dst)
+	}
 
 	srcIndex := strings.LastIndex(src, "/")
 	//if runtime.GOOS == "darwin" {
@@ -489,31 +1244,87 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) (status
 	}
 
 	if rename {
-		var fi model.ListModel
-		strArr := strings.Split(src, "/")
-		list, _ := aliyun.GetList(h.Config.Token, h.Config.DriveId, "")
-		fi, _ = findUrl(strArr, h.Config.Token, h.Config.DriveId, list)
+		//优先使用缓存的FileId，避免从根目录逐级查找
+		fi := h.findCachedFile(r.Context(), src)
+		if fi.FileId == "" {
+			strArr := strings.Split(src, "/")
+			list, err := aliyun.GetList(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, "")
+			if err != nil {
+				return http.StatusNotFound, err
+			}
+			fi, err = findUrl(r.Context(), strArr, h.CurrentConfig().Token, h.CurrentConfig().DriveId, list)
+			if errors.Is(err, net.ErrRiskControl) {
+				return http.StatusNotFound, err
+			}
+		}
+
+		if fi.FileId == "" {
+			return http.StatusNotFound, os.ErrNotExist
+		}
 
 		if dstIndex == -1 {
 			dstIndex = 0
 		} else {
 			dstIndex += 1
 		}
-		aliyun.ReName(h.Config.Token, h.Config.DriveId, dst[dstIndex:], fi.FileId)
-		return http.StatusNoContent, nil
+		if folderId, err := h.moveIntoFolder(r.Context(), fi, fi.ParentFileId, dst[dstIndex:]); err != nil {
+			return http.StatusBadGateway, err
+		} else if folderId != "" {
+			return h.moveInto(r, fi, src, dst, folderId)
+		}
+		d, status, err := h.checkOverwrite(r, fi.ParentFileId, dst[dstIndex:], fi.FileId)
+		if err != nil {
+			return status, err
+		}
+		if !aliyun.ReName(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, dst[dstIndex:], fi.FileId) {
+			d.restore(r)
+			return http.StatusBadGateway, errMoveFailed
+		}
+		renameCachedPath(h.CurrentConfig().DriveId, src, dst, fi.FileId)
+		d.discard(r)
+		return moveStatus(d.replaced()), nil
 	}
 
 	if src[srcIndex+1:] == dst[dstIndex+1:] && srcIndex != dstIndex {
 		var fi model.ListModel
 		strArr := strings.Split(src, "/")
-		list, _ := aliyun.GetList(h.Config.Token, h.Config.DriveId, "")
-		fi, _ = findUrl(strArr, h.Config.Token, h.Config.DriveId, list)
+		list, err := aliyun.GetList(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, "")
+		if err != nil {
+			return http.StatusNotFound, err
+		}
+		fi, err = findUrl(r.Context(), strArr, h.CurrentConfig().Token, h.CurrentConfig().DriveId, list)
+		if errors.Is(err, net.ErrRiskControl) {
+			return http.StatusNotFound, err
+		}
 
-		strArrParent := strings.Split(dst[:dstIndex], "/")
-		parent, _ := findUrl(strArrParent, h.Config.Token, h.Config.DriveId, list)
+		if fi.FileId == "" {
+			return http.StatusNotFound, os.ErrNotExist
+		}
+		parentFileId, err := resolveOrCreateParent(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, dst[:dstIndex], false)
+		if err != nil {
+			if os.IsNotExist(err) || err == errNotADirectory {
+				return http.StatusConflict, err
+			}
+			return http.StatusBadGateway, err
+		}
 
-		aliyun.BatchFile(h.Config.Token, h.Config.DriveId, fi.FileId, parent.FileId)
-		return http.StatusNoContent, nil
+		if folderId, err := h.moveIntoFolder(r.Context(), fi, parentFileId, fi.Name); err != nil {
+			return http.StatusBadGateway, err
+		} else if folderId != "" {
+			return h.moveInto(r, fi, src, dst, folderId)
+		}
+		d, status, err := h.checkOverwrite(r, parentFileId, fi.Name, fi.FileId)
+		if err != nil {
+			return status, err
+		}
+		if !aliyun.BatchFile(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.FileId, parentFileId) {
+			d.restore(r)
+			return http.StatusBadGateway, errMoveFailed
+		}
+		cache.GoCache.Delete(cache.ListKey(h.CurrentConfig().DriveId, fi.ParentFileId))
+		renameCachedPath(h.CurrentConfig().DriveId, src, dst, fi.FileId)
+		d.discard(r)
+		return moveStatus(d.replaced()), nil
 	}
 
 	ctx := r.Context()
@@ -522,32 +1333,6 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) (status
 		//fmt.Println("move")
 	}
 
-	if r.Method == "COPY" {
-		// Section 7.5.1 says that a COPY only needs to lock the destination,
-		// not both destination and source. Strictly speaking, this is racy,
-		// even though a COPY doesn't modify the source, if a concurrent
-		// operation modifies the source. However, the litmus test explicitly
-		// checks that COPYing a locked-by-another source is OK.
-		release, status, err := h.confirmLocks(r, "", dst)
-		if err != nil {
-			return status, err
-		}
-		defer release()
-
-		// Section 9.8.3 says that "The COPY method on a collection without a Depth
-		// header must act as if a Depth header with value "infinity" was included".
-		depth := infiniteDepth
-		if hdr := r.Header.Get("Depth"); hdr != "" {
-			depth = parseDepth(hdr)
-			if depth != 0 && depth != infiniteDepth {
-				// Section 9.8.3 says that "A client may submit a Depth header on a
-				// COPY on a collection with a value of "0" or "infinity"."
-				return http.StatusBadRequest, errInvalidDepth
-			}
-		}
-		return copyFiles(ctx, h.FileSystem, src, dst, r.Header.Get("Overwrite") != "F", depth, 0)
-	}
-
 	//release, status, err := h.confirmLocks(r, src, dst)
 	//if err != nil {
 	//	return status, err
@@ -565,6 +1350,239 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) (status
 	return moveFiles(ctx, h.FileSystem, src, dst, r.Header.Get("Overwrite") == "T")
 }
 
+// copyResource copies src to dst within the drive with a server-side copy,
+// leaving src in place. An existing destination is replaced unless
+// "Overwrite: F" is given, the same way as for MOVE: checkOverwrite renames
+// it aside and it is only discarded once the copy is in place.
+func (h *Handler) copyResource(r *http.Request, src, dst string) (status int, err error) {
+	// Section 9.8.3 says that "The COPY method on a collection without a Depth
+	// header must act as if a Depth header with value "infinity" was included".
+	depth := infiniteDepth
+	if hdr := r.Header.Get("Depth"); hdr != "" {
+		depth = parseDepth(hdr)
+		if depth != 0 && depth != infiniteDepth {
+			// Section 9.8.3 says that "A client may submit a Depth header on a
+			// COPY on a collection with a value of "0" or "infinity"."
+			return http.StatusBadRequest, errInvalidDepth
+		}
+	}
+	if src == dst {
+		return http.StatusForbidden, errDestinationEqualsSource
+	}
+	// Section 7.5.1 says that a COPY only needs to lock the destination,
+	// not both destination and source. Strictly speaking, this is racy,
+	// even though a COPY doesn't modify the source, if a concurrent
+	// operation modifies the source. However, the litmus test explicitly
+	// checks that COPYing a locked-by-another source is OK.
+	release, status, err := h.confirmLocks(r, "", dst)
+	if err != nil {
+		return status, err
+	}
+	defer release()
+
+	ctx, config := r.Context(), h.CurrentConfig()
+	fi, status, err := h.findDriveFile(ctx, src)
+	if err != nil {
+		return status, err
+	}
+	dir, name := path.Split(dst)
+	parentFileId, err := resolveOrCreateParent(ctx, config.Token, config.DriveId, dir, false)
+	if err != nil {
+		if os.IsNotExist(err) || err == errNotADirectory {
+			return http.StatusConflict, err
+		}
+		return http.StatusBadGateway, err
+	}
+	d, status, err := h.checkOverwrite(r, parentFileId, name, fi.FileId)
+	if err != nil {
+		return status, err
+	}
+	//被替换的项已改名，它的路径缓存不再有效
+	cache.GoCache.Delete(cache.FileIdKey(config.DriveId, dst))
+	cache.GoCache.DeletePrefix(cache.FileIdKey(config.DriveId, dst+"/"))
+
+	var fileId string
+	if fi.Type == "folder" && depth == 0 {
+		//Depth: 0只复制文件夹本身，不复制其中的内容
+		fileId, err = resolveOrCreateParent(ctx, config.Token, config.DriveId, dst, true)
+	} else if fileId, err = aliyun.CopyFile(ctx, config.Token, config.DriveId, fi.FileId, parentFileId); err == nil && fi.Name != name {
+		//副本与原文件同名(同一目录下时被自动改名)，再改为目标名称
+		if !aliyun.ReName(ctx, config.Token, config.DriveId, name, fileId) {
+			aliyun.RemoveTrash(ctx, config.Token, config.DriveId, fileId, parentFileId)
+			err = errCopyFailed
+		}
+	}
+	if err != nil {
+		logln(r, "❌  复制失败", src, dst, err)
+		d.restore(r)
+		return http.StatusBadGateway, err
+	}
+	logln(r, "📄  复制", src, dst)
+	cache.GoCache.Set(cache.FileIdKey(config.DriveId, dst), fileId, -1)
+	d.discard(r)
+	return moveStatus(d.replaced()), nil
+}
+
+// renameCachedPath moves the FID_ cache entry of src to dst and drops the
+// entries below src, which are keyed by the old folder name.
+func renameCachedPath(driveId, src, dst, fileId string) {
+	cache.GoCache.Delete(cache.FileIdKey(driveId, src))
+	cache.GoCache.Set(cache.FileIdKey(driveId, dst), fileId, -1)
+	cache.GoCache.DeletePrefix(cache.FileIdKey(driveId, src+"/"))
+}
+
+// Rename renames the file or folder fileId to newName in place, without
+// resolving its path. The cached path of the item, looked up from its
+// ancestors, is moved to the new name and the paths below it are dropped.
+func (h *Handler) Rename(ctx context.Context, fileId, newName string) error {
+	if newName == "" || newName == "." || newName == ".." || strings.Contains(newName, "/") {
+		return errInvalidDestination
+	}
+	if h.MaxNameLength > 0 && utf8.RuneCountInString(newName) > h.MaxNameLength {
+		return errNameTooLong
+	}
+	fi, err := aliyun.GetFileDetail(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fileId)
+	if err != nil {
+		return err
+	}
+	list, err := aliyun.GetList(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.ParentFileId)
+	if err != nil {
+		return err
+	}
+	for _, item := range list.Items {
+		if item.Name == newName && item.FileId != fileId {
+			return os.ErrExist
+		}
+	}
+	if !aliyun.ReName(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId, newName, fileId) {
+		return errMoveFailed
+	}
+	cache.GoCache.Delete(cache.ListKey(h.CurrentConfig().DriveId, fi.ParentFileId))
+	//由文件路径得到缓存键，不遍历缓存；不在根目录下的文件没有缓存路径
+	if dirs, ok := h.pathBelow(ctx, fileId, aliyun.RootFileId()); ok {
+		dir := path.Join(dirs...)
+		renameCachedPath(h.CurrentConfig().DriveId, path.Join(dir, fi.Name), path.Join(dir, newName), fileId)
+	}
+	return nil
+}
+
+// checkOverwrite looks for an existing item called name under parentFileId
+// before a rename or move lands there. Section 9.9.3 says that with
+// "Overwrite: F" the request must fail with 412 (Precondition Failed);
+// otherwise the existing item is replaced, as if deleted by DELETE, whether
+// it is a file or a folder. It is only renamed aside here, so that nothing
+// is lost if the rename or move then fails: the caller either restores it
+// or, once the source is in place, discards it.
+func (h *Handler) checkOverwrite(r *http.Request, parentFileId, name, srcFileId string) (d displaced, status int, err error) {
+	list, err := aliyun.GetList(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, parentFileId)
+	if err != nil {
+		return d, http.StatusBadGateway, err
+	}
+	var existing []model.ListModel
+	for _, item := range list.Items {
+		if item.Name == name && item.FileId != srcFileId {
+			existing = append(existing, item)
+		}
+	}
+	if len(existing) > 0 && r.Header.Get("Overwrite") == "F" {
+		return d, http.StatusPreconditionFailed, os.ErrExist
+	}
+	d = displaced{h: h, name: name, parentFileId: parentFileId}
+	suffix := ".replaced-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	for i, item := range existing {
+		aside := name + suffix + "-" + strconv.Itoa(i)
+		if !aliyun.ReName(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, aside, item.FileId) {
+			d.restore(r)
+			return displaced{}, http.StatusBadGateway, errMoveFailed
+		}
+		item.Name = aside
+		d.items = append(d.items, item)
+	}
+	return d, 0, nil
+}
+
+// displaced are the items renamed aside by checkOverwrite to make room for
+// a rename or move onto name.
+type displaced struct {
+	h            *Handler
+	name         string
+	parentFileId string
+	items        []model.ListModel
+}
+
+// replaced reports whether the rename or move replaced existing items.
+func (d displaced) replaced() bool {
+	return len(d.items) > 0
+}
+
+// restore gives the displaced items their name back after a failed rename
+// or move.
+func (d displaced) restore(r *http.Request) {
+	for _, item := range d.items {
+		if !aliyun.ReName(r.Context(), d.h.CurrentConfig().Token, d.h.CurrentConfig().DriveId, d.name, item.FileId) {
+			logln(r, "❌  恢复被替换的文件失败", d.name, "现在的名称为", item.Name)
+		}
+	}
+	cache.GoCache.Delete(cache.ListKey(d.h.CurrentConfig().DriveId, d.parentFileId))
+}
+
+// discard moves the displaced items to the trash once the rename or move
+// succeeded. An item that can't be trashed is left under its temporary
+// name rather than failing a request that has already taken effect.
+func (d displaced) discard(r *http.Request) {
+	for _, item := range d.items {
+		if err := aliyun.RemoveTrash(r.Context(), d.h.CurrentConfig().Token, d.h.CurrentConfig().DriveId, item.FileId, item.ParentFileId); err != nil {
+			logln(r, "❌  删除被替换的文件失败", item.Name, err)
+		}
+	}
+}
+
+// moveStatus is the status of a successful MOVE or COPY. Sections 9.9.4
+// and 9.8.5 say it is 201 (Created) when a new resource was created at the
+// destination and 204 (No Content) when an existing one was overwritten.
+func moveStatus(replaced bool) int {
+	if replaced {
+		return http.StatusNoContent
+	}
+	return http.StatusCreated
+}
+
+// moveIntoFolder returns the id of the folder called name under
+// parentFileId if, with MoveIntoFolder set, the file fi moved there is to
+// go inside that folder instead of replacing it. It returns "" otherwise.
+func (h *Handler) moveIntoFolder(ctx context.Context, fi model.ListModel, parentFileId, name string) (string, error) {
+	if !h.MoveIntoFolder || fi.Type == "folder" {
+		return "", nil
+	}
+	list, err := aliyun.GetList(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId, parentFileId)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range list.Items {
+		if item.Name == name && item.Type == "folder" {
+			return item.FileId, nil
+		}
+	}
+	return "", nil
+}
+
+// moveInto moves the file fi, found at src, inside the existing folder
+// folderId found at dst, keeping its name.
+func (h *Handler) moveInto(r *http.Request, fi model.ListModel, src, dst, folderId string) (int, error) {
+	d, status, err := h.checkOverwrite(r, folderId, fi.Name, fi.FileId)
+	if err != nil {
+		return status, err
+	}
+	if !aliyun.BatchFile(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.FileId, folderId) {
+		d.restore(r)
+		return http.StatusBadGateway, errMoveFailed
+	}
+	cache.GoCache.Delete(cache.ListKey(h.CurrentConfig().DriveId, fi.ParentFileId))
+	renameCachedPath(h.CurrentConfig().DriveId, src, path.Join(dst, fi.Name), fi.FileId)
+	d.discard(r)
+	return moveStatus(d.replaced()), nil
+}
+
 func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus int, retErr error) {
 	userAgent := r.Header.Get("User-Agent")
 	if len(userAgent) > 0 && strings.Index(userAgent, "Darwin") > -1 {
@@ -581,7 +1599,11 @@ func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus
 	if err != nil {
 		return http.StatusBadRequest, err
 	}
+	body := h.limitBody(w, r)
 	li, status, err := readLockInfo(r.Body)
+	if body.tooLarge {
+		return http.StatusRequestEntityTooLarge, errRequestTooLarge
+	}
 	if err != nil {
 		return status, err
 	}
@@ -624,8 +1646,9 @@ func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus
 		if err != nil {
 			return status, err
 		}
+		//lockroot与lockdiscovery中相同，是以/开头的路径
 		ld = LockDetails{
-			Root:      reqPath,
+			Root:      slashClean(reqPath),
 			Duration:  duration,
 			OwnerXML:  li.Owner.InnerXML,
 			ZeroDepth: depth == 0,
@@ -649,10 +1672,10 @@ func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus
 		if lastIndex == -1 {
 			lastIndex = 0
 		}
-		if len(reqPath) > 0 && !strings.HasSuffix(reqPath, "/") {
+		if len(reqPath) > 0 {
 			strArr := strings.Split(reqPath[:lastIndex], "/")
-			list, _ := aliyun.GetList(h.Config.Token, h.Config.DriveId, getFileId(strArr))
-			fi, _ = findUrl(strArr, h.Config.Token, h.Config.DriveId, list)
+			list, _ := aliyun.GetList(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, getFileId(h.CurrentConfig().DriveId, strArr))
+			fi, _ = findUrl(r.Context(), strArr, h.CurrentConfig().Token, h.CurrentConfig().DriveId, list)
 		}
 		if reflect.DeepEqual(fi, model.ListModel{}) {
 			created = true
@@ -698,56 +1721,98 @@ func (h *Handler) handleUnlock(w http.ResponseWriter, r *http.Request) (status i
 }
 
 func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	body := h.limitBody(w, r)
+	//请求内容已经读出时，解析propfind要用读出的内容，否则会被当成空请求而返回allprop
+	var propfindBody io.Reader = r.Body
 	if r.ContentLength > 0 {
-		available, _ := ioutil.ReadAll(r.Body)
+		available, err := ioutil.ReadAll(r.Body)
+		if body.tooLarge {
+			return http.StatusRequestEntityTooLarge, errRequestTooLarge
+		}
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
 		if strings.Contains(string(available), "quota-available-bytes") {
-			totle, used := aliyun.GetBoxSize(h.Config.Token)
+			totle, used := aliyun.GetDriveSize(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId)
 			to, _ := strconv.ParseInt(string(totle), 10, 64)
 			us, _ := strconv.ParseInt(string(used), 10, 64)
-			w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:"><D:response><D:href>/</D:href><D:propstat><D:prop><D:quota-available-bytes>` + strconv.FormatInt(to-us, 10) + `</D:quota-available-bytes><D:quota-used-bytes>` + used + `</D:quota-used-bytes></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>
+			w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:"><D:response><D:href>` + escapeXML(escapeHref(r.URL.Path)) + `</D:href><D:propstat><D:prop><D:quota-available-bytes>` + strconv.FormatInt(to-us, 10) + `</D:quota-available-bytes><D:quota-used-bytes>` + used + `</D:quota-used-bytes></D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>
 			</D:multistatus>`))
 			return 0, nil
 		}
 		//fmt.Println(string(available))
+		propfindBody = bytes.NewReader(available)
 	}
 	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if virtual, err := h.virtualTrash(r.Context(), strings.Trim(reqPath, "/")); err != nil {
+		return http.StatusBadGateway, err
+	} else if virtual {
+		return h.handleTrashPropfind(w, r, strings.Trim(reqPath, "/"), propfindBody)
+	}
 	var list model.FileListModel
 	var fi model.ListModel
 	//fmt.Println(reqPath)
 	var unfindListErr error
 	var walkErr error
 	//定位当前文件或文件夹位置,假设同级目录下无重名文件或文件夹
-	if strings.HasSuffix(reqPath, "/") {
-		reqPath = reqPath[0 : len(reqPath)-1]
-	}
 	var parentFileId string
+	//从缓存中找到父目录时只需在父目录中查找最后一段
+	walkPaths := strings.Split(strings.Trim(reqPath, "/"), "/")
 	if reqPath == "" {
-		parentFileId = "root"
+		parentFileId = aliyun.RootFileId()
 	} else {
-		paths := strings.Split(reqPath, "/")
+		paths := walkPaths
 		if len(paths) == 1 {
-			parentFileId = "root"
+			parentFileId = aliyun.RootFileId()
 		} else {
-			if pid, err := cache.GoCache.Get("FID_" + strings.Join(paths[:len(paths)-1], "/")); err {
+			if pid, err := cache.GoCache.Get(cache.FileIdKey(h.CurrentConfig().DriveId, strings.Join(paths[:len(paths)-1], "/"))); err {
 				parentFileId = pid.(string)
+				walkPaths = paths[len(paths)-1:]
 			} else {
-				parentFileId = "root"
+				parentFileId = aliyun.RootFileId()
 			}
 		}
 	}
 
-	fi, list, walkErr = aliyun.Walk(h.Config.Token, h.Config.DriveId, strings.Split(reqPath, "/"), parentFileId)
-	if walkErr == nil && fi.FileId != "" {
-		cache.GoCache.Set("FID_"+reqPath, fi.FileId, -1)
+	sc, isShortcut := h.Shortcuts.Get(reqPath)
+	_, isVirtual := h.VirtualFiles.Get(reqPath)
+	if isVirtual {
+		fi = h.VirtualFiles.item(cleanShortcutPath(reqPath), "")
+	} else if isShortcut {
+		//快捷方式不在网盘中，不能写入FID_缓存
+		fi, walkErr = h.shortcutItem(r.Context(), sc, "")
+		if walkErr == nil && fi.Type == "folder" {
+			list, walkErr = aliyun.GetList(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, fi.FileId)
+		}
+	} else {
+		fi, list, walkErr = aliyun.Walk(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, walkPaths, parentFileId)
+	}
+	if !isShortcut && !isVirtual && walkErr == nil && fi.FileId != "" {
+		items := make(map[string]interface{}, len(list.Items)+1)
+		items[cache.FileIdKey(h.CurrentConfig().DriveId, reqPath)] = fi.FileId
 		for _, i := range list.Items {
-			cache.GoCache.Set("FID_"+reqPath+"/"+i.Name, i.FileId, -1)
+			items[cache.FileIdKey(h.CurrentConfig().DriveId, reqPath+"/"+i.Name)] = i.FileId
 		}
+		cache.SetMany(items)
 	}
 
 	if walkErr != nil {
-		return http.StatusNotFound, errors.New("not exists")
+		if errors.Is(walkErr, aliyun.ErrUnexpectedResponse) {
+			return http.StatusBadGateway, walkErr
+		}
+		return http.StatusNotFound, walkErr
+	}
+	if (fi == model.ListModel{}) || fi.Type == "folder" {
+		dirId := fi.FileId
+		if dirId == "" {
+			dirId = aliyun.RootFileId()
+		}
+		list = h.withVirtualFiles(reqPath, dirId, h.withShortcuts(r.Context(), reqPath, dirId, list))
+	}
+	ctx := context.WithValue(r.Context(), folderListerKey{}, folderLister(h.listFolder))
+	if FolderSizes {
+		ctx = context.WithValue(ctx, folderSizerKey{}, h.newFolderSizer())
 	}
-	ctx := r.Context()
 	if (walkErr != nil || fi == model.ListModel{}) && reqPath != "" && reqPath != "/" && strings.Index(reqPath, "test.png") == -1 {
 		//新建或修改名称的时候需要判断是否已存在
 		if len(list.Items) == 0 || unfindListErr != nil {
@@ -763,26 +1828,81 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 			return http.StatusBadRequest, errInvalidDepth
 		}
 	}
-	pf, status, err := readPropfind(r.Body)
+	pf, status, err := readPropfind(propfindBody)
+	if body.tooLarge {
+		return http.StatusRequestEntityTooLarge, errRequestTooLarge
+	}
 	if err != nil {
 		return status, err
 	}
 
-	mw := multistatusWriter{w: w}
+	prefs := parsePrefer(r)
+	isDir := fi == model.ListModel{} || fi.Type == "folder"
+	if applied := prefs.applied(isDir, pf.Propname != nil, h.PropfindLimit); applied != "" {
+		w.Header().Set("Preference-Applied", applied)
+		w.Header().Add("Vary", "Prefer")
+	}
+	limit, responses, truncated, rootHref := prefs.limit(h.PropfindLimit), 0, false, ""
+	walkCtx, stopWalk := context.WithCancel(ctx)
+	defer stopWalk()
+
+	mw := multistatusWriter{w: w, flushBytes: h.PropfindFlushBytes}
 
 	walkFn := func(parent model.ListModel, info model.FileListModel, err error) error {
+		//第一次调用是请求的资源本身，之后是子项；子项超出数量上限时停止列出
+		if limit > 0 && responses > limit {
+			truncated = true
+			stopWalk()
+			return nil
+		}
+		root := responses == 0
+		responses++
 		if reflect.DeepEqual(parent, model.ListModel{}) {
 			parent.Type = "folder"
-			parent.ParentFileId = "root"
+			parent.ParentFileId = aliyun.RootFileId()
+		}
+		//请求的目录本身及其子项可以直接由请求路径得到href，无需再查询文件路径
+		dirId := fi.FileId
+		if dirId == "" {
+			dirId = aliyun.RootFileId()
 		}
+		href := path.Join(h.Prefix, parent.Name)
+		if parent.ParentFileId == aliyun.RootFileId() && parent.FileId == "" {
+			href = "/" + parent.Name
+		} else if parent.FileId == fi.FileId || parent.ParentFileId == dirId {
+			href = path.Join("/", h.Prefix, reqPath)
+			if parent.FileId != fi.FileId {
+				href = path.Join(href, parent.Name)
+			}
+			if parent.Type == "folder" {
+				href = strings.TrimSuffix(href, "/") + "/"
+			}
+		} else {
+			href, _ = aliyun.GetFilePath(r.Context(), h.CurrentConfig().Token, h.CurrentConfig().DriveId, parent.ParentFileId, parent.FileId, parent.Type)
+			href += parent.Name
+			if parent.Type == "folder" {
+				href += "/"
+			}
+			//list, _ = aliyun.GetList(r.Context(), h.Config.Token, h.Config.DriveId, parent.FileId)
+
+		}
+		if root {
+			rootHref = href
+			if prefs.noRoot && isDir && depth != 0 {
+				return nil
+			}
+		}
+		//某个子目录列表获取失败时只在该目录的响应中报告错误，其它已取得的结果照常返回
 		if err != nil {
-			return err
+			return mw.write(makeFailedResponse(href, http.StatusBadGateway, err))
 		}
+		//锁的根路径是去掉前缀的请求路径
+		name := slashClean(strings.TrimPrefix(href, strings.TrimSuffix(h.Prefix, "/")))
 		var pstats []Propstat
 		if pf.Propname != nil {
 			pnames, err := propnames(parent)
 			if err != nil {
-				return err
+				return mw.write(makeFailedResponse(href, http.StatusInternalServerError, err))
 			}
 			pstat := Propstat{Status: http.StatusOK}
 			for _, xmlname := range pnames {
@@ -790,74 +1910,72 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 			}
 			pstats = append(pstats, pstat)
 		} else if pf.Allprop != nil {
-			pstats, err = allprop(ctx, h.FileSystem, h.LockSystem, pf.Prop, parent)
+			pstats, err = allprop(ctx, h.FileSystem, h.LockSystem, name, pf.Include, parent)
 		} else {
-			pstats, err = props(ctx, h.FileSystem, h.LockSystem, pf.Prop, parent)
+			pstats, err = props(ctx, h.FileSystem, h.LockSystem, name, pf.Prop, parent)
 		}
 		if err != nil {
-			return err
+			return mw.write(makeFailedResponse(href, http.StatusInternalServerError, err))
 		}
-		href := path.Join(h.Prefix, parent.Name)
-		if parent.ParentFileId == "root" && parent.FileId == "" {
-			href = "/" + parent.Name
-		} else {
-			href, _ = aliyun.GetFilePath(h.Config.Token, h.Config.DriveId, parent.ParentFileId, parent.FileId, parent.Type)
-			href += parent.Name
-			if parent.Type == "folder" {
-				href += "/"
-			}
-			//list, _ = aliyun.GetList(h.Config.Token, h.Config.DriveId, parent.FileId)
-
+		if prefs.minimal && pf.Propname == nil {
+			pstats = minimalPropstats(pstats)
 		}
 		return mw.write(makePropstatResponse(href, pstats))
 	}
 	userAgent := r.Header.Get("User-Agent")
 	cheng := 1
-	walkError := walkFS(ctx, h.FileSystem, depth, fi, list, walkFn, h.Config.Token, h.Config.DriveId, userAgent, cheng)
-	closeErr := mw.close()
+	walkError := walkFS(walkCtx, h.FileSystem, depth, fi, list, walkFn, h.CurrentConfig().Token, h.CurrentConfig().DriveId, userAgent, cheng)
+	if truncated {
+		walkError = mw.write(makeTruncatedResponse(rootHref))
+	}
+	if walkError != nil && mw.enc == nil {
+		return http.StatusInternalServerError, walkError
+	}
 	if walkError != nil {
-		return http.StatusInternalServerError, walkErr
+		//已经开始返回207，只能返回已取得的部分结果
+		logln(r, "⚠️  PROPFIND incomplete", reqPath, walkError)
 	}
+	closeErr := mw.close()
 	if closeErr != nil {
 		return http.StatusInternalServerError, closeErr
 	}
 	return 0, nil
 }
 
-func getParentFileId(strArr []string) string {
+func getParentFileId(driveId string, strArr []string) string {
 	cacheKey := strArr[0]
 	for _, folder := range strArr[1:] {
 		cacheKey = cacheKey + "/" + folder
 	}
-	va, ok := cache.GoCache.Get("FID_" + cacheKey)
+	va, ok := cache.GoCache.Get(cache.FileIdKey(driveId, cacheKey))
 	if ok {
 		return va.(string)
 	} else {
-		return "root"
+		return aliyun.RootFileId()
 	}
 
 }
 
-func getFileId(strArr []string) string {
+func getFileId(driveId string, strArr []string) string {
 	//如果是新建或者修改文件或者文件夹，获取上级的parentFileId
 	if len(strArr) > 1 {
 		cacheKey := strArr[0]
 		for _, folder := range strArr[1 : len(strArr)-1] {
 			cacheKey = cacheKey + "/" + folder
 		}
-		va, ok := cache.GoCache.Get("FID_" + cacheKey)
+		va, ok := cache.GoCache.Get(cache.FileIdKey(driveId, cacheKey))
 		if ok {
 			return va.(string)
 		} else {
-			return "root"
+			return aliyun.RootFileId()
 		}
 
 	} else {
-		va, ok := cache.GoCache.Get("FID_" + strArr[0])
+		va, ok := cache.GoCache.Get(cache.FileIdKey(driveId, strArr[0]))
 		if ok {
 			return va.(string)
 		} else {
-			return "root"
+			return aliyun.RootFileId()
 		}
 	}
 }
@@ -881,7 +1999,11 @@ func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (statu
 		}
 		return http.StatusMethodNotAllowed, err
 	}
+	body := h.limitBody(w, r)
 	patches, status, err := readProppatch(r.Body)
+	if body.tooLarge {
+		return http.StatusRequestEntityTooLarge, errRequestTooLarge
+	}
 	if err != nil {
 		return status, err
 	}
@@ -889,7 +2011,7 @@ func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (statu
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
-	mw := multistatusWriter{w: w}
+	mw := multistatusWriter{w: w, flushBytes: h.PropfindFlushBytes}
 	writeErr := mw.write(makePropstatResponse(r.URL.Path, pstats))
 	closeErr := mw.close()
 	if writeErr != nil {
@@ -901,14 +2023,17 @@ func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (statu
 	return 0, nil
 }
 
-func findUrl(strArr []string, token, driveId string, list model.FileListModel) (model.ListModel, error) {
+func findUrl(ctx context.Context, strArr []string, token, driveId string, list model.FileListModel) (model.ListModel, error) {
 	var m model.ListModel
 	for _, v := range list.Items {
 		if v.Name == strArr[0] {
 			m = v
 			if len(strArr) > 1 {
-				list, _ := aliyun.GetList(token, driveId, v.FileId)
-				return findUrl(strArr[1:], token, driveId, list)
+				list, err := aliyun.GetList(ctx, token, driveId, v.FileId)
+				if err != nil {
+					return m, err
+				}
+				return findUrl(ctx, strArr[1:], token, driveId, list)
 			} else {
 				return m, nil
 			}
@@ -917,16 +2042,16 @@ func findUrl(strArr []string, token, driveId string, list model.FileListModel) (
 	return m, nil
 }
 
-func findList(strArr []string, token, driveId string, parentId string) (model.FileListModel, error) {
+func findList(ctx context.Context, strArr []string, token, driveId string, parentId string) (model.FileListModel, error) {
 	var list model.FileListModel
 	var err error
 	err = errors.New("未找到数据")
-	list, _ = aliyun.GetList(token, driveId, parentId)
+	list, _ = aliyun.GetList(ctx, token, driveId, parentId)
 	num := 0
 	for _, a := range strArr {
 		for _, v := range list.Items {
 			if v.Name == a {
-				list, _ = aliyun.GetList(token, driveId, v.FileId)
+				list, _ = aliyun.GetList(ctx, token, driveId, v.FileId)
 				num += 1
 				break
 			}
@@ -938,9 +2063,25 @@ func findList(strArr []string, token, driveId string, parentId string) (model.Fi
 	return list, err
 }
 
+// escapeHref percent-encodes the path p for use in a DAV:href. Names are
+// only ever encoded there, never in DAV:displayname.
+func escapeHref(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// makeFailedResponse returns a response reporting that href could not be
+// processed, without properties.
+func makeFailedResponse(href string, status int, err error) *response {
+	return &response{
+		Href:                []string{escapeHref(href)},
+		Status:              fmt.Sprintf("HTTP/1.1 %d %s", status, StatusText(status)),
+		ResponseDescription: err.Error(),
+	}
+}
+
 func makePropstatResponse(href string, pstats []Propstat) *response {
 	resp := response{
-		Href:     []string{(&url.URL{Path: href}).EscapedPath()},
+		Href:     []string{escapeHref(href)},
 		Propstat: make([]propstat, 0, len(pstats)),
 	}
 	for _, p := range pstats {
@@ -1012,7 +2153,15 @@ func StatusText(code int) string {
 var (
 	errDestinationEqualsSource = errors.New("webdav: destination equals source")
 	errDirectoryNotEmpty       = errors.New("webdav: directory not empty")
+	errDownloadFailed          = errors.New("webdav: download failed")
+	errEmptyFile               = errors.New("webdav: empty file rejected")
+	errFolderTooLarge          = errors.New("webdav: folder too large to size")
+	errInsufficientStorage     = errors.New("webdav: insufficient storage")
+	errCopyFailed              = errors.New("webdav: copy failed")
+	errCreateDirectory         = errors.New("webdav: create directory failed")
 	errInvalidDepth            = errors.New("webdav: invalid depth")
+	errInvalidContentRange     = errors.New("webdav: invalid Content-Range")
+	errInvalidUploadId         = errors.New("webdav: missing or invalid Upload-Id")
 	errInvalidDestination      = errors.New("webdav: invalid destination")
 	errInvalidIfHeader         = errors.New("webdav: invalid If header")
 	errInvalidLockInfo         = errors.New("webdav: invalid lock info")
@@ -1020,12 +2169,28 @@ var (
 	errInvalidPropfind         = errors.New("webdav: invalid propfind")
 	errInvalidProppatch        = errors.New("webdav: invalid proppatch")
 	errInvalidResponse         = errors.New("webdav: invalid response")
+	errInvalidShortcut         = errors.New("webdav: invalid shortcut")
 	errInvalidTimeout          = errors.New("webdav: invalid timeout")
+	errMoveFailed              = errors.New("webdav: move failed")
+	errNameTooLong             = errors.New("webdav: name too long")
 	errNoFileSystem            = errors.New("webdav: no file system")
 	errNoLockSystem            = errors.New("webdav: no lock system")
 	errNotADirectory           = errors.New("webdav: not a directory")
 	errPrefixMismatch          = errors.New("webdav: prefix mismatch")
+	errPropUnavailable         = errors.New("webdav: property unavailable")
+	errPropfindTruncated       = errors.New("webdav: listing truncated, too many results")
+	errRangeNotSatisfiable     = errors.New("webdav: requested range not satisfiable")
+	errReadOnly                = errors.New("webdav: read-only")
 	errRecursionTooDeep        = errors.New("webdav: recursion too deep")
+	errRequestTooLarge         = errors.New("webdav: request body too large")
+	errTrashAmbiguous          = errors.New("webdav: several trashed items match")
+	errTokenExpired            = errors.New("webdav: access token expired and refresh failing")
+	errTooManyClientRequests   = errors.New("webdav: too many concurrent requests from client")
+	errTooManyRequests         = errors.New("webdav: too many concurrent requests")
+	errTranscodeUnavailable    = errors.New("webdav: transcoded stream not available")
+	errUnsupportedEncoding     = errors.New("webdav: unsupported content encoding")
 	errUnsupportedLockInfo     = errors.New("webdav: unsupported lock info")
 	errUnsupportedMethod       = errors.New("webdav: unsupported method")
+	errUploadFailed            = errors.New("webdav: upload failed")
+	errVirtualFile             = errors.New("webdav: virtual file is read-only")
 )
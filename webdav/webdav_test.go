@@ -0,0 +1,2143 @@
+package webdav
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/tidwall/gjson"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/aliyuntest"
+	"go-aliyun-webdav/aliyun/cache"
+	"go-aliyun-webdav/aliyun/model"
+	"go-aliyun-webdav/aliyun/net"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHandler returns a Handler serving the drive of a fake Aliyun API,
+// which is closed at the end of the test. Every test starts with an empty
+// cache and its own directory for upload temp files.
+func newTestHandler(t *testing.T) (*Handler, *aliyuntest.Server) {
+	t.Helper()
+	cache.GoCache = cache.New(cache.DefaultExpiration, 0)
+	tempDir := aliyun.TempDir
+	t.Cleanup(func() { aliyun.TempDir = tempDir })
+	aliyun.TempDir = t.TempDir()
+	s := aliyuntest.New()
+	t.Cleanup(s.Close)
+	aliyun.SetRoot("root", "/")
+	h := &Handler{
+		Prefix:     "/",
+		FileSystem: Dir(t.TempDir()),
+		LockSystem: NewMemLS(),
+		Config: model.Config{
+			RefreshToken: "refresh",
+			Token:        "token",
+			DriveId:      aliyuntest.DriveId,
+			ExpireTime:   time.Now().Add(time.Hour).Unix(),
+		},
+	}
+	return h, s
+}
+
+// serve sends a request to h and returns the recorded response. hdr holds
+// header names and values in turn.
+func serve(h http.Handler, method, target string, body io.Reader, hdr ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(hdr); i += 2 {
+		r.Header.Set(hdr[i], hdr[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// responseProps parses a multistatus body into the inner XML of the
+// properties found (status 200) for each href.
+func responseProps(t *testing.T, body []byte) map[string]string {
+	t.Helper()
+	var ms struct {
+		Responses []struct {
+			Href      string `xml:"href"`
+			Propstats []struct {
+				Prop struct {
+					Inner string `xml:",innerxml"`
+				} `xml:"prop"`
+				Status string `xml:"status"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(body, &ms); err != nil {
+		t.Fatalf("invalid multistatus: %v\n%s", err, body)
+	}
+	props := map[string]string{}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if strings.Contains(ps.Status, " 200 ") {
+				props[r.Href] += ps.Prop.Inner
+			}
+		}
+	}
+	return props
+}
+
+// doPropfind sends a PROPFIND of target with the given Depth and body.
+func doPropfind(h http.Handler, target, depth, body string, hdr ...string) *httptest.ResponseRecorder {
+	return serve(h, "PROPFIND", target, strings.NewReader(body), append([]string{"Depth", depth}, hdr...)...)
+}
+
+func TestRedirectDownload(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.RedirectDownload = true
+	id := s.Put("root", "movie.mp4", []byte("0123456789"))
+
+	w := serve(h, "GET", "/movie.mp4", nil, "Range", "bytes=2-5")
+	if w.Code != http.StatusFound {
+		t.Fatalf("GET = %d, want 302", w.Code)
+	}
+	loc := w.Header().Get("Location")
+	if want := s.URL + "/oss/download/" + id; loc != want {
+		t.Fatalf("Location = %q, want %q", loc, want)
+	}
+	if n := s.Calls("/oss/download/" + id); n != 0 {
+		t.Errorf("server proxied %d downloads in redirect mode", n)
+	}
+
+	//客户端跟随跳转时带上原来的Range
+	r, _ := http.NewRequest("GET", loc, nil)
+	r.Header.Set("Range", "bytes=2-5")
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusPartialContent || string(body) != "2345" {
+		t.Errorf("following the redirect = %d %q, want 206 \"2345\"", res.StatusCode, body)
+	}
+}
+
+func TestProxyDownloadByDefault(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "movie.mp4", []byte("0123456789"))
+
+	w := serve(h, "GET", "/movie.mp4", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("GET = %d %q, want the proxied content", w.Code, w.Body.String())
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "电影 1.mp4", []byte("movie"))
+	const encoded = `filename="______ 1.mp4"; filename*=UTF-8''%E7%94%B5%E5%BD%B1%201.mp4`
+
+	w := serve(h, "GET", "/%E7%94%B5%E5%BD%B1%201.mp4?download=1", nil)
+	if got, want := w.Header().Get("Content-Disposition"), "attachment; "+encoded; got != want {
+		t.Errorf("?download=1: Content-Disposition = %q, want %q", got, want)
+	}
+	w = serve(h, "GET", "/%E7%94%B5%E5%BD%B1%201.mp4", nil)
+	if got, want := w.Header().Get("Content-Disposition"), "inline; "+encoded; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+	h.AttachmentDownload = true
+	w = serve(h, "GET", "/%E7%94%B5%E5%BD%B1%201.mp4", nil)
+	if got := w.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment;") {
+		t.Errorf("AttachmentDownload: Content-Disposition = %q", got)
+	}
+}
+
+func TestHeadWarmCache(t *testing.T) {
+	h, s := newTestHandler(t)
+	a := s.Mkdir("root", "a")
+	b := s.Mkdir(a, "b")
+	s.Put(b, "c.txt", []byte("hello"))
+
+	if w := doPropfind(h, "/a/b/", "1", ""); w.Code != StatusMulti {
+		t.Fatalf("PROPFIND = %d", w.Code)
+	}
+	//去掉所有目录的列表缓存，只留下FID_缓存，从根目录逐级查找时就要重新列目录
+	for _, id := range []string{"root", a, b} {
+		cache.GoCache.Delete(cache.ListKey(aliyuntest.DriveId, id))
+	}
+	lists, gets := s.Calls("/adrive/v3/file/list"), s.Calls("/v2/file/get")
+
+	w := serve(h, "HEAD", "/a/b/c.txt", nil)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+		t.Fatalf("HEAD = %d, ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+	if n := s.Calls("/adrive/v3/file/list") - lists; n != 0 {
+		t.Errorf("warm HEAD listed %d folders, want none", n)
+	}
+	if n := s.Calls("/v2/file/get") - gets; n != 1 {
+		t.Errorf("warm HEAD made %d detail calls, want one", n)
+	}
+
+	//缓存未命中时从根目录逐级查找
+	cache.GoCache.Flush()
+	if w := serve(h, "HEAD", "/a/b/c.txt", nil); w.Code != http.StatusOK {
+		t.Errorf("cold HEAD = %d, want 200", w.Code)
+	}
+	if w := serve(h, "HEAD", "/a/b/missing.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a missing file = %d, want 404", w.Code)
+	}
+}
+
+func TestOptionsReflectsFeatures(t *testing.T) {
+	h, _ := newTestHandler(t)
+	allowed := func(w *httptest.ResponseRecorder) map[string]bool {
+		m := map[string]bool{}
+		for _, method := range strings.Split(w.Header().Get("Allow"), ", ") {
+			m[method] = true
+		}
+		return m
+	}
+
+	w := serve(h, "OPTIONS", "/", nil)
+	if allow := allowed(w); !allow["DELETE"] || !allow["LOCK"] {
+		t.Errorf("default Allow = %q", w.Header().Get("Allow"))
+	}
+	if w.Header().Get("DAV") != "1, 2" || w.Header().Get("MS-Author-Via") != "DAV" {
+		t.Errorf("default DAV %q, MS-Author-Via %q", w.Header().Get("DAV"), w.Header().Get("MS-Author-Via"))
+	}
+
+	h.ReadOnly = true
+	w = serve(h, "OPTIONS", "/", nil)
+	for method := range writeMethods {
+		if allowed(w)[method] {
+			t.Errorf("read-only Allow = %q includes %s", w.Header().Get("Allow"), method)
+		}
+	}
+	if !allowed(w)["PROPFIND"] {
+		t.Errorf("read-only Allow = %q lacks PROPFIND", w.Header().Get("Allow"))
+	}
+	if w.Header().Get("DAV") != "1" || w.Header().Get("MS-Author-Via") != "" {
+		t.Errorf("read-only DAV %q, MS-Author-Via %q", w.Header().Get("DAV"), w.Header().Get("MS-Author-Via"))
+	}
+	h.ReadOnly, h.LockSystem = false, nil
+	w = serve(h, "OPTIONS", "/", nil)
+	if allow := allowed(w); allow["LOCK"] || allow["UNLOCK"] || !allow["DELETE"] || w.Header().Get("DAV") != "1" {
+		t.Errorf("without locking Allow %q, DAV %q", w.Header().Get("Allow"), w.Header().Get("DAV"))
+	}
+}
+
+func TestPropfindCachesChildIds(t *testing.T) {
+	h, s := newTestHandler(t)
+	media := s.Mkdir("root", "media")
+	ids := map[string]string{}
+	for _, name := range []string{"a.mkv", "b.mkv", "c"} {
+		ids[name] = s.Put(media, name, []byte(name))
+	}
+
+	if w := doPropfind(h, "/media/", "1", ""); w.Code != StatusMulti {
+		t.Fatalf("PROPFIND = %d", w.Code)
+	}
+	if fid, ok := cache.GoCache.Get(cache.FileIdKey(aliyuntest.DriveId, "media")); !ok || fid != media {
+		t.Errorf("cached id of media = %v, want %s", fid, media)
+	}
+	for name, id := range ids {
+		if fid, ok := cache.GoCache.Get(cache.FileIdKey(aliyuntest.DriveId, "media/"+name)); !ok || fid != id {
+			t.Errorf("cached id of media/%s = %v, want %s", name, fid, id)
+		}
+	}
+}
+
+func TestRootFolder(t *testing.T) {
+	h, s := newTestHandler(t)
+	media := s.Mkdir("root", "Media")
+	s.Put(media, "inside.mkv", []byte("inside"))
+	s.Put("root", "outside.txt", []byte("outside"))
+	if err := aliyun.SetRootFolder(context.Background(), "token", aliyuntest.DriveId, "/Media"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { aliyun.SetRoot("root", "/") })
+
+	w := doPropfind(h, "/", "1", "")
+	if w.Code != StatusMulti {
+		t.Fatalf("PROPFIND = %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "<D:href>/inside.mkv</D:href>") || strings.Contains(body, "outside.txt") {
+		t.Errorf("PROPFIND / does not list just the root folder:\n%s", body)
+	}
+	if w := serve(h, "GET", "/inside.mkv", nil); w.Code != http.StatusOK || w.Body.String() != "inside" {
+		t.Errorf("GET /inside.mkv = %d %q", w.Code, w.Body.String())
+	}
+	if w := serve(h, "GET", "/outside.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /outside.txt = %d, want 404 outside the root folder", w.Code)
+	}
+}
+
+func TestRiskControlUnavailable(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "a.txt", []byte("a"))
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":"NeedSecondVerify","message":"verify"}`))
+	})
+	for _, method := range []string{"PROPFIND", "GET", "DELETE"} {
+		if w := serve(h, method, "/a.txt", nil, "Depth", "0"); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s under risk control = %d, want 503", method, w.Code)
+		}
+	}
+	if w := serve(h, "MOVE", "/a.txt", nil, "Destination", "http://example.com/b.txt"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("MOVE under risk control = %d, want 503", w.Code)
+	}
+
+	//风控期间没有请求阿里云就失败的请求保持原来的状态码
+	if net.RiskControlled() == nil {
+		t.Fatal("risk control not recorded")
+	}
+	if w := serve(h, "LOCK", "/a.txt", nil, "If", "(<opaquelocktoken:missing>)"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("refreshing an unknown lock under risk control = %d, want 412", w.Code)
+	}
+	h.Prefix = "/dav"
+	if w := serve(h, "MKCOL", "/other/b", nil); w.Code != http.StatusNotFound {
+		t.Errorf("MKCOL outside the prefix under risk control = %d, want 404", w.Code)
+	}
+	h.Prefix = "/"
+
+	s.Handle("/adrive/v3/file/list", nil)
+	if w := doPropfind(h, "/a.txt", "0", ""); w.Code != StatusMulti {
+		t.Errorf("PROPFIND after verification = %d, want 207", w.Code)
+	}
+}
+
+func TestMoveOverwrite(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		dst  string
+	}{
+		{"rename", "/b.txt"},
+		{"move", "/dir/a.txt"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h, s := newTestHandler(t)
+			dir := s.Mkdir("root", "dir")
+			s.Put("root", "a.txt", []byte("source"))
+			parent := "root"
+			if c.name == "move" {
+				parent = dir
+			}
+			s.Put(parent, path.Base(c.dst), []byte("destination"))
+			dst := "http://example.com" + c.dst
+
+			w := serve(h, "MOVE", "/a.txt", nil, "Destination", dst, "Overwrite", "F")
+			if w.Code != http.StatusPreconditionFailed {
+				t.Errorf("MOVE onto an existing file with Overwrite: F = %d, want 412", w.Code)
+			}
+			if f, ok := s.Lookup(c.dst); !ok || string(f.Content) != "destination" {
+				t.Errorf("destination changed by a refused MOVE")
+			}
+			if _, ok := s.Lookup("a.txt"); !ok {
+				t.Errorf("source gone after a refused MOVE")
+			}
+
+			w = serve(h, "MOVE", "/a.txt", nil, "Destination", dst, "Overwrite", "T")
+			if w.Code != http.StatusNoContent {
+				t.Errorf("MOVE with Overwrite: T = %d, want 204", w.Code)
+			}
+			if f, ok := s.Lookup(c.dst); !ok || string(f.Content) != "source" {
+				t.Errorf("destination does not hold the moved file")
+			}
+			if _, ok := s.Lookup("a.txt"); ok {
+				t.Errorf("source still there after MOVE")
+			}
+		})
+	}
+}
+
+func TestCopyOverwrite(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		dst  string
+	}{
+		{"same folder", "/b.txt"},
+		{"other folder", "/dir/a.txt"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h, s := newTestHandler(t)
+			dir := s.Mkdir("root", "dir")
+			src := s.Put("root", "a.txt", []byte("source"))
+			parent := "root"
+			if c.name == "other folder" {
+				parent = dir
+			}
+			old := s.Put(parent, path.Base(c.dst), []byte("destination"))
+			dst := "http://example.com" + c.dst
+
+			w := serve(h, "COPY", "/a.txt", nil, "Destination", dst, "Overwrite", "F")
+			if w.Code != http.StatusPreconditionFailed {
+				t.Errorf("COPY onto an existing file with Overwrite: F = %d, want 412", w.Code)
+			}
+			if f, ok := s.Lookup(c.dst); !ok || string(f.Content) != "destination" {
+				t.Errorf("destination changed by a refused COPY")
+			}
+
+			w = serve(h, "COPY", "/a.txt", nil, "Destination", dst, "Overwrite", "T")
+			if w.Code != http.StatusNoContent {
+				t.Errorf("COPY with Overwrite: T = %d, want 204", w.Code)
+			}
+			if f, ok := s.Lookup(c.dst); !ok || string(f.Content) != "source" || f.Id == src {
+				t.Errorf("destination does not hold a copy of the source: %+v", f)
+			}
+			if f, _ := s.File(old); !f.Trashed {
+				t.Errorf("replaced destination not trashed")
+			}
+			if f, ok := s.Lookup("a.txt"); !ok || f.Id != src || string(f.Content) != "source" {
+				t.Errorf("source changed by COPY: %+v", f)
+			}
+		})
+	}
+}
+
+// TestCopyFolder checks that COPY copies a folder with its content, or
+// only the folder itself with Depth: 0, and refuses to copy onto itself.
+func TestCopyFolder(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put(s.Mkdir("root", "dir"), "inner.txt", []byte("inner"))
+
+	if w := serve(h, "COPY", "/dir", nil, "Destination", "http://example.com/copy"); w.Code != http.StatusCreated {
+		t.Errorf("COPY of a folder = %d, want 201", w.Code)
+	}
+	for _, p := range []string{"dir/inner.txt", "copy/inner.txt"} {
+		if f, ok := s.Lookup(p); !ok || string(f.Content) != "inner" {
+			t.Errorf("%s missing after COPY", p)
+		}
+	}
+	if w := serve(h, "COPY", "/dir", nil, "Destination", "http://example.com/empty", "Depth", "0"); w.Code != http.StatusCreated {
+		t.Errorf("COPY of a folder with Depth: 0 = %d, want 201", w.Code)
+	}
+	if f, ok := s.Lookup("empty"); !ok || f.Type != "folder" {
+		t.Error("folder not created by COPY with Depth: 0")
+	}
+	if _, ok := s.Lookup("empty/inner.txt"); ok {
+		t.Error("COPY with Depth: 0 copied the folder content")
+	}
+	if w := serve(h, "COPY", "/dir", nil, "Destination", "http://example.com/dir/"); w.Code != http.StatusForbidden {
+		t.Errorf("COPY onto itself = %d, want 403", w.Code)
+	}
+
+	//文件复制到已有的目录上时替换该目录，原文件保留
+	if w := serve(h, "COPY", "/dir/inner.txt", nil, "Destination", "http://example.com/copy", "Overwrite", "F"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("COPY of a file onto a folder with Overwrite: F = %d, want 412", w.Code)
+	}
+	if w := serve(h, "COPY", "/dir/inner.txt", nil, "Destination", "http://example.com/copy"); w.Code != http.StatusNoContent {
+		t.Errorf("COPY of a file onto a folder = %d, want 204", w.Code)
+	}
+	if f, ok := s.Lookup("copy"); !ok || f.Type != "file" || string(f.Content) != "inner" {
+		t.Errorf("folder not replaced by the copied file: %+v", f)
+	}
+	if _, ok := s.Lookup("dir/inner.txt"); !ok {
+		t.Error("source gone after COPY onto a folder")
+	}
+}
+
+func TestPutQuota(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Handle("/v2/drive/get", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"drive_id":"1","total_size":1000,"used_size":900}`))
+	})
+
+	w := serve(h, "PUT", "/big.bin", bytes.NewReader(make([]byte, 200)))
+	if w.Code != StatusInsufficientStorage {
+		t.Errorf("PUT beyond the free space = %d, want 507", w.Code)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 0 {
+		t.Errorf("upload started %d times on a full drive", n)
+	}
+	if w := serve(h, "PUT", "/small.bin", bytes.NewReader(make([]byte, 50))); w.Code != http.StatusCreated {
+		t.Errorf("PUT within the free space = %d, want 201", w.Code)
+	}
+
+	//并发上传预留的空间合计不能超过剩余空间
+	release, _, err := h.reserveSpace(context.Background(), 60)
+	if err != nil {
+		t.Fatalf("first reservation: %v", err)
+	}
+	if _, status, err := h.reserveSpace(context.Background(), 60); err == nil || status != StatusInsufficientStorage {
+		t.Errorf("second reservation = %d, %v; want 507 while the first is held", status, err)
+	}
+	release()
+	if release, _, err := h.reserveSpace(context.Background(), 60); err != nil {
+		t.Errorf("reservation after release: %v", err)
+	} else {
+		release()
+	}
+}
+
+// TestMoveOntoFolder checks MOVE onto an existing item of the other type,
+// and MoveIntoFolder putting a file inside the destination folder.
+func TestMoveOntoFolder(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "a.txt", []byte("a"))
+	s.Put("root", "b.txt", []byte("b"))
+	s.Put(s.Mkdir("root", "dir"), "inner.txt", []byte("inner"))
+	s.Mkdir("root", "folder")
+	s.Put("root", "file", []byte("file"))
+
+	if w := serve(h, "MOVE", "/a.txt", nil, "Destination", "http://example.com/dir", "Overwrite", "F"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("MOVE of a file onto a folder with Overwrite: F = %d, want 412", w.Code)
+	}
+	if _, ok := s.Lookup("dir/inner.txt"); !ok {
+		t.Fatal("folder changed by a refused MOVE")
+	}
+
+	//MoveIntoFolder时文件放进目标目录，目录保留
+	h.MoveIntoFolder = true
+	if w := serve(h, "MOVE", "/a.txt", nil, "Destination", "http://example.com/dir"); w.Code != http.StatusCreated {
+		t.Errorf("MOVE into a folder = %d, want 201", w.Code)
+	}
+	if f, ok := s.Lookup("dir/a.txt"); !ok || string(f.Content) != "a" {
+		t.Error("file not moved inside the folder")
+	}
+	if _, ok := s.Lookup("dir/inner.txt"); !ok {
+		t.Error("folder replaced with MoveIntoFolder")
+	}
+	if w := serve(h, "GET", "/dir/a.txt", nil); w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Errorf("GET of the moved file = %d %q", w.Code, w.Body.String())
+	}
+
+	//按RFC 4918替换目标目录
+	h.MoveIntoFolder = false
+	if w := serve(h, "MOVE", "/b.txt", nil, "Destination", "http://example.com/dir", "Overwrite", "T"); w.Code != http.StatusNoContent {
+		t.Errorf("MOVE of a file onto a folder = %d, want 204", w.Code)
+	}
+	if f, ok := s.Lookup("dir"); !ok || f.Type != "file" || string(f.Content) != "b" {
+		t.Errorf("folder not replaced by the file: %+v", f)
+	}
+
+	//目录替换已有文件
+	if w := serve(h, "MOVE", "/folder", nil, "Destination", "http://example.com/file"); w.Code != http.StatusNoContent {
+		t.Errorf("MOVE of a folder onto a file = %d, want 204", w.Code)
+	}
+	if f, ok := s.Lookup("file"); !ok || f.Type != "folder" {
+		t.Errorf("file not replaced by the folder: %+v", f)
+	}
+	//目标不存在时为201
+	if w := serve(h, "MOVE", "/file", nil, "Destination", "http://example.com/new"); w.Code != http.StatusCreated {
+		t.Errorf("MOVE to a new name = %d, want 201", w.Code)
+	}
+}
+
+// TestMoveRenameCached checks that renaming a file whose folder is cached
+// does not walk from the root folder.
+func TestMoveRenameCached(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	sub := s.Mkdir(dir, "sub")
+	id := s.Put(sub, "a.txt", []byte("a"))
+	cache.GoCache.Set(cache.FileIdKey(aliyuntest.DriveId, "dir/sub/a.txt"), id, -1)
+	rootLists := 0
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if gjson.GetBytes(data, "parent_file_id").Str == "root" {
+			rootLists++
+		}
+		s.Default(w, r)
+	})
+
+	if w := serve(h, "MOVE", "/dir/sub/a.txt", nil, "Destination", "http://example.com/dir/sub/b.txt"); w.Code != http.StatusCreated {
+		t.Fatalf("MOVE = %d, want 201", w.Code)
+	}
+	if f, _ := s.File(id); f.Name != "b.txt" || f.ParentId != sub {
+		t.Errorf("file = %+v, want b.txt in sub", f)
+	}
+	if rootLists != 0 {
+		t.Errorf("cached rename listed the root folder %d times", rootLists)
+	}
+
+	//缓存未命中时从根目录查找
+	cache.GoCache.Flush()
+	if w := serve(h, "MOVE", "/dir/sub/b.txt", nil, "Destination", "http://example.com/dir/sub/c.txt"); w.Code != http.StatusCreated {
+		t.Fatalf("uncached MOVE = %d, want 201", w.Code)
+	}
+	if f, _ := s.File(id); f.Name != "c.txt" {
+		t.Errorf("file named %q, want c.txt", f.Name)
+	}
+	if rootLists == 0 {
+		t.Error("uncached rename resolved without a walk")
+	}
+}
+
+func TestRenameExtension(t *testing.T) {
+	h, s := newTestHandler(t)
+	id := s.Put("root", "a.txt", []byte("<p>hi</p>"))
+	if w := serve(h, "GET", "/a.txt", nil); w.Code != http.StatusOK {
+		t.Fatalf("GET /a.txt = %d", w.Code)
+	}
+
+	if w := serve(h, "MOVE", "/a.txt", nil, "Destination", "http://example.com/a.html"); w.Code != http.StatusCreated {
+		t.Fatalf("MOVE = %d, want 201", w.Code)
+	}
+	if f, _ := s.File(id); f.Name != "a.html" {
+		t.Errorf("renamed to %q, want a.html", f.Name)
+	}
+	w := serve(h, "GET", "/a.html", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "<p>hi</p>" {
+		t.Fatalf("GET /a.html = %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Content-Type after the rename = %q, want text/html", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, `filename="a.html"`) {
+		t.Errorf("Content-Disposition after the rename = %q", got)
+	}
+	if w := serve(h, "GET", "/a.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET of the old name = %d, want 404", w.Code)
+	}
+
+	//文件名经过URL编码时按解码后的名称重命名
+	if w := serve(h, "MOVE", "/a.html", nil, "Destination", "http://example.com/%E6%96%B0%20a.html"); w.Code != http.StatusCreated {
+		t.Fatalf("MOVE to an encoded name = %d, want 201", w.Code)
+	}
+	if f, _ := s.File(id); f.Name != "新 a.html" {
+		t.Errorf("renamed to %q, want the decoded name", f.Name)
+	}
+}
+
+func TestPropfindRequestedProps(t *testing.T) {
+	h, s := newTestHandler(t)
+	a := s.Mkdir("root", "a")
+	b := s.Mkdir(a, "b")
+	s.Put(b, "c.txt", []byte("hello"))
+	s.Mkdir(b, "d")
+	const body = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:resourcetype/></D:prop></D:propfind>`
+
+	w := doPropfind(h, "/a/b/", "1", body)
+	if w.Code != StatusMulti {
+		t.Fatalf("PROPFIND = %d", w.Code)
+	}
+	out := w.Body.String()
+	for _, want := range []string{"<D:href>/a/b/</D:href>", "<D:href>/a/b/c.txt</D:href>", "<D:href>/a/b/d/</D:href>", "<D:getcontentlength>5</D:getcontentlength>", "<D:collection"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("response lacks %s:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"getlastmodified", "getetag", "displayname"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("response has unrequested %s:\n%s", unwanted, out)
+		}
+	}
+	if n := s.Calls("/adrive/v1/file/get_path"); n != 0 {
+		t.Errorf("resolved %d paths for hrefs known from the request path", n)
+	}
+}
+
+// TestDeleteFailure checks that a DELETE rejected upstream is reported as
+// such and leaves the file in place.
+func TestDeleteFailure(t *testing.T) {
+	h, s := newTestHandler(t)
+	id := s.Put("root", "a.txt", []byte("a"))
+	s.Handle("/v2/recyclebin/trash", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"code":"ForbiddenNoPermission.File","message":"No permission to access resource File"}`))
+	})
+	if w := serve(h, "DELETE", "/a.txt", nil); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE with a read-only token = %d, want 403", w.Code)
+	}
+	s.Handle("/v2/recyclebin/trash", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"code":"InternalError","message":"oops"}`))
+	})
+	if w := serve(h, "DELETE", "/a.txt", nil); w.Code != http.StatusBadGateway {
+		t.Errorf("DELETE failing upstream = %d, want 502", w.Code)
+	}
+	if f, _ := s.File(id); f.Trashed {
+		t.Error("file trashed")
+	}
+
+	s.Handle("/v2/recyclebin/trash", nil)
+	if w := serve(h, "DELETE", "/missing.txt", nil); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a missing file = %d, want 404", w.Code)
+	}
+}
+
+func TestDeleteDepth(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	s.Put(dir, "a.txt", []byte("a"))
+	file := s.Put("root", "b.txt", []byte("b"))
+
+	for _, depth := range []string{"0", "1"} {
+		if w := serve(h, "DELETE", "/dir", nil, "Depth", depth); w.Code != http.StatusBadRequest {
+			t.Errorf("DELETE of a folder with Depth: %s = %d, want 400", depth, w.Code)
+		}
+	}
+	if f, _ := s.File(dir); f.Trashed {
+		t.Fatal("folder deleted by a refused DELETE")
+	}
+	if w := serve(h, "DELETE", "/dir", nil, "Depth", "infinity"); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE of a folder with Depth: infinity = %d, want 204", w.Code)
+	}
+	if f, _ := s.File(dir); !f.Trashed {
+		t.Error("folder not deleted")
+	}
+	//Depth只约束文件夹
+	if w := serve(h, "DELETE", "/b.txt", nil, "Depth", "0"); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE of a file with Depth: 0 = %d, want 204", w.Code)
+	}
+	if f, _ := s.File(file); !f.Trashed {
+		t.Error("file not deleted")
+	}
+}
+
+func TestPropfindResourceId(t *testing.T) {
+	h, s := newTestHandler(t)
+	a := s.Put("root", "a.txt", []byte("a"))
+	dir := s.Mkdir("root", "dir")
+	const body = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:resource-id/></D:prop></D:propfind>`
+	resourceId := func(href string) string {
+		w := doPropfind(h, "/", "1", body)
+		prop := responseProps(t, w.Body.Bytes())[href]
+		if i := strings.Index(prop, "urn:aliyundrive:"); i >= 0 {
+			return strings.SplitN(prop[i+len("urn:aliyundrive:"):], "<", 2)[0]
+		}
+		t.Fatalf("no resource-id for %s in %s", href, w.Body.String())
+		return ""
+	}
+
+	for href, want := range map[string]string{"/": "root", "/a.txt": a, "/dir/": dir} {
+		if got := resourceId(href); got != want {
+			t.Errorf("resource-id of %s = %s, want %s", href, got, want)
+		}
+	}
+
+	//重命名后resource-id不变，替换后改变
+	serve(h, "MOVE", "/a.txt", nil, "Destination", "http://example.com/b.txt")
+	if got := resourceId("/b.txt"); got != a {
+		t.Errorf("resource-id after a rename = %s, want %s", got, a)
+	}
+	serve(h, "PUT", "/b.txt", strings.NewReader("new content"))
+	if got := resourceId("/b.txt"); got == a {
+		t.Errorf("resource-id after replacing the file is still %s", got)
+	}
+}
+
+func TestUnexpectedResponseBadGateway(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "a.txt", []byte("a"))
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"entries":[],"next_marker":""}`))
+	})
+	for _, method := range []string{"PROPFIND", "GET"} {
+		if w := serve(h, method, "/a.txt", nil, "Depth", "0"); w.Code != http.StatusBadGateway {
+			t.Errorf("%s with a changed list schema = %d, want 502", method, w.Code)
+		}
+	}
+}
+
+func TestNoInlineRefresh(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.Config.ExpireTime = time.Now().Add(-time.Hour).Unix()
+
+	h.NoInlineRefresh = true
+	doPropfind(h, "/", "0", "")
+	if n := s.Calls("/token/refresh"); n != 0 {
+		t.Errorf("refreshed %d times inline with NoInlineRefresh", n)
+	}
+
+	h.NoInlineRefresh = false
+	doPropfind(h, "/", "0", "")
+	if n := s.Calls("/token/refresh"); n != 1 {
+		t.Errorf("refreshed %d times inline, want once for an expired token", n)
+	}
+	if c := h.CurrentConfig(); c.Token != "access-refresh" || c.ExpireTime <= time.Now().Unix() {
+		t.Errorf("config after the inline refresh = %+v", c)
+	}
+}
+
+// TestRejectExpiredToken checks that requests get 503 while the token is
+// expired and cannot be refreshed, and are served again once it can.
+func TestRejectExpiredToken(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "a.txt", []byte("a"))
+	h.Config.ExpireTime = time.Now().Add(-time.Hour).Unix()
+	h.RejectExpiredToken = true
+	down := true
+	s.Handle("/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.Write([]byte("<html>gateway error</html>"))
+			return
+		}
+		s.Default(w, r)
+	})
+
+	for _, method := range []string{"PROPFIND", "GET", "PUT", "DELETE"} {
+		w := serve(h, method, "/a.txt", strings.NewReader("b"))
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s with an expired token = %d (Retry-After %q), want 503 with Retry-After", method, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	if w := serve(h, "OPTIONS", "/", nil); w.Code != http.StatusOK {
+		t.Errorf("OPTIONS with an expired token = %d, want 200", w.Code)
+	}
+	if n := s.Calls("/adrive/v3/file/list") + s.Calls("/v2/file/get"); n != 0 {
+		t.Errorf("forwarded %d requests with an expired token", n)
+	}
+	//刷新失败时保留refresh_token，恢复后还能刷新
+	if c := h.CurrentConfig(); c.RefreshToken != "refresh" {
+		t.Errorf("refresh token after failed refreshes = %q", c.RefreshToken)
+	}
+
+	down = false
+	if w := serve(h, "GET", "/a.txt", nil); w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Errorf("GET after the refresh recovered = %d %q, want 200", w.Code, w.Body.String())
+	}
+
+	//未开启时照常转发
+	h.RejectExpiredToken, h.NoInlineRefresh = false, true
+	h.Config.ExpireTime = time.Now().Add(-time.Hour).Unix()
+	if w := serve(h, "GET", "/a.txt", nil); w.Code == http.StatusServiceUnavailable {
+		t.Errorf("GET with an expired token and the option off = %d", w.Code)
+	}
+}
+
+func TestTouchThenUpload(t *testing.T) {
+	h, s := newTestHandler(t)
+	if w := serve(h, "PUT", "/a.txt", strings.NewReader("")); w.Code != http.StatusCreated {
+		t.Fatalf("empty PUT = %d, want 201", w.Code)
+	}
+	if f, ok := s.Lookup("a.txt"); !ok || len(f.Content) != 0 {
+		t.Fatalf("placeholder not created")
+	}
+	if w := serve(h, "PUT", "/a.txt", strings.NewReader("content")); w.Code != http.StatusCreated {
+		t.Fatalf("PUT over the placeholder = %d, want 201", w.Code)
+	}
+	w := doPropfind(h, "/", "1", "")
+	if n := strings.Count(w.Body.String(), "<D:href>/a"); n != 1 {
+		t.Errorf("%d files named a* after touch-then-upload, want one:\n%s", n, w.Body.String())
+	}
+	if w := serve(h, "GET", "/a.txt", nil); w.Body.String() != "content" {
+		t.Errorf("GET = %q, want the uploaded content", w.Body.String())
+	}
+}
+
+func TestRejectEmptyFiles(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.RejectEmptyFiles = true
+
+	if w := serve(h, "PUT", "/a.txt", strings.NewReader("")); w.Code != http.StatusForbidden {
+		t.Errorf("empty PUT = %d, want 403", w.Code)
+	}
+	r := httptest.NewRequest("PUT", "/b.txt", strings.NewReader(""))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("empty chunked PUT = %d, want 403", w.Code)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 0 {
+		t.Errorf("created %d files", n)
+	}
+	if w := serve(h, "PUT", "/c.txt", strings.NewReader("content")); w.Code != http.StatusCreated {
+		t.Errorf("PUT with content = %d, want 201", w.Code)
+	}
+}
+
+func TestQuotaPerMount(t *testing.T) {
+	h1, s := newTestHandler(t)
+	s.Handle("/v2/drive/get", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if gjson.GetBytes(data, "drive_id").Str == "2" {
+			w.Write([]byte(`{"drive_id":"2","total_size":5000,"used_size":4000}`))
+			return
+		}
+		w.Write([]byte(`{"drive_id":"1","total_size":1000,"used_size":100}`))
+	})
+	h1.Prefix = "/one"
+	h2 := &Handler{
+		Prefix:     "/two",
+		FileSystem: h1.FileSystem,
+		LockSystem: NewMemLS(),
+		Config:     h1.Config,
+	}
+	h2.Config.DriveId = "2"
+	mux := http.NewServeMux()
+	mux.Handle("/one/", h1)
+	mux.Handle("/two/", h2)
+
+	const body = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/><D:quota-used-bytes/></D:prop></D:propfind>`
+	for _, c := range []struct{ target, available, used string }{
+		{"/one/", "900", "100"},
+		{"/two/", "1000", "4000"},
+	} {
+		w := doPropfind(mux, c.target, "0", body)
+		got := w.Body.String()
+		if !strings.Contains(got, "<D:quota-available-bytes>"+c.available+"<") || !strings.Contains(got, "<D:quota-used-bytes>"+c.used+"<") {
+			t.Errorf("PROPFIND %s quota, want available %s and used %s:\n%s", c.target, c.available, c.used, got)
+		}
+	}
+}
+
+// TestFileIdCachePerDrive checks that the same path in two mounted drives
+// is cached separately.
+func TestFileIdCachePerDrive(t *testing.T) {
+	h1, s := newTestHandler(t)
+	one := s.Mkdir("root", "dir")
+	s.Put(one, "a.txt", []byte("one"))
+	//模拟服务只有一个网盘，另一个网盘中的同名目录放在别处，并直接记下它的路径缓存
+	two := s.Mkdir(s.Mkdir("root", "drive2"), "dir")
+	twoFile := s.Put(two, "a.txt", []byte("two"))
+	h1.Prefix = "/one/"
+	h2 := &Handler{Prefix: "/two/", FileSystem: h1.FileSystem, LockSystem: NewMemLS(), Config: h1.Config}
+	h2.Config.DriveId = "2"
+	mux := http.NewServeMux()
+	mux.Handle("/one/", h1)
+	mux.Handle("/two/", h2)
+
+	if w := doPropfind(mux, "/one/dir/", "1", ""); w.Code != StatusMulti {
+		t.Fatalf("PROPFIND /one/dir/ = %d", w.Code)
+	}
+	if id, ok := cache.GoCache.Get(cache.FileIdKey("1", "dir")); !ok || id != one {
+		t.Errorf("drive 1 cached dir as %v, want %s", id, one)
+	}
+	for _, p := range []string{"dir", "dir/a.txt"} {
+		if id, ok := cache.GoCache.Get(cache.FileIdKey("2", p)); ok {
+			t.Errorf("PROPFIND of drive 1 cached %s of drive 2 as %v", p, id)
+		}
+	}
+
+	cache.GoCache.Set(cache.FileIdKey("2", "dir"), two, -1)
+	cache.GoCache.Set(cache.FileIdKey("2", "dir/a.txt"), twoFile, -1)
+	for target, want := range map[string]string{"/one/dir/a.txt": "one", "/two/dir/a.txt": "two"} {
+		if w := serve(mux, "GET", target, nil); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s = %d %q, want %q", target, w.Code, w.Body, want)
+		}
+	}
+	if id, _ := cache.GoCache.Get(cache.FileIdKey("1", "dir")); id != one {
+		t.Errorf("drive 2 changed the cached dir of drive 1 to %v", id)
+	}
+
+	//两个网盘的根目录都是root，列表缓存同样要分开
+	cache.GoCache.Set(cache.ListKey("2", "root"), model.FileListModel{Items: []model.ListModel{{FileId: two, Name: "only-two", Type: "folder"}}}, -1)
+	one1 := doPropfind(mux, "/one/", "1", "").Body.String()
+	two1 := doPropfind(mux, "/two/", "1", "").Body.String()
+	if !strings.Contains(one1, "<D:displayname>dir<") || strings.Contains(one1, "only-two") {
+		t.Errorf("PROPFIND /one/ did not list the root of drive 1:\n%s", one1)
+	}
+	if !strings.Contains(two1, "<D:displayname>only-two<") || strings.Contains(two1, "<D:displayname>dir<") {
+		t.Errorf("PROPFIND /two/ did not list the root of drive 2:\n%s", two1)
+	}
+	if v, ok := cache.GoCache.Get(cache.ListKey("1", "root")); !ok || len(v.(model.FileListModel).Items) < 2 {
+		t.Errorf("root listing of drive 1 cached as %v", v)
+	}
+}
+
+func TestPropfindTimeZone(t *testing.T) {
+	h, s := newTestHandler(t)
+	id := s.Put("root", "a.txt", []byte("a"))
+	s.Update(id, func(f *aliyuntest.File) {
+		f.CreatedAt = time.Date(2021, 9, 1, 8, 30, 15, 0, time.UTC)
+		f.UpdatedAt = time.Date(2021, 9, 2, 20, 0, 0, 0, time.UTC)
+	})
+	const body = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:getlastmodified/><D:creationdate/></D:prop></D:propfind>`
+
+	//默认按规范使用GMT
+	props := responseProps(t, doPropfind(h, "/a.txt", "0", body).Body.Bytes())["/a.txt"]
+	if !strings.Contains(props, "Thu, 02 Sep 2021 20:00:00 GMT") || !strings.Contains(props, "Wed, 01 Sep 2021 08:30:15 GMT") {
+		t.Errorf("GMT dates missing:\n%s", props)
+	}
+
+	defer func(old *time.Location) { TimeZone = old }(TimeZone)
+	TimeZone = time.FixedZone("CST", 8*3600)
+	cache.GoCache.Flush()
+	props = responseProps(t, doPropfind(h, "/a.txt", "0", body).Body.Bytes())["/a.txt"]
+	if !strings.Contains(props, "Fri, 03 Sep 2021 04:00:00 +0800") || !strings.Contains(props, "Wed, 01 Sep 2021 16:30:15 +0800") {
+		t.Errorf("dates not in the configured zone:\n%s", props)
+	}
+}
+
+func TestMkcolExisting(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "file", []byte("f"))
+
+	if w := serve(h, "MKCOL", "/dir", nil); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL = %d, want 201", w.Code)
+	}
+	if f, ok := s.Lookup("dir"); !ok || f.Type != "folder" {
+		t.Fatal("folder not created")
+	}
+	if w := serve(h, "MKCOL", "/dir", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("MKCOL of an existing folder = %d, want 405", w.Code)
+	}
+	if w := serve(h, "MKCOL", "/file", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("MKCOL over an existing file = %d, want 405", w.Code)
+	}
+
+	h.IdempotentMkcol = true
+	if w := serve(h, "MKCOL", "/dir", nil); w.Code != http.StatusCreated {
+		t.Errorf("idempotent MKCOL of an existing folder = %d, want 201", w.Code)
+	}
+	//同名的文件仍然不能当成文件夹
+	if w := serve(h, "MKCOL", "/file", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("idempotent MKCOL over an existing file = %d, want 405", w.Code)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 1 {
+		t.Errorf("created %d folders, want only the first", n)
+	}
+	if w := serve(h, "PUT", "/dir/a.txt", strings.NewReader("a")); w.Code != http.StatusCreated {
+		t.Errorf("PUT into the folder = %d, want 201", w.Code)
+	}
+	if _, ok := s.Lookup("dir/a.txt"); !ok {
+		t.Error("file not stored in the existing folder")
+	}
+}
+
+// TestConcurrentMkcol checks that simultaneous MKCOLs of one path create a
+// single folder.
+func TestConcurrentMkcol(t *testing.T) {
+	h, s := newTestHandler(t)
+	//创建较慢时，其余请求都在创建完成前到达
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		s.Default(w, r)
+	})
+	const n = 5
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() { codes <- serve(h, "MKCOL", "/dir", nil).Code }()
+	}
+	created := 0
+	for i := 0; i < n; i++ {
+		switch code := <-codes; code {
+		case http.StatusCreated:
+			created++
+		case http.StatusMethodNotAllowed:
+		default:
+			t.Errorf("concurrent MKCOL = %d", code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d MKCOLs succeeded, want 1", created)
+	}
+	if calls := s.Calls("/adrive/v2/file/createWithFolders"); calls != 1 {
+		t.Errorf("created the folder %d times, want once", calls)
+	}
+}
+
+func TestMaxNameLength(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.MaxNameLength = 10
+	s.Put("root", "a.txt", []byte("a"))
+
+	for _, name := range []string{"abcdefghijk.txt", "一二三四五六七八九十.txt"} {
+		w := serve(h, "PUT", "/"+url.PathEscape(name), strings.NewReader("x"))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "10 characters") {
+			t.Errorf("PUT %s = %d %q, want 400 stating the limit", name, w.Code, w.Body.String())
+		}
+	}
+	if w := serve(h, "MKCOL", "/abcdefghijk", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("MKCOL of a long name = %d, want 400", w.Code)
+	}
+	if w := serve(h, "MOVE", "/a.txt", nil, "Destination", "/abcdefghijk.txt"); w.Code != http.StatusBadRequest {
+		t.Errorf("MOVE to a long name = %d, want 400", w.Code)
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 0 {
+		t.Errorf("created %d files with long names", n)
+	}
+	//按字符而不是字节计算长度：10个字符的中文名称有22个字节
+	if w := serve(h, "PUT", "/"+url.PathEscape("一二三四五六.txt"), strings.NewReader("x")); w.Code != http.StatusCreated {
+		t.Errorf("PUT of a 10 character CJK name = %d, want 201", w.Code)
+	}
+
+	h.TruncateLongNames = true
+	for name, want := range map[string]string{
+		"abcdefghijk.txt":     "abcdef.txt",
+		"一二三四五六七八九十.txt":      "一二三四五六.txt",
+		"abcdefghijk":         "abcdefghij",
+		"a.verylongextension": "a.verylong",
+	} {
+		if w := serve(h, "PUT", "/"+url.PathEscape(name), strings.NewReader("x")); w.Code != http.StatusCreated {
+			t.Errorf("PUT %s with truncation = %d, want 201", name, w.Code)
+		}
+		if _, ok := s.Lookup(want); !ok {
+			t.Errorf("%s not stored as %s", name, want)
+		}
+	}
+}
+
+func TestTempDiskLimit(t *testing.T) {
+	h, s := newTestHandler(t)
+	defer func(limit int64) { aliyun.TempDiskLimit = limit }(aliyun.TempDiskLimit)
+	aliyun.TempDiskLimit = 100
+
+	//第一个上传停在创建文件，期间一直占用中间文件的空间
+	reached := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case reached <- struct{}{}:
+		default:
+		}
+		<-proceed
+		s.Default(w, r)
+	})
+	done := make(chan int)
+	go func() { done <- serve(h, "PUT", "/first.bin", bytes.NewReader(make([]byte, 80))).Code }()
+	<-reached
+
+	w := serve(h, "PUT", "/second.bin", bytes.NewReader(make([]byte, 50)))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("upload beyond the disk budget = %d, want 503 with Retry-After", w.Code)
+	}
+	close(proceed)
+	if code := <-done; code != http.StatusCreated {
+		t.Fatalf("first upload = %d, want 201", code)
+	}
+	if w := serve(h, "PUT", "/second.bin", bytes.NewReader(make([]byte, 50))); w.Code != http.StatusCreated {
+		t.Errorf("upload after the budget was released = %d, want 201", w.Code)
+	}
+}
+
+func TestPropfindCachedParent(t *testing.T) {
+	h, s := newTestHandler(t)
+	media := s.Mkdir("root", "media")
+	movies := s.Mkdir(media, "movies")
+	s.Put(movies, "film.mp4", []byte("film"))
+
+	//列出上级目录后子目录的FileId已在缓存中，再次查找时从缓存的父目录开始
+	for _, p := range []string{"/media/", "/media/movies/", "/media/movies", "/media/movies/film.mp4"} {
+		w := doPropfind(h, p, "1", "")
+		if w.Code != http.StatusMultiStatus {
+			t.Errorf("PROPFIND %s = %d, want 207", p, w.Code)
+		}
+	}
+	w := doPropfind(h, "/media/movies/", "1", "")
+	if !strings.Contains(w.Body.String(), "<D:href>/media/movies/film.mp4</D:href>") {
+		t.Errorf("PROPFIND /media/movies/ with a cached parent:\n%s", w.Body.String())
+	}
+}
+
+func TestPutRenamedByAliyun(t *testing.T) {
+	h, s := newTestHandler(t)
+	renamed := "b(1).txt"
+	//阿里云以其他名称创建文件，如同名冲突时自动重命名
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		body["name"] = renamed
+		data, _ := json.Marshal(body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		rec := httptest.NewRecorder()
+		s.Default(rec, r)
+		var created map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &created)
+		created["file_name"] = renamed
+		json.NewEncoder(w).Encode(created)
+	})
+
+	w := serve(h, "PUT", "/b.txt", strings.NewReader("new"))
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/b%281%29.txt" {
+		t.Fatalf("PUT = %d with Location %q, want 201 with /b%%281%%29.txt", w.Code, w.Header().Get("Location"))
+	}
+	f, _ := s.Lookup("b(1).txt")
+	if id, ok := cache.GoCache.Get(cache.FileIdKey(aliyuntest.DriveId, "b(1).txt")); !ok || id != f.Id {
+		t.Errorf("cached id of the real name = %v, want %s", id, f.Id)
+	}
+	if _, ok := cache.GoCache.Get(cache.FileIdKey(aliyuntest.DriveId, "b.txt")); ok {
+		t.Error("requested name cached for the renamed file")
+	}
+	if w := serve(h, "GET", "/b(1).txt", nil); w.Body.String() != "new" {
+		t.Errorf("GET of the real name = %d %q", w.Code, w.Body.String())
+	}
+	//Location是URI，名称中的空格、%和非ASCII字符要编码
+	renamed = "b 100% 文.txt"
+	w = serve(h, "PUT", "/c.txt", strings.NewReader("c"))
+	if loc := w.Header().Get("Location"); loc != "/b%20100%25%20%E6%96%87.txt" {
+		t.Errorf("Location = %q, want the escaped name", loc)
+	}
+}
+
+func TestIgnoreNames(t *testing.T) {
+	h, s := newTestHandler(t)
+	//默认只丢弃macOS客户端上传的AppleDouble文件
+	if w := serve(h, "PUT", "/._foo", strings.NewReader("resource fork"), "User-Agent", "rclone/v1.57"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT ._foo = %d, want 201", w.Code)
+	}
+	if _, ok := s.Lookup("._foo"); !ok {
+		t.Error("._foo from a non-Darwin client dropped without an ignore list")
+	}
+
+	h.IgnoreNames = []string{"._*", "Thumbs.db"}
+	for _, name := range []string{"._bar", "Thumbs.db"} {
+		if w := serve(h, "PUT", "/dir/"+name, strings.NewReader("x"), "User-Agent", "rclone/v1.57"); w.Code != http.StatusCreated {
+			t.Errorf("PUT %s = %d, want 201", name, w.Code)
+		}
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 1 {
+		t.Errorf("uploaded %d files, want the ignored ones dropped", n)
+	}
+	if w := serve(h, "PUT", "/bar", strings.NewReader("kept"), "User-Agent", "rclone/v1.57"); w.Code != http.StatusCreated {
+		t.Errorf("PUT of a name not ignored = %d, want 201", w.Code)
+	}
+	if _, ok := s.Lookup("bar"); !ok {
+		t.Error("file not matching the ignore list not uploaded")
+	}
+}
+
+func TestFolderContentLength(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	s.Put(dir, "a.txt", []byte("hello"))
+	const named = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/></D:prop></D:propfind>`
+
+	for _, body := range []string{"", named} {
+		props := responseProps(t, doPropfind(h, "/dir/", "1", body).Body.Bytes())
+		if !strings.Contains(props["/dir/"], "<D:getcontentlength>0</D:getcontentlength>") {
+			t.Errorf("folder props %q, want getcontentlength 0", props["/dir/"])
+		}
+		if !strings.Contains(props["/dir/a.txt"], "<D:getcontentlength>5</D:getcontentlength>") {
+			t.Errorf("file props %q, want getcontentlength 5", props["/dir/a.txt"])
+		}
+	}
+	if props := responseProps(t, doPropfind(h, "/", "0", named).Body.Bytes()); !strings.Contains(props["/"], "<D:getcontentlength>0</D:getcontentlength>") {
+		t.Errorf("root props %q, want getcontentlength 0", props["/"])
+	}
+
+	defer func(old bool) { OmitFolderContentLength = old }(OmitFolderContentLength)
+	OmitFolderContentLength = true
+	for _, body := range []string{"", named} {
+		props := responseProps(t, doPropfind(h, "/dir/", "1", body).Body.Bytes())
+		if strings.Contains(props["/dir/"], "getcontentlength") {
+			t.Errorf("folder props %q, want no getcontentlength", props["/dir/"])
+		}
+		if !strings.Contains(props["/dir/a.txt"], "<D:getcontentlength>5</D:getcontentlength>") {
+			t.Errorf("file props %q, want getcontentlength 5", props["/dir/a.txt"])
+		}
+	}
+}
+
+// TestWalkChildListFails checks that a folder whose list fails is reported
+// on its own while the walk goes on with its siblings.
+func TestWalkChildListFails(t *testing.T) {
+	_, s := newTestHandler(t)
+	good := s.Mkdir("root", "good")
+	bad := s.Mkdir("root", "bad")
+	s.Put(good, "in-good.txt", []byte("a"))
+	s.Put("root", "a.txt", []byte("a"))
+	badCalls := 0
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if gjson.GetBytes(data, "parent_file_id").String() == bad {
+			badCalls++
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.Default(w, r)
+	})
+
+	root, err := aliyun.GetList(context.Background(), "token", aliyuntest.DriveId, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	walked := map[string]error{}
+	walkFn := func(fi model.ListModel, _ model.FileListModel, err error) error {
+		walked[fi.Name] = err
+		return nil
+	}
+	//每个子项都会使层级加一，层级小于2时才列出子目录，这里让每个子目录都被列出
+	cheng := -len(root.Items)
+	if err := walkFS(context.Background(), nil, 1, model.ListModel{Name: "root", Type: "folder"}, root, walkFn, "token", aliyuntest.DriveId, "", cheng); err != nil {
+		t.Fatalf("walkFS = %v, want nil", err)
+	}
+	if walked["bad"] == nil {
+		t.Error("the folder whose list failed was not reported with an error")
+	}
+	for _, name := range []string{"root", "good", "a.txt", "in-good.txt"} {
+		if err, ok := walked[name]; !ok || err != nil {
+			t.Errorf("%s walked = %v, %v; want no error", name, ok, err)
+		}
+	}
+	if badCalls != 2 {
+		t.Errorf("failing list requested %d times, want one retry", badCalls)
+	}
+}
+
+// TestPropfindFailedResponse checks that a resource reported as failed is
+// written into the 207 multistatus next to the other responses.
+func TestPropfindFailedResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	mw := multistatusWriter{w: w}
+	if err := mw.write(makePropstatResponse("/good/", []Propstat{{Status: http.StatusOK}})); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.write(makeFailedResponse("/bad dir/", http.StatusBadGateway, errors.New("list failed"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != StatusMulti {
+		t.Fatalf("status = %d, want 207", w.Code)
+	}
+	var ms struct {
+		Responses []struct {
+			Href        string `xml:"href"`
+			Status      string `xml:"status"`
+			Description string `xml:"responsedescription"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &ms); err != nil {
+		t.Fatal(err)
+	}
+	if len(ms.Responses) != 2 {
+		t.Fatalf("got %d responses, want 2:\n%s", len(ms.Responses), w.Body)
+	}
+	failed := ms.Responses[1]
+	if failed.Href != "/bad%20dir/" || failed.Status != "HTTP/1.1 502 Bad Gateway" || failed.Description != "list failed" {
+		t.Errorf("failed response = %+v", failed)
+	}
+}
+
+// TestXMLBodyLimit checks that PROPFIND, PROPPATCH and LOCK bodies larger
+// than MaxXMLBodySize get 413 without being read in full.
+func TestXMLBodyLimit(t *testing.T) {
+	h := putIfTarget(t)
+	h.MaxXMLBodySize = 1 << 10
+	pad := "<!--" + strings.Repeat("x", 4<<10) + "-->"
+	bodies := map[string]string{
+		"PROPFIND":  `<?xml version="1.0"?><D:propfind xmlns:D="DAV:">` + pad + `<D:prop><D:quota-available-bytes/></D:prop></D:propfind>`,
+		"PROPPATCH": `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:">` + pad + `</D:propertyupdate>`,
+		"LOCK":      `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:">` + pad + `<D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`,
+	}
+	for method, body := range bodies {
+		if w := serve(h, method, "/a.txt", strings.NewReader(body), "Depth", "0"); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s with a %d byte body = %d, want 413", method, len(body), w.Code)
+		}
+		//分块传输时没有Content-Length，同样按读取的大小限制
+		r := httptest.NewRequest(method, "/a.txt", ioutil.NopCloser(strings.NewReader(body)))
+		r.ContentLength = -1
+		r.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("chunked %s with a %d byte body = %d, want 413", method, len(body), w.Code)
+		}
+	}
+	if w := doPropfind(h, "/a.txt", "0", `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`); w.Code != StatusMulti {
+		t.Errorf("PROPFIND with a small body = %d, want 207", w.Code)
+	}
+	h.MaxXMLBodySize = 0
+	if w := doPropfind(h, "/a.txt", "0", `<?xml version="1.0"?><D:propfind xmlns:D="DAV:">`+pad+`<D:allprop/></D:propfind>`); w.Code != StatusMulti {
+		t.Errorf("PROPFIND without a limit = %d, want 207", w.Code)
+	}
+}
+
+// TestRequestTimeout checks that a request running past RequestTimeout is
+// abandoned with 504, while downloads are exempt.
+func TestRequestTimeout(t *testing.T) {
+	h, s := newTestHandler(t)
+	h.RequestTimeout = 100 * time.Millisecond
+	s.Mkdir("root", "dir")
+	id := s.Put("root", "a.txt", []byte("hello"))
+	//列目录一直等到请求被放弃之后
+	release := make(chan struct{})
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		s.Default(w, r)
+	})
+	start := time.Now()
+	if w := doPropfind(h, "/dir/", "1", ""); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("slow PROPFIND = %d, want 504", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("slow PROPFIND took %v, want it abandoned at the deadline", elapsed)
+	}
+	close(release)
+	s.Handle("/adrive/v3/file/list", nil)
+
+	//下载超出时限也不中断
+	s.Handle("/oss/download/"+id, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		s.Default(w, r)
+	})
+	if w := serve(h, "GET", "/a.txt", nil); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("slow GET = %d %q, want the file", w.Code, w.Body)
+	}
+	if w := doPropfind(h, "/dir/", "1", ""); w.Code != StatusMulti {
+		t.Errorf("PROPFIND in time = %d, want 207", w.Code)
+	}
+}
+
+// TestRangeAfterRapidUpload checks that a range request right after a rapid
+// upload uses the uploaded size while Aliyun still lists the file as empty.
+func TestRangeAfterRapidUpload(t *testing.T) {
+	h, s := newTestHandler(t)
+	content := bytes.Repeat([]byte("0123456789"), 20*1024)
+	s.Put("root", "original.bin", content)
+	//闪传后阿里云的列表暂时还是旧的大小
+	s.Handle("/adrive/v3/file/list", func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		s.Default(rec, r)
+		var list map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &list)
+		items, _ := list["items"].([]interface{})
+		for _, item := range items {
+			if item := item.(map[string]interface{}); item["name"] == "copy.bin" {
+				item["size"] = 0
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	})
+	s.Handle("/v2/file/get", func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		s.Default(rec, r)
+		var fi map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &fi)
+		if fi["name"] == "copy.bin" {
+			fi["size"] = 0
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fi)
+	})
+	if w := doPropfind(h, "/", "1", ""); w.Code != StatusMulti {
+		t.Fatalf("PROPFIND = %d", w.Code)
+	}
+
+	if w := serve(h, "PUT", "/copy.bin", bytes.NewReader(content)); w.Code != http.StatusCreated {
+		t.Fatalf("PUT = %d, want 201", w.Code)
+	}
+	if n := s.Calls("/v2/file/complete"); n != 0 {
+		t.Fatalf("upload completed %d times, want a rapid upload", n)
+	}
+	size := len(content)
+	check := func(when string) {
+		t.Helper()
+		w := serve(h, "GET", "/copy.bin", nil, "Range", "bytes=-10")
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("%s: range GET = %d, want 206", when, w.Code)
+		}
+		if got, want := w.Header().Get("Content-Range"), "bytes "+strconv.Itoa(size-10)+"-"+strconv.Itoa(size-1)+"/"+strconv.Itoa(size); got != want {
+			t.Errorf("%s: Content-Range = %q, want %q", when, got, want)
+		}
+		if !bytes.Equal(w.Body.Bytes(), content[size-10:]) {
+			t.Errorf("%s: body = %q, want the last 10 bytes", when, w.Body)
+		}
+	}
+	//通过FID_缓存获取的文件详情同样按上传的大小修正
+	check("cached file id")
+
+	//列表缓存过期后重新获取的旧列表同样按上传的大小修正
+	cache.GoCache.DeletePrefix(cache.FileIdKey(aliyuntest.DriveId, ""))
+	check("cached listing")
+	cache.GoCache.Delete(cache.ListKey(aliyuntest.DriveId, "root"))
+	check("fresh listing")
+}
+
+// TestRangeDiskCache checks that once a file is in the local read-through
+// cache, range requests are served without going to OSS.
+func TestRangeDiskCache(t *testing.T) {
+	h, s := newTestHandler(t)
+	defer func(dir string, limit int64) { aliyun.DiskCacheDir, aliyun.DiskCacheLimit = dir, limit }(aliyun.DiskCacheDir, aliyun.DiskCacheLimit)
+	aliyun.DiskCacheDir, aliyun.DiskCacheLimit = t.TempDir(), 1<<20
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	id := s.Put("root", "movie.mp4", content)
+
+	ranges := []struct {
+		header     string
+		start, end int
+	}{{"bytes=100-299", 100, 300}, {"bytes=200-399", 200, 400}}
+	for _, r := range ranges {
+		w := serve(h, "GET", "/movie.mp4", nil, "Range", r.header)
+		if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[r.start:r.end]) {
+			t.Fatalf("GET %s = %d %q", r.header, w.Code, w.Body)
+		}
+	}
+	//等待后台把整个文件下载到本地
+	fi, _ := aliyun.GetFileDetail(context.Background(), "token", aliyuntest.DriveId, id)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if f, ok := aliyun.CachedFile(fi); ok {
+			f.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("file not cached")
+		}
+	}
+
+	downloads, urls := s.Calls("/oss/download/"+id), s.Calls("/v2/file/get_download_url")
+	for _, r := range ranges {
+		w := serve(h, "GET", "/movie.mp4", nil, "Range", r.header)
+		if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[r.start:r.end]) {
+			t.Errorf("cached GET %s = %d %q", r.header, w.Code, w.Body)
+		}
+	}
+	if n := s.Calls("/oss/download/" + id); n != downloads {
+		t.Errorf("cached ranges made %d more OSS requests, want none", n-downloads)
+	}
+	if n := s.Calls("/v2/file/get_download_url"); n != urls {
+		t.Errorf("cached ranges fetched %d download urls, want none", n-urls)
+	}
+	//只有两次Range请求本身和一次完整下载经过OSS
+	if downloads > len(ranges)+1 {
+		t.Errorf("warmup made %d OSS requests, want one full download", downloads)
+	}
+}
+
+// TestUploadPermissionDenied checks that an upload refused for lack of
+// permission gets 403 without refreshing the token.
+func TestUploadPermissionDenied(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"code":"ForbiddenNoPermission.File","message":"No permission to access resource File"}`))
+	})
+	for _, body := range []string{"content", ""} {
+		w := serve(h, "PUT", "/a.txt", strings.NewReader(body))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("PUT of %d bytes with a read-only token = %d, want 403", len(body), w.Code)
+		}
+	}
+	if n := s.Calls("/token/refresh"); n != 0 {
+		t.Errorf("refreshed the token %d times for a permission error", n)
+	}
+	if _, ok := s.Lookup("a.txt"); ok {
+		t.Error("file created")
+	}
+}
+
+// TestUploadUpstreamFailure checks that uploads rejected upstream report
+// the upstream failure instead of a client error.
+func TestUploadUpstreamFailure(t *testing.T) {
+	h, s := newTestHandler(t)
+	for _, c := range []struct {
+		status int
+		body   string
+		want   int
+	}{
+		{http.StatusInternalServerError, `{"code":"InternalError","message":"oops"}`, http.StatusBadGateway},
+		{http.StatusBadRequest, `{"code":"NeedSecondVerify","message":"verify"}`, http.StatusServiceUnavailable},
+	} {
+		s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		})
+		if w := serve(h, "PUT", "/a.txt", strings.NewReader("content")); w.Code != c.want {
+			t.Errorf("PUT answered upstream with %s = %d, want %d", c.body, w.Code, c.want)
+		}
+	}
+	//正常的响应解除风控状态
+	s.Handle("/adrive/v2/file/createWithFolders", nil)
+	if w := serve(h, "PUT", "/a.txt", strings.NewReader("content")); w.Code != http.StatusCreated || net.RiskControlled() != nil {
+		t.Errorf("PUT after risk control = %d, risk control %v", w.Code, net.RiskControlled())
+	}
+}
+
+// TestTrailingSlashes checks that folder and file paths are handled the same
+// with and without a trailing slash.
+func TestTrailingSlashes(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	s.Put(dir, "b.txt", []byte("b"))
+	s.Put("root", "a.txt", []byte("a"))
+
+	for target, href := range map[string]string{
+		"/dir": "/dir/", "/dir/": "/dir/", "//dir//": "/dir/",
+		"/a.txt": "/a.txt", "/a.txt/": "/a.txt",
+	} {
+		w := doPropfind(h, target, "1", "")
+		if w.Code != StatusMulti {
+			t.Errorf("PROPFIND %s = %d, want 207", target, w.Code)
+			continue
+		}
+		props := responseProps(t, w.Body.Bytes())
+		if _, ok := props[href]; !ok {
+			t.Errorf("PROPFIND %s responses %v, want %s", target, props, href)
+		}
+		if href == "/dir/" {
+			if _, ok := props["/dir/b.txt"]; !ok || len(props) != 2 {
+				t.Errorf("PROPFIND %s responses %v, want the folder and /dir/b.txt", target, props)
+			}
+		}
+	}
+
+	for _, c := range []struct{ create, again, remove string }{
+		{"/new", "/new/", "/new/"},
+		{"/other/", "/other", "/other"},
+	} {
+		if w := serve(h, "MKCOL", c.create, nil); w.Code != http.StatusCreated {
+			t.Errorf("MKCOL %s = %d, want 201", c.create, w.Code)
+		}
+		name := strings.Trim(c.create, "/")
+		f, ok := s.Lookup(name)
+		if !ok || f.Type != "folder" {
+			t.Fatalf("MKCOL %s created no folder %s", c.create, name)
+		}
+		if w := serve(h, "MKCOL", c.again, nil); w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("MKCOL %s after %s = %d, want 405", c.again, c.create, w.Code)
+		}
+		if w := serve(h, "DELETE", c.remove, nil); w.Code != http.StatusNoContent {
+			t.Errorf("DELETE %s = %d, want 204", c.remove, w.Code)
+		}
+		if f, _ := s.File(f.Id); !f.Trashed {
+			t.Errorf("DELETE %s left the folder", c.remove)
+		}
+	}
+	if w := serve(h, "DELETE", "/a.txt/", nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE /a.txt/ = %d, want 204", w.Code)
+	}
+	if _, ok := s.Lookup("a.txt"); ok {
+		t.Error("DELETE /a.txt/ left the file")
+	}
+}
+
+// TestAllpropInclude checks that allprop leaves out the extra live
+// properties, and the work they need, unless they are named in include.
+func TestAllpropInclude(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	s.Put(dir, "a.txt", []byte("a"))
+
+	w := doPropfind(h, "/", "1", `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`)
+	props := responseProps(t, w.Body.Bytes())["/dir/"]
+	for _, want := range []string{"displayname", "getlastmodified", "resourcetype", "supportedlock"} {
+		if !strings.Contains(props, want) {
+			t.Errorf("allprop missing %s: %s", want, props)
+		}
+	}
+	for _, extra := range []string{"resource-id", "getctag"} {
+		if strings.Contains(props, extra) {
+			t.Errorf("allprop without include returned %s: %s", extra, props)
+		}
+	}
+	if n := s.Calls("/adrive/v3/file/list"); n != 1 {
+		t.Errorf("allprop listed %d folders, want only the requested one", n)
+	}
+
+	const include = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:" xmlns:CS="http://calendarserver.org/ns/"><D:allprop/><D:include><D:resource-id/><CS:getctag/></D:include></D:propfind>`
+	props = responseProps(t, doPropfind(h, "/", "1", include).Body.Bytes())["/dir/"]
+	for _, want := range []string{"displayname", "resource-id", "getctag"} {
+		if !strings.Contains(props, want) {
+			t.Errorf("allprop with include missing %s: %s", want, props)
+		}
+	}
+	if strings.Contains(props, "owncloud") {
+		t.Errorf("allprop returned a property not included: %s", props)
+	}
+}
+
+// TestUploadNoIntermediateFile checks that an upload gets 507 when no
+// intermediate file can be created on disk or in memory.
+func TestUploadNoIntermediateFile(t *testing.T) {
+	h, s := newTestHandler(t)
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldTmp, hadTmp := os.LookupEnv("TMPDIR")
+	defer func() {
+		if hadTmp {
+			os.Setenv("TMPDIR", oldTmp)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+	}()
+	os.Setenv("TMPDIR", notDir)
+	aliyun.TempDir = notDir
+	defer func(old int64) { aliyun.MemoryUploadLimit = old }(aliyun.MemoryUploadLimit)
+	aliyun.MemoryUploadLimit = 10
+
+	if w := serve(h, "PUT", "/big.bin", bytes.NewReader(make([]byte, 100))); w.Code != StatusInsufficientStorage {
+		t.Errorf("PUT beyond the memory limit = %d, want 507", w.Code)
+	}
+	//内存可以缓冲的小文件仍能上传
+	if w := serve(h, "PUT", "/small.bin", bytes.NewReader([]byte("small"))); w.Code != http.StatusCreated {
+		t.Errorf("PUT within the memory limit = %d, want 201", w.Code)
+	}
+	if _, ok := s.Lookup("small.bin"); !ok {
+		t.Error("small.bin not uploaded")
+	}
+}
+
+// TestPropfindEmptyBody checks that a PROPFIND without a body is answered
+// as allprop, and that a body read for the quota check is still parsed.
+func TestPropfindEmptyBody(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "a.txt", []byte("abc"))
+
+	for _, body := range []io.Reader{nil, strings.NewReader("")} {
+		w := serve(h, "PROPFIND", "/a.txt", body, "Depth", "0")
+		if w.Code != StatusMulti {
+			t.Fatalf("empty PROPFIND = %d, want 207", w.Code)
+		}
+		props := responseProps(t, w.Body.Bytes())["/a.txt"]
+		for _, want := range []string{"displayname", "getcontentlength", "getlastmodified", "getetag", "resourcetype", "supportedlock"} {
+			if !strings.Contains(props, want) {
+				t.Errorf("empty PROPFIND missing %s: %s", want, props)
+			}
+		}
+	}
+
+	//请求内容只要displayname时不能当成allprop
+	w := doPropfind(h, "/a.txt", "0", `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:displayname/></D:prop></D:propfind>`)
+	props := responseProps(t, w.Body.Bytes())["/a.txt"]
+	if !strings.Contains(props, "displayname") || strings.Contains(props, "getcontentlength") {
+		t.Errorf("PROPFIND of displayname returned %s", props)
+	}
+}
+
+// TestHeadFolder checks that HEAD on a folder succeeds with collection
+// headers, while GET on it is still refused.
+func TestHeadFolder(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Mkdir("root", "dir")
+
+	for _, target := range []string{"/dir", "/dir/"} {
+		w := serve(h, "HEAD", target, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("HEAD %s = %d, want 200", target, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "httpd/unix-directory" {
+			t.Errorf("HEAD %s Content-Type = %q", target, ct)
+		}
+		if cl := w.Header().Get("Content-Length"); cl != "0" || w.Body.Len() != 0 {
+			t.Errorf("HEAD %s Content-Length = %q with %d bytes", target, cl, w.Body.Len())
+		}
+		if _, err := http.ParseTime(w.Header().Get("Last-Modified")); err != nil {
+			t.Errorf("HEAD %s Last-Modified: %v", target, err)
+		}
+	}
+	if w := serve(h, "HEAD", "/missing/", nil); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a missing folder = %d, want 404", w.Code)
+	}
+	if w := serve(h, "GET", "/dir", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET of a folder = %d, want 405", w.Code)
+	}
+}
+
+// unreadBody is a request body that records whether it was read.
+type unreadBody struct {
+	io.Reader
+	read bool
+}
+
+func (b *unreadBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.Reader.Read(p)
+}
+
+// TestPutRejectedBeforeBody checks that rejected PUTs are answered without
+// reading the body, so Expect: 100-continue clients don't send it.
+func TestPutRejectedBeforeBody(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Handle("/v2/drive/get", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"drive_id":"1","total_size":1000,"used_size":900}`))
+	})
+	defer func(old int64) { aliyun.TempDiskLimit = old }(aliyun.TempDiskLimit)
+
+	for _, c := range []struct {
+		name   string
+		target string
+		size   int
+		setup  func()
+		want   int
+	}{
+		{"read-only", "/a.txt", 10, func() { h.ReadOnly = true }, http.StatusForbidden},
+		{"missing parent", "/missing/a.txt", 10, nil, http.StatusConflict},
+		{"empty", "/a.txt", 0, func() { h.RejectEmptyFiles = true }, http.StatusForbidden},
+		{"temp disk full", "/a.txt", 10, func() { aliyun.TempDiskLimit = 5 }, http.StatusServiceUnavailable},
+		{"drive full", "/a.txt", 200, nil, StatusInsufficientStorage},
+	} {
+		h.ReadOnly, h.RejectEmptyFiles, aliyun.TempDiskLimit = false, false, 0
+		if c.setup != nil {
+			c.setup()
+		}
+		body := &unreadBody{Reader: bytes.NewReader(make([]byte, c.size))}
+		r := httptest.NewRequest("PUT", c.target, body)
+		r.ContentLength = int64(c.size)
+		r.Header.Set("Expect", "100-continue")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s: PUT = %d, want %d", c.name, w.Code, c.want)
+		}
+		if body.read {
+			t.Errorf("%s: rejected PUT read the body", c.name)
+		}
+	}
+	if n := s.Calls("/adrive/v2/file/createWithFolders"); n != 0 {
+		t.Errorf("rejected PUTs started %d uploads", n)
+	}
+}
+
+// TestCopyMoveOtherMount checks that COPY and MOVE to a destination outside
+// the handler's prefix, which it can't reach, get 502 and change nothing.
+func TestCopyMoveOtherMount(t *testing.T) {
+	h, s := newTestHandler(t)
+	s.Put("root", "a.txt", []byte("a"))
+	h.Prefix = "/one/"
+
+	for _, method := range []string{"COPY", "MOVE"} {
+		for _, dest := range []string{"http://example.com/two/a.txt", "http://example.com/b.txt"} {
+			if w := serve(h, method, "/one/a.txt", nil, "Destination", dest); w.Code != http.StatusBadGateway {
+				t.Errorf("%s to %s = %d, want 502", method, dest, w.Code)
+			}
+		}
+	}
+	if _, ok := s.Lookup("a.txt"); !ok {
+		t.Error("source removed by a MOVE to another mount")
+	}
+	for _, p := range []string{"b.txt", "two"} {
+		if _, ok := s.Lookup(p); ok {
+			t.Errorf("%s created by a COPY to another mount", p)
+		}
+	}
+	//同一挂载点内不受影响
+	if w := serve(h, "COPY", "/one/a.txt", nil, "Destination", "http://example.com/one/b.txt"); w.Code != http.StatusCreated {
+		t.Errorf("COPY within the mount = %d, want 201", w.Code)
+	}
+	for _, p := range []string{"a.txt", "b.txt"} {
+		if f, ok := s.Lookup(p); !ok || string(f.Content) != "a" {
+			t.Errorf("%s missing after a COPY within the mount", p)
+		}
+	}
+}
+
+// TestPutGzip checks that gzip-encoded PUT bodies are stored decompressed
+// when DecodeGzipUploads is set, and as sent otherwise.
+func TestPutGzip(t *testing.T) {
+	h, s := newTestHandler(t)
+	content := bytes.Repeat([]byte("compressible line\r\n\x00"), 20000)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(content)
+	zw.Close()
+
+	//未开启时按原样保存
+	if w := serve(h, "PUT", "/raw.txt", bytes.NewReader(gz.Bytes()), "Content-Encoding", "gzip"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT without decoding = %d, want 201", w.Code)
+	}
+	if f, _ := s.Lookup("raw.txt"); !bytes.Equal(f.Content, gz.Bytes()) {
+		t.Error("PUT without decoding did not store the body as sent")
+	}
+
+	h.DecodeGzipUploads = true
+	for _, encoding := range []string{"gzip", "X-Gzip"} {
+		name := encoding + ".txt"
+		if w := serve(h, "PUT", "/"+name, bytes.NewReader(gz.Bytes()), "Content-Encoding", encoding); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %s = %d, want 201", encoding, w.Code)
+		}
+		f, _ := s.Lookup(name)
+		if !bytes.Equal(f.Content, content) {
+			t.Errorf("PUT %s stored %d bytes, want the %d decompressed bytes", encoding, len(f.Content), len(content))
+		}
+		//上传后缓存的列表中是解压后的大小
+		props := responseProps(t, doPropfind(h, "/"+name, "0", "").Body.Bytes())["/"+name]
+		if want := "<D:getcontentlength>" + strconv.Itoa(len(content)) + "</D:getcontentlength>"; !strings.Contains(props, want) {
+			t.Errorf("PUT %s listed as %s, want %s", encoding, props, want)
+		}
+	}
+	if w := serve(h, "PUT", "/identity.txt", strings.NewReader("plain"), "Content-Encoding", "identity"); w.Code != http.StatusCreated {
+		t.Errorf("PUT identity = %d, want 201", w.Code)
+	}
+	if w := serve(h, "PUT", "/br.txt", strings.NewReader("x"), "Content-Encoding", "br"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PUT br = %d, want 415", w.Code)
+	}
+	if w := serve(h, "PUT", "/bad.txt", strings.NewReader("not gzip"), "Content-Encoding", "gzip"); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT invalid gzip = %d, want 400", w.Code)
+	}
+	for _, p := range []string{"br.txt", "bad.txt"} {
+		if _, ok := s.Lookup(p); ok {
+			t.Errorf("%s stored after a refused PUT", p)
+		}
+	}
+
+	//解压后为空的上传同样按RejectEmptyFiles拒绝
+	h.RejectEmptyFiles = true
+	gz.Reset()
+	zw = gzip.NewWriter(&gz)
+	zw.Close()
+	if w := serve(h, "PUT", "/empty.txt", bytes.NewReader(gz.Bytes()), "Content-Encoding", "gzip"); w.Code != http.StatusForbidden {
+		t.Errorf("PUT of empty gzip content = %d, want 403", w.Code)
+	}
+}
+
+// countingWriter records how a response is written: the largest single
+// write and the most bytes written without a flush.
+type countingWriter struct {
+	*httptest.ResponseRecorder
+	flushes      int
+	unflushed    int
+	maxWrite     int
+	maxUnflushed int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if len(p) > c.maxWrite {
+		c.maxWrite = len(p)
+	}
+	if c.unflushed += len(p); c.unflushed > c.maxUnflushed {
+		c.maxUnflushed = c.unflushed
+	}
+	return c.ResponseRecorder.Write(p)
+}
+
+func (c *countingWriter) Flush() {
+	c.flushes++
+	c.unflushed = 0
+	c.ResponseRecorder.Flush()
+}
+
+// TestPropfindStreamed checks that the listing of a huge folder is written
+// in small pieces and flushed every PropfindFlushBytes.
+func TestPropfindStreamed(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "big")
+	const files = 2000
+	for i := 0; i < files; i++ {
+		s.Put(dir, "file-"+strconv.Itoa(i)+".txt", []byte("x"))
+	}
+	h.PropfindFlushBytes = 8 << 10
+
+	w := &countingWriter{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest("PROPFIND", "/big/", nil)
+	r.Header.Set("Depth", "1")
+	h.ServeHTTP(w, r)
+	if w.Code != StatusMulti {
+		t.Fatalf("PROPFIND = %d, want 207", w.Code)
+	}
+	if n := len(responseProps(t, w.Body.Bytes())); n != files+1 {
+		t.Fatalf("listed %d resources, want %d", n, files+1)
+	}
+	total := w.Body.Len()
+	//每条响应单独编码写出，不会整个放在内存中
+	if w.maxWrite > 8<<10 {
+		t.Errorf("largest write %d bytes of a %d byte response", w.maxWrite, total)
+	}
+	//写满8KB后的那次写入之后flush，间隔略大于8KB
+	if w.flushes < total/(16<<10) {
+		t.Errorf("flushed %d times for %d bytes, want about every 8KB", w.flushes, total)
+	}
+	if w.maxUnflushed > 16<<10 {
+		t.Errorf("%d bytes written without a flush, want about 8KB", w.maxUnflushed)
+	}
+
+	//为0时不主动flush
+	h.PropfindFlushBytes = 0
+	w = &countingWriter{ResponseRecorder: httptest.NewRecorder()}
+	r = httptest.NewRequest("PROPFIND", "/big/", nil)
+	r.Header.Set("Depth", "1")
+	h.ServeHTTP(w, r)
+	if w.flushes != 0 {
+		t.Errorf("flushed %d times with PropfindFlushBytes 0", w.flushes)
+	}
+	if w.maxWrite > 8<<10 {
+		t.Errorf("largest write %d bytes with PropfindFlushBytes 0", w.maxWrite)
+	}
+}
+
+// TestCTag checks that the getctag of a folder is stable while its children
+// are unchanged and changes when one is added, renamed or removed.
+func TestCTag(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	s.Put(dir, "a.txt", []byte("a"))
+	const body = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:" xmlns:CS="http://calendarserver.org/ns/"><D:prop><CS:getctag/></D:prop></D:propfind>`
+	ctag := func(target string) string {
+		t.Helper()
+		props := responseProps(t, doPropfind(h, target, "0", body).Body.Bytes())[target]
+		start, end := strings.Index(props, ">"), strings.LastIndex(props, "</")
+		if start < 0 || end <= start {
+			return ""
+		}
+		return props[start+1 : end]
+	}
+
+	first := ctag("/dir/")
+	if first == "" {
+		t.Fatal("no getctag for /dir/")
+	}
+	if again := ctag("/dir/"); again != first {
+		t.Errorf("getctag changed from %s to %s without changes", first, again)
+	}
+	if ctag("/") == "" || ctag("/") == first {
+		t.Error("the root folder has no getctag of its own")
+	}
+	if ctag("/dir/a.txt") != "" {
+		t.Error("a file has a getctag")
+	}
+
+	seen := map[string]bool{first: true}
+	for _, change := range []struct {
+		name, method, target, dest string
+	}{
+		{"add", "PUT", "/dir/b.txt", ""},
+		{"rename", "MOVE", "/dir/b.txt", "/dir/c.txt"},
+		{"remove", "DELETE", "/dir/a.txt", ""},
+	} {
+		var hdr []string
+		if change.dest != "" {
+			hdr = []string{"Destination", "http://example.com" + change.dest}
+		}
+		if w := serve(h, change.method, change.target, strings.NewReader("b"), hdr...); w.Code >= 300 {
+			t.Fatalf("%s %s = %d", change.method, change.target, w.Code)
+		}
+		tag := ctag("/dir/")
+		if seen[tag] {
+			t.Errorf("getctag after %s is %s, seen before", change.name, tag)
+		}
+		seen[tag] = true
+	}
+}
+
+// TestUnsafeNames checks that items named . and .. are listed under escaped
+// names that reach them, while . and .. in request paths never do.
+func TestUnsafeNames(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	s.Put(dir, "..", []byte("dotdot"))
+	s.Put(dir, ".", []byte("dot"))
+	s.Put(dir, "a/b", []byte("slash"))
+	s.Put("root", "secret.txt", []byte("secret"))
+
+	props := responseProps(t, doPropfind(h, "/dir/", "1", "").Body.Bytes())
+	var hrefs []string
+	for href := range props {
+		hrefs = append(hrefs, href)
+	}
+	sort.Strings(hrefs)
+	if want := []string{"/dir/", "/dir/%252E", "/dir/%252E%252E", "/dir/a%252Fb"}; !reflect.DeepEqual(hrefs, want) {
+		t.Errorf("listing hrefs = %q, want %q", hrefs, want)
+	}
+	for href, content := range map[string]string{"/dir/%252E%252E": "dotdot", "/dir/%252E": "dot", "/dir/a%252Fb": "slash"} {
+		if w := serve(h, "GET", href, nil); w.Code != http.StatusOK || w.Body.String() != content {
+			t.Errorf("GET %s = %d %q, want %q", href, w.Code, w.Body.String(), content)
+		}
+	}
+	//请求路径中的..只是上级目录，不会取到名为..的文件
+	if w := serve(h, "GET", "/dir/..", nil); w.Body.String() == "dotdot" {
+		t.Error("GET /dir/.. served the file named ..")
+	}
+	if w := serve(h, "GET", "/dir/../secret.txt", nil); w.Code != http.StatusOK || w.Body.String() != "secret" {
+		t.Errorf("GET /dir/../secret.txt = %d %q, want the file in the root", w.Code, w.Body.String())
+	}
+	if w := serve(h, "GET", "/dir/a/b", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /dir/a/b = %d, want 404 rather than the file named a/b", w.Code)
+	}
+}
+
+// TestDisplayName checks that displayname carries the stored name, decoded,
+// while hrefs are percent-encoded.
+func TestDisplayName(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "my dir")
+	s.Put(dir, "a b&c.txt", []byte("a"))
+	s.Put(dir, "100%.txt", []byte("b"))
+	s.Put(dir, "..", []byte("c"))
+
+	w := doPropfind(h, "/my%20dir/", "1", `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:displayname/></D:prop></D:propfind>`)
+	props := responseProps(t, w.Body.Bytes())
+	for href, name := range map[string]string{
+		"/my%20dir/":            "my dir",
+		"/my%20dir/a%20b&c.txt": "a b&amp;c.txt",
+		"/my%20dir/100%25.txt":  "100%.txt",
+		"/my%20dir/%252E%252E":  "..",
+	} {
+		if want := "<D:displayname>" + name + "</D:displayname>"; !strings.Contains(props[href], want) {
+			t.Errorf("%s has %q, want %s", href, props[href], want)
+		}
+	}
+
+	//下载时的文件名同样使用阿里云中的名称
+	w = serve(h, "GET", "/my%20dir/%252E%252E", nil)
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, `".."`) {
+		t.Errorf("Content-Disposition of .. = %q", cd)
+	}
+
+	//lockroot同样编码
+	w = serve(h, "LOCK", "/my%20dir/a%20b&c.txt", strings.NewReader(lockBody), "Timeout", "Second-60")
+	if body := w.Body.String(); !strings.Contains(body, "<D:href>/my%20dir/a%20b&amp;c.txt</D:href>") {
+		t.Errorf("lockroot not percent-encoded:\n%s", body)
+	}
+}
+
+// TestHLSContentTypes checks that HLS playlists and segments are served
+// with the types players expect, and segments honour Range.
+func TestHLSContentTypes(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "hls")
+	playlist := s.Put(dir, "index.m3u8", []byte("#EXTM3U\n#EXTINF:10,\nseg0.ts\n#EXT-X-ENDLIST\n"))
+	segment := make([]byte, 1000)
+	for i := range segment {
+		segment[i] = byte(i)
+	}
+	seg := s.Put(dir, "SEG0.TS", segment)
+	//阿里云和系统的类型表常把.ts当成TypeScript
+	for _, id := range []string{playlist, seg} {
+		s.Update(id, func(f *aliyuntest.File) { f.ContentType = "application/typescript" })
+	}
+
+	w := serve(h, "GET", "/hls/index.m3u8", nil)
+	if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("GET playlist = %d with Content-Type %q", w.Code, ct)
+	}
+	w = serve(h, "GET", "/hls/SEG0.TS", nil, "Range", "bytes=100-199")
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), segment[100:200]) {
+		t.Errorf("GET segment range = %d with %d bytes, want 206 with bytes 100-199", w.Code, w.Body.Len())
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 100-199/1000" {
+		t.Errorf("segment Content-Range = %q", cr)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "video/mp2t" {
+		t.Errorf("segment Content-Type = %q, want video/mp2t", ct)
+	}
+	props := responseProps(t, doPropfind(h, "/hls/", "1", "").Body.Bytes())
+	if !strings.Contains(props["/hls/SEG0.TS"], "<D:getcontenttype>video/mp2t</D:getcontenttype>") {
+		t.Errorf("PROPFIND of the segment = %s", props["/hls/SEG0.TS"])
+	}
+}
+
+// TestTrailingSlashesWithPrefix checks that paths are normalized below a
+// prefix ending in a slash, whose collection root keeps its slash.
+func TestTrailingSlashesWithPrefix(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	s.Put(dir, "b.txt", []byte("b"))
+	h.Prefix = "/one/"
+
+	for _, target := range []string{"/one/", "/one/dir/", "/one/dir", "/one//dir//"} {
+		if w := doPropfind(h, target, "1", ""); w.Code != StatusMulti {
+			t.Errorf("PROPFIND %s = %d, want 207", target, w.Code)
+		}
+	}
+	if w := serve(h, "MKCOL", "/one/new/", nil); w.Code != http.StatusCreated {
+		t.Errorf("MKCOL /one/new/ = %d, want 201", w.Code)
+	}
+	if f, ok := s.Lookup("new"); !ok || f.Type != "folder" {
+		t.Error("MKCOL /one/new/ created no folder")
+	}
+}
+
+// TestPropfindHrefPrefix checks that hrefs derived from the request path
+// keep the handler's prefix.
+func TestPropfindHrefPrefix(t *testing.T) {
+	h, s := newTestHandler(t)
+	dir := s.Mkdir("root", "dir")
+	s.Put(dir, "b.txt", []byte("b"))
+	h.Prefix = "/one/"
+
+	props := responseProps(t, doPropfind(h, "/one/dir/", "1", "").Body.Bytes())
+	for _, href := range []string{"/one/dir/", "/one/dir/b.txt"} {
+		if _, ok := props[href]; !ok {
+			t.Errorf("PROPFIND /one/dir/ responses %v, want %s", props, href)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-aliyun-webdav/aliyun"
+	"go-aliyun-webdav/aliyun/net"
+	"net/http"
+	"path"
+	"time"
+)
+
+// webhookAttempts is how many times an upload notification is posted
+// before it is given up, waiting webhookRetryDelay times the attempt number
+// between two attempts.
+const webhookAttempts = 3
+
+var webhookRetryDelay = 5 * time.Second
+
+// uploadEvent is the JSON payload posted to UploadWebhook.
+type uploadEvent struct {
+	Event  string `json:"event"`
+	Path   string `json:"path"`
+	FileId string `json:"file_id"`
+	Size   int64  `json:"size"`
+	Sha1   string `json:"sha1"`
+}
+
+// notifyUpload posts an uploadEvent for the file fileId, just uploaded to
+// reqPath, to UploadWebhook in the background. The file details are read
+// back from the drive, so the size and hash are those Aliyun stored.
+func (h *Handler) notifyUpload(ctx context.Context, reqPath, fileId string) {
+	if h.UploadWebhook == "" {
+		return
+	}
+	//请求结束后仍在后台通知
+	ctx = net.Detached(ctx)
+	go func() {
+		ev := uploadEvent{Event: "upload", Path: path.Join("/", h.Prefix, reqPath), FileId: fileId}
+		if fi, err := aliyun.GetFileDetail(ctx, h.CurrentConfig().Token, h.CurrentConfig().DriveId, fileId); err == nil {
+			ev.Size, ev.Sha1 = fi.Size, fi.ContentHash
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return
+		}
+		client := &http.Client{Timeout: 30 * time.Second}
+		for i := 1; i <= webhookAttempts; i++ {
+			res, err := client.Post(h.UploadWebhook, "application/json", bytes.NewReader(data))
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode < 300 {
+					return
+				}
+				err = fmt.Errorf("status %d", res.StatusCode)
+			}
+			net.Logln(ctx, "⚠️  上传通知发送失败", ev.Path, i, err)
+			if i < webhookAttempts {
+				time.Sleep(webhookRetryDelay * time.Duration(i))
+			}
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package webdav
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUploadWebhook checks that a successful upload is posted to
+// UploadWebhook in the background, with a retry after a failure.
+func TestUploadWebhook(t *testing.T) {
+	h, s := newTestHandler(t)
+	defer func(old time.Duration) { webhookRetryDelay = old }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	//第一次返回500，之后等到放行才回复
+	events := make(chan uploadEvent, 4)
+	release := make(chan struct{})
+	attempts := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var ev uploadEvent
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &ev); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook body %s (%s): %v", data, r.Header.Get("Content-Type"), err)
+		}
+		<-release
+		events <- ev
+	}))
+	defer hook.Close()
+	defer close(release)
+	h.UploadWebhook = hook.URL
+
+	dir := s.Mkdir("root", "dir")
+	start := time.Now()
+	if w := serve(h, "PUT", "/dir/a.txt", strings.NewReader("content")); w.Code != http.StatusCreated {
+		t.Fatalf("PUT = %d, want 201", w.Code)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("PUT took %v, waiting for the webhook", d)
+	}
+	release <- struct{}{}
+	select {
+	case ev := <-events:
+		f, _ := s.Lookup("dir/a.txt")
+		want := uploadEvent{Event: "upload", Path: "/dir/a.txt", FileId: f.Id, Size: 7, Sha1: f.Sha1()}
+		if f.ParentId != dir || ev != want {
+			t.Errorf("webhook event = %+v, want %+v", ev, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not posted")
+	}
+	if attempts != 2 {
+		t.Errorf("webhook posted %d times, want a retry after the failure", attempts)
+	}
+
+	//失败的上传不通知
+	s.Handle("/adrive/v2/file/createWithFolders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if w := serve(h, "PUT", "/b.txt", strings.NewReader("b")); w.Code < 300 {
+		t.Fatalf("failed PUT = %d", w.Code)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("webhook posted for a failed upload: %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -97,7 +97,7 @@ func writeLockInfo(w io.Writer, token string, ld LockDetails) (int, error) {
 		"	<D:locktoken><D:href>%s</D:href></D:locktoken>\n"+
 		"	<D:lockroot><D:href>%s</D:href></D:lockroot>\n"+
 		"</D:activelock></D:lockdiscovery></D:prop>",
-		depth, ld.OwnerXML, timeout, escape(token), escape(ld.Root),
+		depth, ld.OwnerXML, timeout, escape(token), escape(escapeHref(ld.Root)),
 	)
 }
 
@@ -315,6 +315,29 @@ type multistatusWriter struct {
 
 	w   http.ResponseWriter
 	enc *ixml.Encoder
+	// flushBytes is how many bytes are written between two flushes of w.
+	// Zero means w is never flushed explicitly.
+	flushBytes int
+}
+
+// flushingWriter flushes the underlying http.ResponseWriter every time
+// threshold bytes have been written through it.
+type flushingWriter struct {
+	w         http.ResponseWriter
+	threshold int
+	pending   int
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.pending += n
+	if f.threshold > 0 && f.pending >= f.threshold {
+		if fl, ok := f.w.(http.Flusher); ok {
+			fl.Flush()
+		}
+		f.pending = 0
+	}
+	return n, err
 }
 
 // Write validates and emits a DAV response as part of a multistatus response
@@ -358,7 +381,7 @@ func (w *multistatusWriter) writeHeader() error {
 	if err != nil {
 		return err
 	}
-	w.enc = ixml.NewEncoder(w.w)
+	w.enc = ixml.NewEncoder(&flushingWriter{w: w.w, threshold: w.flushBytes})
 	return w.enc.EncodeToken(ixml.StartElement{
 		Name: ixml.Name{
 			Space: "DAV:",